@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Bulk actions accepted by POST /api/actions
+var bulkActions = []string{"power", "wake", "snapshot"}
+
+const (
+	defaultActionConcurrency = 4
+	maxActionConcurrency     = 32
+	maxTagLength             = 64
+)
+
+// DeviceSelector picks local devices by ID or tag. A device is selected if
+// its ID is listed or it carries every listed tag.
+type DeviceSelector struct {
+	IDs  []string `toml:"ids,omitempty" json:"ids,omitempty"`
+	Tags []string `toml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// ActionRequest is the body of POST /api/actions
+type ActionRequest struct {
+	Action      string         `json:"action"`                 // One of bulkActions
+	PowerAction string         `json:"power_action,omitempty"` // For "power": one of powerActions
+	Selector    DeviceSelector `json:"selector"`
+	DryRun      bool           `json:"dry_run,omitempty"`
+	Concurrency int            `json:"concurrency,omitempty"` // Devices handled at once (default 4, max 32)
+	RunID       string         `json:"run_id,omitempty"`      // Marks progress events; generated if empty
+}
+
+// ActionResult is the outcome of a bulk action on one device
+type ActionResult struct {
+	ID     string `json:"id"`
+	Alias  string `json:"alias,omitempty"`
+	Host   string `json:"host"`
+	Status string `json:"status"` // "ok", "error", "skipped", or "pending" in dry runs
+	Error  string `json:"error,omitempty"`
+}
+
+// ActionResponse is returned by POST /api/actions once every device is done
+type ActionResponse struct {
+	RunID       string         `json:"run_id"`
+	Action      string         `json:"action"`
+	PowerAction string         `json:"power_action,omitempty"`
+	DryRun      bool           `json:"dry_run"`
+	Results     []ActionResult `json:"results"`
+	Succeeded   int            `json:"succeeded"`
+	Failed      int            `json:"failed"`
+	Skipped     int            `json:"skipped"`
+}
+
+// ActionProgress is published on the event stream as each device finishes
+type ActionProgress struct {
+	RunID  string       `json:"run_id"`
+	Done   int          `json:"done"`
+	Total  int          `json:"total"`
+	Result ActionResult `json:"result"`
+}
+
+// validateTags rejects empty tags and tags with spaces or commas
+func validateTags(tags []string) error {
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			return fmt.Errorf("tags cannot be empty")
+		}
+		if len(t) > maxTagLength {
+			return fmt.Errorf("tag %q is longer than %d characters", t, maxTagLength)
+		}
+		if strings.ContainsAny(t, ", \t") {
+			return fmt.Errorf("tag %q cannot contain spaces or commas", t)
+		}
+	}
+	return nil
+}
+
+// normalizeTags lowercases and de-duplicates tags, keeping their order
+func normalizeTags(tags []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// splitTags parses a comma-separated tag list, as used in CSV and the CLI
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// hasTag reports whether a device carries a tag
+func hasTag(d Device, tag string) bool {
+	for _, t := range d.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// empty reports whether the selector names nothing
+func (s DeviceSelector) empty() bool {
+	return len(s.IDs) == 0 && len(normalizeTags(s.Tags)) == 0
+}
+
+// matches reports whether the selector picks a device
+func (s DeviceSelector) matches(d Device) bool {
+	for _, id := range s.IDs {
+		if d.ID == id {
+			return true
+		}
+	}
+	tags := normalizeTags(s.Tags)
+	if len(tags) == 0 {
+		return false
+	}
+	for _, t := range tags {
+		if !hasTag(d, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectDevices returns the local devices a selector picks
+func (c *Config) SelectDevices(s DeviceSelector) []Device {
+	var selected []Device
+	for _, d := range c.GetDevices() {
+		if s.matches(d) {
+			selected = append(selected, d)
+		}
+	}
+	return selected
+}
+
+// prepareAction checks whether a device supports an action, returning the
+// function that carries it out or why the device is skipped
+func (h *Handlers) prepareAction(req ActionRequest, d Device) (func(ctx context.Context) error, error) {
+	switch req.Action {
+	case "power":
+		ctrl, err := newPowerController(d)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			if err := ctrl.Power(ctx, req.PowerAction); err != nil {
+				return err
+			}
+			log.Printf("Power %s sent to device %s (%s) by bulk action %s", req.PowerAction, d.ID, d.Host, req.RunID)
+			h.config.events.Publish(Event{Type: "power", Data: PowerEvent{ID: d.ID, Action: req.PowerAction, Time: time.Now().UTC()}})
+			return nil
+		}, nil
+	case "wake":
+		if d.MAC == "" {
+			return nil, fmt.Errorf("device has no MAC address")
+		}
+		return func(ctx context.Context) error {
+			target, err := sendWake(d)
+			if err != nil {
+				return err
+			}
+			log.Printf("Wake-on-LAN sent to device %s (%s) via %s by bulk action %s", d.ID, d.MAC, target, req.RunID)
+			h.config.events.Publish(Event{Type: "wake", Data: WakeEvent{ID: d.ID, Time: time.Now().UTC()}})
+			return nil
+		}, nil
+	case "snapshot":
+		ctrl, _ := newPowerController(d)
+		snap, ok := ctrl.(snapshotter)
+		if !ok {
+			return nil, fmt.Errorf("%s devices can't capture the screen", typeName(d))
+		}
+		return func(ctx context.Context) error {
+			data, err := snap.Snapshot(ctx)
+			if err != nil {
+				return err
+			}
+			thumb, err := ProcessThumbnail(data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", d.Host, err)
+			}
+			return h.config.SetThumbnail(d.ID, thumb, ".jpg")
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", req.Action)
+}
+
+// ActionsHandler applies a power, wake or snapshot action to every device a
+// selector picks, a few at a time (POST /api/actions). It answers once all
+// devices are done; progress is published as "action" events meanwhile.
+func (h *Handlers) ActionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !containsString(bulkActions, req.Action) {
+		http.Error(w, fmt.Sprintf("action must be one of %s", strings.Join(bulkActions, ", ")), http.StatusBadRequest)
+		return
+	}
+	if req.Action == "power" && !isPowerAction(req.PowerAction) {
+		http.Error(w, fmt.Sprintf("power_action must be one of %s", strings.Join(powerActions, ", ")), http.StatusBadRequest)
+		return
+	}
+	if req.Selector.empty() {
+		http.Error(w, "selector must list ids or tags", http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency <= 0 {
+		req.Concurrency = defaultActionConcurrency
+	}
+	if req.Concurrency > maxActionConcurrency {
+		req.Concurrency = maxActionConcurrency
+	}
+	if req.RunID == "" {
+		req.RunID = uuid.New().String()
+	}
+
+	devices := h.config.SelectDevices(req.Selector)
+	resp := ActionResponse{
+		RunID:       req.RunID,
+		Action:      req.Action,
+		PowerAction: req.PowerAction,
+		DryRun:      req.DryRun,
+		Results:     make([]ActionResult, len(devices)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	finish := func(i int, res ActionResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		resp.Results[i] = res
+		done++
+		switch res.Status {
+		case "ok":
+			resp.Succeeded++
+		case "error":
+			resp.Failed++
+		case "skipped":
+			resp.Skipped++
+		}
+		if !req.DryRun {
+			h.config.events.Publish(Event{Type: "action", Data: ActionProgress{RunID: req.RunID, Done: done, Total: len(devices), Result: res}})
+		}
+	}
+
+	// Actions run to completion even if the client goes away, so a rack
+	// isn't left half power-cycled
+	sem := make(chan struct{}, req.Concurrency)
+	for i, d := range devices {
+		res := ActionResult{ID: d.ID, Alias: d.Alias, Host: d.Host}
+		run, err := h.prepareAction(req, d)
+		if err != nil {
+			res.Status, res.Error = "skipped", err.Error()
+			finish(i, res)
+			continue
+		}
+		if req.DryRun {
+			res.Status = "pending"
+			finish(i, res)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, res ActionResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ctx, cancel := context.WithTimeout(context.Background(), powerTimeout)
+			defer cancel()
+			res.Status = "ok"
+			if err := run(ctx); err != nil {
+				res.Status, res.Error = "error", err.Error()
+			}
+			finish(i, res)
+		}(i, res)
+	}
+	wg.Wait()
+
+	if !req.DryRun {
+		log.Printf("Bulk %s on %d devices by %s: %d ok, %d failed, %d skipped",
+			strings.TrimSpace(req.Action+" "+req.PowerAction), len(devices), clientIP(r), resp.Succeeded, resp.Failed, resp.Skipped)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	defaultBackupCount = 10
+	backupIDFormat     = "20060102T150405.000000Z"
+)
+
+// ConfigBackup describes a point-in-time snapshot of config.toml
+type ConfigBackup struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Devices   int       `json:"devices"`
+	Size      int64     `json:"size"`
+}
+
+// GetBackupDir returns the path to the config snapshots directory
+func (c *Config) GetBackupDir() string {
+	return filepath.Join(c.GetConfigDir(), "backups")
+}
+
+// backupCount returns how many snapshots to keep (0 disables backups)
+func (c *Config) backupCount() int {
+	switch {
+	case c.Server.Backups < 0:
+		return 0
+	case c.Server.Backups == 0:
+		return defaultBackupCount
+	default:
+		return c.Server.Backups
+	}
+}
+
+// snapshot writes the currently stored settings, devices and maintenance
+// windows, plus the thumbnails the devices reference, to a new timestamped
+// backup and prunes old ones.
+// It runs before each write, so it captures the state being replaced.
+// Callers must hold c.mu.
+func (c *Config) snapshot() error {
+	keep := c.backupCount()
+	if keep == 0 {
+		return nil
+	}
+
+	if c.store == nil {
+		return nil
+	}
+	if _, err := os.Stat(c.filePath); os.IsNotExist(err) {
+		return nil // Nothing to back up yet
+	}
+
+	// Render the stored state, which for non-TOML stores isn't in config.toml
+	devices, err := c.store.List()
+	if err != nil {
+		return fmt.Errorf("reading devices for backup: %w", err)
+	}
+	file := configFile{SchemaVersion: schemaVersion, Server: c.Server, Devices: devices, Maintenance: c.Maintenance}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(file); err != nil {
+		return fmt.Errorf("encoding backup: %w", err)
+	}
+
+	id := time.Now().UTC().Format(backupIDFormat)
+	dir := filepath.Join(c.GetBackupDir(), id)
+	if err := os.MkdirAll(filepath.Join(dir, "thumbnails"), 0755); err != nil {
+		return fmt.Errorf("creating backup dir: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.toml"), buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing backup: %w", err)
+	}
+
+	for _, name := range thumbnailFiles(devices) {
+		src := filepath.Join(c.GetThumbnailDir(), name)
+		if err := copyFile(src, filepath.Join(dir, "thumbnails", name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("snapshot: failed to copy thumbnail %s: %v", name, err)
+		}
+	}
+
+	return c.pruneBackups(keep)
+}
+
+// pruneBackups removes all but the newest keep snapshots
+func (c *Config) pruneBackups(keep int) error {
+	ids, err := c.backupIDs()
+	if err != nil {
+		return err
+	}
+	for len(ids) > keep {
+		if err := os.RemoveAll(filepath.Join(c.GetBackupDir(), ids[0])); err != nil {
+			return fmt.Errorf("pruning backup %s: %w", ids[0], err)
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// backupIDs returns snapshot IDs oldest first
+func (c *Config) backupIDs() ([]string, error) {
+	entries, err := os.ReadDir(c.GetBackupDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading backup dir: %w", err)
+	}
+
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupIDFormat, e.Name()); err != nil {
+			continue
+		}
+		ids = append(ids, e.Name())
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ListBackups returns the available snapshots, newest first
+func (c *Config) ListBackups() ([]ConfigBackup, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ids, err := c.backupIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]ConfigBackup, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		path := filepath.Join(c.GetBackupDir(), ids[i], "config.toml")
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		created, _ := time.Parse(backupIDFormat, ids[i])
+		backup := ConfigBackup{ID: ids[i], CreatedAt: created, Size: info.Size()}
+		if snap, err := readBackupConfig(path); err == nil {
+			backup.Devices = len(snap.Devices)
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
+
+// RestoreBackup replaces the device inventory, thumbnails and maintenance
+// windows with those from a snapshot. Server settings are only kept for
+// reference, since most need a restart. The current state is itself
+// snapshotted by Save, so a restore can be undone by restoring the newest
+// backup.
+func (c *Config) RestoreBackup(id string) error {
+	if _, err := time.Parse(backupIDFormat, id); err != nil || strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("backup not found")
+	}
+
+	dir := filepath.Join(c.GetBackupDir(), id)
+	snap, err := readBackupConfig(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("backup not found")
+		}
+		return err
+	}
+
+	if err := validateDevices(snap.Devices); err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+
+	if err := c.EnsureThumbnailDir(); err != nil {
+		return fmt.Errorf("creating thumbnail dir: %w", err)
+	}
+	for _, name := range thumbnailFiles(snap.Devices) {
+		src := filepath.Join(dir, "thumbnails", name)
+		if err := copyFile(src, filepath.Join(c.GetThumbnailDir(), name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("restoring thumbnail %s: %w", name, err)
+		}
+	}
+
+	c.mu.Lock()
+	oldDevices := c.Devices
+	keep := make(map[string]bool, len(snap.Devices))
+	for _, d := range snap.Devices {
+		keep[d.ID] = true
+	}
+	var deletes []string
+	for _, d := range oldDevices {
+		if !keep[d.ID] {
+			deletes = append(deletes, d.ID)
+		}
+	}
+	c.Devices = snap.Devices
+
+	if err := c.commit(snap.Devices, deletes); err != nil {
+		// Rollback
+		c.Devices = oldDevices
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Unlock()
+
+	if err := c.replaceMaintenance(snap.Maintenance); err != nil {
+		return fmt.Errorf("restoring maintenance windows: %w", err)
+	}
+
+	c.GenerateMissingThumbnails()
+	return nil
+}
+
+// readBackupConfig loads a snapshot, upgrading it to the current schema
+func readBackupConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	migrated, _, err := migrateConfigData(data)
+	if err != nil {
+		return nil, err
+	}
+	snap := &Config{}
+	if err := toml.Unmarshal(migrated, snap); err != nil {
+		return nil, fmt.Errorf("parsing backup: %w", err)
+	}
+	return snap, nil
+}
+
+// thumbnailFiles returns the thumbnail filenames used by devices, both
+// explicit and auto-generated
+func thumbnailFiles(devices []Device) []string {
+	var names []string
+	for _, d := range devices {
+		if d.Thumbnail != "" {
+			names = append(names, filepath.Base(d.Thumbnail))
+		}
+		if d.ID != "" && d.Thumbnail != d.ID+".jpg" {
+			names = append(names, d.ID+".jpg")
+		}
+	}
+	return names
+}
+
+// copyFile copies src to dst, replacing dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BatchOperation is a single create, update or delete in a batch request
+type BatchOperation struct {
+	Op     string         `json:"op"` // "create", "update" or "delete"
+	ID     string         `json:"id,omitempty"`
+	Device DeviceWithAuth `json:"device"`
+}
+
+// BatchResult reports the outcome of a single batch operation
+type BatchResult struct {
+	Index  int     `json:"index"`
+	Op     string  `json:"op"`
+	ID     string  `json:"id,omitempty"`
+	Status string  `json:"status"` // "ok", "error" or "skipped"
+	Error  string  `json:"error,omitempty"`
+	Device *Device `json:"device,omitempty"`
+}
+
+// ApplyBatch applies operations all-or-nothing under a single lock and save.
+// If any operation is invalid, or the save fails, the inventory is left
+// unchanged; the returned bool reports whether the batch was committed.
+func (c *Config) ApplyBatch(ops []BatchOperation) ([]BatchResult, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldDevices := c.Devices
+	working := make([]Device, len(c.Devices))
+	copy(working, c.Devices)
+
+	find := func(id string) int {
+		for i, d := range working {
+			if d.ID == id && d.DeletedAt == nil {
+				return i
+			}
+		}
+		return -1
+	}
+
+	results := make([]BatchResult, len(ops))
+	var created []Device
+	changed := make(map[string]bool)
+	failed := false
+	for i, op := range ops {
+		res := BatchResult{Index: i, Op: op.Op, ID: op.ID}
+		if failed {
+			res.Status = "skipped"
+			results[i] = res
+			continue
+		}
+
+		err := func() error {
+			switch op.Op {
+			case "create":
+				if op.Device.Host == "" {
+					return fmt.Errorf("host is required")
+				}
+				if err := op.Device.validate(); err != nil {
+					return err
+				}
+				d := Device{
+					ID:       uuid.New().String(),
+					Host:     op.Device.Host,
+					Alias:    op.Device.Alias,
+					Username: op.Device.Username,
+					Password: op.Device.Password,
+					Type:     op.Device.Type,
+					MAC:      op.Device.MAC,
+					Tags:     normalizeTags(op.Device.Tags),
+
+					WakeBroadcast: op.Device.WakeBroadcast,
+					WakeInterface: op.Device.WakeInterface,
+				}
+				working = append(working, d)
+				created = append(created, d)
+				changed[d.ID] = true
+				res.ID = d.ID
+				res.Device = &d
+			case "update":
+				if op.Device.Host == "" {
+					return fmt.Errorf("host is required")
+				}
+				if err := op.Device.validate(); err != nil {
+					return err
+				}
+				idx := find(op.ID)
+				if idx == -1 {
+					return fmt.Errorf("device not found")
+				}
+				d := working[idx]
+				d.Host = op.Device.Host
+				d.Alias = op.Device.Alias
+				// A blank password keeps the stored one, as in UpdateDevice
+				if op.Device.Password != "" || op.Device.Username == "" {
+					d.Password = op.Device.Password
+				}
+				d.Username = op.Device.Username
+				d.Type = op.Device.Type
+				d.MAC = op.Device.MAC
+				d.Tags = normalizeTags(op.Device.Tags)
+				d.WakeBroadcast = op.Device.WakeBroadcast
+				d.WakeInterface = op.Device.WakeInterface
+				working[idx] = d
+				changed[d.ID] = true
+				res.Device = &d
+			case "delete":
+				idx := find(op.ID)
+				if idx == -1 {
+					return fmt.Errorf("device not found")
+				}
+				now := time.Now().UTC()
+				working[idx].DeletedAt = &now
+				changed[op.ID] = true
+			default:
+				return fmt.Errorf("unknown op %q (use create, update or delete)", op.Op)
+			}
+			return nil
+		}()
+
+		if err != nil {
+			res.Status = "error"
+			res.Error = err.Error()
+			failed = true
+		} else {
+			res.Status = "ok"
+		}
+		results[i] = res
+	}
+
+	if failed {
+		// Operations before the failure were not applied either
+		for i := range results {
+			if results[i].Status == "ok" {
+				results[i].Status = "skipped"
+				results[i].Device = nil
+				if results[i].Op == "create" {
+					results[i].ID = ""
+				}
+			}
+		}
+		return results, false, nil
+	}
+
+	var puts []Device
+	for _, d := range working {
+		if changed[d.ID] {
+			puts = append(puts, d)
+		}
+	}
+
+	c.Devices = working
+	if err := c.commit(puts, nil); err != nil {
+		// Rollback
+		c.Devices = oldDevices
+		return nil, false, err
+	}
+
+	// Generate auto-thumbnails for new devices (not saved to config)
+	for _, d := range created {
+		seed := d.ID + d.Host + d.Alias
+		if pattern, err := GeneratePatternThumbnail(seed); err == nil {
+			c.SaveAutoThumbnail(d.ID, pattern)
+		}
+	}
+
+	return results, true, nil
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -22,62 +25,53 @@ type CLIDevice struct {
 	Host      string `json:"host"`
 	Alias     string `json:"alias"`
 	Username  string `json:"username"`
+	Type      string `json:"type"`
+	MAC       string `json:"mac"`
 	Thumbnail string `json:"thumbnail"`
-}
+	Site      string `json:"site"`
+	Remote    bool   `json:"remote"`
 
-// CLIDeviceStatus represents device status from the API
-type CLIDeviceStatus struct {
-	ID        string `json:"id"`
-	Reachable bool   `json:"reachable"`
+	Tags          []string `json:"tags"`
+	WakeBroadcast string   `json:"wake_broadcast"`
+	WakeInterface string   `json:"wake_interface"`
 }
 
-func getServer() string {
-	// Priority: environment variable > config file > default
-	if server := os.Getenv("KVMM_SERVER"); server != "" {
-		return server
-	}
-
-	if server := readConfigFile(); server != "" {
-		return server
+// hasTags reports whether the device carries every one of tags
+func (d CLIDevice) hasTags(tags []string) bool {
+	for _, tag := range tags {
+		if !hasTag(Device{Tags: d.Tags}, tag) {
+			return false
+		}
 	}
+	return true
+}
 
-	return defaultServer
+// CLITrashedDevice represents a deleted device from the API
+type CLITrashedDevice struct {
+	CLIDevice
+	DeletedAt time.Time `json:"deleted_at"`
 }
 
-func readConfigFile() string {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return ""
-	}
+// CLIDeviceStatus represents device status from the API
+type CLIDeviceStatus struct {
+	ID        string  `json:"id"`
+	Reachable bool    `json:"reachable"`
+	LatencyMS float64 `json:"latency_ms"`
 
-	configPath := filepath.Join(home, ".config", "kvmm.conf")
-	file, err := os.Open(configPath)
-	if err != nil {
-		return ""
-	}
-	defer file.Close()
+	Maintenance *CLIDeviceMaintenance `json:"maintenance"`
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		// Parse key=value or just value
-		if strings.HasPrefix(line, "server=") || strings.HasPrefix(line, "server =") {
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				return strings.TrimSpace(parts[1])
-			}
-		}
-		// If no key, treat first non-comment line as server URL
-		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
-			return line
-		}
-	}
+// CLIDeviceMaintenance is the maintenance window a device is in
+type CLIDeviceMaintenance struct {
+	ID     string    `json:"id" yaml:"id"`
+	Reason string    `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Author string    `json:"author,omitempty" yaml:"author,omitempty"`
+	End    time.Time `json:"end" yaml:"end"`
+}
 
-	return ""
+// getServer returns the server URL of the current context
+func getServer() string {
+	return currentContext().Server
 }
 
 func printCLIUsage() {
@@ -86,40 +80,147 @@ func printCLIUsage() {
 Usage:
   kvmm                  List all devices (alias for 'kvmm list')
   kvmm list             List all devices with status
+  kvmm list --offline   List the devices cached from the last successful fetch
+  kvmm status [alias] [--tag <tag>]  Show whether devices are reachable
+  kvmm status --watch [filter] [--tag <tag>]  Live dashboard (s sort, r reverse, / filter, q quit)
   kvmm <alias>          Open device by alias or hostname
+  kvmm <site>/<alias>   Open a device from one federated site
+  kvmm pick [filter]    Choose a device to open from an interactive list
+  kvmm show <alias>     Show a device's details and status
+  kvmm url <alias> [--copy] [--qr] [--once]  Print, copy or QR-encode a device's URL
+  kvmm power <alias> [status|on|off|off-hard|reset] [-y]
+                        Show or change a device's power (asks before off and reset)
+  kvmm sensors <alias>  Show a BMC's temperatures, fans, voltages and power draw
+  kvmm sel <alias> [-n 20]    Show a BMC's system event log
+  kvmm wake <alias> [--wait 2m]  Send a Wake-on-LAN packet, optionally waiting for the host
+  kvmm bulk power <action>|wake|snapshot --tag <tag> [--dry-run] [-c 4] [-y]
+                        Act on every device with a tag, showing progress
+  kvmm maint start [alias] [--tag tag] [--for 1h] [--at 22:00] [--reason text]
+                        Mark devices as in maintenance and hold back their alerts
+  kvmm maint list [--all]     List current and scheduled maintenance windows
+  kvmm maint end <id>         End a maintenance window now
+  kvmm media list      List the server's ISO library
+  kvmm media upload <file> [--name name] [--sha256 sum]  Add an image to the library
+  kvmm media rm <image> [-y]  Delete an image from the library
+  kvmm media attach <alias> <image> [--flash] [--rw] [--force]
+                        Upload an image to a PiKVM and connect it to the host
+  kvmm media eject <alias>    Disconnect a PiKVM's virtual drive
+  kvmm media status <alias>   Show a PiKVM's virtual drive and stored images
+  kvmm add --host <host> [--alias name] [--user name] [--type type] [--mac addr]
+           [--tag tag] [--password-stdin]
+  kvmm edit <alias> --set key=value   Change host, alias, user, type, mac, tags,
+                        wake_broadcast or wake_interface
+  kvmm edit <alias> --password-stdin  Change the password (asks on a terminal)
+  kvmm rm <alias> [-y]  Move a device to the trash
+  kvmm share create <alias> [--for 1h] [--uses 1] [--note text]
+                        Create a link that opens one device without an account
+  kvmm share list [alias]     List share links and when they were last used
+  kvmm share revoke <id>      Stop a share link from working
   kvmm server           Start the web server
+  kvmm config migrate   Upgrade config.toml to the current schema
+  kvmm config backups   List config snapshots kept by the server
+  kvmm config restore <id>  Restore a config snapshot
+  kvmm trash list       List deleted devices
+  kvmm trash restore <alias>  Restore a deleted device
+  kvmm trash purge [alias]    Permanently remove deleted devices
+  kvmm store migrate -from toml -to bolt   Move devices to another storage backend
+  kvmm import <file>    Create or update devices from CSV, JSON or YAML
+  kvmm export           Write all devices as CSV, JSON or YAML
+  kvmm completion bash|zsh|fish|powershell  Print a shell completion script
   kvmm help             Show this help
 
 Server Options:
   kvmm server -config <path>    Config file (default: config.toml)
   kvmm server -port <port>      Override port from config
 
-Configuration:
-  ~/.config/kvmm.conf   Client config file (server URL)
-  KVMM_SERVER           Environment variable (overrides config file)
+Config Options:
+  kvmm config migrate -config <path>   Config file (default: config.toml)
+  kvmm config migrate -dry-run         Print the changes without writing them
+
+Import/Export Options:
+  kvmm import <file> -dry-run         Show what would change without saving
+  kvmm import <file> -match alias     Update existing devices by alias (default: host)
+  kvmm export -format csv|json|yaml   Output format (default: json)
+  kvmm export -credentials            Include passwords (server must allow it)
+  kvmm export -o <file>               Write to a file instead of stdout
 
-Config file format (~/.config/kvmm.conf):
-  server = http://192.168.1.50:8080
+Output Options (list, show, status):
+  -o table|wide|json|yaml|csv|name    Output format (default: table, or the context's output)
+  -o template='{{.Alias}} {{.Host}}'  Go template applied to each device
+  --no-headers                        Omit table and CSV headers
+  --no-color                          Disable colour (also off when not a terminal or NO_COLOR is set)
+
+Exit Codes:
+  1 request failed, 2 bad arguments, 3 no device matched, 4 several devices matched
+
+Contexts:
+  kvmm context list             List server contexts (* = current)
+  kvmm context use <name>       Switch the current context
+  kvmm context add <name> <url> [-token t] [-ca-file path] [-output format]
+  kvmm context remove <name>    Delete a context
+
+Global Options:
+  --server <url>        Talk to this server instead of the current context
+  --context <name>      Use a context for this command only
+
+Configuration:
+  $XDG_CONFIG_HOME/kvmm/config.toml   Client contexts (default ~/.config/kvmm/config.toml)
+  KVMM_SERVER           Server URL (overrides the current context)
+  KVMM_CONTEXT          Context name (overrides the current context)
 
 Examples:
   kvmm list
   kvmm "Server Room"
   kvmm 192.168.1.100
+  kvmm berlin/rack-1
+  kvmm --context office list
+  kvmm list -o json
+  kvmm url rack-1 --qr
   kvmm server -config /etc/kvmm/config.toml`)
 }
 
-func runList() {
-	server := getServer()
-	devices, err := fetchDevices(server)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	out := addOutputFlags(fs)
+	offline := fs.Bool("offline", false, "Show the cached device list without contacting the server")
+	if positional := parseFlags(fs, args); len(positional) > 0 {
+		fail(exitUsage, "unexpected argument %q", positional[0])
 	}
+	opts := out.options()
 
-	statuses, _ := fetchStatuses(server)
-	statusMap := make(map[string]bool)
-	for _, s := range statuses {
-		statusMap[s.ID] = s.Reachable
+	server := getServer()
+	var devices []CLIDevice
+	var views []CLIDeviceView
+	if *offline {
+		cache, err := loadDeviceCache(server)
+		if err != nil {
+			fail(exitError, "%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Device list cached %s (%s); statuses unknown\n",
+			cache.SavedAt.Local().Format("2006-01-02 15:04"), server)
+		devices = cache.Devices
+		views = deviceViews(server, devices, nil)
+		for i := range views {
+			views[i].URL = directURL(devices[i])
+		}
+	} else {
+		var err error
+		devices, err = fetchDevices(server)
+		if isUnreachable(err) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintln(os.Stderr, "Use 'kvmm list --offline' for the last cached device list")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		statuses, _ := fetchStatuses(server)
+		views = deviceViews(server, devices, statuses)
+	}
+	if writeStructured(os.Stdout, views, opts, false) {
+		return
 	}
 
 	if len(devices) == 0 {
@@ -127,88 +228,134 @@ func runList() {
 		return
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "STATUS\tALIAS\tHOST\tAUTH")
-	fmt.Fprintln(w, "------\t-----\t----\t----")
-
+	// Federated servers label devices with their site
+	showSite := false
 	for _, d := range devices {
-		status := "?"
-		if reachable, ok := statusMap[d.ID]; ok {
-			if reachable {
-				status = "●"
-			} else {
-				status = "○"
-			}
+		if d.Site != "" {
+			showSite = true
+			break
 		}
+	}
 
-		alias := d.Alias
-		if alias == "" {
-			alias = "-"
-		}
+	t := newTableWriter(opts)
+	switch {
+	case opts.format == "wide":
+		t.header("STATUS", "ALIAS", "HOST", "SITE", "USERNAME", "ID", "URL")
+	case showSite:
+		t.header("STATUS", "SITE", "ALIAS", "HOST", "AUTH")
+	default:
+		t.header("STATUS", "ALIAS", "HOST", "AUTH")
+	}
 
+	for _, v := range views {
 		auth := "no"
-		if d.Username != "" {
+		if v.AutoLogin {
 			auth = "yes"
 		}
 
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status, alias, d.Host, auth)
+		switch {
+		case opts.format == "wide":
+			t.row(v.symbol(), dash(v.Alias), v.Host, dash(v.Site), dash(v.Username), v.ID, v.URL)
+		case showSite:
+			t.row(v.symbol(), dash(v.Site), dash(v.Alias), v.Host, auth)
+		default:
+			t.row(v.symbol(), dash(v.Alias), v.Host, auth)
+		}
 	}
-	w.Flush()
+	t.flush()
 
-	fmt.Println()
-	fmt.Println("● = online, ○ = offline")
+	if !opts.noHeaders {
+		fmt.Println()
+		fmt.Println("● = online, ○ = offline, ◐ = in maintenance")
+	}
 }
 
-func runOpen(query string) {
+// runStatus prints the reachability of every device, or those matching a query
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	out := addOutputFlags(fs)
+	watch := fs.Bool("watch", false, "Show a live full-screen dashboard")
+	interval := fs.Duration("interval", 5*time.Second, "How often --watch polls for latency")
+	sortBy := fs.String("sort", "status", "--watch sort column: "+strings.Join(watchSortColumns, ", "))
+	var tags tagFlags
+	fs.Var(&tags, "tag", "Only show devices with this tag; repeat to require several")
+	positional := parseFlags(fs, args)
+	opts := out.options()
+
 	server := getServer()
-	devices, err := fetchDevices(server)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if *watch {
+		runStatusWatch(server, strings.Join(positional, " "), tags, *sortBy, *interval, opts.color)
+		return
 	}
-
-	query = strings.ToLower(query)
-
-	// First try exact match (case insensitive)
-	for i, d := range devices {
-		if strings.ToLower(d.Alias) == query || strings.ToLower(d.Host) == query {
-			openDeviceInBrowser(server, &devices[i])
-			return
+	var devices []CLIDevice
+	var err error
+	if len(positional) > 0 {
+		query := strings.Join(positional, " ")
+		if devices, _, err = searchServer(server, query); err != nil {
+			fail(exitError, "%v", err)
+		}
+		if len(devices) == 0 {
+			fmt.Fprintf(os.Stderr, "No device found matching: %s\n", query)
+			os.Exit(exitNotFound)
 		}
+	} else if devices, err = fetchDevices(server); err != nil {
+		fail(exitError, "%v", err)
 	}
-
-	// Collect all partial matches
-	var matches []CLIDevice
-	for _, d := range devices {
-		if strings.Contains(strings.ToLower(d.Alias), query) ||
-			strings.Contains(strings.ToLower(d.Host), query) {
-			matches = append(matches, d)
+	if len(tags) > 0 {
+		var tagged []CLIDevice
+		for _, d := range devices {
+			if d.hasTags(tags) {
+				tagged = append(tagged, d)
+			}
+		}
+		if len(tagged) == 0 {
+			fmt.Fprintf(os.Stderr, "No device found with tag: %s\n", tags.String())
+			os.Exit(exitNotFound)
 		}
+		devices = tagged
 	}
 
-	switch len(matches) {
-	case 0:
-		fmt.Fprintf(os.Stderr, "No device found matching: %s\n", query)
-		fmt.Fprintln(os.Stderr, "Use 'kvmm list' to see available devices")
-		os.Exit(1)
-	case 1:
-		openDeviceInBrowser(server, &matches[0])
-	default:
-		fmt.Fprintf(os.Stderr, "Multiple devices match '%s':\n\n", query)
-		w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(w, "ALIAS\tHOST")
-		fmt.Fprintln(w, "-----\t----")
-		for _, d := range matches {
-			alias := d.Alias
-			if alias == "" {
-				alias = "-"
-			}
-			fmt.Fprintf(w, "%s\t%s\n", alias, d.Host)
+	statuses, err := fetchStatuses(server)
+	if err != nil {
+		fail(exitError, "failed to fetch status: %v", err)
+	}
+	views := deviceViews(server, devices, statuses)
+	if writeStructured(os.Stdout, views, opts, false) {
+		return
+	}
+
+	t := newTableWriter(opts)
+	if opts.format == "wide" {
+		t.header("STATUS", "ALIAS", "HOST", "SITE", "ID")
+	} else {
+		t.header("STATUS", "ALIAS", "HOST")
+	}
+	for _, v := range views {
+		status := v.symbol() + " " + v.Status
+		if v.Maintenance != nil {
+			status += " (maintenance)"
+		}
+		if opts.format == "wide" {
+			t.row(status, dash(v.Alias), v.Host, dash(v.Site), v.ID)
+		} else {
+			t.row(status, dash(v.Alias), v.Host)
 		}
-		w.Flush()
-		fmt.Fprintln(os.Stderr, "\nBe more specific.")
-		os.Exit(1)
 	}
+	t.flush()
+}
+
+func runOpen(query string) {
+	server := getServer()
+	matches, best, err := searchServer(server, query)
+	if isUnreachable(err) {
+		runOpenOffline(server, query, err)
+		return
+	}
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	device := chooseDevice(server, query, matches, best)
+	openDeviceInBrowser(server, &device)
 }
 
 func openDeviceInBrowser(server string, device *CLIDevice) {
@@ -226,11 +373,16 @@ func openDeviceInBrowser(server string, device *CLIDevice) {
 }
 
 func fetchDevices(server string) ([]CLIDevice, error) {
-	client := &http.Client{Timeout: 5 * time.Second}
+	return fetchDevicesTimeout(server, 5*time.Second)
+}
+
+// fetchDevicesTimeout fetches the device list, refreshing the offline cache
+func fetchDevicesTimeout(server string, timeout time.Duration) ([]CLIDevice, error) {
+	client := newCLIClient(timeout)
 
 	resp, err := client.Get(server + "/api/devices")
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server: %v", err)
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -243,11 +395,12 @@ func fetchDevices(server string) ([]CLIDevice, error) {
 		return nil, fmt.Errorf("failed to parse response: %v", err)
 	}
 
+	saveDeviceCache(server, devices)
 	return devices, nil
 }
 
 func fetchStatuses(server string) ([]CLIDeviceStatus, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := newCLIClient(10 * time.Second)
 
 	resp, err := client.Get(server + "/api/status")
 	if err != nil {
@@ -274,3 +427,404 @@ func openBrowser(url string) error {
 
 	return cmd.Start()
 }
+
+// CLIConfigBackup represents a config snapshot from the API
+type CLIConfigBackup struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Devices   int       `json:"devices"`
+	Size      int64     `json:"size"`
+}
+
+func runConfigBackups() {
+	server := getServer()
+	client := newCLIClient(10 * time.Second)
+
+	resp, err := client.Get(server + "/api/config/backups")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to connect to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Error: server returned %d\n", resp.StatusCode)
+		os.Exit(1)
+	}
+
+	var backups []CLIConfigBackup
+	if err := json.NewDecoder(resp.Body).Decode(&backups); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to parse response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(backups) == 0 {
+		fmt.Println("No backups available")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tDEVICES")
+	fmt.Fprintln(w, "--\t-------\t-------")
+	for _, b := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", b.ID, b.CreatedAt.Local().Format("2006-01-02 15:04:05"), b.Devices)
+	}
+	w.Flush()
+}
+
+func runConfigRestore(id string) {
+	server := getServer()
+	client := newCLIClient(30 * time.Second)
+
+	resp, err := client.Post(server+"/api/config/backups/"+id+"/restore", "application/json", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to connect to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", readAPIError(resp))
+		os.Exit(1)
+	}
+
+	fmt.Printf("Restored backup %s\n", id)
+}
+
+// readAPIError turns a non-2xx API response into an error using the
+// plain-text message written by http.Error
+func readAPIError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if text := strings.TrimSpace(string(msg)); text != "" {
+		return fmt.Errorf("%s", text)
+	}
+	return fmt.Errorf("server returned %d", resp.StatusCode)
+}
+
+func runTrash(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		runTrashList()
+	case "restore":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "Usage: kvmm trash restore <alias>")
+			os.Exit(1)
+		}
+		runTrashRestore(strings.Join(args[1:], " "))
+	case "purge":
+		runTrashPurge(strings.Join(args[1:], " "))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown trash command: %s\n", args[0])
+		os.Exit(1)
+	}
+}
+
+func runTrashList() {
+	devices, err := fetchTrash(getServer())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("Trash is empty")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ALIAS\tHOST\tDELETED")
+	fmt.Fprintln(w, "-----\t----\t-------")
+	for _, d := range devices {
+		alias := d.Alias
+		if alias == "" {
+			alias = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", alias, d.Host, d.DeletedAt.Local().Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+}
+
+func runTrashRestore(query string) {
+	server := getServer()
+	device := findTrashedDevice(server, query)
+
+	client := newCLIClient(10 * time.Second)
+	resp, err := client.Post(server+"/api/devices/"+device.ID+"/restore", "application/json", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to connect to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", readAPIError(resp))
+		os.Exit(1)
+	}
+
+	fmt.Printf("Restored %s (%s)\n", displayName(device), device.Host)
+}
+
+func runTrashPurge(query string) {
+	server := getServer()
+	path := "/api/trash"
+	if query != "" {
+		device := findTrashedDevice(server, query)
+		path += "/" + device.ID
+		if !confirm(fmt.Sprintf("Permanently delete %s?", displayName(device))) {
+			return
+		}
+	} else if !confirm("Permanently delete every device in the trash?") {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, server+path, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	client := newCLIClient(10 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to connect to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", readAPIError(resp))
+		os.Exit(1)
+	}
+
+	fmt.Println("Purged")
+}
+
+// findTrashedDevice resolves an alias, host or ID among trashed devices
+func findTrashedDevice(server, query string) CLIDevice {
+	devices, err := fetchTrash(server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	query = strings.ToLower(query)
+	var matches []CLIDevice
+	for _, d := range devices {
+		if d.ID == query || strings.ToLower(d.Alias) == query || strings.ToLower(d.Host) == query {
+			matches = append(matches, d.CLIDevice)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		fmt.Fprintf(os.Stderr, "No deleted device found matching: %s\n", query)
+		os.Exit(1)
+	case 1:
+		return matches[0]
+	}
+	fmt.Fprintf(os.Stderr, "Multiple deleted devices match '%s'; use the device ID\n", query)
+	for _, d := range matches {
+		fmt.Fprintf(os.Stderr, "  %s  %s\n", d.ID, displayName(d))
+	}
+	os.Exit(1)
+	return CLIDevice{}
+}
+
+func fetchTrash(server string) ([]CLITrashedDevice, error) {
+	client := newCLIClient(5 * time.Second)
+
+	resp, err := client.Get(server + "/api/trash")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readAPIError(resp)
+	}
+
+	var devices []CLITrashedDevice
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	return devices, nil
+}
+
+// displayName returns the alias of a device, or its host when unset
+func displayName(d CLIDevice) string {
+	if d.Alias != "" {
+		return d.Alias
+	}
+	return d.Host
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	reader := bufio.NewReader(os.Stdin)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// CLIImportResult represents a per-row import result from the API
+type CLIImportResult struct {
+	Row    int    `json:"row"`
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	Host   string `json:"host"`
+	Alias  string `json:"alias"`
+	Error  string `json:"error"`
+}
+
+// parseFlags parses args allowing flags before and after positional
+// arguments, and returns the positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show what would change without saving")
+	match := fs.String("match", "host", "Match existing devices by host or alias")
+	format := fs.String("format", "", "Input format: csv, json or yaml (default: from file extension)")
+	files := parseFlags(fs, args)
+
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm import <file> [-dry-run] [-match host|alias] [-format csv|json|yaml]")
+		os.Exit(1)
+	}
+
+	name := *format
+	if name == "" {
+		name = filepath.Ext(files[0])
+	}
+	if _, err := transferFormat(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var in io.Reader = os.Stdin
+	if files[0] != "-" {
+		f, err := os.Open(files[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	query := url.Values{}
+	query.Set("format", strings.TrimPrefix(name, "."))
+	query.Set("match", *match)
+	if *dryRun {
+		query.Set("dry_run", "true")
+	}
+
+	client := newCLIClient(60 * time.Second)
+	resp, err := client.Post(getServer()+"/api/devices/import?"+query.Encode(), "application/octet-stream", in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to connect to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnprocessableEntity {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", readAPIError(resp))
+		os.Exit(1)
+	}
+
+	var out struct {
+		Applied bool              `json:"applied"`
+		Results []CLIImportResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to parse response: %v\n", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROW\tACTION\tALIAS\tHOST\tERROR")
+	fmt.Fprintln(w, "---\t------\t-----\t----\t-----")
+	counts := make(map[string]int)
+	for _, r := range out.Results {
+		counts[r.Action]++
+		alias := r.Alias
+		if alias == "" {
+			alias = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", r.Row, r.Action, alias, r.Host, r.Error)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d created, %d updated, %d errors\n", counts["created"], counts["updated"], counts["error"])
+	switch {
+	case counts["error"] > 0:
+		fmt.Fprintln(os.Stderr, "No changes were saved.")
+		os.Exit(1)
+	case *dryRun:
+		fmt.Println("Dry run: no changes were saved.")
+	}
+}
+
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "Output format: csv, json or yaml")
+	credentials := fs.Bool("credentials", false, "Include passwords (server must allow it)")
+	output := fs.String("o", "", "Write to a file instead of stdout")
+	parseFlags(fs, args)
+
+	name, err := transferFormat(*format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	query := url.Values{}
+	query.Set("format", name)
+	if *credentials {
+		query.Set("credentials", "true")
+	}
+
+	client := newCLIClient(30 * time.Second)
+	resp, err := client.Get(getServer() + "/api/devices/export?" + query.Encode())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to connect to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", readAPIError(resp))
+		os.Exit(1)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tagFlags collects repeated --tag flags, each of which may also be a
+// comma-separated list
+type tagFlags []string
+
+func (t *tagFlags) String() string { return strings.Join(*t, ",") }
+
+func (t *tagFlags) Set(v string) error {
+	*t = append(*t, splitTags(v)...)
+	return nil
+}
+
+// CLIActionResult is a device's outcome from POST /api/actions
+type CLIActionResult struct {
+	ID     string `json:"id"`
+	Alias  string `json:"alias"`
+	Host   string `json:"host"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// name is the alias, or the host for devices without one
+func (r CLIActionResult) name() string {
+	if r.Alias != "" {
+		return r.Alias
+	}
+	return r.Host
+}
+
+// CLIActionResponse is the response of POST /api/actions
+type CLIActionResponse struct {
+	Results   []CLIActionResult `json:"results"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Skipped   int               `json:"skipped"`
+}
+
+// bulkEventsWait is how long to wait for the event stream before starting
+// without live progress
+const bulkEventsWait = 3 * time.Second
+
+// runBulk applies an action to every device with the given tags:
+// `kvmm bulk power reset --tag rack3`. Progress is printed per device as
+// the server reports it.
+func runBulk(args []string) {
+	fs := flag.NewFlagSet("bulk", flag.ExitOnError)
+	var tags tagFlags
+	fs.Var(&tags, "tag", "Act on devices with this tag; repeat to require several")
+	dryRun := fs.Bool("dry-run", false, "List the devices that would be affected")
+	concurrency := fs.Int("c", 0, "Devices handled at once (default 4, max 32)")
+	yes := fs.Bool("y", false, "Don't ask for confirmation")
+	positional := parseFlags(fs, args)
+
+	usage := "usage: kvmm bulk power <on|off|off-hard|reset>|wake|snapshot --tag <tag> [--dry-run] [-c 4] [-y]"
+	if len(positional) == 0 || len(tags) == 0 {
+		fail(exitUsage, usage)
+	}
+	req := ActionRequest{
+		Action:      positional[0],
+		Selector:    DeviceSelector{Tags: tags},
+		Concurrency: *concurrency,
+	}
+	switch req.Action {
+	case "power":
+		if len(positional) != 2 {
+			fail(exitUsage, usage)
+		}
+		req.PowerAction = strings.ReplaceAll(positional[1], "-", "_")
+	case "wake", "snapshot":
+		if len(positional) != 1 {
+			fail(exitUsage, usage)
+		}
+	default:
+		fail(exitUsage, usage)
+	}
+	server := getServer()
+	selection := strings.Join(tags, ", ")
+
+	// A dry run shows what will happen, and is the list to confirm
+	prompts := map[string]string{
+		"off":      "Shut down %d devices tagged %s?",
+		"off_hard": "Force %d devices tagged %s off? Unsaved work will be lost.",
+		"reset":    "Reset %d devices tagged %s? Unsaved work will be lost.",
+	}
+	prompt, needsConfirm := prompts[req.PowerAction]
+	if *dryRun || (needsConfirm && !*yes) {
+		req.DryRun = true
+		plan := postBulk(server, req)
+		req.DryRun = false
+		if len(plan.Results) == 0 {
+			fail(exitNotFound, "no devices tagged %s", selection)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DEVICE\tHOST\tSTATUS")
+		fmt.Fprintln(w, "------\t----\t------")
+		for _, r := range plan.Results {
+			status := r.Status
+			if r.Error != "" {
+				status += ": " + r.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.name(), r.Host, status)
+		}
+		w.Flush()
+		if *dryRun {
+			return
+		}
+		pending := len(plan.Results) - plan.Skipped
+		if pending == 0 {
+			fmt.Println("Nothing to do")
+			return
+		}
+		if !confirm(fmt.Sprintf(prompt, pending, selection)) {
+			fmt.Println("Aborted")
+			return
+		}
+	}
+
+	// Follow progress on the event stream, if the server has one
+	req.RunID = uuid.New().String()
+	var mu sync.Mutex
+	printed := make(map[string]bool)
+	finished := false
+	report := func(done, total int, r CLIActionResult) {
+		if printed[r.ID] {
+			return
+		}
+		printed[r.ID] = true
+		line := fmt.Sprintf("[%*d/%d] %s: %s", len(fmt.Sprint(total)), done, total, r.name(), r.Status)
+		if r.Error != "" {
+			line += ": " + r.Error
+		}
+		fmt.Println(line)
+	}
+	connected := make(chan struct{})
+	go streamEvents(server, func() { close(connected) }, func(event string, data []byte) {
+		if event != "action" {
+			return
+		}
+		var progress struct {
+			RunID  string          `json:"run_id"`
+			Done   int             `json:"done"`
+			Total  int             `json:"total"`
+			Result CLIActionResult `json:"result"`
+		}
+		if json.Unmarshal(data, &progress) != nil || progress.RunID != req.RunID {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !finished {
+			report(progress.Done, progress.Total, progress.Result)
+		}
+	})
+	select {
+	case <-connected:
+	case <-time.After(bulkEventsWait):
+	}
+
+	result := postBulk(server, req)
+	mu.Lock()
+	finished = true
+	if len(result.Results) == 0 {
+		fail(exitNotFound, "no devices tagged %s", selection)
+	}
+	// Anything the event stream missed
+	done := len(printed)
+	for _, r := range result.Results {
+		if !printed[r.ID] {
+			done++
+			report(done, len(result.Results), r)
+		}
+	}
+	mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%d succeeded, %d failed, %d skipped\n", result.Succeeded, result.Failed, result.Skipped)
+	if result.Failed > 0 {
+		os.Exit(exitError)
+	}
+}
+
+// postBulk sends a bulk action request, exiting on failure. It waits for
+// every device, so there is no timeout.
+func postBulk(server string, req ActionRequest) CLIActionResponse {
+	body, _ := json.Marshal(req)
+	resp, err := newCLIClient(0).Post(server+"/api/actions", "application/json", bytes.NewReader(body))
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var result CLIActionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+	return result
+}
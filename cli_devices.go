@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// CLI exit codes
+const (
+	exitError     = 1 // Request failed or the server rejected it
+	exitUsage     = 2 // Bad arguments
+	exitNotFound  = 3 // No device matched
+	exitAmbiguous = 4 // Several devices matched
+)
+
+// CLIDeviceInput is the body of create and update requests
+type CLIDeviceInput struct {
+	Host     string `json:"host"`
+	Alias    string `json:"alias,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Type     string `json:"type,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+
+	Tags          []string `json:"tags,omitempty"`
+	WakeBroadcast string   `json:"wake_broadcast,omitempty"`
+	WakeInterface string   `json:"wake_interface,omitempty"`
+}
+
+// setFlags collects repeated --set key=value flags
+type setFlags []string
+
+func (s *setFlags) String() string { return strings.Join(*s, ",") }
+
+func (s *setFlags) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+// fail prints an error and exits with code
+func fail(code int, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Error: "+format+"\n", args...)
+	os.Exit(code)
+}
+
+// apiExitCode maps an API response status to a CLI exit code
+func apiExitCode(status int) int {
+	switch status {
+	case http.StatusNotFound:
+		return exitNotFound
+	case http.StatusBadRequest:
+		return exitUsage
+	}
+	return exitError
+}
+
+// CLISearchResponse is the ranked result of GET /api/devices/search
+type CLISearchResponse struct {
+	Results []CLIDevice `json:"results"`
+	Best    string      `json:"best"`
+}
+
+// searchServer ranks devices against query on the server, best first,
+// returning the ID of a clear winner if there is one. Servers without the
+// search endpoint fall back to matchDevices.
+func searchServer(server, query string) ([]CLIDevice, string, error) {
+	client := newCLIClient(5 * time.Second)
+	resp, err := client.Get(server + "/api/devices/search?q=" + url.QueryEscape(query))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		devices, err := fetchDevices(server)
+		if err != nil {
+			return nil, "", err
+		}
+		matches := matchDevices(devices, query)
+		if len(matches) == 1 {
+			return matches, matches[0].ID, nil
+		}
+		return matches, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", readAPIError(resp)
+	}
+
+	var result CLISearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", fmt.Errorf("failed to parse response: %v", err)
+	}
+	return result.Results, result.Best, nil
+}
+
+// matchDevices is the lookup used before servers could search: an exact
+// ID, alias or host match wins, otherwise every alias or host containing
+// the query matches. "site/name" narrows the search to one federated site.
+func matchDevices(devices []CLIDevice, query string) []CLIDevice {
+	query = strings.ToLower(query)
+
+	if site, rest, ok := strings.Cut(query, "/"); ok && site != "" {
+		var filtered []CLIDevice
+		for _, d := range devices {
+			if strings.ToLower(d.Site) == site {
+				filtered = append(filtered, d)
+			}
+		}
+		devices, query = filtered, rest
+	}
+
+	for _, d := range devices {
+		if strings.ToLower(d.ID) == query || strings.ToLower(d.Alias) == query || strings.ToLower(d.Host) == query {
+			return []CLIDevice{d}
+		}
+	}
+
+	var matches []CLIDevice
+	for _, d := range devices {
+		if strings.Contains(strings.ToLower(d.Alias), query) ||
+			strings.Contains(strings.ToLower(d.Host), query) {
+			matches = append(matches, d)
+		}
+	}
+	return matches
+}
+
+// findDevice resolves a query to one device, opening the clear winner of a
+// ranked search. Otherwise it shows a picker on a terminal, or lists the
+// candidates and exits.
+func findDevice(server, query string) CLIDevice {
+	matches, best, err := searchServer(server, query)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	return chooseDevice(server, query, matches, best)
+}
+
+// chooseDevice picks from the results of a search. server is empty when
+// working from the offline cache, so the picker shows no statuses.
+func chooseDevice(server, query string, matches []CLIDevice, best string) CLIDevice {
+	if len(matches) == 0 {
+		fmt.Fprintf(os.Stderr, "No device found matching: %s\n", query)
+		fmt.Fprintln(os.Stderr, "Use 'kvmm list' to see available devices")
+		os.Exit(exitNotFound)
+	}
+	for _, d := range matches {
+		if best != "" && d.ID == best {
+			return d
+		}
+	}
+
+	// Let the user choose when there's a terminal to draw on
+	if canPick() {
+		var statuses <-chan []CLIDeviceStatus
+		if server != "" {
+			statuses = fetchStatusesAsync(server)
+		}
+		device, ok := pickDevice(matches, "", statuses)
+		if !ok {
+			os.Exit(exitAmbiguous)
+		}
+		return device
+	}
+
+	fmt.Fprintf(os.Stderr, "Multiple devices match '%s':\n\n", query)
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ALIAS\tHOST\tSITE")
+	fmt.Fprintln(w, "-----\t----\t----")
+	for _, d := range matches {
+		alias := d.Alias
+		if alias == "" {
+			alias = "-"
+		}
+		site := d.Site
+		if site == "" {
+			site = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", alias, d.Host, site)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nBe more specific.")
+	os.Exit(exitAmbiguous)
+	return CLIDevice{}
+}
+
+// findLocalDevice is findDevice for commands that modify devices, which
+// federated devices don't allow
+func findLocalDevice(server, query string) CLIDevice {
+	device := findDevice(server, query)
+	if device.Remote {
+		fail(exitError, "%s belongs to site %q; change it on that site's server", displayName(device), device.Site)
+	}
+	return device
+}
+
+// readPasswordStdin reads a password from the first line of stdin, asking
+// for it without echo when stdin is a terminal
+func readPasswordStdin() string {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			fail(exitError, "reading password: %v", err)
+		}
+		return string(password)
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fail(exitUsage, "no password on stdin")
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// sendDevice sends a create or update request and decodes the saved device
+func sendDevice(method, path string, input CLIDeviceInput) CLIDevice {
+	body, _ := json.Marshal(input)
+	req, err := http.NewRequest(method, getServer()+path, bytes.NewReader(body))
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newCLIClient(10 * time.Second).Do(req)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+
+	var device CLIDevice
+	if err := json.NewDecoder(resp.Body).Decode(&device); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+	return device
+}
+
+func runAdd(args []string) {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	host := fs.String("host", "", "Device host or host:port (required)")
+	alias := fs.String("alias", "", "Display name")
+	user := fs.String("user", "", "Username for auto-login")
+	deviceType := fs.String("type", "", "Device type: pikvm (default), blikvm, redfish, ipmi or generic")
+	mac := fs.String("mac", "", "MAC address of the host, for Wake-on-LAN")
+	var tags tagFlags
+	fs.Var(&tags, "tag", "Tag for bulk actions, e.g. rack3; repeatable")
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from stdin")
+	if positional := parseFlags(fs, args); len(positional) > 0 {
+		fail(exitUsage, "unexpected argument %q", positional[0])
+	}
+
+	if *host == "" {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm add --host <host> [--alias name] [--user name] [--type type] [--mac addr] [--tag tag] [--password-stdin]")
+		os.Exit(exitUsage)
+	}
+
+	input := CLIDeviceInput{Host: *host, Alias: *alias, Username: *user, Type: *deviceType, MAC: *mac, Tags: tags}
+	if *passwordStdin {
+		input.Password = readPasswordStdin()
+	}
+
+	device := sendDevice(http.MethodPost, "/api/devices", input)
+	fmt.Printf("Added %s (%s)\n", displayName(device), device.ID)
+}
+
+func runEdit(args []string) {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	var sets setFlags
+	fs.Var(&sets, "set", "Field to change as key=value (host, alias, user, type, mac, tags, wake_broadcast, wake_interface); repeatable")
+	passwordStdin := fs.Bool("password-stdin", false, "Read a new password from stdin")
+	positional := parseFlags(fs, args)
+
+	if len(positional) == 0 || (len(sets) == 0 && !*passwordStdin) {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm edit <alias> --set key=value [--set key=value...] [--password-stdin]")
+		os.Exit(exitUsage)
+	}
+
+	server := getServer()
+	device := findLocalDevice(server, strings.Join(positional, " "))
+
+	// The password isn't returned by the API; leaving it blank keeps it
+	input := CLIDeviceInput{
+		Host:          device.Host,
+		Alias:         device.Alias,
+		Username:      device.Username,
+		Type:          device.Type,
+		MAC:           device.MAC,
+		Tags:          device.Tags,
+		WakeBroadcast: device.WakeBroadcast,
+		WakeInterface: device.WakeInterface,
+	}
+	for _, kv := range sets {
+		key, value, _ := strings.Cut(kv, "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "host":
+			input.Host = value
+		case "alias":
+			input.Alias = value
+		case "user", "username":
+			input.Username = value
+		case "password":
+			// Arguments show up in ps and shell history
+			fail(exitUsage, "passwords can't be set with --set; use --password-stdin")
+		case "type":
+			input.Type = value
+		case "mac":
+			input.MAC = value
+		case "tags":
+			input.Tags = splitTags(value)
+		case "wake_broadcast":
+			input.WakeBroadcast = value
+		case "wake_interface":
+			input.WakeInterface = value
+		default:
+			fail(exitUsage, "unknown field %q (use host, alias, user, type, mac, tags, wake_broadcast or wake_interface)", key)
+		}
+	}
+	if *passwordStdin {
+		input.Password = readPasswordStdin()
+	}
+	if input.Host == "" {
+		fail(exitUsage, "host cannot be empty")
+	}
+
+	updated := sendDevice(http.MethodPut, "/api/devices/"+device.ID, input)
+	fmt.Printf("Updated %s\n", displayName(updated))
+}
+
+func runRemove(args []string) {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	yes := fs.Bool("y", false, "Don't ask for confirmation")
+	positional := parseFlags(fs, args)
+
+	if len(positional) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm rm <alias> [-y]")
+		os.Exit(exitUsage)
+	}
+
+	server := getServer()
+	device := findLocalDevice(server, strings.Join(positional, " "))
+	if !*yes && !confirm(fmt.Sprintf("Delete %s (%s)?", displayName(device), device.Host)) {
+		fmt.Println("Aborted")
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, server+"/api/devices/"+device.ID, nil)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	resp, err := newCLIClient(10 * time.Second).Do(req)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	fmt.Printf("Moved %s to the trash (undo with 'kvmm trash restore %s')\n", displayName(device), device.ID)
+}
+
+func runShow(args []string) {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	out := addOutputFlags(fs)
+	positional := parseFlags(fs, args)
+	if len(positional) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm show <alias> [-o format]")
+		os.Exit(exitUsage)
+	}
+	opts := out.options()
+
+	server := getServer()
+	device := findDevice(server, strings.Join(positional, " "))
+	statuses, _ := fetchStatuses(server)
+
+	views := deviceViews(server, []CLIDevice{device}, statuses)
+	if writeStructured(os.Stdout, views, opts, true) {
+		return
+	}
+
+	v := views[0]
+	autoLogin := "no"
+	if v.AutoLogin {
+		autoLogin = "yes"
+	}
+
+	// Headers don't apply to the key/value layout
+	opts.noHeaders = true
+	t := newTableWriter(opts)
+	t.row("ID:", v.ID)
+	t.row("Alias:", dash(v.Alias))
+	t.row("Host:", v.Host)
+	t.row("Type:", v.Type)
+	if v.MAC != "" {
+		t.row("MAC:", v.MAC)
+	}
+	if len(v.Tags) > 0 {
+		t.row("Tags:", strings.Join(v.Tags, ", "))
+	}
+	if v.Site != "" {
+		t.row("Site:", v.Site)
+	}
+	t.row("Username:", dash(v.Username))
+	t.row("Auto-login:", autoLogin)
+	t.row("Thumbnail:", dash(v.Thumbnail))
+	t.row("Status:", v.symbol()+" "+v.Status)
+	if m := v.Maintenance; m != nil {
+		note := "until " + m.End.Local().Format("2006-01-02 15:04")
+		if m.Reason != "" {
+			note = m.Reason + ", " + note
+		}
+		t.row("Maintenance:", note)
+	}
+	t.row("URL:", v.URL)
+	t.flush()
+}
+
+// fetchStatusesAsync fetches statuses in the background, as the checks can
+// take a few seconds
+func fetchStatusesAsync(server string) <-chan []CLIDeviceStatus {
+	ch := make(chan []CLIDeviceStatus, 1)
+	go func() {
+		statuses, _ := fetchStatuses(server)
+		ch <- statuses
+	}()
+	return ch
+}
+
+// runPick opens a device chosen from an interactive list
+func runPick(args []string) {
+	if !canPick() {
+		fail(exitUsage, "kvmm pick needs an interactive terminal")
+	}
+
+	server := getServer()
+	devices, err := fetchDevices(server)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	if len(devices) == 0 {
+		fmt.Println("No devices configured")
+		return
+	}
+
+	device, ok := pickDevice(devices, strings.Join(args, " "), fetchStatusesAsync(server))
+	if !ok {
+		os.Exit(exitError)
+	}
+	openDeviceInBrowser(server, &device)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CLIMaintenance is a maintenance window as returned by the API
+type CLIMaintenance struct {
+	ID       string `json:"id"`
+	Selector struct {
+		IDs  []string `json:"ids"`
+		Tags []string `json:"tags"`
+	} `json:"selector"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+	Author string    `json:"author"`
+	State  string    `json:"state"`
+}
+
+// runMaint dispatches `kvmm maint <subcommand>`
+func runMaint(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch args[0] {
+	case "start":
+		runMaintStart(args[1:])
+	case "list", "ls":
+		runMaintList(args[1:])
+	case "end":
+		if len(args) != 2 {
+			fail(exitUsage, "usage: kvmm maint end <window-id>")
+		}
+		runMaintEnd(args[1])
+	default:
+		fail(exitUsage, "unknown maint command: %s (use start, list or end)", args[0])
+	}
+}
+
+func runMaintStart(args []string) {
+	fs := flag.NewFlagSet("maint start", flag.ExitOnError)
+	var tags tagFlags
+	fs.Var(&tags, "tag", "Devices with this tag; repeat to require several")
+	duration := fs.Duration("for", time.Hour, "How long the window lasts")
+	at := fs.String("at", "", "Start later: \"15:04\", \"2006-01-02 15:04\" or RFC 3339 (default now)")
+	reason := fs.String("reason", "", "Why, e.g. a change ticket")
+	author := fs.String("author", currentUsername(), "Who is doing the work")
+	positional := parseFlags(fs, args)
+	if len(positional) == 0 && len(tags) == 0 {
+		fail(exitUsage, "usage: kvmm maint start [alias] [--tag tag] [--for 1h] [--at time] [--reason text]")
+	}
+
+	server := getServer()
+	req := MaintenanceRequest{
+		Selector: DeviceSelector{Tags: tags},
+		Duration: duration.String(),
+		Reason:   *reason,
+		Author:   *author,
+	}
+	if len(positional) > 0 {
+		device := findLocalDevice(server, strings.Join(positional, " "))
+		req.Selector.IDs = []string{device.ID}
+	}
+	if *at != "" {
+		start, err := parseStartTime(*at, time.Now())
+		if err != nil {
+			fail(exitUsage, "%v", err)
+		}
+		req.Start = &start
+	}
+
+	body, _ := json.Marshal(req)
+	resp, err := newCLIClient(10*time.Second).Post(server+"/api/maintenance", "application/json", bytes.NewReader(body))
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var m CLIMaintenance
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+
+	what := describeMaintDevices(m, deviceNamesByID(server))
+	if m.State == "scheduled" {
+		fmt.Printf("Scheduled maintenance %s for %s from %s until %s\n", m.ID, what,
+			m.Start.Local().Format("2006-01-02 15:04"), m.End.Local().Format("2006-01-02 15:04"))
+		return
+	}
+	fmt.Printf("Started maintenance %s for %s until %s\n", m.ID, what, m.End.Local().Format("2006-01-02 15:04"))
+}
+
+func runMaintList(args []string) {
+	fs := flag.NewFlagSet("maint list", flag.ExitOnError)
+	all := fs.Bool("all", false, "Include windows that ended in the last week")
+	parseFlags(fs, args)
+
+	server := getServer()
+	endpoint := server + "/api/maintenance"
+	if *all {
+		endpoint += "?all=true"
+	}
+	resp, err := newCLIClient(10 * time.Second).Get(endpoint)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var windows []CLIMaintenance
+	if err := json.NewDecoder(resp.Body).Decode(&windows); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+	if len(windows) == 0 {
+		fmt.Println("No maintenance windows")
+		return
+	}
+
+	names := deviceNamesByID(server)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tDEVICES\tSTART\tEND\tAUTHOR\tREASON")
+	fmt.Fprintln(w, "--\t-----\t-------\t-----\t---\t------\t------")
+	for _, m := range windows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", m.ID, m.State, describeMaintDevices(m, names),
+			m.Start.Local().Format("2006-01-02 15:04"), m.End.Local().Format("2006-01-02 15:04"), dash(m.Author), dash(m.Reason))
+	}
+	w.Flush()
+}
+
+func runMaintEnd(id string) {
+	req, err := http.NewRequest(http.MethodDelete, getServer()+"/api/maintenance/"+url.PathEscape(id), nil)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	resp, err := newCLIClient(10 * time.Second).Do(req)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	fmt.Printf("Ended maintenance %s\n", id)
+}
+
+// describeMaintDevices names a window's devices, e.g. "tag rack3, db-1"
+func describeMaintDevices(m CLIMaintenance, names map[string]string) string {
+	var parts []string
+	if len(m.Selector.Tags) > 0 {
+		parts = append(parts, "tag "+strings.Join(m.Selector.Tags, "+"))
+	}
+	for _, id := range m.Selector.IDs {
+		if name, ok := names[id]; ok {
+			parts = append(parts, name)
+		} else {
+			parts = append(parts, id)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// deviceNamesByID maps device IDs to display names, empty if the list fails
+func deviceNamesByID(server string) map[string]string {
+	names := make(map[string]string)
+	if devices, err := fetchDevices(server); err == nil {
+		for _, d := range devices {
+			names[d.ID] = displayName(d)
+		}
+	}
+	return names
+}
+
+// parseStartTime reads --at: a clock time (the next one to come), a local
+// date and time, or RFC 3339
+func parseStartTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", s, time.Local); err == nil {
+		start := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		if !start.After(now) {
+			start = start.AddDate(0, 0, 1)
+		}
+		return start, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --at %q (use 15:04, 2006-01-02 15:04 or RFC 3339)", s)
+}
+
+// currentUsername is the local user, recorded as a window's author
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// CLIMediaImage is an image in the server's ISO library
+type CLIMediaImage struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// CLIMediaState is a device's virtual drive
+type CLIMediaState struct {
+	Image     string `json:"image"`
+	Connected bool   `json:"connected"`
+	CDROM     bool   `json:"cdrom"`
+	RW        bool   `json:"rw"`
+	Busy      bool   `json:"busy"`
+	Free      int64  `json:"free"`
+	Stored    []struct {
+		Name     string `json:"name"`
+		Size     int64  `json:"size"`
+		Complete bool   `json:"complete"`
+	} `json:"stored"`
+}
+
+// progressLine redraws a one-line progress report on stderr, if it's a
+// terminal, at most a few times a second
+type progressLine struct {
+	label string
+	total int64
+
+	mu   sync.Mutex
+	last time.Time
+	tty  bool
+}
+
+func newProgressLine(label string, total int64) *progressLine {
+	return &progressLine{label: label, total: total, tty: term.IsTerminal(int(os.Stderr.Fd()))}
+}
+
+func (p *progressLine) update(n int64) {
+	p.set(n, p.total)
+}
+
+// set is update for reports that carry their own total
+func (p *progressLine) set(n, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+	if !p.tty || time.Since(p.last) < 200*time.Millisecond && (p.total == 0 || n < p.total) {
+		return
+	}
+	p.last = time.Now()
+	line := fmt.Sprintf("%s %s", p.label, formatSize(n))
+	if p.total > 0 {
+		line = fmt.Sprintf("%s %3d%%  %s of %s", p.label, n*100/p.total, formatSize(n), formatSize(p.total))
+	}
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%s", line)
+}
+
+// done clears the progress line
+func (p *progressLine) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty && !p.last.IsZero() {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+	}
+	p.tty = false
+}
+
+// formatSize formats a byte count, e.g. "4.7 GB"
+func formatSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTP"[exp])
+}
+
+// runMedia dispatches `kvmm media <subcommand>`
+func runMedia(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		runMediaList()
+	case "upload":
+		runMediaUpload(args[1:])
+	case "rm", "remove":
+		runMediaRemove(args[1:])
+	case "attach":
+		runMediaAttach(args[1:])
+	case "eject":
+		if len(args) != 2 {
+			fail(exitUsage, "usage: kvmm media eject <alias>")
+		}
+		runMediaEject(args[1])
+	case "status":
+		if len(args) != 2 {
+			fail(exitUsage, "usage: kvmm media status <alias>")
+		}
+		runMediaStatus(args[1])
+	default:
+		fail(exitUsage, "unknown media command: %s (use list, upload, rm, attach, eject or status)", args[0])
+	}
+}
+
+func runMediaList() {
+	resp, err := newCLIClient(10 * time.Second).Get(getServer() + "/api/media")
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var images []CLIMediaImage
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+	if len(images) == 0 {
+		fmt.Println("No images")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tUPLOADED\tSHA256")
+	fmt.Fprintln(w, "----\t----\t--------\t------")
+	for _, img := range images {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Name, formatSize(img.Size),
+			img.UploadedAt.Local().Format("2006-01-02 15:04"), dash(img.SHA256))
+	}
+	w.Flush()
+}
+
+// runMediaUpload streams a file to the library. The checksum is computed
+// on the way, and the upload is removed again if the server saw different
+// bytes.
+func runMediaUpload(args []string) {
+	fs := flag.NewFlagSet("media upload", flag.ExitOnError)
+	name := fs.String("name", "", "Name in the library (default: the file's name)")
+	expected := fs.String("sha256", "", "Reject the upload unless the file has this SHA-256")
+	positional := parseFlags(fs, args)
+	if len(positional) != 1 {
+		fail(exitUsage, "usage: kvmm media upload <file> [--name name] [--sha256 sum]")
+	}
+
+	f, err := os.Open(positional[0])
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	if *name == "" {
+		*name = filepath.Base(positional[0])
+	}
+
+	server := getServer()
+	endpoint := server + "/api/media/" + url.PathEscape(*name)
+	if *expected != "" {
+		endpoint += "?sha256=" + url.QueryEscape(*expected)
+	}
+	hash := sha256.New()
+	progress := newProgressLine("Uploading "+*name, info.Size())
+	body := &progressReader{r: io.TeeReader(f, hash), progress: progress.update}
+	req, err := http.NewRequest(http.MethodPut, endpoint, body)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := newCLIClient(0).Do(req)
+	progress.done()
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var img CLIMediaImage
+	if err := json.NewDecoder(resp.Body).Decode(&img); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(img.SHA256, sum) {
+		deleteMedia(server, img.Name)
+		fail(exitError, "upload corrupted: sent SHA-256 %s, server stored %s; removed it", sum, dash(img.SHA256))
+	}
+	fmt.Printf("Uploaded %s (%s, sha256 %s)\n", img.Name, formatSize(img.Size), img.SHA256)
+}
+
+func runMediaRemove(args []string) {
+	fs := flag.NewFlagSet("media rm", flag.ExitOnError)
+	yes := fs.Bool("y", false, "Don't ask for confirmation")
+	positional := parseFlags(fs, args)
+	if len(positional) != 1 {
+		fail(exitUsage, "usage: kvmm media rm <image> [-y]")
+	}
+	name := positional[0]
+	if !*yes && !confirm(fmt.Sprintf("Delete %s from the library?", name)) {
+		fmt.Println("Aborted")
+		return
+	}
+	deleteMedia(getServer(), name)
+	fmt.Printf("Deleted %s\n", name)
+}
+
+// deleteMedia removes an image from the library, exiting on failure
+func deleteMedia(server, name string) {
+	req, err := http.NewRequest(http.MethodDelete, server+"/api/media/"+url.PathEscape(name), nil)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	resp, err := newCLIClient(10 * time.Second).Do(req)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+}
+
+// runMediaAttach pushes a library image to a device and connects it,
+// showing the upload's progress from the event stream
+func runMediaAttach(args []string) {
+	fs := flag.NewFlagSet("media attach", flag.ExitOnError)
+	flash := fs.Bool("flash", false, "Present the image as a flash drive rather than a CD-ROM")
+	rw := fs.Bool("rw", false, "Let the host write to a flash drive image")
+	force := fs.Bool("force", false, "Upload even if the device already has the image")
+	positional := parseFlags(fs, args)
+	if len(positional) != 2 {
+		fail(exitUsage, "usage: kvmm media attach <alias> <image> [--flash] [--rw] [--force]")
+	}
+
+	server := getServer()
+	device := findLocalDevice(server, positional[0])
+	req := MediaRequest{Image: positional[1], RW: *rw, Force: *force}
+	if *flash || *rw {
+		cdrom := false
+		req.CDROM = &cdrom
+	}
+
+	progress := newProgressLine("Uploading "+req.Image+" to "+displayName(device), 0)
+	connected := make(chan struct{})
+	go streamEvents(server, func() { close(connected) }, func(event string, data []byte) {
+		if event != "media" {
+			return
+		}
+		var p MediaProgress
+		if json.Unmarshal(data, &p) != nil || p.ID != device.ID || p.Image != req.Image || p.Stage != "uploading" {
+			return
+		}
+		progress.set(p.Bytes, p.Total)
+	})
+	select {
+	case <-connected:
+	case <-time.After(bulkEventsWait):
+	}
+
+	body, _ := json.Marshal(req)
+	resp, err := newCLIClient(0).Post(server+"/api/devices/"+url.PathEscape(device.ID)+"/media", "application/json", bytes.NewReader(body))
+	progress.done()
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var result struct {
+		Uploaded bool          `json:"uploaded"`
+		State    CLIMediaState `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+
+	note := ""
+	if !result.Uploaded {
+		note = " (already on the device)"
+	}
+	fmt.Printf("Attached %s to %s as a %s%s\n", req.Image, displayName(device), driveKind(result.State), note)
+}
+
+func runMediaEject(query string) {
+	server := getServer()
+	device := findLocalDevice(server, query)
+	req, err := http.NewRequest(http.MethodDelete, server+"/api/devices/"+url.PathEscape(device.ID)+"/media", nil)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	resp, err := newCLIClient(20 * time.Second).Do(req)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	fmt.Printf("Ejected virtual media from %s\n", displayName(device))
+}
+
+func runMediaStatus(query string) {
+	server := getServer()
+	device := findLocalDevice(server, query)
+	resp, err := newCLIClient(20 * time.Second).Get(server + "/api/devices/" + url.PathEscape(device.ID) + "/media")
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var state CLIMediaState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+
+	drive := "not connected"
+	if state.Connected {
+		drive = "connected as a " + driveKind(state)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Image:\t%s\n", dash(state.Image))
+	fmt.Fprintf(w, "Drive:\t%s\n", drive)
+	fmt.Fprintf(w, "Free:\t%s\n", formatSize(state.Free))
+	w.Flush()
+	if len(state.Stored) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "STORED\tSIZE\t")
+		for _, s := range state.Stored {
+			incomplete := ""
+			if !s.Complete {
+				incomplete = "incomplete"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, formatSize(s.Size), incomplete)
+		}
+		w.Flush()
+	}
+}
+
+// driveKind describes how a drive is presented to the host
+func driveKind(s CLIMediaState) string {
+	switch {
+	case s.CDROM:
+		return "CD-ROM"
+	case s.RW:
+		return "writable flash drive"
+	}
+	return "read-only flash drive"
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Status symbols used in tables
+const (
+	symbolOnline      = "●"
+	symbolOffline     = "○"
+	symbolUnknown     = "?"
+	symbolMaintenance = "◐"
+)
+
+// CLIDeviceView is a device as printed by list, show and status
+type CLIDeviceView struct {
+	ID        string `json:"id" yaml:"id"`
+	Alias     string `json:"alias" yaml:"alias"`
+	Host      string `json:"host" yaml:"host"`
+	Type      string `json:"type" yaml:"type"`
+	MAC       string `json:"mac,omitempty" yaml:"mac,omitempty"`
+	Site      string `json:"site,omitempty" yaml:"site,omitempty"`
+	Username  string `json:"username,omitempty" yaml:"username,omitempty"`
+	AutoLogin bool   `json:"auto_login" yaml:"auto_login"`
+	Thumbnail string `json:"thumbnail,omitempty" yaml:"thumbnail,omitempty"`
+	Status    string `json:"status" yaml:"status"` // "online", "offline" or "unknown"
+	URL       string `json:"url" yaml:"url"`
+
+	Tags        []string              `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Maintenance *CLIDeviceMaintenance `json:"maintenance,omitempty" yaml:"maintenance,omitempty"`
+}
+
+// Name is the alias, or the host for devices without one
+func (v CLIDeviceView) Name() string {
+	if v.Alias != "" {
+		return v.Alias
+	}
+	return v.Host
+}
+
+// symbol returns the table symbol for the device's status. Devices in a
+// maintenance window get their own, whatever their reachability.
+func (v CLIDeviceView) symbol() string {
+	if v.Maintenance != nil {
+		return symbolMaintenance
+	}
+	switch v.Status {
+	case "online":
+		return symbolOnline
+	case "offline":
+		return symbolOffline
+	}
+	return symbolUnknown
+}
+
+// deviceViews combines devices with their statuses for printing
+func deviceViews(server string, devices []CLIDevice, statuses []CLIDeviceStatus) []CLIDeviceView {
+	statusMap := make(map[string]bool)
+	maintenance := make(map[string]*CLIDeviceMaintenance)
+	for _, s := range statuses {
+		statusMap[s.ID] = s.Reachable
+		maintenance[s.ID] = s.Maintenance
+	}
+
+	views := make([]CLIDeviceView, len(devices))
+	for i, d := range devices {
+		deviceType := d.Type
+		if deviceType == "" {
+			deviceType = deviceTypePiKVM
+		}
+		status := "unknown"
+		if reachable, ok := statusMap[d.ID]; ok {
+			status = "offline"
+			if reachable {
+				status = "online"
+			}
+		}
+		views[i] = CLIDeviceView{
+			ID:        d.ID,
+			Alias:     d.Alias,
+			Host:      d.Host,
+			Type:      deviceType,
+			MAC:       d.MAC,
+			Tags:      d.Tags,
+			Site:      d.Site,
+			Username:  d.Username,
+			AutoLogin: d.Username != "",
+			Thumbnail: d.Thumbnail,
+			Status:    status,
+			URL:       server + "/go/" + d.ID,
+
+			Maintenance: maintenance[d.ID],
+		}
+	}
+	return views
+}
+
+// outputFlags are the formatting flags shared by list, show and status
+type outputFlags struct {
+	format    string
+	noHeaders bool
+	noColor   bool
+}
+
+func addOutputFlags(fs *flag.FlagSet) *outputFlags {
+	f := &outputFlags{}
+	usage := "Output format: table, wide, json, yaml, csv, name or template='{{.Alias}}'"
+	fs.StringVar(&f.format, "o", "", usage)
+	fs.StringVar(&f.format, "output", "", usage)
+	fs.BoolVar(&f.noHeaders, "no-headers", false, "Omit table and CSV headers")
+	fs.BoolVar(&f.noColor, "no-color", false, "Disable coloured output")
+	return f
+}
+
+// outputOptions is a validated output format
+type outputOptions struct {
+	format    string // table, wide, json, yaml, csv, name or template
+	template  *template.Template
+	noHeaders bool
+	color     bool
+}
+
+// options validates the flags, defaulting to the context's output format
+func (f *outputFlags) options() outputOptions {
+	format := f.format
+	if format == "" {
+		format = currentContext().Output
+	}
+	if format == "" {
+		format = "table"
+	}
+
+	opts := outputOptions{
+		noHeaders: f.noHeaders,
+		color:     !f.noColor && useColor(),
+	}
+	var err error
+	if opts.format, opts.template, err = parseOutputFormat(format); err != nil {
+		fail(exitUsage, "%v", err)
+	}
+	return opts
+}
+
+// parseOutputFormat validates an output format, parsing template=...
+// formats into the template
+func parseOutputFormat(format string) (string, *template.Template, error) {
+	if text, ok := strings.CutPrefix(format, "template="); ok {
+		tmpl, err := template.New("output").Parse(text)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid template: %v", err)
+		}
+		return "template", tmpl, nil
+	}
+
+	switch format {
+	case "table", "wide", "json", "yaml", "csv", "name":
+		return format, nil, nil
+	}
+	return "", nil, fmt.Errorf("unknown output format %q (use table, wide, json, yaml, csv, name or template=...)", format)
+}
+
+// useColor reports whether stdout is a terminal that wants colour
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorizeStatus colours the status symbols of a rendered table. This runs
+// after tabwriter, which would otherwise count escape codes as width.
+func colorizeStatus(table string) string {
+	return strings.NewReplacer(
+		symbolOnline, "\x1b[32m"+symbolOnline+"\x1b[0m",
+		symbolOffline, "\x1b[31m"+symbolOffline+"\x1b[0m",
+		symbolMaintenance, "\x1b[33m"+symbolMaintenance+"\x1b[0m",
+	).Replace(table)
+}
+
+// writeStructured handles the formats that don't depend on the command.
+// It reports false for table and wide, which the caller renders.
+func writeStructured(w io.Writer, views []CLIDeviceView, opts outputOptions, single bool) bool {
+	switch opts.format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if single {
+			enc.Encode(views[0])
+		} else {
+			enc.Encode(views)
+		}
+	case "yaml":
+		var data []byte
+		if single {
+			data, _ = yaml.Marshal(views[0])
+		} else {
+			data, _ = yaml.Marshal(views)
+		}
+		w.Write(data)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if !opts.noHeaders {
+			cw.Write([]string{"id", "alias", "host", "site", "username", "auto_login", "status", "url"})
+		}
+		for _, v := range views {
+			cw.Write([]string{v.ID, v.Alias, v.Host, v.Site, v.Username, fmt.Sprint(v.AutoLogin), v.Status, v.URL})
+		}
+		cw.Flush()
+	case "name":
+		for _, v := range views {
+			fmt.Fprintln(w, v.Name())
+		}
+	case "template":
+		for _, v := range views {
+			if err := opts.template.Execute(w, v); err != nil {
+				fail(exitUsage, "template: %v", err)
+			}
+			fmt.Fprintln(w)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// tableWriter renders rows with tabwriter and colours status symbols
+type tableWriter struct {
+	buf  bytes.Buffer
+	tw   *tabwriter.Writer
+	opts outputOptions
+}
+
+func newTableWriter(opts outputOptions) *tableWriter {
+	t := &tableWriter{opts: opts}
+	t.tw = tabwriter.NewWriter(&t.buf, 0, 0, 2, ' ', 0)
+	return t
+}
+
+// header writes column names and their underline unless --no-headers
+func (t *tableWriter) header(columns ...string) {
+	if t.opts.noHeaders {
+		return
+	}
+	underline := make([]string, len(columns))
+	for i, c := range columns {
+		underline[i] = strings.Repeat("-", len(c))
+	}
+	fmt.Fprintln(t.tw, strings.Join(columns, "\t"))
+	fmt.Fprintln(t.tw, strings.Join(underline, "\t"))
+}
+
+func (t *tableWriter) row(cells ...string) {
+	fmt.Fprintln(t.tw, strings.Join(cells, "\t"))
+}
+
+func (t *tableWriter) flush() {
+	t.tw.Flush()
+	out := t.buf.String()
+	if t.opts.color {
+		out = colorizeStatus(out)
+	}
+	fmt.Print(out)
+}
+
+// dash stands in for empty table cells
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CLIPowerState is a device's power state as returned by the API
+type CLIPowerState struct {
+	Power string          `json:"power"`
+	LEDs  map[string]bool `json:"leds"`
+	Busy  bool            `json:"busy"`
+}
+
+// runPower shows or changes a device's power: `kvmm power <alias> [action]`.
+// Anything that can interrupt a running machine asks first.
+func runPower(args []string) {
+	fs := flag.NewFlagSet("power", flag.ExitOnError)
+	yes := fs.Bool("y", false, "Don't ask for confirmation")
+	positional := parseFlags(fs, args)
+
+	action := "status"
+	if n := len(positional); n > 1 {
+		switch a := strings.ReplaceAll(positional[n-1], "-", "_"); a {
+		case "status", "on", "off", "off_hard", "reset":
+			action = a
+			positional = positional[:n-1]
+		}
+	}
+	if len(positional) == 0 {
+		fail(exitUsage, "usage: kvmm power <alias> [status|on|off|off-hard|reset] [-y]")
+	}
+
+	server := getServer()
+	device := findLocalDevice(server, strings.Join(positional, " "))
+	endpoint := server + "/api/devices/" + device.ID + "/power"
+
+	if action == "status" {
+		var state CLIPowerState
+		getDeviceJSON(endpoint, &state)
+		fmt.Printf("%s: %s\n", displayName(device), describePower(state))
+		return
+	}
+
+	prompts := map[string]string{
+		"off":      "Shut down %s (%s)?",
+		"off_hard": "Force %s (%s) off? Unsaved work will be lost.",
+		"reset":    "Reset %s (%s)? Unsaved work will be lost.",
+	}
+	if prompt, ok := prompts[action]; ok && !*yes {
+		if !confirm(fmt.Sprintf(prompt, displayName(device), device.Host)) {
+			fmt.Println("Aborted")
+			return
+		}
+	}
+
+	body, _ := json.Marshal(map[string]string{"action": action})
+	resp, err := newCLIClient(30*time.Second).Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var result struct {
+		State CLIPowerState `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Sent %s to %s\n", strings.ReplaceAll(action, "_", "-"), displayName(device))
+	fmt.Printf("%s: %s\n", displayName(device), describePower(result.State))
+}
+
+// CLISensorReading is a BMC sensor as returned by the API
+type CLISensorReading struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Value  *float64 `json:"value"`
+	Units  string   `json:"units"`
+	Status string   `json:"status"`
+}
+
+// CLISELEntry is a BMC event log entry as returned by the API
+type CLISELEntry struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+// runSensors prints a BMC's sensor readings
+func runSensors(args []string) {
+	if len(args) == 0 {
+		fail(exitUsage, "usage: kvmm sensors <alias>")
+	}
+	server := getServer()
+	device := findLocalDevice(server, strings.Join(args, " "))
+
+	var sensors []CLISensorReading
+	getDeviceJSON(server+"/api/devices/"+device.ID+"/sensors", &sensors)
+	if len(sensors) == 0 {
+		fmt.Println("No sensors")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tREADING\tSTATUS")
+	fmt.Fprintln(w, "----\t----\t-------\t------")
+	for _, s := range sensors {
+		reading := "-"
+		if s.Value != nil {
+			reading = strings.TrimSpace(strconv.FormatFloat(*s.Value, 'f', -1, 64) + " " + s.Units)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Type, reading, s.Status)
+	}
+	w.Flush()
+}
+
+// runSEL prints a BMC's system event log, newest first
+func runSEL(args []string) {
+	fs := flag.NewFlagSet("sel", flag.ExitOnError)
+	limit := fs.Int("n", 20, "Number of entries to show (0 for all)")
+	positional := parseFlags(fs, args)
+	if len(positional) == 0 {
+		fail(exitUsage, "usage: kvmm sel <alias> [-n 20]")
+	}
+	server := getServer()
+	device := findLocalDevice(server, strings.Join(positional, " "))
+
+	var entries []CLISELEntry
+	getDeviceJSON(server+"/api/devices/"+device.ID+"/sel", &entries)
+	if len(entries) == 0 {
+		fmt.Println("The event log is empty")
+		return
+	}
+	if *limit > 0 && len(entries) > *limit {
+		entries = entries[:*limit]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSEVERITY\tMESSAGE")
+	fmt.Fprintln(w, "----\t--------\t-------")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Time.Local().Format("2006-01-02 15:04:05"), dash(e.Severity), e.Message)
+	}
+	w.Flush()
+}
+
+// getDeviceJSON fetches a device endpoint, exiting on failure. Reading a
+// BMC can take a while, hence the long timeout.
+func getDeviceJSON(endpoint string, out interface{}) {
+	resp, err := newCLIClient(30 * time.Second).Get(endpoint)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+}
+
+// describePower summarises a power state, e.g. "on (hdd active)"
+func describePower(s CLIPowerState) string {
+	desc := s.Power
+	if s.LEDs["hdd"] {
+		desc += " (hdd active)"
+	}
+	if s.LEDs["identify"] {
+		desc += " (identify LED on)"
+	}
+	if s.Busy {
+		desc += ", action in progress"
+	}
+	return desc
+}
+
+// runWake sends a Wake-on-LAN packet to the host behind a device and, with
+// --wait, waits until it reports power or answers the status check
+func runWake(args []string) {
+	fs := flag.NewFlagSet("wake", flag.ExitOnError)
+	wait := fs.Duration("wait", 0, "Wait up to this long for the host to come up (max 10m)")
+	positional := parseFlags(fs, args)
+	if len(positional) == 0 {
+		fail(exitUsage, "usage: kvmm wake <alias> [--wait 2m]")
+	}
+	if *wait > maxWakeWait {
+		fail(exitUsage, "--wait may not exceed %s", maxWakeWait)
+	}
+
+	server := getServer()
+	device := findLocalDevice(server, strings.Join(positional, " "))
+
+	body, _ := json.Marshal(WakeRequest{Wait: waitString(*wait)})
+	if *wait > 0 {
+		fmt.Fprintf(os.Stderr, "Waking %s, waiting up to %s...\n", displayName(device), *wait)
+	}
+	resp, err := newCLIClient(*wait+30*time.Second).Post(server+"/api/devices/"+device.ID+"/wake", "application/json", bytes.NewReader(body))
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	var result WakeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+
+	fmt.Printf("Sent magic packet for %s to %s\n", result.MAC, result.Target)
+	if result.Awake == nil {
+		return
+	}
+	if !*result.Awake {
+		fail(exitError, "%s didn't come up within %s", displayName(device), *wait)
+	}
+	fmt.Printf("%s is up after %s\n", displayName(device), result.Elapsed)
+}
+
+// waitString formats an optional wait for the API, empty meaning none
+func waitString(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CLIShare is a share link as returned by the API
+type CLIShare struct {
+	ID        string     `json:"id"`
+	DeviceID  string     `json:"device_id"`
+	Note      string     `json:"note"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	Access    []struct {
+		Time     time.Time `json:"time"`
+		RemoteIP string    `json:"remote_ip"`
+		Result   string    `json:"result"`
+	} `json:"access"`
+	URL string `json:"url"`
+}
+
+// state mirrors Share.state on the server
+func (s CLIShare) state() string {
+	switch {
+	case s.RevokedAt != nil:
+		return "revoked"
+	case time.Now().After(s.ExpiresAt):
+		return "expired"
+	case s.MaxUses > 0 && s.Uses >= s.MaxUses:
+		return "used up"
+	}
+	return "active"
+}
+
+// runShare dispatches `kvmm share <subcommand>`
+func runShare(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch args[0] {
+	case "create":
+		runShareCreate(args[1:])
+	case "list", "ls":
+		runShareList(args[1:])
+	case "revoke":
+		if len(args) != 2 {
+			fail(exitUsage, "usage: kvmm share revoke <share-id>")
+		}
+		runShareRevoke(args[1])
+	default:
+		fail(exitUsage, "unknown share command: %s (use create, list or revoke)", args[0])
+	}
+}
+
+func runShareCreate(args []string) {
+	fs := flag.NewFlagSet("share create", flag.ExitOnError)
+	duration := fs.Duration("for", time.Hour, "How long the link works (max 168h)")
+	uses := fs.Int("uses", 1, "How many times the link can be opened (0 = unlimited)")
+	note := fs.String("note", "", "Who the link is for, e.g. a ticket number")
+	positional := parseFlags(fs, args)
+	if len(positional) == 0 {
+		fail(exitUsage, "usage: kvmm share create <alias> [--for 1h] [--uses 1] [--note text]")
+	}
+
+	server := getServer()
+	device := findLocalDevice(server, strings.Join(positional, " "))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"duration": duration.String(),
+		"uses":     *uses,
+		"note":     *note,
+	})
+	resp, err := newCLIClient(10*time.Second).Post(server+"/api/devices/"+device.ID+"/share", "application/json", bytes.NewReader(body))
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+
+	var share CLIShare
+	if err := json.NewDecoder(resp.Body).Decode(&share); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+
+	limit := "unlimited uses"
+	if share.MaxUses > 0 {
+		limit = fmt.Sprintf("%d use(s)", share.MaxUses)
+	}
+	fmt.Fprintf(os.Stderr, "Share %s for %s: %s, until %s\n",
+		share.ID, displayName(device), limit, share.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	fmt.Println(share.URL)
+}
+
+func runShareList(args []string) {
+	server := getServer()
+	endpoint := server + "/api/shares"
+	if len(args) > 0 {
+		device := findDevice(server, strings.Join(args, " "))
+		endpoint += "?device=" + url.QueryEscape(device.ID)
+	}
+
+	resp, err := newCLIClient(10 * time.Second).Get(endpoint)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+
+	var shares []CLIShare
+	if err := json.NewDecoder(resp.Body).Decode(&shares); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+	if len(shares) == 0 {
+		fmt.Println("No shares")
+		return
+	}
+
+	// Show device names rather than IDs where we can
+	names := make(map[string]string)
+	if devices, err := fetchDevices(server); err == nil {
+		for _, d := range devices {
+			names[d.ID] = displayName(d)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDEVICE\tSTATE\tUSES\tEXPIRES\tLAST USED\tNOTE")
+	fmt.Fprintln(w, "--\t------\t-----\t----\t-------\t---------\t----")
+	for _, s := range shares {
+		device := names[s.DeviceID]
+		if device == "" {
+			device = s.DeviceID
+		}
+		uses := fmt.Sprintf("%d/%d", s.Uses, s.MaxUses)
+		if s.MaxUses == 0 {
+			uses = fmt.Sprintf("%d/∞", s.Uses)
+		}
+		last := "-"
+		if n := len(s.Access); n > 0 {
+			a := s.Access[n-1]
+			last = fmt.Sprintf("%s from %s (%s)", a.Time.Local().Format("01-02 15:04"), a.RemoteIP, a.Result)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, device, s.state(), uses,
+			s.ExpiresAt.Local().Format("2006-01-02 15:04"), last, dash(s.Note))
+	}
+	w.Flush()
+}
+
+func runShareRevoke(id string) {
+	req, err := http.NewRequest(http.MethodDelete, getServer()+"/api/shares/"+url.PathEscape(id), nil)
+	if err != nil {
+		fail(exitError, "%v", err)
+	}
+	resp, err := newCLIClient(10 * time.Second).Do(req)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+	fmt.Printf("Revoked share %s\n", id)
+}
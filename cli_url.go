@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// CLIOneTimeLink is the response of POST /api/devices/{id}/link
+type CLIOneTimeLink struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// runURL prints a device's URL, optionally copying it or drawing a QR
+// code, for machines that can't open a browser
+func runURL(args []string) {
+	fs := flag.NewFlagSet("url", flag.ExitOnError)
+	copyURL := fs.Bool("copy", false, "Copy the URL to the clipboard (OSC 52)")
+	showQR := fs.Bool("qr", false, "Draw the URL as a QR code")
+	once := fs.Bool("once", false, "Use a signed one-time link that expires (default with --qr)")
+	ttl := fs.Duration("ttl", 5*time.Minute, "How long a one-time link stays valid (max 1h)")
+	positional := parseFlags(fs, args)
+	if len(positional) == 0 {
+		fail(exitUsage, "usage: kvmm url <alias> [--copy] [--qr] [--once] [--ttl 5m]")
+	}
+
+	// A QR code is usually scanned by a phone without a session, so it gets
+	// a one-time link unless --once=false was given
+	onceSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "once" {
+			onceSet = true
+		}
+	})
+	if *showQR && !onceSet {
+		*once = true
+	}
+
+	server := getServer()
+	device := findDevice(server, strings.Join(positional, " "))
+
+	link := server + "/go/" + device.ID
+	if *once {
+		l := createOneTimeLink(server, device.ID, *ttl)
+		link = l.URL
+		fmt.Fprintf(os.Stderr, "One-time link to %s, valid until %s\n",
+			displayName(device), l.ExpiresAt.Local().Format("15:04:05"))
+	}
+	fmt.Println(link)
+
+	if *copyURL {
+		if err := copyToClipboard(link); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not copy to clipboard: %v\n", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "Copied to clipboard")
+		}
+	}
+	if *showQR {
+		if err := writeQR(os.Stdout, link); err != nil {
+			fail(exitError, "drawing QR code: %v", err)
+		}
+	}
+}
+
+// createOneTimeLink asks the server for a signed link to a device
+func createOneTimeLink(server, id string, ttl time.Duration) CLIOneTimeLink {
+	endpoint := server + "/api/devices/" + id + "/link?ttl=" + url.QueryEscape(ttl.String())
+	resp, err := newCLIClient(10*time.Second).Post(endpoint, "application/json", nil)
+	if err != nil {
+		fail(exitError, "failed to connect to server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		fail(exitError, "this server doesn't support one-time links; use --once=false")
+	}
+	if resp.StatusCode != http.StatusOK {
+		fail(apiExitCode(resp.StatusCode), "%v", readAPIError(resp))
+	}
+
+	var link CLIOneTimeLink
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		fail(exitError, "failed to parse response: %v", err)
+	}
+	return link
+}
+
+// copyToClipboard sets the terminal's clipboard with an OSC 52 escape,
+// which also works over SSH. tmux and screen need it wrapped to pass it on.
+func copyToClipboard(text string) error {
+	seq := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a"
+	switch {
+	case os.Getenv("TMUX") != "":
+		seq = "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+	case strings.HasPrefix(os.Getenv("TERM"), "screen"):
+		seq = "\x1bP" + seq + "\x1b\\"
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	_, err = tty.WriteString(seq)
+	return err
+}
+
+// writeQR draws text as a QR code using half blocks, two modules per
+// character row. Light modules are drawn in the foreground colour, so the
+// code reads correctly on a dark terminal.
+func writeQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return err
+	}
+
+	const quiet = 2 // Light border, in modules
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+
+	var b strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
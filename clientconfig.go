@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ClientContext is a named kvmm server the CLI can talk to
+type ClientContext struct {
+	Server string `toml:"server"`
+	Token  string `toml:"token,omitempty"`   // Sent as a bearer token
+	CAFile string `toml:"ca_file,omitempty"` // PEM bundle for servers with a private CA
+	Output string `toml:"output,omitempty"`  // Default output format
+}
+
+// ClientConfig is the CLI's config file (~/.config/kvmm/config.toml)
+type ClientConfig struct {
+	CurrentContext string                   `toml:"current_context,omitempty"`
+	Contexts       map[string]ClientContext `toml:"contexts,omitempty"`
+}
+
+// Global flags that pick the server for any command
+var (
+	serverFlag  string
+	contextFlag string
+)
+
+var (
+	activeContextOnce sync.Once
+	activeContext     ClientContext
+)
+
+// clientConfigDir honours XDG_CONFIG_HOME, falling back to ~/.config
+func clientConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config")
+}
+
+// clientConfigPath returns the path of the CLI config file
+func clientConfigPath() string {
+	return filepath.Join(clientConfigDir(), "kvmm", "config.toml")
+}
+
+// loadClientConfig reads the CLI config. When it doesn't exist yet, the
+// server from an old ~/.config/kvmm.conf becomes the "default" context.
+func loadClientConfig() (*ClientConfig, error) {
+	cc := &ClientConfig{Contexts: make(map[string]ClientContext)}
+
+	path := clientConfigPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if server := readLegacyConfigFile(); server != "" {
+			cc.CurrentContext = "default"
+			cc.Contexts["default"] = ClientContext{Server: server}
+		}
+		return cc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := toml.Unmarshal(data, cc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if cc.Contexts == nil {
+		cc.Contexts = make(map[string]ClientContext)
+	}
+	return cc, nil
+}
+
+// Save writes the CLI config, readable only by the user as it holds tokens
+func (cc *ClientConfig) Save() error {
+	path := clientConfigPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating config dir: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(cc); err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// readLegacyConfigFile reads the server URL from the old one-line
+// ~/.config/kvmm.conf format. Older versions ignored XDG_CONFIG_HOME, so
+// neither does this.
+func readLegacyConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	file, err := os.Open(filepath.Join(home, ".config", "kvmm.conf"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "server" {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			return line
+		}
+	}
+	return ""
+}
+
+// resolveContext picks the server for this invocation. Priority:
+// --server > --context > KVMM_SERVER > KVMM_CONTEXT > current_context > default
+func resolveContext() (ClientContext, error) {
+	if serverFlag != "" {
+		return ClientContext{Server: serverFlag}, nil
+	}
+
+	cc, err := loadClientConfig()
+	if err != nil {
+		return ClientContext{}, err
+	}
+
+	name := contextFlag
+	if name == "" {
+		if server := os.Getenv("KVMM_SERVER"); server != "" {
+			return ClientContext{Server: server}, nil
+		}
+		name = os.Getenv("KVMM_CONTEXT")
+	}
+	if name == "" {
+		name = cc.CurrentContext
+	}
+	if name == "" {
+		return ClientContext{Server: defaultServer}, nil
+	}
+
+	ctx, ok := cc.Contexts[name]
+	if !ok {
+		return ClientContext{}, fmt.Errorf("context %q not found (see 'kvmm context list')", name)
+	}
+	if ctx.Server == "" {
+		return ClientContext{}, fmt.Errorf("context %q has no server", name)
+	}
+	return ctx, nil
+}
+
+// currentContext returns the resolved context, exiting on config errors
+func currentContext() ClientContext {
+	activeContextOnce.Do(func() {
+		ctx, err := resolveContext()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		ctx.Server = strings.TrimSuffix(ctx.Server, "/")
+		activeContext = ctx
+	})
+	return activeContext
+}
+
+// tokenTransport adds the context's bearer token to every request
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
+
+// newCLIClient returns an HTTP client set up for the current context
+func newCLIClient(timeout time.Duration) *http.Client {
+	ctx := currentContext()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ctx.CAFile != "" {
+		pem, err := os.ReadFile(expandHome(ctx.CAFile))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: reading CA file: %v\n", err)
+			os.Exit(1)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fmt.Fprintf(os.Stderr, "Error: no certificates found in %s\n", ctx.CAFile)
+			os.Exit(1)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var rt http.RoundTripper = transport
+	if ctx.Token != "" {
+		rt = &tokenTransport{token: ctx.Token, base: transport}
+	}
+	return &http.Client{Timeout: timeout, Transport: rt}
+}
+
+// expandHome expands a leading ~/ in a path
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// parseGlobalFlags strips --server and --context from the arguments,
+// wherever they appear before a "--"
+func parseGlobalFlags(args []string) []string {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || (name != "server" && name != "context") {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "Error: %s requires a value\n", arg)
+				os.Exit(1)
+			}
+			i++
+			value = args[i]
+		}
+		if name == "server" {
+			serverFlag = value
+		} else {
+			contextFlag = value
+		}
+	}
+	return rest
+}
+
+// runContext dispatches `kvmm context <subcommand>`
+func runContext(args []string) {
+	if len(args) == 0 {
+		runContextList()
+		return
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		runContextList()
+	case "use":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: kvmm context use <name>")
+			os.Exit(1)
+		}
+		runContextUse(args[1])
+	case "add":
+		runContextAdd(args[1:])
+	case "remove", "rm":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: kvmm context remove <name>")
+			os.Exit(1)
+		}
+		runContextRemove(args[1])
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: kvmm context [list|use|add|remove]")
+		os.Exit(1)
+	}
+}
+
+func mustLoadClientConfig() *ClientConfig {
+	cc, err := loadClientConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return cc
+}
+
+func mustSaveClientConfig(cc *ClientConfig) {
+	if err := cc.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runContextList() {
+	cc := mustLoadClientConfig()
+	if len(cc.Contexts) == 0 {
+		fmt.Println("No contexts configured")
+		fmt.Println("Add one with: kvmm context add <name> <server-url>")
+		return
+	}
+
+	names := make([]string, 0, len(cc.Contexts))
+	for name := range cc.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CURRENT\tNAME\tSERVER\tAUTH\tOUTPUT")
+	fmt.Fprintln(w, "-------\t----\t------\t----\t------")
+	for _, name := range names {
+		ctx := cc.Contexts[name]
+		current := ""
+		if name == cc.CurrentContext {
+			current = "*"
+		}
+		auth := "no"
+		if ctx.Token != "" {
+			auth = "token"
+		}
+		output := ctx.Output
+		if output == "" {
+			output = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", current, name, ctx.Server, auth, output)
+	}
+	w.Flush()
+}
+
+func runContextUse(name string) {
+	cc := mustLoadClientConfig()
+	if _, ok := cc.Contexts[name]; !ok {
+		fmt.Fprintf(os.Stderr, "Error: context %q not found\n", name)
+		os.Exit(1)
+	}
+	cc.CurrentContext = name
+	mustSaveClientConfig(cc)
+	fmt.Printf("Switched to context %q (%s)\n", name, cc.Contexts[name].Server)
+}
+
+func runContextAdd(args []string) {
+	fs := flag.NewFlagSet("context add", flag.ExitOnError)
+	token := fs.String("token", "", "Bearer token sent to the server")
+	caFile := fs.String("ca-file", "", "PEM file with the server's CA certificate")
+	output := fs.String("output", "", "Default output format")
+	positional := parseFlags(fs, args)
+
+	if len(positional) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm context add <name> <server-url> [-token t] [-ca-file path] [-output format]")
+		os.Exit(1)
+	}
+	name, server := positional[0], positional[1]
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		fmt.Fprintf(os.Stderr, "Error: server must be an http:// or https:// URL\n")
+		os.Exit(1)
+	}
+	if *output != "" {
+		if _, _, err := parseOutputFormat(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	cc := mustLoadClientConfig()
+	_, existed := cc.Contexts[name]
+	cc.Contexts[name] = ClientContext{Server: server, Token: *token, CAFile: *caFile, Output: *output}
+	if cc.CurrentContext == "" {
+		cc.CurrentContext = name
+	}
+	mustSaveClientConfig(cc)
+
+	if existed {
+		fmt.Printf("Updated context %q\n", name)
+	} else {
+		fmt.Printf("Added context %q\n", name)
+	}
+}
+
+func runContextRemove(name string) {
+	cc := mustLoadClientConfig()
+	if _, ok := cc.Contexts[name]; !ok {
+		fmt.Fprintf(os.Stderr, "Error: context %q not found\n", name)
+		os.Exit(1)
+	}
+	delete(cc.Contexts, name)
+	if cc.CurrentContext == name {
+		cc.CurrentContext = ""
+	}
+	mustSaveClientConfig(cc)
+	fmt.Printf("Removed context %q\n", name)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The old one-line config is found in ~/.config wherever XDG_CONFIG_HOME
+// points, as versions before contexts always read it from there
+func TestLegacyConfigIgnoresXDG(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(t.TempDir(), "xdg"))
+	if err := os.MkdirAll(filepath.Join(home, ".config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := "# kvmm server\nserver = \"http://kvmm.lan:8080\"\n"
+	if err := os.WriteFile(filepath.Join(home, ".config", "kvmm.conf"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := loadClientConfig()
+	if err != nil {
+		t.Fatalf("loadClientConfig: %v", err)
+	}
+	if cc.CurrentContext != "default" || cc.Contexts["default"].Server != "http://kvmm.lan:8080" {
+		t.Errorf("legacy server not picked up: %+v", cc)
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	for _, format := range []string{"table", "wide", "json", "yaml", "csv", "name", "template={{.Name}}"} {
+		if _, _, err := parseOutputFormat(format); err != nil {
+			t.Errorf("%q: %v", format, err)
+		}
+	}
+	for _, format := range []string{"", "jsno", "template={{.Name"} {
+		if _, _, err := parseOutputFormat(format); err == nil {
+			t.Errorf("%q accepted", format)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultLeaseTTL = 15 * time.Second
+	leaseName       = "kvmm-leader"
+)
+
+// ClusterConfig configures running several kvmm replicas against a shared store
+type ClusterConfig struct {
+	Enabled  bool   `toml:"enabled,omitempty"`
+	NodeID   string `toml:"node_id,omitempty"`   // Defaults to the hostname plus a random suffix
+	LeaseTTL string `toml:"lease_ttl,omitempty"` // e.g. "15s"
+}
+
+// leaseLock is a shared lease that at most one replica holds at a time
+type leaseLock interface {
+	// TryAcquire takes or renews the lease for holder and reports whether
+	// holder now owns it
+	TryAcquire(holder string, ttl time.Duration) (bool, error)
+	// Release gives the lease up if holder owns it
+	Release(holder string) error
+}
+
+// leaseRecord is the contents of a file lease
+type leaseRecord struct {
+	Holder    string    `json:"holder"`
+	RenewedAt time.Time `json:"renewed_at"`
+	TTL       string    `json:"ttl"`
+}
+
+func (r leaseRecord) expired(now time.Time) bool {
+	ttl, err := time.ParseDuration(r.TTL)
+	if err != nil {
+		return true
+	}
+	return now.After(r.RenewedAt.Add(ttl))
+}
+
+// fileLease keeps the lease in a file next to a shared config, for replicas
+// sharing a TOML store on a network volume. A short-lived lock file guards
+// the read-modify-write.
+type fileLease struct {
+	path string
+}
+
+func (l *fileLease) lock() (func(), error) {
+	return lockFile(l.path + ".lock")
+}
+
+func (l *fileLease) read() (leaseRecord, error) {
+	var rec leaseRecord
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return leaseRecord{}, nil // Treat a corrupt lease as free
+	}
+	return rec, nil
+}
+
+func (l *fileLease) TryAcquire(holder string, ttl time.Duration) (bool, error) {
+	unlock, err := l.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	now := time.Now().UTC()
+	rec, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	if rec.Holder != "" && rec.Holder != holder && !rec.expired(now) {
+		return false, nil
+	}
+
+	data, _ := json.Marshal(leaseRecord{Holder: holder, RenewedAt: now, TTL: ttl.String()})
+	if err := writeFileAtomic(l.path, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *fileLease) Release(holder string) error {
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rec, err := l.read()
+	if err != nil || rec.Holder != holder {
+		return err
+	}
+	return os.Remove(l.path)
+}
+
+// kubeLease uses a coordination.k8s.io Lease; the API server's optimistic
+// concurrency makes acquisition safe between replicas
+type kubeLease struct {
+	store *kubernetesStore
+	name  string
+}
+
+type kubeLeaseObject struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Metadata   kubeMeta `json:"metadata"`
+	Spec       struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+	} `json:"spec"`
+}
+
+func (l *kubeLease) path() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.store.namespace)
+}
+
+func (l *kubeLease) TryAcquire(holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	var lease kubeLeaseObject
+	err := l.store.do(http.MethodGet, l.path()+"/"+l.name, "", nil, &lease)
+	exists := err == nil
+	if err != nil && !isKubeStatus(err, http.StatusNotFound) {
+		return false, err
+	}
+
+	if exists && lease.Spec.HolderIdentity != "" && lease.Spec.HolderIdentity != holder {
+		renewed, _ := time.Parse(time.RFC3339Nano, lease.Spec.RenewTime)
+		duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+		if now.Before(renewed.Add(duration)) {
+			return false, nil
+		}
+	}
+
+	lease.APIVersion = "coordination.k8s.io/v1"
+	lease.Kind = "Lease"
+	lease.Metadata.Name = l.name
+	lease.Metadata.Namespace = l.store.namespace
+	lease.Spec.HolderIdentity = holder
+	lease.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+	lease.Spec.RenewTime = now.Format("2006-01-02T15:04:05.000000Z07:00")
+
+	if exists {
+		err = l.store.do(http.MethodPut, l.path()+"/"+l.name, "", lease, nil)
+	} else {
+		err = l.store.do(http.MethodPost, l.path(), "", lease, nil)
+	}
+	if isKubeStatus(err, http.StatusConflict) {
+		return false, nil // Another replica won the race
+	}
+	return err == nil, err
+}
+
+func (l *kubeLease) Release(holder string) error {
+	var lease kubeLeaseObject
+	if err := l.store.do(http.MethodGet, l.path()+"/"+l.name, "", nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != holder {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	return l.store.do(http.MethodPut, l.path()+"/"+l.name, "", lease, nil)
+}
+
+// Elector runs leader election over a leaseLock and starts or stops the
+// leader-only work as leadership changes
+type Elector struct {
+	id      string
+	lock    leaseLock
+	ttl     time.Duration
+	onStart func()
+	onStop  func()
+
+	mu     sync.Mutex
+	leader bool
+}
+
+// NewElector builds an elector for the config's store. Clustering requires
+// a store that several replicas can share.
+func NewElector(cfg *Config, onStart, onStop func()) (*Elector, error) {
+	cc := cfg.Server.Cluster
+
+	// Replicas usually share one config, so the default identity must be
+	// unique per process even on a single host
+	id := cc.NodeID
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cluster: node_id not set: %w", err)
+		}
+		id = host + "-" + uuid.NewString()[:8]
+	}
+
+	ttl := defaultLeaseTTL
+	if cc.LeaseTTL != "" {
+		d, err := time.ParseDuration(cc.LeaseTTL)
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("cluster: invalid lease_ttl %q", cc.LeaseTTL)
+		}
+		ttl = d
+	}
+
+	var lock leaseLock
+	switch s := cfg.store.(type) {
+	case *kubernetesStore:
+		lock = &kubeLease{store: s, name: leaseName}
+	case *tomlStore:
+		lock = &fileLease{path: filepath.Join(cfg.GetConfigDir(), leaseName+".lease")}
+	default:
+		return nil, fmt.Errorf("cluster: the %s store cannot be shared between replicas", cfg.storeKind())
+	}
+
+	return &Elector{id: id, lock: lock, ttl: ttl, onStart: onStart, onStop: onStop}, nil
+}
+
+// IsLeader reports whether this replica currently holds the lease
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Run renews the lease every third of its TTL until stop is closed, then
+// releases it. It blocks, so run it in its own goroutine.
+func (e *Elector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		ok, err := e.lock.TryAcquire(e.id, e.ttl)
+		if err != nil {
+			log.Printf("Cluster: lease renewal failed: %v", err)
+			ok = false
+		}
+		e.setLeader(ok)
+
+		select {
+		case <-stop:
+			e.setLeader(false)
+			if err := e.lock.Release(e.id); err != nil {
+				log.Printf("Cluster: releasing lease: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mu.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if leader {
+		log.Printf("Cluster: %s is now the leader", e.id)
+		e.onStart()
+	} else {
+		log.Printf("Cluster: %s is no longer the leader", e.id)
+		e.onStop()
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replica is one kvmm server in the cluster test: its own Config, poller
+// and elector over a shared config directory
+type replica struct {
+	cfg     *Config
+	elector *Elector
+	events  <-chan Event
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (r *replica) shutdown() {
+	close(r.stop)
+	<-r.done
+}
+
+// flappingHost is a TCP address that alternates between accepting and
+// refusing connections, so every poll of it reports a status change
+func flappingHost(t *testing.T, every time.Duration) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				if ln != nil {
+					ln.Close()
+				}
+				return
+			case <-ticker.C:
+			}
+			if ln != nil {
+				ln.Close()
+				ln = nil
+			} else if ln, err = net.Listen("tcp", addr); err != nil {
+				ln = nil // Port briefly unavailable; stays down a little longer
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return addr
+}
+
+func TestClusterOnlyLeaderPolls(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	config := fmt.Sprintf(`schema_version = %d
+
+[server]
+status_interval = "50ms"
+
+[server.cluster]
+enabled = true
+lease_ttl = "1s"
+
+[[devices]]
+id = "flapping"
+host = %q
+`, schemaVersion, flappingHost(t, 120*time.Millisecond))
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	replicas := make([]*replica, 3)
+	for i := range replicas {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("LoadConfig: %v", err)
+		}
+		cfg.Server.Cluster.NodeID = fmt.Sprintf("replica-%d", i)
+		poller := NewStatusPoller(cfg)
+		elector, err := NewElector(cfg, poller.Start, poller.Stop)
+		if err != nil {
+			t.Fatalf("NewElector: %v", err)
+		}
+		events, unsubscribe := cfg.events.Subscribe()
+		t.Cleanup(unsubscribe)
+		r := &replica{cfg: cfg, elector: elector, events: events, stop: make(chan struct{}), done: make(chan struct{})}
+		go func() {
+			elector.Run(r.stop)
+			close(r.done)
+		}()
+		replicas[i] = r
+	}
+	stopped := make(map[int]bool)
+	t.Cleanup(func() {
+		for i, r := range replicas {
+			if !stopped[i] {
+				r.shutdown()
+			}
+		}
+	})
+
+	live := []int{0, 1, 2}
+	for round := 0; round < 2; round++ {
+		leader := waitForLeader(t, replicas, live)
+		assertOnlyLeaderReports(t, replicas, live, leader)
+
+		// The leader shuts down and hands the lease over
+		replicas[leader].shutdown()
+		stopped[leader] = true
+		if replicas[leader].elector.IsLeader() {
+			t.Fatalf("replica-%d still leader after shutting down", leader)
+		}
+		var remaining []int
+		for _, i := range live {
+			if i != leader {
+				remaining = append(remaining, i)
+			}
+		}
+		// A stopped replica must stay quiet too
+		assertOnlyLeaderReports(t, replicas, append(remaining, leader), waitForLeader(t, replicas, remaining))
+		live = remaining
+	}
+}
+
+// Device changes made through one replica reach the inventory and SSE
+// clients of the others, for both shared stores a cluster can run on
+func TestClusterDeviceChangesReachEveryReplica(t *testing.T) {
+	for _, store := range []string{"toml", "kubernetes"} {
+		t.Run(store, func(t *testing.T) {
+			config := fmt.Sprintf("schema_version = %d\n\n[server]\nstore = %q\n\n[server.cluster]\nenabled = true\n", schemaVersion, store)
+			if store == "kubernetes" {
+				kube := newFakeKube(t)
+				config += fmt.Sprintf("\n[server.kubernetes]\napi_server = %q\nnamespace = %q\n", kube.URL, kube.namespace)
+			}
+			replicas := watchingReplicas(t, config)
+			followers := replicas[1:]
+
+			added, err := replicas[0].cfg.AddDevice(DeviceWithAuth{Host: "10.0.0.7", Alias: "rack7", Tags: []string{"lab"}})
+			if err != nil {
+				t.Fatalf("AddDevice: %v", err)
+			}
+			waitForDevices(t, followers, "the new device", func(devices []Device) bool {
+				return len(devices) == 1 && devices[0].ID == added.ID && devices[0].Alias == "rack7"
+			})
+
+			if _, err := replicas[0].cfg.UpdateDevice(added.ID, DeviceWithAuth{Host: "10.0.0.8", Alias: "rack8"}); err != nil {
+				t.Fatalf("UpdateDevice: %v", err)
+			}
+			waitForDevices(t, followers, "the update", func(devices []Device) bool {
+				return len(devices) == 1 && devices[0].Host == "10.0.0.8" && devices[0].Alias == "rack8"
+			})
+
+			if err := replicas[0].cfg.DeleteDevice(added.ID); err != nil {
+				t.Fatalf("DeleteDevice: %v", err)
+			}
+			waitForDevices(t, followers, "the delete", func(devices []Device) bool {
+				return len(devices) == 0
+			})
+		})
+	}
+}
+
+// Media transfer progress reaches SSE clients on every replica, once each
+func TestClusterMediaProgressReachesEveryReplica(t *testing.T) {
+	kube := newFakeKube(t)
+	replicas := watchingReplicas(t, fmt.Sprintf(`schema_version = %d
+
+[server]
+store = "kubernetes"
+media_dir = %q
+
+[server.kubernetes]
+api_server = %q
+namespace = %q
+
+[server.cluster]
+enabled = true
+`, schemaVersion, t.TempDir(), kube.URL, kube.namespace))
+
+	transfer := (&Handlers{config: replicas[0].cfg}).newMediaTransfer(MediaProgress{ID: "rack-1", Image: "debian.iso", Stage: "uploading", Total: 1024})
+	// Followers relay the latest record, so each stage is awaited before the
+	// next; real transfers publish at most once per mediaProgressInterval
+	transfer.update(512)
+	waitForMedia(t, replicas, MediaProgress{ID: "rack-1", Image: "debian.iso", Stage: "uploading", Bytes: 512, Total: 1024})
+	transfer.done("attached", 1024)
+	waitForMedia(t, replicas, MediaProgress{ID: "rack-1", Image: "debian.iso", Stage: "attached", Bytes: 1024, Total: 1024})
+
+	// Nothing is published twice, including on the replica that did the transfer
+	time.Sleep(200 * time.Millisecond)
+	for i, r := range replicas {
+		for len(r.events) > 0 {
+			if ev := <-r.events; ev.Type == "media" {
+				t.Errorf("replica-%d published %+v again", i, ev.Data)
+			}
+		}
+	}
+}
+
+// The library is local to each pod unless media_dir names a shared volume
+func TestClusterMediaNeedsSharedDir(t *testing.T) {
+	for _, tc := range []struct {
+		server ServerConfig
+		shared bool
+	}{
+		{ServerConfig{}, true},
+		{ServerConfig{Store: "kubernetes"}, true},
+		{ServerConfig{Cluster: ClusterConfig{Enabled: true}}, true}, // Shares the config directory
+		{ServerConfig{Store: "kubernetes", Cluster: ClusterConfig{Enabled: true}}, false},
+		{ServerConfig{Store: "kubernetes", MediaDir: "/data/media", Cluster: ClusterConfig{Enabled: true}}, true},
+	} {
+		cfg := &Config{Server: tc.server}
+		if cfg.mediaDirShared() != tc.shared {
+			t.Errorf("%+v: shared = %v, want %v", tc.server, !tc.shared, tc.shared)
+		}
+		if tc.shared {
+			continue
+		}
+		w := httptest.NewRecorder()
+		(&Handlers{config: cfg}).MediaHandler(w, httptest.NewRequest(http.MethodGet, "/api/media", nil))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "media_dir") {
+			t.Errorf("GET /api/media = %d %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+// A replica that dies without releasing the lease is replaced once it expires
+func TestFileLeaseExpiry(t *testing.T) {
+	lease := &fileLease{path: filepath.Join(t.TempDir(), leaseName+".lease")}
+	if ok, err := lease.TryAcquire("crashed", time.Second); !ok || err != nil {
+		t.Fatalf("TryAcquire = %v, %v", ok, err)
+	}
+	if ok, err := lease.TryAcquire("standby", time.Second); ok || err != nil {
+		t.Fatalf("TryAcquire while held = %v, %v", ok, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if ok, err := lease.TryAcquire("standby", time.Second); !ok || err != nil {
+		t.Fatalf("TryAcquire after expiry = %v, %v", ok, err)
+	}
+	// The old holder can't release what it no longer owns
+	if err := lease.Release("crashed"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := lease.TryAcquire("crashed", time.Second); ok {
+		t.Error("lease taken back from the new holder")
+	}
+}
+
+// waitForLeader waits until exactly one of the live replicas leads
+func waitForLeader(t *testing.T, replicas []*replica, live []int) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader, leaders := -1, 0
+		for _, i := range live {
+			if replicas[i].elector.IsLeader() {
+				leader = i
+				leaders++
+			}
+		}
+		if leaders > 1 {
+			t.Fatalf("%d replicas lead at once", leaders)
+		}
+		if leaders == 1 {
+			return leader
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no leader among replicas %v", live)
+	return -1
+}
+
+// assertOnlyLeaderReports checks that over a few polls the leader publishes
+// status events and no other replica does
+func assertOnlyLeaderReports(t *testing.T, replicas []*replica, watched []int, leader int) {
+	t.Helper()
+	for _, i := range watched {
+		drainEvents(replicas[i].events)
+	}
+	time.Sleep(600 * time.Millisecond)
+	for _, i := range watched {
+		n := drainEvents(replicas[i].events)
+		switch {
+		case i == leader && n == 0:
+			t.Errorf("leader replica-%d published no status events", i)
+		case i != leader && n > 0:
+			t.Errorf("replica-%d published %d status events while replica-%d leads", i, n, leader)
+		}
+	}
+}
+
+// watchingReplicas starts three replicas on one config, each following the
+// store with WatchStore and subscribed to its own events
+func watchingReplicas(t *testing.T, config string) []*replica {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	replicas := make([]*replica, 3)
+	for i := range replicas {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("LoadConfig: %v", err)
+		}
+		cfg.Server.Cluster.NodeID = fmt.Sprintf("replica-%d", i)
+		events, unsubscribe := cfg.events.Subscribe()
+		r := &replica{cfg: cfg, events: events, stop: make(chan struct{}), done: make(chan struct{})}
+		go func() {
+			cfg.WatchStore(r.stop)
+			close(r.done)
+		}()
+		t.Cleanup(func() {
+			r.shutdown()
+			unsubscribe()
+			cfg.Close()
+		})
+		replicas[i] = r
+	}
+	return replicas
+}
+
+// waitForMedia checks that the next media event of each replica is want
+func waitForMedia(t *testing.T, replicas []*replica, want MediaProgress) {
+	t.Helper()
+	for i, r := range replicas {
+		timeout := time.After(5 * time.Second)
+		for done := false; !done; {
+			select {
+			case ev := <-r.events:
+				if ev.Type != "media" {
+					continue
+				}
+				if got := ev.Data.(MediaProgress); got != want {
+					t.Errorf("replica-%d got media event %+v, want %+v", i, got, want)
+				}
+				done = true
+			case <-timeout:
+				t.Fatalf("replica-%d never got media event %+v", i, want)
+			}
+		}
+	}
+}
+
+// waitForDevices waits until each replica has published a "device" event
+// after which its inventory satisfies ok
+func waitForDevices(t *testing.T, replicas []*replica, change string, ok func([]Device) bool) {
+	t.Helper()
+	for _, r := range replicas {
+		timeout := time.After(10 * time.Second)
+		for done := false; !done; {
+			select {
+			case ev := <-r.events:
+				done = ev.Type == "device" && ok(r.cfg.GetDevices())
+			case <-timeout:
+				t.Fatalf("%s never saw %s: devices %+v", r.cfg.Server.Cluster.NodeID, change, r.cfg.GetDevices())
+			}
+		}
+	}
+}
+
+// drainEvents discards pending events, returning how many were status events
+func drainEvents(events <-chan Event) int {
+	n := 0
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == "status" {
+				n++
+			}
+		default:
+			return n
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	completionCacheTTL = 30 * time.Second
+	completionTimeout  = 2 * time.Second // Keep TAB responsive when the server is down
+)
+
+// completionCommands are the subcommands offered for the first word
+var completionCommands = []string{
+	"list", "status", "pick", "show", "url", "power", "sensors", "sel", "wake", "bulk", "maint", "media", "add",
+	"edit", "rm", "server", "config", "trash", "share", "store", "context", "import", "export", "completion", "help",
+}
+
+// completionSubcommands are the second words of commands that take one
+var completionSubcommands = map[string][]string{
+	"config":     {"migrate", "backups", "restore"},
+	"trash":      {"list", "restore", "purge"},
+	"share":      {"create", "list", "revoke"},
+	"bulk":       {"power", "wake", "snapshot"},
+	"maint":      {"start", "list", "end"},
+	"media":      {"list", "upload", "rm", "attach", "eject", "status"},
+	"store":      {"migrate"},
+	"context":    {"list", "use", "add", "remove"},
+	"completion": {"bash", "zsh", "fish", "powershell"},
+}
+
+// completionFlags are the flags of each command, keyed by "command" or
+// "command subcommand"
+var completionFlags = map[string][]string{
+	"list":           {"-o", "--output", "--no-headers", "--no-color", "--offline"},
+	"status":         {"-o", "--output", "--no-headers", "--no-color", "--watch", "--interval", "--sort", "--tag"},
+	"show":           {"-o", "--output", "--no-headers", "--no-color"},
+	"url":            {"--copy", "--qr", "--once", "--ttl"},
+	"power":          {"-y"},
+	"sel":            {"-n"},
+	"wake":           {"--wait"},
+	"bulk power":     {"--tag", "--dry-run", "-c", "-y"},
+	"bulk wake":      {"--tag", "--dry-run", "-c"},
+	"bulk snapshot":  {"--tag", "--dry-run", "-c"},
+	"maint start":    {"--tag", "--for", "--at", "--reason", "--author"},
+	"maint list":     {"--all"},
+	"media upload":   {"--name", "--sha256"},
+	"media rm":       {"-y"},
+	"media attach":   {"--flash", "--rw", "--force"},
+	"add":            {"--host", "--alias", "--user", "--type", "--mac", "--tag", "--password-stdin"},
+	"edit":           {"--set", "--password-stdin"},
+	"rm":             {"-y"},
+	"server":         {"-config", "-port"},
+	"import":         {"-dry-run", "-match", "-format"},
+	"export":         {"-format", "-credentials", "-o"},
+	"config migrate": {"-config", "-dry-run"},
+	"store migrate":  {"-config", "-from", "-to"},
+	"context add":    {"-token", "-ca-file", "-output"},
+	"share create":   {"--for", "--uses", "--note"},
+}
+
+// outputFormats are the values of -o for list, show and status
+var outputFormats = []string{"table", "wide", "json", "yaml", "csv", "name", "template="}
+
+// completionValues are the values of flags that take one, keyed by
+// "command flag". Free-form values such as paths map to nil.
+var completionValues = map[string][]string{
+	"list -o":                outputFormats,
+	"list --output":          outputFormats,
+	"status -o":              outputFormats,
+	"status --output":        outputFormats,
+	"status --interval":      nil,
+	"status --sort":          watchSortColumns,
+	"status --tag":           nil,
+	"show -o":                outputFormats,
+	"show --output":          outputFormats,
+	"url --ttl":              nil,
+	"add --host":             nil,
+	"add --alias":            nil,
+	"add --user":             nil,
+	"add --type":             deviceTypes,
+	"add --mac":              nil,
+	"add --tag":              nil,
+	"sel -n":                 nil,
+	"wake --wait":            nil,
+	"bulk power --tag":       nil,
+	"bulk power -c":          nil,
+	"bulk wake --tag":        nil,
+	"bulk wake -c":           nil,
+	"bulk snapshot --tag":    nil,
+	"bulk snapshot -c":       nil,
+	"maint start --tag":      nil,
+	"maint start --for":      nil,
+	"maint start --at":       nil,
+	"maint start --reason":   nil,
+	"maint start --author":   nil,
+	"media upload --name":    nil,
+	"media upload --sha256":  nil,
+	"edit --set":             {"host=", "alias=", "user=", "type=", "mac=", "tags=", "wake_broadcast=", "wake_interface="},
+	"server -config":         nil,
+	"server -port":           nil,
+	"import -match":          {"host", "alias"},
+	"import -format":         {"csv", "json", "yaml"},
+	"export -format":         {"csv", "json", "yaml"},
+	"export -o":              nil,
+	"config migrate -config": nil,
+	"store migrate -config":  nil,
+	"store migrate -from":    {"toml", "bolt", "kubernetes"},
+	"store migrate -to":      {"toml", "bolt", "kubernetes"},
+	"share create --for":     nil,
+	"share create --uses":    nil,
+	"share create --note":    nil,
+	"context add -token":     nil,
+	"context add -ca-file":   nil,
+	"context add -output":    outputFormats[:6],
+}
+
+// Commands whose positional arguments are device names
+var deviceArgCommands = map[string]bool{
+	"show": true, "url": true, "power": true, "sensors": true, "sel": true, "wake": true, "edit": true, "rm": true, "status": true, "pick": true,
+}
+
+// runCompletion prints the completion script for a shell
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		fail(exitUsage, "usage: kvmm completion bash|zsh|fish|powershell")
+	}
+
+	switch args[0] {
+	case "bash":
+		os.Stdout.WriteString(bashCompletion)
+	case "zsh":
+		os.Stdout.WriteString(zshCompletion)
+	case "fish":
+		os.Stdout.WriteString(fishCompletion)
+	case "powershell", "pwsh":
+		os.Stdout.WriteString(powershellCompletion)
+	default:
+		fail(exitUsage, "unsupported shell %q (use bash, zsh, fish or powershell)", args[0])
+	}
+}
+
+// runComplete implements the hidden `kvmm __complete <words...>` command
+// used by the completion scripts. words are the arguments typed so far, the
+// last being the (possibly empty) word under the cursor. Candidates are
+// printed unquoted, one per line; the scripts quote them for their shell.
+func runComplete(words []string) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	for _, c := range completeWords(words) {
+		fmt.Println(c)
+	}
+}
+
+// completeWords returns the candidates for the last of words
+func completeWords(words []string) []string {
+	cur := unquoteWord(words[len(words)-1])
+	prev := make([]string, 0, len(words)-1)
+	for _, w := range words[:len(words)-1] {
+		prev = append(prev, unquoteWord(w))
+	}
+
+	// Values of the global flags
+	if n := len(prev); n > 0 {
+		switch prev[n-1] {
+		case "--context", "-context":
+			return filterPrefix(contextNames(), cur)
+		case "--server", "-server":
+			return nil
+		}
+	}
+	if strings.HasPrefix(cur, "--context=") || strings.HasPrefix(cur, "-context=") {
+		flagName, value, _ := strings.Cut(cur, "=")
+		return addPrefix(flagName+"=", filterPrefix(contextNames(), value))
+	}
+
+	// Drop the global flags so the command is the first word, honouring
+	// --server and --context when fetching devices
+	var args []string
+	for i := 0; i < len(prev); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(prev[i], "-"), "=")
+		if !strings.HasPrefix(prev[i], "-") || (name != "server" && name != "context") {
+			args = append(args, prev[i])
+			continue
+		}
+		if !hasValue && i+1 < len(prev) {
+			i++
+			value = prev[i]
+		}
+		if name == "server" {
+			serverFlag = value
+		} else {
+			contextFlag = value
+		}
+	}
+
+	if len(args) == 0 {
+		if strings.HasPrefix(cur, "-") {
+			return filterPrefix([]string{"--server", "--context", "--help"}, cur)
+		}
+		return append(filterPrefix(completionCommands, cur), filterPrefix(deviceNames(), cur)...)
+	}
+
+	cmd := args[0]
+	if cmd == "remove" {
+		cmd = "rm"
+	}
+	key := cmd
+	if subs, ok := completionSubcommands[cmd]; ok {
+		if len(args) == 1 {
+			return filterPrefix(subs, cur)
+		}
+		key = cmd + " " + args[1]
+	}
+
+	// The value of a flag
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "-") && !strings.Contains(last, "=") {
+		if values, ok := completionValues[key+" "+last]; ok {
+			return filterPrefix(values, cur)
+		}
+	}
+
+	if strings.HasPrefix(cur, "-") {
+		return filterPrefix(completionFlags[key], cur)
+	}
+
+	switch key {
+	case "context use", "context remove", "context rm":
+		if len(args) == 2 {
+			return filterPrefix(contextNames(), cur)
+		}
+	case "share create", "share list", "maint start", "media eject", "media status":
+		if positionalCount(key, args[2:]) == 0 {
+			return filterPrefix(deviceNames(), cur)
+		}
+	case "media attach":
+		switch positionalCount(key, args[2:]) {
+		case 0:
+			return filterPrefix(deviceNames(), cur)
+		case 1:
+			return filterPrefix(mediaNames(), cur)
+		}
+	case "media rm":
+		if positionalCount(key, args[2:]) == 0 {
+			return filterPrefix(mediaNames(), cur)
+		}
+	case "trash restore", "trash purge":
+		if len(args) == 2 {
+			return filterPrefix(trashNames(), cur)
+		}
+	case "power":
+		if positionalCount(key, args[1:]) == 1 {
+			return filterPrefix([]string{"status", "on", "off", "off-hard", "reset"}, cur)
+		}
+	case "bulk power":
+		if positionalCount(key, args[2:]) == 0 {
+			return filterPrefix([]string{"on", "off", "off-hard", "reset"}, cur)
+		}
+	}
+	if deviceArgCommands[cmd] && positionalCount(key, args[1:]) == 0 {
+		return filterPrefix(deviceNames(), cur)
+	}
+	return nil
+}
+
+// positionalCount counts the non-flag arguments, skipping flag values
+func positionalCount(key string, args []string) int {
+	n := 0
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") {
+			n++
+			continue
+		}
+		if strings.Contains(a, "=") {
+			continue
+		}
+		if _, takesValue := completionValues[key+" "+a]; takesValue {
+			i++
+		}
+	}
+	return n
+}
+
+// unquoteWord strips the shell quoting from a partly typed word: a leading
+// quote, a matching closing one and backslash escapes
+func unquoteWord(w string) string {
+	if len(w) > 0 && (w[0] == '\'' || w[0] == '"') {
+		q := w[0]
+		w = w[1:]
+		if len(w) > 0 && w[len(w)-1] == q {
+			w = w[:len(w)-1]
+		}
+		if q == '\'' {
+			return w
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(w); i++ {
+		if w[i] == '\\' && i+1 < len(w) {
+			i++
+		}
+		b.WriteByte(w[i])
+	}
+	return b.String()
+}
+
+// filterPrefix keeps the candidates starting with prefix, ignoring case
+func filterPrefix(candidates []string, prefix string) []string {
+	prefix = strings.ToLower(prefix)
+	var out []string
+	for _, c := range candidates {
+		if strings.HasPrefix(strings.ToLower(c), prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func addPrefix(prefix string, values []string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = prefix + v
+	}
+	return out
+}
+
+// contextNames lists the configured contexts
+func contextNames() []string {
+	cc, err := loadClientConfig()
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(cc.Contexts))
+	for name := range cc.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deviceNames lists the aliases and hosts of the server's devices, plus
+// site/alias for federated ones. A device cache younger than
+// completionCacheTTL saves repeated TABs from each hitting the server, and
+// an older one is used if the server is unreachable.
+func deviceNames() []string {
+	server := getServer()
+	cache, _ := loadDeviceCache(server)
+
+	var devices []CLIDevice
+	if cache != nil && time.Since(cache.SavedAt) < completionCacheTTL {
+		devices = cache.Devices
+	} else if fetched, err := fetchDevicesTimeout(server, completionTimeout); err == nil {
+		devices = fetched
+	} else if cache != nil {
+		devices = cache.Devices
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, d := range devices {
+		add(d.Alias)
+		add(d.Host)
+		if d.Site != "" {
+			add(d.Site + "/" + displayName(d))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// trashNames lists the aliases and hosts of deleted devices
+func trashNames() []string {
+	var devices []CLITrashedDevice
+	if err := getCompletionJSON(getServer()+"/api/trash", &devices); err != nil {
+		return nil
+	}
+	var names []string
+	for _, d := range devices {
+		if d.Alias != "" {
+			names = append(names, d.Alias)
+		}
+		names = append(names, d.Host)
+	}
+	return names
+}
+
+// mediaNames lists the images in the server's library
+func mediaNames() []string {
+	var images []CLIMediaImage
+	if err := getCompletionJSON(getServer()+"/api/media", &images); err != nil {
+		return nil
+	}
+	var names []string
+	for _, img := range images {
+		names = append(names, img.Name)
+	}
+	return names
+}
+
+// getCompletionJSON fetches and decodes url with the short completion timeout
+func getCompletionJSON(url string, v any) error {
+	resp, err := newCLIClient(completionTimeout).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+const bashCompletion = `# kvmm bash completion
+# Load with: source <(kvmm completion bash)
+
+_kvmm() {
+    local cur words cword
+    if declare -F _get_comp_words_by_ref >/dev/null 2>&1; then
+        _get_comp_words_by_ref -n =: cur words cword
+    else
+        cur="${COMP_WORDS[COMP_CWORD]}"
+        words=("${COMP_WORDS[@]}")
+        cword=$COMP_CWORD
+    fi
+
+    local IFS=$'\n' candidate
+    COMPREPLY=()
+    for candidate in $(kvmm __complete "${words[@]:1:cword}" 2>/dev/null); do
+        if [[ $candidate == *= ]]; then
+            compopt -o nospace 2>/dev/null
+        fi
+        COMPREPLY+=("$(printf '%q' "$candidate")")
+    done
+
+    if declare -F __ltrim_colon_completions >/dev/null 2>&1; then
+        __ltrim_colon_completions "$cur"
+    fi
+}
+
+complete -o default -F _kvmm kvmm
+`
+
+const zshCompletion = `#compdef kvmm
+# kvmm zsh completion
+# Load with: source <(kvmm completion zsh)
+# or save as _kvmm in a directory on your $fpath
+
+_kvmm() {
+    local -a candidates
+    candidates=(${(f)"$(kvmm __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+    if (( ${#candidates} )); then
+        # -U: kvmm already matched case-insensitively. compadd quotes spaces.
+        if [[ ${candidates[1]} == *= ]]; then
+            compadd -U -S '' -a candidates
+        else
+            compadd -U -a candidates
+        fi
+    else
+        _files
+    fi
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+    _kvmm "$@"
+else
+    compdef _kvmm kvmm
+fi
+`
+
+const fishCompletion = `# kvmm fish completion
+# Load with: kvmm completion fish | source
+# or save as ~/.config/fish/completions/kvmm.fish
+
+function __kvmm_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    kvmm __complete $tokens[2..-1] 2>/dev/null
+end
+
+complete -c kvmm -f -a '(__kvmm_complete)'
+complete -c kvmm -n '__fish_seen_subcommand_from import' -F
+`
+
+const powershellCompletion = `# kvmm PowerShell completion
+# Load with: kvmm completion powershell | Out-String | Invoke-Expression
+
+Register-ArgumentCompleter -Native -CommandName kvmm -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $words = @($commandAst.CommandElements |
+        Where-Object { $_.Extent.StartOffset -lt $cursorPosition } |
+        Select-Object -Skip 1 |
+        ForEach-Object { $_.Extent.Text })
+    if ($wordToComplete -eq '') {
+        $words += '""'
+    }
+
+    & kvmm __complete @words 2>$null | ForEach-Object {
+        $text = $_
+        if ($text -match '[\s''"$;,(){}@&|<>#]') {
+            $text = "'" + ($text -replace "'", "''") + "'"
+        }
+        [System.Management.Automation.CompletionResult]::new($text, $_, 'ParameterValue', $_)
+    }
+}
+`
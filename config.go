@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/google/uuid"
@@ -13,67 +15,199 @@ import (
 
 // Device represents a KVM device configuration
 type Device struct {
-	ID        string `toml:"id" json:"id"`
-	Host      string `toml:"host" json:"host"`
-	Alias     string `toml:"alias,omitempty" json:"alias,omitempty"`
-	Username  string `toml:"username,omitempty" json:"username,omitempty"`
-	Password  string `toml:"password,omitempty" json:"-"` // Hidden from JSON output
-	Thumbnail string `toml:"thumbnail,omitempty" json:"thumbnail,omitempty"`
+	ID        string     `toml:"id" json:"id"`
+	Host      string     `toml:"host" json:"host"`
+	Alias     string     `toml:"alias,omitempty" json:"alias,omitempty"`
+	Username  string     `toml:"username,omitempty" json:"username,omitempty"`
+	Password  string     `toml:"password,omitempty" json:"-"`          // Hidden from JSON output
+	Type      string     `toml:"type,omitempty" json:"type,omitempty"` // See deviceTypes; empty means PiKVM
+	MAC       string     `toml:"mac,omitempty" json:"mac,omitempty"`   // Of the host behind the KVM, for Wake-on-LAN
+	Tags      []string   `toml:"tags,omitempty" json:"tags,omitempty"` // e.g. "rack3", for bulk actions
+	Thumbnail string     `toml:"thumbnail,omitempty" json:"thumbnail,omitempty"`
+	DeletedAt *time.Time `toml:"deleted_at,omitempty" json:"deleted_at,omitempty"` // Set while the device is in the trash
+	Site      string     `toml:"-" json:"site,omitempty"`                          // Site label in federated listings
+	Remote    bool       `toml:"-" json:"remote,omitempty"`                        // Device belongs to an upstream server
+
+	// Where magic packets go: an address (default 255.255.255.255:9) and/or
+	// a server interface to send from
+	WakeBroadcast string `toml:"wake_broadcast,omitempty" json:"wake_broadcast,omitempty"`
+	WakeInterface string `toml:"wake_interface,omitempty" json:"wake_interface,omitempty"`
 }
 
 // DeviceWithAuth is used for creating/updating devices (includes password in JSON)
 type DeviceWithAuth struct {
-	ID       string `json:"id"`
-	Host     string `json:"host"`
-	Alias    string `json:"alias,omitempty"`
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
+	ID       string `json:"id" yaml:"id,omitempty"`
+	Host     string `json:"host" yaml:"host"`
+	Alias    string `json:"alias,omitempty" yaml:"alias,omitempty"`
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+	MAC      string `json:"mac,omitempty" yaml:"mac,omitempty"`
+
+	Tags          []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	WakeBroadcast string   `json:"wake_broadcast,omitempty" yaml:"wake_broadcast,omitempty"`
+	WakeInterface string   `json:"wake_interface,omitempty" yaml:"wake_interface,omitempty"`
+}
+
+// validate checks a device's optional fields; callers check the host
+func (d DeviceWithAuth) validate() error {
+	if err := validateDeviceType(d.Type); err != nil {
+		return err
+	}
+	if d.MAC != "" {
+		if _, err := parseMAC(d.MAC); err != nil {
+			return err
+		}
+	}
+	if d.WakeBroadcast != "" {
+		if _, err := wakeAddr(d.WakeBroadcast); err != nil {
+			return err
+		}
+	}
+	return validateTags(d.Tags)
 }
 
 // ServerConfig holds server-specific configuration
 type ServerConfig struct {
 	Port       int    `toml:"port"`
 	ConfigFile string `toml:"config_file"`
+	Backups    int    `toml:"backups,omitzero"` // Snapshots to keep (default 10, -1 disables)
+	// How long deleted devices stay in the trash, e.g. "168h" (default 30 days)
+	TrashRetention string `toml:"trash_retention,omitempty"`
+	// Allow GET /api/devices/export?credentials=true to include passwords
+	AllowCredentialExport bool `toml:"allow_credential_export,omitempty"`
+	// Device storage backend: "toml" (default, [[devices]] in this file) or "bolt"
+	Store     string `toml:"store,omitempty"`
+	StorePath string `toml:"store_path,omitempty"` // Database file for bolt (default kvmm.db)
+	// API access for store = "kubernetes"
+	Kubernetes KubernetesConfig `toml:"kubernetes,omitempty"`
+	// How often devices are checked for status events, e.g. "30s" (default)
+	StatusInterval string `toml:"status_interval,omitempty"`
+	// URLs that receive a JSON POST when a device goes up or down
+	Webhooks []string `toml:"webhooks,omitempty"`
+	// Leader election between replicas sharing a store
+	Cluster ClusterConfig `toml:"cluster,omitempty"`
+	// Site label for this server's devices when federating
+	Site string `toml:"site,omitempty"`
+	// Other kvmm servers whose devices are listed alongside ours
+	Upstreams          []UpstreamConfig `toml:"upstreams,omitempty"`
+	FederationInterval string           `toml:"federation_interval,omitempty"` // e.g. "30s" (default)
+	// Key for signing one-time and share links (default: a random key
+	// kept in the device store)
+	LinkSecret string `toml:"link_secret,omitempty"`
+	// Directory of the ISO library (default: media beside the config)
+	MediaDir string `toml:"media_dir,omitempty"`
 }
 
 // Config represents the complete application configuration
 type Config struct {
-	Server  ServerConfig `toml:"server"`
-	Devices []Device     `toml:"devices"`
+	SchemaVersion int                 `toml:"schema_version"`
+	Server        ServerConfig        `toml:"server"`
+	Devices       []Device            `toml:"devices"`
+	Maintenance   []MaintenanceWindow `toml:"maintenance"` // Cached from the store; see importMaintenance
 
 	mu       sync.RWMutex
 	filePath string
+	store    DeviceStore
+	events   *EventBroker
+
+	mediaMu    sync.Mutex
+	mediaSeen  map[string]string // Media progress records of other replicas already published, by ID
+	mediaLocal map[string]bool   // Media transfers made by this replica, by ID
+}
+
+// configFile is the on-disk layout of config.toml
+type configFile struct {
+	SchemaVersion int                 `toml:"schema_version"`
+	Server        ServerConfig        `toml:"server"`
+	Devices       []Device            `toml:"devices"`
+	Maintenance   []MaintenanceWindow `toml:"maintenance,omitempty"`
 }
 
 // LoadConfig reads configuration from a TOML file
 func LoadConfig(path string) (*Config, error) {
 	cfg := &Config{
+		SchemaVersion: schemaVersion,
 		Server: ServerConfig{
 			Port:       8080,
 			ConfigFile: path,
 		},
 		filePath: path,
+		events:   NewEventBroker(),
 	}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Create default config if file doesn't exist
+			cfg.store = newTOMLStore(path)
 			return cfg, cfg.Save()
 		}
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 
-	if err := toml.Unmarshal(data, cfg); err != nil {
+	// Upgrade older schema versions before decoding into Config
+	migrated, from, err := migrateConfigData(data)
+	if err != nil {
+		return nil, err
+	}
+	if from < schemaVersion {
+		if err := writeMigrationBackup(path, from, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := toml.Unmarshal(migrated, cfg); err != nil {
 		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
 
 	cfg.filePath = path
 
-	// Ensure all devices have IDs
-	for i := range cfg.Devices {
-		if cfg.Devices[i].ID == "" {
-			cfg.Devices[i].ID = uuid.New().String()
+	cfg.store, err = openStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.storeKind() != "toml" {
+		if len(cfg.Devices) > 0 {
+			log.Printf("Ignoring %d [[devices]] in %s: devices are kept in the %s store (see 'kvmm store migrate')",
+				len(cfg.Devices), path, cfg.storeKind())
+		}
+		if cfg.Devices, err = cfg.store.List(); err != nil {
+			cfg.store.Close()
+			return nil, fmt.Errorf("loading devices: %w", err)
+		}
+	}
+
+	// Ensure all devices have IDs, persisting any that were assigned so
+	// later per-device writes can find them
+	assigned := assignMissingIDs(cfg.Devices)
+
+	if from < schemaVersion || assigned {
+		if err := cfg.Save(); err != nil {
+			cfg.store.Close()
+			return nil, fmt.Errorf("saving migrated config: %w", err)
+		}
+	}
+
+	// Maintenance windows live in the store; move any left in config.toml
+	if len(cfg.Maintenance) > 0 {
+		if err := cfg.importMaintenance(cfg.Maintenance); err != nil {
+			cfg.store.Close()
+			return nil, err
+		}
+		if err := cfg.Save(); err != nil {
+			log.Printf("Could not drop [[maintenance]] from %s, remove it by hand: %v", path, err)
+		}
+	}
+	if err := cfg.loadMaintenance(); err != nil {
+		cfg.store.Close()
+		return nil, err
+	}
+
+	// Restore explicit thumbnails kept by the store before filling gaps
+	if m, ok := cfg.store.(thumbnailMirror); ok {
+		if err := m.FetchThumbnails(cfg.GetThumbnailDir()); err != nil {
+			log.Printf("Failed to fetch thumbnails from %s store: %v", cfg.storeKind(), err)
 		}
 	}
 
@@ -83,12 +217,36 @@ func LoadConfig(path string) (*Config, error) {
 	return cfg, nil
 }
 
+// assignMissingIDs gives every device without an ID a new one, reporting
+// whether any were assigned
+func assignMissingIDs(devices []Device) bool {
+	assigned := false
+	for i := range devices {
+		if devices[i].ID == "" {
+			devices[i].ID = uuid.New().String()
+			assigned = true
+		}
+	}
+	return assigned
+}
+
+// Close releases the device store
+func (c *Config) Close() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Close()
+}
+
 // GenerateMissingThumbnails creates pattern thumbnails for devices that don't have one.
 // Auto-generated thumbnails are saved to disk but NOT recorded in the config file.
 // They are automatically matched to devices by ID when serving.
 func (c *Config) GenerateMissingThumbnails() {
 	log.Printf("GenerateMissingThumbnails: checking %d devices", len(c.Devices))
 	for _, device := range c.Devices {
+		if device.DeletedAt != nil {
+			continue
+		}
 		if device.Thumbnail == "" {
 			// Check if auto-generated thumbnail already exists
 			autoPath := filepath.Join(c.GetThumbnailDir(), device.ID+".jpg")
@@ -131,44 +289,109 @@ func (c *Config) SaveAutoThumbnail(id string, data []byte) error {
 	return os.WriteFile(thumbPath, data, 0644)
 }
 
+// encode renders config.toml. Devices are only included when they are
+// kept in the file itself. Callers must hold c.mu.
+func (c *Config) encode() ([]byte, error) {
+	c.SchemaVersion = schemaVersion
+
+	file := configFile{SchemaVersion: c.SchemaVersion, Server: c.Server}
+	if c.storeKind() == "toml" {
+		file.Devices = c.Devices
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(file); err != nil {
+		return nil, fmt.Errorf("encoding config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
 // Save writes the configuration to the TOML file atomically
 func (c *Config) Save() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Write to temporary file first
-	tmpFile := c.filePath + ".tmp"
-	f, err := os.Create(tmpFile)
+	return c.save()
+}
+
+// save rewrites config.toml from memory. Callers must hold c.mu, which lets
+// multi-step changes apply and persist under a single lock.
+func (c *Config) save() error {
+	data, err := c.encode()
 	if err != nil {
-		return fmt.Errorf("creating temp config file: %w", err)
+		return err
 	}
 
-	encoder := toml.NewEncoder(f)
-	if err := encoder.Encode(c); err != nil {
-		f.Close()
-		os.Remove(tmpFile)
-		return fmt.Errorf("encoding config: %w", err)
+	// Keep a copy of the state being replaced
+	if err := c.snapshot(); err != nil {
+		log.Printf("Save: failed to back up config: %v", err)
 	}
 
-	if err := f.Close(); err != nil {
-		os.Remove(tmpFile)
-		return fmt.Errorf("closing temp config file: %w", err)
+	if err := writeFileAtomic(c.filePath, data); err != nil {
+		return err
 	}
+	if ts, ok := c.store.(*tomlStore); ok {
+		ts.markWritten()
+	}
+
+	return nil
+}
+
+// Commit persists changed and removed devices through the device store
+func (c *Config) Commit(puts []Device, deletes []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.commit(puts, deletes)
+}
 
-	// Atomic rename
-	if err := os.Rename(tmpFile, c.filePath); err != nil {
-		os.Remove(tmpFile)
-		return fmt.Errorf("renaming config file: %w", err)
+// commit is Commit for callers that already hold c.mu
+func (c *Config) commit(puts []Device, deletes []string) error {
+	// Keep a copy of the state being replaced
+	if err := c.snapshot(); err != nil {
+		log.Printf("Commit: failed to back up config: %v", err)
 	}
 
+	return c.store.Commit(puts, deletes)
+}
+
+// validateDevices checks a device list before it replaces the live inventory
+func validateDevices(devices []Device) error {
+	seen := make(map[string]bool)
+	for i, d := range devices {
+		if d.Host == "" {
+			return fmt.Errorf("device %d: host is required", i+1)
+		}
+		if d.ID == "" {
+			return fmt.Errorf("device %d: id is required", i+1)
+		}
+		if seen[d.ID] {
+			return fmt.Errorf("device %d: duplicate id %s", i+1, d.ID)
+		}
+		seen[d.ID] = true
+	}
 	return nil
 }
 
-// GetDevices returns a copy of all devices
+// GetDevices returns a copy of all devices that are not in the trash
 func (c *Config) GetDevices() []Device {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	devices := make([]Device, 0, len(c.Devices))
+	for _, d := range c.Devices {
+		if d.DeletedAt == nil {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// GetAllDevices returns a copy of all devices, including trashed ones
+func (c *Config) GetAllDevices() []Device {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	devices := make([]Device, len(c.Devices))
 	copy(devices, c.Devices)
 	return devices
@@ -180,7 +403,7 @@ func (c *Config) GetDevice(id string) (Device, bool) {
 	defer c.mu.RUnlock()
 
 	for _, d := range c.Devices {
-		if d.ID == id {
+		if d.ID == id && d.DeletedAt == nil {
 			return d, true
 		}
 	}
@@ -196,11 +419,17 @@ func (c *Config) AddDevice(d DeviceWithAuth) (Device, error) {
 		Alias:    d.Alias,
 		Username: d.Username,
 		Password: d.Password,
+		Type:     d.Type,
+		MAC:      d.MAC,
+		Tags:     normalizeTags(d.Tags),
+
+		WakeBroadcast: d.WakeBroadcast,
+		WakeInterface: d.WakeInterface,
 	}
 	c.Devices = append(c.Devices, device)
 	c.mu.Unlock()
 
-	if err := c.Save(); err != nil {
+	if err := c.Commit([]Device{device}, nil); err != nil {
 		// Rollback
 		c.mu.Lock()
 		c.Devices = c.Devices[:len(c.Devices)-1]
@@ -225,7 +454,7 @@ func (c *Config) UpdateDevice(id string, d DeviceWithAuth) (Device, error) {
 	var idx int
 
 	for i, dev := range c.Devices {
-		if dev.ID == id {
+		if dev.ID == id && dev.DeletedAt == nil {
 			oldDevice = dev
 			found = true
 			idx = i
@@ -244,12 +473,22 @@ func (c *Config) UpdateDevice(id string, d DeviceWithAuth) (Device, error) {
 		Alias:     d.Alias,
 		Username:  d.Username,
 		Password:  d.Password,
+		Type:      d.Type,
+		MAC:       d.MAC,
+		Tags:      normalizeTags(d.Tags),
 		Thumbnail: oldDevice.Thumbnail, // Preserve existing thumbnail
+
+		WakeBroadcast: d.WakeBroadcast,
+		WakeInterface: d.WakeInterface,
+	}
+	// A blank password keeps the stored one, unless credentials are removed
+	if updated.Password == "" && updated.Username != "" {
+		updated.Password = oldDevice.Password
 	}
 	c.Devices[idx] = updated
 	c.mu.Unlock()
 
-	if err := c.Save(); err != nil {
+	if err := c.Commit([]Device{updated}, nil); err != nil {
 		// Rollback
 		c.mu.Lock()
 		c.Devices[idx] = oldDevice
@@ -260,32 +499,31 @@ func (c *Config) UpdateDevice(id string, d DeviceWithAuth) (Device, error) {
 	return updated, nil
 }
 
-// DeleteDevice removes a device and saves the config
+// DeleteDevice moves a device to the trash and saves the config.
+// Trashed devices are purged after the trash retention by the TrashJanitor.
 func (c *Config) DeleteDevice(id string) error {
 	c.mu.Lock()
-	var oldDevices []Device
-	var found bool
-
+	var idx int = -1
 	for i, d := range c.Devices {
-		if d.ID == id {
-			oldDevices = make([]Device, len(c.Devices))
-			copy(oldDevices, c.Devices)
-			c.Devices = append(c.Devices[:i], c.Devices[i+1:]...)
-			found = true
+		if d.ID == id && d.DeletedAt == nil {
+			idx = i
 			break
 		}
 	}
 
-	if !found {
+	if idx == -1 {
 		c.mu.Unlock()
 		return fmt.Errorf("device not found")
 	}
+	now := time.Now().UTC()
+	c.Devices[idx].DeletedAt = &now
+	deleted := c.Devices[idx]
 	c.mu.Unlock()
 
-	if err := c.Save(); err != nil {
+	if err := c.Commit([]Device{deleted}, nil); err != nil {
 		// Rollback
 		c.mu.Lock()
-		c.Devices = oldDevices
+		c.Devices[idx].DeletedAt = nil
 		c.mu.Unlock()
 		return err
 	}
@@ -303,6 +541,18 @@ func (c *Config) GetThumbnailDir() string {
 	return filepath.Join(c.GetConfigDir(), "thumbnails")
 }
 
+// GetMediaDir returns the path to the ISO library, relative to the config
+// unless absolute
+func (c *Config) GetMediaDir() string {
+	switch {
+	case c.Server.MediaDir == "":
+		return filepath.Join(c.GetConfigDir(), "media")
+	case filepath.IsAbs(c.Server.MediaDir):
+		return c.Server.MediaDir
+	}
+	return filepath.Join(c.GetConfigDir(), c.Server.MediaDir)
+}
+
 // EnsureThumbnailDir creates the thumbnails directory if it doesn't exist
 func (c *Config) EnsureThumbnailDir() error {
 	return os.MkdirAll(c.GetThumbnailDir(), 0755)
@@ -317,7 +567,7 @@ func (c *Config) SetThumbnail(id string, data []byte, ext string) error {
 	c.mu.Lock()
 	var idx int = -1
 	for i, d := range c.Devices {
-		if d.ID == id {
+		if d.ID == id && d.DeletedAt == nil {
 			idx = i
 			break
 		}
@@ -331,6 +581,9 @@ func (c *Config) SetThumbnail(id string, data []byte, ext string) error {
 	oldThumb := c.Devices[idx].Thumbnail
 	if oldThumb != "" {
 		os.Remove(filepath.Join(c.GetThumbnailDir(), oldThumb))
+		if oldThumb != id+ext {
+			c.unmirrorThumbnail(oldThumb)
+		}
 	}
 
 	// Save new thumbnail
@@ -342,9 +595,12 @@ func (c *Config) SetThumbnail(id string, data []byte, ext string) error {
 	}
 
 	c.Devices[idx].Thumbnail = filename
+	device := c.Devices[idx]
 	c.mu.Unlock()
 
-	return c.Save()
+	c.mirrorThumbnail(filename, data)
+
+	return c.Commit([]Device{device}, nil)
 }
 
 // DeleteThumbnail removes a device's explicit thumbnail and regenerates an auto-thumbnail
@@ -353,7 +609,7 @@ func (c *Config) DeleteThumbnail(id string) error {
 	var idx int = -1
 	var device Device
 	for i, d := range c.Devices {
-		if d.ID == id {
+		if d.ID == id && d.DeletedAt == nil {
 			idx = i
 			device = d
 			break
@@ -366,11 +622,13 @@ func (c *Config) DeleteThumbnail(id string) error {
 
 	if c.Devices[idx].Thumbnail != "" {
 		os.Remove(filepath.Join(c.GetThumbnailDir(), c.Devices[idx].Thumbnail))
+		c.unmirrorThumbnail(c.Devices[idx].Thumbnail)
 		c.Devices[idx].Thumbnail = ""
 	}
+	updated := c.Devices[idx]
 	c.mu.Unlock()
 
-	if err := c.Save(); err != nil {
+	if err := c.Commit([]Device{updated}, nil); err != nil {
 		return err
 	}
 
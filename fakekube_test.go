@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKube is an in-memory Kubernetes API server covering what the
+// kubernetes store uses: KVMDevices with their status subresource,
+// ConfigMaps, Secrets and Leases, label selectors, optimistic concurrency
+// and watches
+type fakeKube struct {
+	*httptest.Server
+	namespace string
+
+	mu      sync.Mutex
+	rv      int
+	objects map[string]map[string]map[string]interface{} // Collection -> name -> object
+	events  []fakeKubeEvent
+	changed *sync.Cond
+	fail    func(r *http.Request) int // Status to fail a request with, or 0
+}
+
+type fakeKubeEvent struct {
+	rv         int
+	collection string
+	Type       string                 `json:"type"`
+	Object     map[string]interface{} `json:"object"`
+}
+
+// newFakeKube starts a fake API server that serves namespace
+func newFakeKube(t *testing.T) *fakeKube {
+	t.Helper()
+	f := &fakeKube{namespace: "kvmm", objects: make(map[string]map[string]map[string]interface{})}
+	f.changed = sync.NewCond(&f.mu)
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(func() {
+		f.mu.Lock()
+		f.rv++ // Wakes watchers so they notice the closed connections
+		f.changed.Broadcast()
+		f.mu.Unlock()
+		f.CloseClientConnections()
+		f.Close()
+	})
+	return f
+}
+
+// store opens a kubernetes store against the fake
+func (f *fakeKube) store(t *testing.T) *kubernetesStore {
+	t.Helper()
+	s, err := newKubernetesStore(KubernetesConfig{APIServer: f.URL, Namespace: f.namespace})
+	if err != nil {
+		t.Fatalf("newKubernetesStore: %v", err)
+	}
+	return s
+}
+
+// failWriteAfter fails the write request that follows n successful ones,
+// and lets every other request through
+func (f *fakeKube) failWriteAfter(n int) {
+	writes := 0
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = func(r *http.Request) int {
+		if r.Method == http.MethodGet {
+			return 0
+		}
+		writes++
+		if writes == n+1 {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+}
+
+// collections served, relative to the namespace
+var fakeKubeCollections = map[string]string{
+	"kvmdevices": "/apis/kvmm.io/v1/namespaces/%s/kvmdevices",
+	"configmaps": "/api/v1/namespaces/%s/configmaps",
+	"secrets":    "/api/v1/namespaces/%s/secrets",
+	"leases":     "/apis/coordination.k8s.io/v1/namespaces/%s/leases",
+}
+
+// route splits a request path into collection, object name and subresource
+func (f *fakeKube) route(path string) (collection, name, sub string, ok bool) {
+	for c, prefix := range fakeKubeCollections {
+		prefix = fmt.Sprintf(prefix, f.namespace)
+		if path == prefix {
+			return c, "", "", true
+		}
+		if rest, found := strings.CutPrefix(path, prefix+"/"); found {
+			name, sub, _ = strings.Cut(rest, "/")
+			return c, name, sub, true
+		}
+	}
+	return "", "", "", false
+}
+
+func (f *fakeKube) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	fail := f.fail
+	f.mu.Unlock()
+	if fail != nil {
+		if code := fail(r); code != 0 {
+			fakeKubeError(w, code, "injected failure")
+			return
+		}
+	}
+	collection, name, sub, ok := f.route(r.URL.Path)
+	if !ok {
+		fakeKubeError(w, http.StatusNotFound, "no such resource "+r.URL.Path)
+		return
+	}
+
+	var body map[string]interface{}
+	if r.Body != nil && r.Method != http.MethodGet {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	switch {
+	case r.Method == http.MethodGet && name == "" && r.URL.Query().Get("watch") != "":
+		f.watch(w, r, collection)
+	case r.Method == http.MethodGet && name == "":
+		f.list(w, r, collection)
+	case r.Method == http.MethodGet:
+		f.respond(w, func() (int, interface{}) {
+			if obj, ok := f.objects[collection][name]; ok {
+				return http.StatusOK, obj
+			}
+			return http.StatusNotFound, nil
+		})
+	case r.Method == http.MethodPost && name == "":
+		f.respond(w, func() (int, interface{}) { return f.create(collection, body) })
+	case r.Method == http.MethodPut:
+		f.respond(w, func() (int, interface{}) { return f.replace(collection, name, body) })
+	case r.Method == http.MethodPatch && sub == "status":
+		f.respond(w, func() (int, interface{}) { return f.patchStatus(collection, name, body) })
+	case r.Method == http.MethodDelete:
+		f.respond(w, func() (int, interface{}) { return f.remove(collection, name, body) })
+	default:
+		fakeKubeError(w, http.StatusMethodNotAllowed, "unsupported")
+	}
+}
+
+// respond runs fn under the lock and writes its status and object
+func (f *fakeKube) respond(w http.ResponseWriter, fn func() (int, interface{})) {
+	f.mu.Lock()
+	code, obj := fn()
+	data, _ := json.Marshal(obj)
+	f.mu.Unlock()
+
+	if code >= 300 {
+		fakeKubeError(w, code, http.StatusText(code))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func fakeKubeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "code": code, "message": message})
+}
+
+func fakeKubeMeta(obj map[string]interface{}) map[string]interface{} {
+	meta, _ := obj["metadata"].(map[string]interface{})
+	if meta == nil {
+		meta = make(map[string]interface{})
+		obj["metadata"] = meta
+	}
+	return meta
+}
+
+// record bumps the resourceVersion, stores obj and queues a watch event.
+// Callers hold f.mu.
+func (f *fakeKube) record(collection, eventType string, obj map[string]interface{}) {
+	f.rv++
+	meta := fakeKubeMeta(obj)
+	meta["resourceVersion"] = strconv.Itoa(f.rv)
+	name := meta["name"].(string)
+	if f.objects[collection] == nil {
+		f.objects[collection] = make(map[string]map[string]interface{})
+	}
+	if eventType == "DELETED" {
+		delete(f.objects[collection], name)
+	} else {
+		f.objects[collection][name] = obj
+	}
+	f.events = append(f.events, fakeKubeEvent{rv: f.rv, collection: collection, Type: eventType, Object: clone(obj)})
+	f.changed.Broadcast()
+}
+
+func (f *fakeKube) create(collection string, obj map[string]interface{}) (int, interface{}) {
+	meta := fakeKubeMeta(obj)
+	name, _ := meta["name"].(string)
+	if name == "" {
+		return http.StatusUnprocessableEntity, nil
+	}
+	if _, exists := f.objects[collection][name]; exists {
+		return http.StatusConflict, nil
+	}
+	meta["creationTimestamp"] = time.Now().UTC().Add(time.Duration(f.rv) * time.Second).Format(time.RFC3339)
+	f.record(collection, "ADDED", obj)
+	return http.StatusCreated, obj
+}
+
+func (f *fakeKube) replace(collection, name string, obj map[string]interface{}) (int, interface{}) {
+	current, exists := f.objects[collection][name]
+	if !exists {
+		return http.StatusNotFound, nil
+	}
+	meta, currentMeta := fakeKubeMeta(obj), fakeKubeMeta(current)
+	if rv, _ := meta["resourceVersion"].(string); rv != "" && rv != currentMeta["resourceVersion"] {
+		return http.StatusConflict, nil
+	}
+	meta["resourceVersion"] = currentMeta["resourceVersion"]
+	meta["creationTimestamp"] = currentMeta["creationTimestamp"]
+	if status, ok := current["status"]; ok && collection == "kvmdevices" {
+		obj["status"] = status // Only changed through the subresource
+	}
+	// Like the real API server, an update that changes nothing is a no-op
+	if reflect.DeepEqual(normalize(obj), normalize(current)) {
+		return http.StatusOK, current
+	}
+	f.record(collection, "MODIFIED", obj)
+	return http.StatusOK, obj
+}
+
+func (f *fakeKube) patchStatus(collection, name string, patch map[string]interface{}) (int, interface{}) {
+	current, exists := f.objects[collection][name]
+	if !exists {
+		return http.StatusNotFound, nil
+	}
+	obj := clone(current)
+	obj["status"] = patch["status"]
+	f.record(collection, "MODIFIED", obj)
+	return http.StatusOK, obj
+}
+
+func (f *fakeKube) remove(collection, name string, options map[string]interface{}) (int, interface{}) {
+	current, exists := f.objects[collection][name]
+	if !exists {
+		return http.StatusNotFound, nil
+	}
+	if pre, ok := options["preconditions"].(map[string]interface{}); ok {
+		if rv, _ := pre["resourceVersion"].(string); rv != "" && rv != fakeKubeMeta(current)["resourceVersion"] {
+			return http.StatusConflict, nil
+		}
+	}
+	f.record(collection, "DELETED", clone(current))
+	return http.StatusOK, map[string]string{"status": "Success"}
+}
+
+// matches applies a labelSelector of "key" or "key=value"
+func matches(obj map[string]interface{}, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	labels, _ := fakeKubeMeta(obj)["labels"].(map[string]interface{})
+	key, value, hasValue := strings.Cut(selector, "=")
+	got, ok := labels[key]
+	return ok && (!hasValue || got == value)
+}
+
+func (f *fakeKube) list(w http.ResponseWriter, r *http.Request, collection string) {
+	selector := r.URL.Query().Get("labelSelector")
+	f.respond(w, func() (int, interface{}) {
+		items := []interface{}{}
+		for _, obj := range f.objects[collection] {
+			if matches(obj, selector) {
+				items = append(items, obj)
+			}
+		}
+		return http.StatusOK, map[string]interface{}{
+			"metadata": map[string]string{"resourceVersion": strconv.Itoa(f.rv)},
+			"items":    items,
+		}
+	})
+}
+
+// watch streams events after the requested resourceVersion until the
+// client goes away
+func (f *fakeKube) watch(w http.ResponseWriter, r *http.Request, collection string) {
+	selector := r.URL.Query().Get("labelSelector")
+	from, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	go func() {
+		<-r.Context().Done()
+		f.mu.Lock()
+		f.changed.Broadcast()
+		f.mu.Unlock()
+	}()
+
+	enc := json.NewEncoder(w)
+	next := 0
+	for {
+		f.mu.Lock()
+		for next < len(f.events) && f.events[next].rv <= from {
+			next++
+		}
+		for next >= len(f.events) && r.Context().Err() == nil {
+			f.changed.Wait()
+		}
+		if r.Context().Err() != nil {
+			f.mu.Unlock()
+			return
+		}
+		ev := f.events[next]
+		next++
+		f.mu.Unlock()
+
+		if ev.collection != collection || !matches(ev.Object, selector) {
+			continue
+		}
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+	}
+}
+
+// object returns a copy of a stored object, or nil
+func (f *fakeKube) object(collection, name string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if obj, ok := f.objects[collection][name]; ok {
+		return clone(obj)
+	}
+	return nil
+}
+
+// names lists the stored objects in a collection
+func (f *fakeKube) names(collection string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.objects[collection] {
+		names = append(names, name)
+	}
+	return names
+}
+
+// apply creates or replaces an object as kubectl would, ignoring conflicts
+func (f *fakeKube) apply(collection string, obj map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	meta := fakeKubeMeta(obj)
+	if current, ok := f.objects[collection][meta["name"].(string)]; ok {
+		meta["creationTimestamp"] = fakeKubeMeta(current)["creationTimestamp"]
+		f.record(collection, "MODIFIED", obj)
+		return
+	}
+	meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	f.record(collection, "ADDED", obj)
+}
+
+// clone deep-copies a JSON object
+func clone(obj map[string]interface{}) map[string]interface{} {
+	data, _ := json.Marshal(obj)
+	var out map[string]interface{}
+	json.Unmarshal(data, &out)
+	return out
+}
+
+// normalize drops server-managed metadata before comparing objects
+func normalize(obj map[string]interface{}) map[string]interface{} {
+	out := clone(obj)
+	meta := fakeKubeMeta(out)
+	delete(meta, "resourceVersion")
+	delete(meta, "creationTimestamp")
+	if len(meta) == 0 {
+		delete(out, "metadata")
+	}
+	return out
+}
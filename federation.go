@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFederationInterval = 30 * time.Second
+
+// UpstreamConfig points at another kvmm server whose devices are shown here
+type UpstreamConfig struct {
+	Name  string `toml:"name"`            // Site label; prefixes the upstream's device IDs
+	URL   string `toml:"url"`             // e.g. "https://kvmm.site-b.example.com"
+	Token string `toml:"token,omitempty"` // Sent as a bearer token
+}
+
+// UpstreamState reports the last sync of an upstream (GET /api/upstreams)
+type UpstreamState struct {
+	Name     string     `json:"name"`
+	URL      string     `json:"url"`
+	Devices  int        `json:"devices"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// siteState is the cached inventory of one upstream
+type siteState struct {
+	upstream UpstreamConfig
+	devices  []Device
+	statuses []DeviceStatus
+	lastSync *time.Time
+	err      string
+}
+
+// Federation periodically pulls devices and statuses from upstream kvmm
+// servers. Remote devices get IDs of the form "<site>:<id>" so they can be
+// told apart from local ones.
+type Federation struct {
+	config   *Config
+	interval time.Duration
+	client   *http.Client
+
+	mu    sync.RWMutex
+	sites []*siteState
+}
+
+// NewFederation validates the configured upstreams
+func NewFederation(cfg *Config) (*Federation, error) {
+	f := &Federation{
+		config:   cfg,
+		interval: defaultFederationInterval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if cfg.Server.FederationInterval != "" {
+		d, err := time.ParseDuration(cfg.Server.FederationInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid federation_interval %q", cfg.Server.FederationInterval)
+		}
+		f.interval = d
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range cfg.Server.Upstreams {
+		if u.Name == "" || u.URL == "" {
+			return nil, fmt.Errorf("upstreams need a name and url")
+		}
+		if strings.ContainsAny(u.Name, ":/. ") {
+			return nil, fmt.Errorf("upstream name %q must not contain ':', '/', '.' or spaces", u.Name)
+		}
+		if seen[u.Name] || u.Name == cfg.Server.Site {
+			return nil, fmt.Errorf("duplicate site name %q", u.Name)
+		}
+		seen[u.Name] = true
+		u.URL = strings.TrimSuffix(u.URL, "/")
+		f.sites = append(f.sites, &siteState{upstream: u})
+	}
+
+	return f, nil
+}
+
+// Run syncs every upstream on the federation interval. It blocks, so run it
+// in its own goroutine.
+func (f *Federation) Run() {
+	if len(f.sites) == 0 {
+		return
+	}
+	for {
+		var wg sync.WaitGroup
+		for _, site := range f.sites {
+			wg.Add(1)
+			go func(s *siteState) {
+				defer wg.Done()
+				f.sync(s)
+			}(site)
+		}
+		wg.Wait()
+		time.Sleep(f.interval)
+	}
+}
+
+// sync refreshes one upstream. On failure the last good inventory is kept
+// so a flaky site doesn't vanish from the list.
+func (f *Federation) sync(s *siteState) {
+	u := s.upstream
+
+	var devices []Device
+	var statuses []DeviceStatus
+	err := f.get(u, "/api/devices?local=true", &devices)
+	if err == nil {
+		err = f.get(u, "/api/status?local=true", &statuses)
+	}
+
+	f.mu.Lock()
+	if err != nil {
+		if s.err == "" {
+			log.Printf("Federation: %s: %v", u.Name, err)
+		}
+		s.err = err.Error()
+		f.mu.Unlock()
+		return
+	}
+
+	for i := range devices {
+		devices[i].ID = remoteDeviceID(u.Name, devices[i].ID)
+		devices[i].Site = u.Name
+		devices[i].Remote = true
+	}
+	for i := range statuses {
+		statuses[i].ID = remoteDeviceID(u.Name, statuses[i].ID)
+	}
+	changed := !reflect.DeepEqual(s.devices, devices)
+	s.devices = devices
+	s.statuses = statuses
+	now := time.Now().UTC()
+	s.lastSync = &now
+	s.err = ""
+	f.mu.Unlock()
+
+	if changed {
+		f.config.events.Publish(Event{Type: "device", Data: map[string]string{"type": "reload", "site": u.Name}})
+	}
+}
+
+// get fetches an upstream API path and decodes the JSON response into out
+func (f *Federation) get(u UpstreamConfig, path string, out interface{}) error {
+	resp, err := f.request(u, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (f *Federation) request(u UpstreamConfig, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+	}
+	return f.client.Do(req)
+}
+
+// Devices returns the cached devices of every upstream
+func (f *Federation) Devices() []Device {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var devices []Device
+	for _, s := range f.sites {
+		devices = append(devices, s.devices...)
+	}
+	return devices
+}
+
+// Statuses returns the cached statuses of every upstream's devices
+func (f *Federation) Statuses() []DeviceStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var statuses []DeviceStatus
+	for _, s := range f.sites {
+		statuses = append(statuses, s.statuses...)
+	}
+	return statuses
+}
+
+// States reports the sync state of every upstream
+func (f *Federation) States() []UpstreamState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	states := make([]UpstreamState, len(f.sites))
+	for i, s := range f.sites {
+		states[i] = UpstreamState{
+			Name:     s.upstream.Name,
+			URL:      s.upstream.URL,
+			Devices:  len(s.devices),
+			LastSync: s.lastSync,
+			Error:    s.err,
+		}
+	}
+	return states
+}
+
+// Lookup resolves a federated device ID to its upstream and the ID the
+// upstream knows it by
+func (f *Federation) Lookup(id string) (UpstreamConfig, string, bool) {
+	site, remoteID, ok := strings.Cut(id, ":")
+	if !ok {
+		return UpstreamConfig{}, "", false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, s := range f.sites {
+		if s.upstream.Name != site {
+			continue
+		}
+		for _, d := range s.devices {
+			if d.ID == id {
+				return s.upstream, remoteID, true
+			}
+		}
+	}
+	return UpstreamConfig{}, "", false
+}
+
+// CopyThumbnail streams a remote device's thumbnail from its upstream
+func (f *Federation) CopyThumbnail(w http.ResponseWriter, id string) error {
+	u, remoteID, ok := f.Lookup(id)
+	if !ok {
+		return fmt.Errorf("device not found")
+	}
+	resp, err := f.request(u, "/thumbnails/"+remoteID)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("device not found")
+	}
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// remoteDeviceID namespaces an upstream device ID with its site
+func remoteDeviceID(site, id string) string {
+	return site + ":" + id
+}
@@ -5,5 +5,11 @@ go 1.24.0
 require (
 	github.com/BurntSushi/toml v1.3.2
 	github.com/google/uuid v1.6.0
+	go.etcd.io/bbolt v1.4.3
 	golang.org/x/image v0.36.0
+	golang.org/x/term v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+	rsc.io/qr v0.2.0
 )
+
+require golang.org/x/sys v0.29.0 // indirect
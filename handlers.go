@@ -15,20 +15,56 @@ import (
 
 // Handlers wraps the config and provides HTTP handlers
 type Handlers struct {
-	config *Config
+	config     *Config
+	federation *Federation
+	links      *linkSigner
+	shares     *shareStore
+	media      *mediaLibrary
 }
 
 // NewHandlers creates a new Handlers instance
-func NewHandlers(cfg *Config) *Handlers {
-	return &Handlers{config: cfg}
+func NewHandlers(cfg *Config, fed *Federation) *Handlers {
+	return &Handlers{
+		config:     cfg,
+		federation: fed,
+		links:      newLinkSigner(cfg.Server.LinkSecret, cfg.store, cfg.GetConfigDir()),
+		shares:     newShareStore(cfg.store, cfg.GetConfigDir()),
+		media:      newMediaLibrary(cfg.GetMediaDir()),
+	}
+}
+
+// includeFederated reports whether a listing should include upstream
+// devices; upstreams pass local=true so federation doesn't cascade
+func (h *Handlers) includeFederated(r *http.Request) bool {
+	return h.federation != nil && r.URL.Query().Get("local") != "true"
 }
 
-// ListDevices returns all devices (GET /api/devices)
+// ListDevices returns all devices, including those of federated upstreams
+// (GET /api/devices)
 func (h *Handlers) ListDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.listDevices(r))
+}
+
+// SearchDevices ranks devices by how well they match q
+// (GET /api/devices/search?q=)
+func (h *Handlers) SearchDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searchDevices(h.listDevices(r), r.URL.Query().Get("q")))
+}
+
+// listDevices gathers local and federated devices for listings
+func (h *Handlers) listDevices(r *http.Request) []Device {
 	devices := h.config.GetDevices()
 
 	// Check for thumbnail existence (explicit or auto-generated) and set the field
 	for i := range devices {
+		devices[i].Site = h.config.Server.Site
 		if _, exists := h.config.GetThumbnailPath(devices[i].ID); exists {
 			// Set a non-empty value so frontend knows a thumbnail is available
 			if devices[i].Thumbnail == "" {
@@ -37,8 +73,10 @@ func (h *Handlers) ListDevices(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(devices)
+	if h.includeFederated(r) {
+		devices = append(devices, h.federation.Devices()...)
+	}
+	return devices
 }
 
 // CreateDevice adds a new device (POST /api/devices)
@@ -53,6 +91,10 @@ func (h *Handlers) CreateDevice(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Host is required", http.StatusBadRequest)
 		return
 	}
+	if err := input.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	device, err := h.config.AddDevice(input)
 	if err != nil {
@@ -83,6 +125,10 @@ func (h *Handlers) UpdateDevice(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Host is required", http.StatusBadRequest)
 		return
 	}
+	if err := input.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	device, err := h.config.UpdateDevice(id, input)
 	if err != nil {
@@ -125,9 +171,34 @@ func (h *Handlers) GoToDevice(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Device ID required", http.StatusBadRequest)
 		return
 	}
+	h.redirectToDevice(w, r, id)
+}
+
+// deviceExists reports whether id is a local or federated device
+func (h *Handlers) deviceExists(id string) bool {
+	if _, found := h.config.GetDevice(id); found {
+		return true
+	}
+	if h.federation != nil {
+		_, _, ok := h.federation.Lookup(id)
+		return ok
+	}
+	return false
+}
 
+// redirectToDevice sends the browser to a device's web interface,
+// logging in automatically when credentials are stored
+func (h *Handlers) redirectToDevice(w http.ResponseWriter, r *http.Request, id string) {
 	device, found := h.config.GetDevice(id)
 	if !found {
+		// Remote devices are opened through the upstream that owns them,
+		// which holds the credentials
+		if h.federation != nil {
+			if u, remoteID, ok := h.federation.Lookup(id); ok {
+				http.Redirect(w, r, u.URL+"/go/"+url.PathEscape(remoteID), http.StatusFound)
+				return
+			}
+		}
 		http.Error(w, "Device not found", http.StatusNotFound)
 		return
 	}
@@ -374,6 +445,12 @@ func (h *Handlers) ServeThumbnail(w http.ResponseWriter, r *http.Request) {
 	log.Printf("ServeThumbnail: request for device %s (path: %s)", id, r.URL.Path)
 
 	thumbPath, found := h.config.GetThumbnailPath(id)
+	if !found && h.federation != nil && strings.Contains(id, ":") {
+		if err := h.federation.CopyThumbnail(w, id); err != nil {
+			http.NotFound(w, r)
+		}
+		return
+	}
 	if !found {
 		log.Printf("ServeThumbnail: thumbnail not found for device %s", id)
 		http.NotFound(w, r)
@@ -386,13 +463,34 @@ func (h *Handlers) ServeThumbnail(w http.ResponseWriter, r *http.Request) {
 
 // DeviceStatus represents the reachability status of a device
 type DeviceStatus struct {
-	ID        string `json:"id"`
-	Reachable bool   `json:"reachable"`
+	ID        string  `json:"id"`
+	Reachable bool    `json:"reachable"`
+	LatencyMS float64 `json:"latency_ms,omitempty"` // TCP connect time, when reachable
+
+	Maintenance *DeviceMaintenance `json:"maintenance,omitempty"` // Set during a maintenance window
 }
 
 // CheckDevicesStatus returns reachability status for all devices (GET /api/status)
 func (h *Handlers) CheckDevicesStatus(w http.ResponseWriter, r *http.Request) {
 	devices := h.config.GetDevices()
+	statuses := checkDevices(devices)
+
+	now := time.Now()
+	for i := range statuses {
+		statuses[i].Maintenance = h.config.deviceMaintenance(devices[i], now)
+	}
+
+	// Upstream statuses come from the last federation sync
+	if h.includeFederated(r) {
+		statuses = append(statuses, h.federation.Statuses()...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// checkDevices tests reachability of every device concurrently
+func checkDevices(devices []Device) []DeviceStatus {
 	statuses := make([]DeviceStatus, len(devices))
 
 	var wg sync.WaitGroup
@@ -400,30 +498,297 @@ func (h *Handlers) CheckDevicesStatus(w http.ResponseWriter, r *http.Request) {
 		wg.Add(1)
 		go func(idx int, d Device) {
 			defer wg.Done()
+			reachable, latency := checkHost(d.Host)
 			statuses[idx] = DeviceStatus{
 				ID:        d.ID,
-				Reachable: checkHostReachable(d.Host),
+				Reachable: reachable,
+			}
+			if reachable {
+				// Tenths of a millisecond are plenty for a dashboard
+				statuses[idx].LatencyMS = float64(latency.Microseconds()/100) / 10
 			}
 		}(i, device)
 	}
 	wg.Wait()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(statuses)
+	return statuses
 }
 
-// checkHostReachable tests if a host is reachable via HTTP or TCP
-func checkHostReachable(host string) bool {
+// checkHost tests if a host is reachable via HTTP or TCP, returning how
+// long the connection took
+func checkHost(host string) (bool, time.Duration) {
 	// Add default port if not specified
 	if !strings.Contains(host, ":") {
 		host = host + ":80"
 	}
 
 	// Try TCP connection with short timeout
+	start := time.Now()
 	conn, err := net.DialTimeout("tcp", host, 2*time.Second)
 	if err != nil {
-		return false
+		return false, 0
 	}
+	latency := time.Since(start)
 	conn.Close()
-	return true
+	return true, latency
+}
+
+// ConfigBackupsHandler routes /api/config/backups requests
+// (GET /api/config/backups, POST /api/config/backups/{id}/restore)
+func (h *Handlers) ConfigBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/config/backups")
+	path = strings.Trim(path, "/")
+
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ListConfigBackups(w, r)
+		return
+	}
+
+	id, action, _ := strings.Cut(path, "/")
+	if action != "restore" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.RestoreConfigBackup(w, r, id)
+}
+
+// ListConfigBackups returns available config snapshots (GET /api/config/backups)
+func (h *Handlers) ListConfigBackups(w http.ResponseWriter, r *http.Request) {
+	backups, err := h.config.ListBackups()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backups)
+}
+
+// RestoreConfigBackup restores a config snapshot (POST /api/config/backups/{id}/restore)
+func (h *Handlers) RestoreConfigBackup(w http.ResponseWriter, r *http.Request, id string) {
+	if err := h.config.RestoreBackup(id); err != nil {
+		switch {
+		case err.Error() == "backup not found":
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case strings.HasPrefix(err.Error(), "invalid backup"):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// RestoreDevice moves a device out of the trash (POST /api/devices/{id}/restore)
+func (h *Handlers) RestoreDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/devices/")
+	id = strings.TrimSuffix(id, "/restore")
+	if id == "" {
+		http.Error(w, "Device ID required", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.config.RestoreDevice(id)
+	if err != nil {
+		if err.Error() == "device not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// TrashHandler routes /api/trash requests
+// (GET /api/trash, DELETE /api/trash, DELETE /api/trash/{id})
+func (h *Handlers) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/trash"), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		if id != "" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		devices := h.config.GetTrashedDevices()
+		if devices == nil {
+			devices = []Device{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+	case http.MethodDelete:
+		if id == "" {
+			n, err := h.config.PurgeTrash()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"purged": n})
+			return
+		}
+		if err := h.config.PurgeDevice(id); err != nil {
+			if err.Error() == "device not found" {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ExportDevices returns all devices as JSON, CSV or YAML
+// (GET /api/devices/export?format=csv|json|yaml&credentials=true)
+func (h *Handlers) ExportDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, err := transferFormat(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withCredentials := r.URL.Query().Get("credentials") == "true"
+	if withCredentials && !h.config.Server.AllowCredentialExport {
+		http.Error(w, "Credential export is disabled (set allow_credential_export in [server])", http.StatusForbidden)
+		return
+	}
+
+	records := exportRecords(h.config.GetDevices(), withCredentials)
+
+	w.Header().Set("Content-Type", transferContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"kvmm-devices.%s\"", format))
+	if err := EncodeDevices(w, format, records); err != nil {
+		log.Printf("ExportDevices: %v", err)
+	}
+}
+
+// ImportDevices creates or updates devices from JSON, CSV or YAML
+// (POST /api/devices/import?format=csv|json|yaml&match=host|alias&dry_run=true)
+func (h *Handlers) ImportDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = formatFromContentType(r.Header.Get("Content-Type"))
+	}
+	format, err := transferFormat(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+	records, err := DecodeDevices(r.Body, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	results, err := h.config.ImportDevices(records, r.URL.Query().Get("match"), dryRun)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "invalid match key") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if importFailed(results) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run": dryRun,
+		"applied": !dryRun && !importFailed(results),
+		"results": results,
+	})
+}
+
+// BatchDevices applies create/update/delete operations atomically
+// (POST /api/devices/batch)
+func (h *Handlers) BatchDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var input struct {
+		Operations []BatchOperation `json:"operations"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(input.Operations) == 0 {
+		http.Error(w, "At least one operation is required", http.StatusBadRequest)
+		return
+	}
+
+	results, committed, err := h.config.ApplyBatch(input.Operations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !committed {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"committed": committed,
+		"results":   results,
+	})
+}
+
+// ListUpstreams reports the sync state of federated upstreams (GET /api/upstreams)
+func (h *Handlers) ListUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	states := []UpstreamState{}
+	if h.federation != nil {
+		states = h.federation.States()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
 }
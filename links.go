@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLinkTTL    = 5 * time.Minute
+	maxLinkTTL        = time.Hour
+	linkKeyFile       = "kvmm-link.key" // Where earlier versions kept the key
+	linkPruneInterval = 10 * time.Minute
+)
+
+// Errors returned by linkSigner.Redeem
+var (
+	errLinkInvalid = errors.New("invalid link")
+	errLinkExpired = errors.New("link expired")
+	errLinkUsed    = errors.New("link already used")
+)
+
+// OneTimeLink is returned by POST /api/devices/{id}/link
+type OneTimeLink struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// linkSigner issues and redeems signed one-time device links. A link
+// carries the device ID, an expiry and a nonce, signed with HMAC-SHA256, so
+// opening it needs no session. Used nonces are recorded in the device store
+// until they expire, so a link can't be opened twice through different
+// replicas.
+type linkSigner struct {
+	key   []byte
+	store DeviceStore
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// linkKeyRecord is the stored signing key
+type linkKeyRecord struct {
+	Key []byte `json:"key"`
+}
+
+// linkNonceRecord marks a nonce as used
+type linkNonceRecord struct {
+	Expires time.Time `json:"expires"`
+}
+
+// newLinkSigner uses the configured link_secret, or a random key kept in
+// the device store so links survive restarts and work on every replica.
+// dir is checked for a key file left by earlier versions.
+func newLinkSigner(secret string, store DeviceStore, dir string) *linkSigner {
+	key := []byte(secret)
+	if secret == "" {
+		key = loadLinkKey(store, filepath.Join(dir, linkKeyFile))
+	}
+	return &linkSigner{key: key, store: store}
+}
+
+// loadLinkKey reads the key from the store, creating it on first use. If
+// the store can't be written the key only lasts until the server restarts.
+func loadLinkKey(store DeviceStore, legacyPath string) []byte {
+	var rec linkKeyRecord
+	err := store.UpdateRecord(linkKeyRecords, "default", func(old []byte) ([]byte, error) {
+		if old != nil && json.Unmarshal(old, &rec) == nil && len(rec.Key) >= 32 {
+			return old, nil
+		}
+		// Keep links signed with an existing key file working
+		if key, err := os.ReadFile(legacyPath); err == nil && len(key) >= 32 {
+			rec.Key = key
+		} else {
+			rec.Key = make([]byte, 32)
+			rand.Read(rec.Key)
+		}
+		return json.Marshal(rec)
+	})
+	if err != nil {
+		log.Printf("Link key: %v; links will stop working on restart (set link_secret)", err)
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key
+	}
+	if err := os.Remove(legacyPath); err == nil {
+		log.Printf("Moved the link key from %s to the device store", legacyPath)
+	}
+	return rec.Key
+}
+
+// Sign returns a token for deviceID that is valid until expires
+func (s *linkSigner) Sign(deviceID string, expires time.Time) string {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	payload := deviceID + "|" + strconv.FormatInt(expires.Unix(), 10) + "|" + base64.RawURLEncoding.EncodeToString(nonce)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + s.sign(payload)
+}
+
+func (s *linkSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignValue returns value with a signature appended, for tokens that are
+// checked against server-side state (e.g. share IDs). purpose keeps a
+// token issued for one use from being accepted for another.
+func (s *linkSigner) SignValue(purpose, value string) string {
+	return value + "." + s.sign(purpose+"|"+value)
+}
+
+// VerifyValue checks a SignValue token and returns its value
+func (s *linkSigner) VerifyValue(purpose, token string) (string, bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", false
+	}
+	value, sig := token[:i], token[i+1:]
+	return value, hmac.Equal([]byte(sig), []byte(s.sign(purpose+"|"+value)))
+}
+
+// Redeem checks a token and marks it used, returning its device ID
+func (s *linkSigner) Redeem(token string) (string, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errLinkInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errLinkInvalid
+	}
+	payload := string(data)
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", errLinkInvalid
+	}
+
+	parts := strings.Split(payload, "|")
+	if len(parts) != 3 {
+		return "", errLinkInvalid
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errLinkInvalid
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errLinkInvalid
+	}
+	expires := time.Unix(unix, 0)
+	now := time.Now()
+	if now.After(expires) {
+		return "", errLinkExpired
+	}
+
+	// Hex keeps the ID usable as a Kubernetes object name
+	used, err := json.Marshal(linkNonceRecord{Expires: expires.UTC()})
+	if err != nil {
+		return "", err
+	}
+	err = s.store.UpdateRecord(linkNonceRecords, hex.EncodeToString(nonce), func(old []byte) ([]byte, error) {
+		if old != nil {
+			return nil, errLinkUsed
+		}
+		return used, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	s.pruneNonces(now)
+	return parts[0], nil
+}
+
+// pruneNonces drops expired nonces from the store, at most every
+// linkPruneInterval
+func (s *linkSigner) pruneNonces(now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastPrune) < linkPruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPrune = now
+	s.mu.Unlock()
+
+	records, err := s.store.ListRecords(linkNonceRecords)
+	if err != nil {
+		log.Printf("Pruning link nonces: %v", err)
+		return
+	}
+	for id, data := range records {
+		var rec linkNonceRecord
+		if json.Unmarshal(data, &rec) == nil && now.Before(rec.Expires) {
+			continue
+		}
+		err := s.store.UpdateRecord(linkNonceRecords, id, func([]byte) ([]byte, error) { return nil, nil })
+		if err != nil {
+			log.Printf("Pruning link nonce %s: %v", id, err)
+		}
+	}
+}
+
+// CreateDeviceLink issues a signed one-time link to a device
+// (POST /api/devices/{id}/link?ttl=5m)
+func (h *Handlers) CreateDeviceLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/link")
+	if !h.deviceExists(id) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	ttl := defaultLinkTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		if d > maxLinkTTL {
+			http.Error(w, fmt.Sprintf("ttl may not exceed %s", maxLinkTTL), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	link := OneTimeLink{
+		URL:       requestBaseURL(r) + "/l/" + h.links.Sign(id, expires),
+		ExpiresAt: expires.UTC(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
+}
+
+// OpenLink redeems a one-time link and redirects to its device (GET /l/{token})
+func (h *Handlers) OpenLink(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/l/")
+	id, err := h.links.Redeem(token)
+	if err != nil {
+		log.Printf("OpenLink: %v from %s", err, r.RemoteAddr)
+		if errors.Is(err, errLinkInvalid) || errors.Is(err, errLinkExpired) || errors.Is(err, errLinkUsed) {
+			http.Error(w, "This link is invalid, expired or has already been used", http.StatusGone)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.redirectToDevice(w, r, id)
+}
+
+// requestBaseURL is the scheme and host the client used to reach us
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
@@ -8,16 +8,27 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 //go:embed static
 var staticFiles embed.FS
 
 func main() {
+	// Completion parses the global flags itself, as the last word may be
+	// a flag still missing its value
+	if len(os.Args) > 1 && os.Args[1] == "__complete" {
+		runComplete(os.Args[2:])
+		return
+	}
+
+	os.Args = parseGlobalFlags(os.Args)
+
 	if len(os.Args) < 2 {
 		// No args = list devices
-		runList()
+		runList(nil)
 		return
 	}
 
@@ -27,7 +38,51 @@ func main() {
 	case "server", "serve":
 		runServer()
 	case "list", "ls":
-		runList()
+		runList(os.Args[2:])
+	case "status":
+		runStatus(os.Args[2:])
+	case "pick":
+		runPick(os.Args[2:])
+	case "show":
+		runShow(os.Args[2:])
+	case "url":
+		runURL(os.Args[2:])
+	case "power":
+		runPower(os.Args[2:])
+	case "sensors":
+		runSensors(os.Args[2:])
+	case "sel":
+		runSEL(os.Args[2:])
+	case "wake":
+		runWake(os.Args[2:])
+	case "bulk":
+		runBulk(os.Args[2:])
+	case "maint", "maintenance":
+		runMaint(os.Args[2:])
+	case "media":
+		runMedia(os.Args[2:])
+	case "add":
+		runAdd(os.Args[2:])
+	case "edit":
+		runEdit(os.Args[2:])
+	case "rm", "remove":
+		runRemove(os.Args[2:])
+	case "config":
+		runConfig(os.Args[2:])
+	case "trash":
+		runTrash(os.Args[2:])
+	case "share":
+		runShare(os.Args[2:])
+	case "store":
+		runStore(os.Args[2:])
+	case "context":
+		runContext(os.Args[2:])
+	case "import":
+		runImport(os.Args[2:])
+	case "export":
+		runExport(os.Args[2:])
+	case "completion":
+		runCompletion(os.Args[2:])
 	case "help", "-h", "--help":
 		printCLIUsage()
 	default:
@@ -55,30 +110,147 @@ func runServer() {
 		cfg.Server.Port = *portOverride
 	}
 
+	if !cfg.mediaDirShared() {
+		log.Printf("Warning: %v", errMediaNotShared)
+	}
+
+	// Pick up inventory changes made outside this process
+	go cfg.WatchStore(nil)
+
+	// Poll device status for events and webhooks, and purge expired devices
+	// from the trash; in a cluster only the lease holder does so
+	poller := NewStatusPoller(cfg)
+	janitor := NewTrashJanitor(cfg)
+	startLeader := func() {
+		poller.Start()
+		janitor.Start()
+	}
+	stopLeader := func() {
+		janitor.Stop()
+		poller.Stop()
+	}
+	if cfg.Server.Cluster.Enabled {
+		elector, err := NewElector(cfg, startLeader, stopLeader)
+		if err != nil {
+			log.Fatalf("Failed to start cluster mode: %v", err)
+		}
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			elector.Run(stop)
+			close(done)
+		}()
+		// Hand the lease over promptly on shutdown instead of waiting for
+		// it to expire
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			close(stop)
+			<-done
+			os.Exit(0)
+		}()
+	} else {
+		startLeader()
+	}
+
+	// Pull devices from other kvmm servers
+	federation, err := NewFederation(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure upstreams: %v", err)
+	}
+	go federation.Run()
+
 	// Create handlers
-	handlers := NewHandlers(cfg)
+	handlers := NewHandlers(cfg, federation)
 
 	// Setup routes
 	mux := http.NewServeMux()
 
 	// API routes
 	mux.HandleFunc("/api/devices", handlers.DevicesHandler)
+	mux.HandleFunc("/api/devices/export", handlers.ExportDevices)
+	mux.HandleFunc("/api/devices/import", handlers.ImportDevices)
+	mux.HandleFunc("/api/devices/batch", handlers.BatchDevices)
+	mux.HandleFunc("/api/devices/search", handlers.SearchDevices)
 	mux.HandleFunc("/api/devices/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/thumbnail") {
 			handlers.ThumbnailHandler(w, r)
 			return
 		}
+		if strings.HasSuffix(r.URL.Path, "/restore") {
+			handlers.RestoreDevice(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/link") {
+			handlers.CreateDeviceLink(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/share") {
+			handlers.CreateShare(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/power") {
+			handlers.PowerHandler(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/sensors") {
+			handlers.SensorsHandler(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/sel") {
+			handlers.SELHandler(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/wake") {
+			handlers.WakeDevice(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/media") {
+			handlers.DeviceMediaHandler(w, r)
+			return
+		}
 		handlers.DevicesHandler(w, r)
 	})
 
+	// Trash routes
+	mux.HandleFunc("/api/trash", handlers.TrashHandler)
+	mux.HandleFunc("/api/trash/", handlers.TrashHandler)
+
 	// Thumbnail serving route
 	mux.HandleFunc("/thumbnails/", handlers.ServeThumbnail)
 
+	// Config backup routes
+	mux.HandleFunc("/api/config/backups", handlers.ConfigBackupsHandler)
+	mux.HandleFunc("/api/config/backups/", handlers.ConfigBackupsHandler)
+
 	// Device status route
 	mux.HandleFunc("/api/status", handlers.CheckDevicesStatus)
 
+	// Bulk power, wake and snapshot actions
+	mux.HandleFunc("/api/actions", handlers.ActionsHandler)
+
+	// Maintenance windows
+	mux.HandleFunc("/api/maintenance", handlers.MaintenanceHandler)
+	mux.HandleFunc("/api/maintenance/", handlers.MaintenanceHandler)
+
+	// ISO library
+	mux.HandleFunc("/api/media", handlers.MediaHandler)
+	mux.HandleFunc("/api/media/", handlers.MediaHandler)
+
+	// Federation status
+	mux.HandleFunc("/api/upstreams", handlers.ListUpstreams)
+
+	// Server-sent device and status events
+	mux.HandleFunc("/api/events", handlers.Events)
+
 	// KVM redirect route
 	mux.HandleFunc("/go/", handlers.GoToDevice)
+	mux.HandleFunc("/l/", handlers.OpenLink)
+	mux.HandleFunc("/s/", handlers.OpenShare)
+
+	// Share management
+	mux.HandleFunc("/api/shares", handlers.SharesHandler)
+	mux.HandleFunc("/api/shares/", handlers.SharesHandler)
 
 	// Static files (embedded)
 	staticFS, err := fs.Sub(staticFiles, "static")
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maintenanceRetention is how long ended windows are kept for reference
+const maintenanceRetention = 7 * 24 * time.Hour
+
+var errMaintenanceNotFound = errors.New("maintenance window not found")
+
+// MaintenanceWindow marks devices as down on purpose between Start and End.
+// They show as in maintenance in /api/status and don't trigger webhooks.
+type MaintenanceWindow struct {
+	ID        string         `toml:"id" json:"id"`
+	Selector  DeviceSelector `toml:"selector" json:"selector"`
+	Start     time.Time      `toml:"start" json:"start"`
+	End       time.Time      `toml:"end" json:"end"`
+	Reason    string         `toml:"reason,omitempty" json:"reason,omitempty"`
+	Author    string         `toml:"author,omitempty" json:"author,omitempty"`
+	CreatedAt time.Time      `toml:"created_at" json:"created_at"`
+	State     string         `toml:"-" json:"state"` // "scheduled", "active" or "ended"
+}
+
+// MaintenanceRequest is the body of POST /api/maintenance. End may be given
+// directly or as a duration from Start, which defaults to now.
+type MaintenanceRequest struct {
+	Selector DeviceSelector `json:"selector"`
+	Start    *time.Time     `json:"start"`
+	End      *time.Time     `json:"end"`
+	Duration string         `json:"duration"` // e.g. "2h"
+	Reason   string         `json:"reason"`
+	Author   string         `json:"author"` // Defaults to the client's address
+}
+
+// DeviceMaintenance is the window a device is in, as shown by /api/status
+type DeviceMaintenance struct {
+	ID     string    `json:"id"`
+	Reason string    `json:"reason,omitempty"`
+	Author string    `json:"author,omitempty"`
+	End    time.Time `json:"end"`
+}
+
+// state reports where a window is in its life
+func (m MaintenanceWindow) state(now time.Time) string {
+	switch {
+	case now.Before(m.Start):
+		return "scheduled"
+	case now.Before(m.End):
+		return "active"
+	}
+	return "ended"
+}
+
+// GetMaintenance returns the maintenance windows, soonest first
+func (c *Config) GetMaintenance() []MaintenanceWindow {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	windows := make([]MaintenanceWindow, len(c.Maintenance))
+	for i, m := range c.Maintenance {
+		m.State = m.state(now)
+		windows[i] = m
+	}
+	sort.SliceStable(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	return windows
+}
+
+// AddMaintenance stores a new maintenance window, dropping long-ended ones.
+// Windows are records in the device store rather than part of config.toml,
+// so every replica sharing the store sees them.
+func (c *Config) AddMaintenance(m MaintenanceWindow) error {
+	c.backupMaintenance()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = c.store.UpdateRecord(maintenanceRecords, m.ID, func(old []byte) ([]byte, error) {
+		if old != nil {
+			return nil, fmt.Errorf("maintenance window %s already exists", m.ID)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, w := range c.GetMaintenance() {
+		if time.Since(w.End) < maintenanceRetention {
+			continue
+		}
+		err := c.store.UpdateRecord(maintenanceRecords, w.ID, func([]byte) ([]byte, error) { return nil, nil })
+		if err != nil {
+			log.Printf("AddMaintenance: dropping window %s: %v", w.ID, err)
+		}
+	}
+	return c.loadMaintenance()
+}
+
+// EndMaintenance ends an active window now. A window that hasn't started is
+// removed, and one that has already ended is left alone.
+func (c *Config) EndMaintenance(id string) (MaintenanceWindow, error) {
+	c.backupMaintenance()
+	var m MaintenanceWindow
+	err := c.store.UpdateRecord(maintenanceRecords, id, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, errMaintenanceNotFound
+		}
+		if err := json.Unmarshal(old, &m); err != nil {
+			return nil, fmt.Errorf("decoding maintenance window %s: %w", id, err)
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		switch m.state(now) {
+		case "ended":
+			return old, nil
+		case "scheduled":
+			return nil, nil
+		}
+		m.End = now
+		return json.Marshal(m)
+	})
+	if err != nil {
+		return MaintenanceWindow{}, err
+	}
+	m.State = "ended"
+	return m, c.loadMaintenance()
+}
+
+// replaceMaintenance makes windows the only ones in the store
+func (c *Config) replaceMaintenance(windows []MaintenanceWindow) error {
+	keep := make(map[string]bool, len(windows))
+	for _, m := range windows {
+		keep[m.ID] = true
+		m.State = ""
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		err = c.store.UpdateRecord(maintenanceRecords, m.ID, func([]byte) ([]byte, error) { return data, nil })
+		if err != nil {
+			return err
+		}
+	}
+	current, err := c.store.ListRecords(maintenanceRecords)
+	if err != nil {
+		return err
+	}
+	for id := range current {
+		if keep[id] {
+			continue
+		}
+		err := c.store.UpdateRecord(maintenanceRecords, id, func([]byte) ([]byte, error) { return nil, nil })
+		if err != nil {
+			return err
+		}
+	}
+	c.refreshMaintenance()
+	return nil
+}
+
+// backupMaintenance snapshots the config before windows change, as saves
+// and device commits do
+func (c *Config) backupMaintenance() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.snapshot(); err != nil {
+		log.Printf("Maintenance: failed to back up config: %v", err)
+	}
+}
+
+// loadMaintenance replaces the in-memory windows with the store's
+func (c *Config) loadMaintenance() error {
+	records, err := c.store.ListRecords(maintenanceRecords)
+	if err != nil {
+		return fmt.Errorf("loading maintenance windows: %w", err)
+	}
+	windows := make([]MaintenanceWindow, 0, len(records))
+	for id, data := range records {
+		var m MaintenanceWindow
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Printf("Skipping maintenance window %s: %v", id, err)
+			continue
+		}
+		m.State = ""
+		windows = append(windows, m)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].CreatedAt.Before(windows[j].CreatedAt) })
+
+	c.mu.Lock()
+	c.Maintenance = windows
+	c.mu.Unlock()
+	return nil
+}
+
+// refreshMaintenance reloads windows changed by another replica and tells
+// SSE clients
+func (c *Config) refreshMaintenance() {
+	before := c.GetMaintenance()
+	if err := c.loadMaintenance(); err != nil {
+		log.Printf("WatchStore: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(before, c.GetMaintenance()) {
+		c.events.Publish(Event{Type: "maintenance", Data: nil})
+	}
+}
+
+// importMaintenance moves windows from a [[maintenance]] section of
+// config.toml, where earlier versions kept them, into the store
+func (c *Config) importMaintenance(windows []MaintenanceWindow) error {
+	for _, m := range windows {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		err = c.store.UpdateRecord(maintenanceRecords, m.ID, func(old []byte) ([]byte, error) {
+			if old != nil {
+				return old, nil
+			}
+			return data, nil
+		})
+		if err != nil {
+			return fmt.Errorf("importing maintenance window %s: %w", m.ID, err)
+		}
+	}
+	log.Printf("Moved %d maintenance windows from %s to the %s store", len(windows), c.filePath, c.storeKind())
+	return nil
+}
+
+// deviceMaintenance returns the active window covering a device, if any.
+// With overlapping windows, the one ending last wins.
+func (c *Config) deviceMaintenance(d Device, now time.Time) *DeviceMaintenance {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var found *DeviceMaintenance
+	for _, m := range c.Maintenance {
+		if m.state(now) != "active" || !m.Selector.matches(d) {
+			continue
+		}
+		if found == nil || m.End.After(found.End) {
+			found = &DeviceMaintenance{ID: m.ID, Reason: m.Reason, Author: m.Author, End: m.End}
+		}
+	}
+	return found
+}
+
+// MaintenanceHandler lists, creates and ends maintenance windows
+// (GET/POST /api/maintenance, GET/DELETE /api/maintenance/{id})
+func (h *Handlers) MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/maintenance"), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			windows := h.config.GetMaintenance()
+			if r.URL.Query().Get("all") != "true" {
+				current := []MaintenanceWindow{}
+				for _, m := range windows {
+					if m.State != "ended" {
+						current = append(current, m)
+					}
+				}
+				windows = current
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(windows)
+		case http.MethodPost:
+			h.createMaintenance(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, m := range h.config.GetMaintenance() {
+			if m.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(m)
+				return
+			}
+		}
+		http.Error(w, "Maintenance window not found", http.StatusNotFound)
+	case http.MethodDelete:
+		m, err := h.config.EndMaintenance(id)
+		if errors.Is(err, errMaintenanceNotFound) {
+			http.Error(w, "Maintenance window not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Maintenance window %s ended by %s", id, clientIP(r))
+		h.config.events.Publish(Event{Type: "maintenance", Data: m})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createMaintenance validates and stores a new window (POST /api/maintenance)
+func (h *Handlers) createMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Selector.empty() {
+		http.Error(w, "selector must list ids or tags", http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(req.Selector.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	m := MaintenanceWindow{
+		ID:        uuid.New().String(),
+		Selector:  DeviceSelector{IDs: req.Selector.IDs, Tags: normalizeTags(req.Selector.Tags)},
+		Start:     now,
+		Reason:    strings.TrimSpace(req.Reason),
+		Author:    strings.TrimSpace(req.Author),
+		CreatedAt: now,
+	}
+	if req.Start != nil && req.Start.After(now) {
+		m.Start = req.Start.UTC()
+	}
+	switch {
+	case req.End != nil && req.Duration != "":
+		http.Error(w, "Give either end or duration", http.StatusBadRequest)
+		return
+	case req.End != nil:
+		m.End = req.End.UTC()
+	case req.Duration != "":
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		m.End = m.Start.Add(d)
+	default:
+		http.Error(w, "end or duration is required", http.StatusBadRequest)
+		return
+	}
+	if !m.End.After(m.Start) {
+		http.Error(w, "end must be after start", http.StatusBadRequest)
+		return
+	}
+	if m.Author == "" {
+		m.Author = clientIP(r)
+	}
+
+	if err := h.config.AddMaintenance(m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.State = m.state(now)
+	log.Printf("Maintenance window %s for %s from %s to %s (%q) by %s", m.ID, describeSelector(m.Selector),
+		m.Start.Format(time.RFC3339), m.End.Format(time.RFC3339), m.Reason, m.Author)
+	h.config.events.Publish(Event{Type: "maintenance", Data: m})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+// describeSelector summarises a selector for logs
+func describeSelector(s DeviceSelector) string {
+	var parts []string
+	if len(s.Tags) > 0 {
+		parts = append(parts, "tags "+strings.Join(s.Tags, "+"))
+	}
+	if len(s.IDs) > 0 {
+		parts = append(parts, fmt.Sprintf("%d devices", len(s.IDs)))
+	}
+	return strings.Join(parts, " and ")
+}
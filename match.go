@@ -0,0 +1,251 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Match scores, out of 100
+const (
+	scoreExact     = 100
+	scoreIDPrefix  = 95
+	scorePrefix    = 90
+	scoreWordStart = 85 // Query found at the start of a word
+	scoreContains  = 80
+	scoreWords     = 75 // Every query word matches a field word, in order
+	scoreScattered = 55 // Query letters appear in order
+	scoreTypo      = 50
+	scoreMinimum   = 30 // Weaker matches are dropped
+
+	// How far ahead the top result must be to be opened without asking
+	clearWinnerMargin = 15
+)
+
+// DeviceMatch is a device ranked against a search query
+type DeviceMatch struct {
+	Device
+	Score   int    `json:"score"`
+	Matched string `json:"matched"` // Field that matched: alias, host, site, tag or id
+}
+
+// SearchResponse is returned by GET /api/devices/search
+type SearchResponse struct {
+	Query   string        `json:"query"`
+	Results []DeviceMatch `json:"results"`
+	Best    string        `json:"best,omitempty"` // ID of a clear winner, if any
+}
+
+// searchDevices ranks devices against query, best first. "site/query"
+// restricts the search to one federated site.
+func searchDevices(devices []Device, query string) SearchResponse {
+	resp := SearchResponse{Query: query, Results: []DeviceMatch{}}
+
+	q := strings.ToLower(strings.TrimSpace(query))
+	if site, rest, ok := strings.Cut(q, "/"); ok && site != "" {
+		var filtered []Device
+		for _, d := range devices {
+			if strings.ToLower(d.Site) == site {
+				filtered = append(filtered, d)
+			}
+		}
+		devices, q = filtered, strings.TrimSpace(rest)
+	}
+	if q == "" {
+		return resp
+	}
+
+	for _, d := range devices {
+		if m, ok := matchDevice(d, q); ok {
+			resp.Results = append(resp.Results, m)
+		}
+	}
+	sort.SliceStable(resp.Results, func(i, j int) bool {
+		return resp.Results[i].Score > resp.Results[j].Score
+	})
+
+	if r := resp.Results; len(r) > 0 && isClearWinner(r) {
+		resp.Best = r[0].ID
+	}
+	return resp
+}
+
+// isClearWinner reports whether the top result should be opened without
+// asking: the only match, the only exact match, or well ahead of the
+// runner-up
+func isClearWinner(results []DeviceMatch) bool {
+	if len(results) == 1 {
+		return true
+	}
+	top, next := results[0].Score, results[1].Score
+	if top == scoreExact {
+		return next < scoreExact
+	}
+	return top-next >= clearWinnerMargin
+}
+
+// matchDevice scores a device by its best matching field
+func matchDevice(d Device, q string) (DeviceMatch, bool) {
+	best := DeviceMatch{Device: d}
+
+	type field struct {
+		name, value string
+		weight      int // Percent
+	}
+	fields := []field{
+		{"alias", d.Alias, 100},
+		{"host", d.Host, 100},
+		{"site", d.Site, 70},
+	}
+	for _, tag := range d.Tags {
+		fields = append(fields, field{"tag", tag, 80})
+	}
+	for _, f := range fields {
+		if s := scoreField(q, strings.ToLower(f.value)) * f.weight / 100; s > best.Score {
+			best.Score, best.Matched = s, f.name
+		}
+	}
+
+	// IDs are only matched by prefix, e.g. the first characters of a UUID
+	if len(q) >= 4 && strings.HasPrefix(strings.ToLower(d.ID), q) && scoreIDPrefix > best.Score {
+		best.Score, best.Matched = scoreIDPrefix, "id"
+	}
+
+	return best, best.Score >= scoreMinimum
+}
+
+// scoreField scores a lower-cased query against a lower-cased field
+func scoreField(q, field string) int {
+	if q == "" || field == "" {
+		return 0
+	}
+
+	switch {
+	case field == q:
+		return scoreExact
+	case strings.HasPrefix(field, q):
+		return scorePrefix
+	}
+
+	words := splitWords(field)
+	for _, w := range words {
+		if strings.HasPrefix(w, q) {
+			return scoreWordStart
+		}
+	}
+	if strings.Contains(field, q) {
+		return scoreContains
+	}
+
+	best := 0
+	if s := scoreWordsInOrder(splitWords(q), words); s > best {
+		best = s
+	}
+	if isSubsequence(q, field) && scoreScattered > best {
+		best = scoreScattered
+	}
+	if d := editDistance(q, field); d <= typoTolerance(q) {
+		if s := scoreTypo - 10*d; s > best {
+			best = s
+		}
+	}
+	return best
+}
+
+// scoreWordsInOrder matches each query word to a later field word: by
+// prefix, by abbreviation ("srv" for "server") or with a typo. The score is
+// scoreWords scaled by how well the words matched.
+func scoreWordsInOrder(qWords, fWords []string) int {
+	if len(qWords) == 0 || len(qWords) > len(fWords) {
+		return 0
+	}
+
+	total, next := 0, 0
+	for _, qw := range qWords {
+		matched := false
+		for ; next < len(fWords); next++ {
+			fw := fWords[next]
+			var s int
+			switch {
+			case strings.HasPrefix(fw, qw):
+				s = 100
+			case qw[0] == fw[0] && isSubsequence(qw, fw):
+				s = 80
+			case editDistance(qw, fw) <= typoTolerance(qw):
+				s = 60
+			default:
+				continue
+			}
+			total += s
+			matched = true
+			next++
+			break
+		}
+		if !matched {
+			return 0
+		}
+	}
+	return scoreWords * total / (100 * len(qWords))
+}
+
+// typoTolerance is how many edits a query of this length may contain
+func typoTolerance(q string) int {
+	switch n := len([]rune(q)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// splitWords splits on anything that isn't a letter or digit
+func splitWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// isSubsequence reports whether the characters of query appear in text in order
+func isSubsequence(query, text string) bool {
+	t := []rune(text)
+	i := 0
+	for _, r := range query {
+		for i < len(t) && t[i] != r {
+			i++
+		}
+		if i == len(t) {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// editDistance is the optimal string alignment distance: insertions,
+// deletions, substitutions and adjacent transpositions each cost one
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+var matchFleet = []Device{
+	{ID: "3b1d0c2e-server-room", Alias: "Server Room KVM", Host: "10.0.1.5"},
+	{ID: "0a9e4f7d-server-rack", Alias: "Server Rack B", Host: "10.0.1.6"},
+	{ID: "c41f2b88-db-primary", Alias: "db-primary", Host: "10.0.2.10", Tags: []string{"postgres", "rack3"}},
+	{ID: "7f3c9a10-lab-switch", Alias: "Lab Switch", Host: "pikvm-lab.local"},
+	{ID: "e2d5b7a1-web-1", Alias: "web-1", Host: "10.0.3.1", Site: "fra1"},
+	{ID: "9c8b7a65-web-2", Alias: "web-2", Host: "10.0.3.2", Site: "ams1"},
+}
+
+func TestSearchDevices(t *testing.T) {
+	for _, tc := range []struct {
+		query   string
+		first   string // ID of the top result
+		matched string
+		best    bool // Opened without asking
+	}{
+		{"Server Room KVM", "3b1d0c2e-server-room", "alias", true},
+		{"srv rm", "3b1d0c2e-server-room", "alias", true},    // Abbreviated words
+		{"lab swtich", "7f3c9a10-lab-switch", "alias", true}, // One typo
+		{"pikvm-lab", "7f3c9a10-lab-switch", "host", true},
+		{"postgres", "c41f2b88-db-primary", "tag", true},
+		{"7f3c", "7f3c9a10-lab-switch", "id", true},
+		{"web-1", "e2d5b7a1-web-1", "alias", true}, // Exact beats a near miss
+		{"web", "e2d5b7a1-web-1", "alias", false},  // Two equally good matches
+		{"server", "3b1d0c2e-server-room", "alias", false},
+		{"ams1/web", "9c8b7a65-web-2", "alias", true}, // Restricted to one site
+	} {
+		resp := searchDevices(matchFleet, tc.query)
+		if len(resp.Results) == 0 {
+			t.Errorf("%q: no results", tc.query)
+			continue
+		}
+		top := resp.Results[0]
+		if top.ID != tc.first || top.Matched != tc.matched {
+			t.Errorf("%q: top result %s (%s, score %d), want %s (%s)", tc.query, top.ID, top.Matched, top.Score, tc.first, tc.matched)
+		}
+		if got := resp.Best != ""; got != tc.best || (got && resp.Best != tc.first) {
+			t.Errorf("%q: best = %q, want opened without asking: %v", tc.query, resp.Best, tc.best)
+		}
+	}
+}
+
+func TestSearchDevicesNoMatch(t *testing.T) {
+	for _, query := range []string{"", "   ", "zzzz", "7f3", "nowhere/web"} {
+		if resp := searchDevices(matchFleet, query); len(resp.Results) != 0 || resp.Best != "" {
+			t.Errorf("%q matched %+v", query, resp.Results)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"switch", "switch", 0},
+		{"swtich", "switch", 1}, // Adjacent transposition
+		{"swich", "switch", 1},
+		{"kvm", "", 3},
+		{"rack", "rm", 3},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
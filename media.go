@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	checksumSuffix        = ".sha256" // Checksum files beside each image, as written by sha256sum
+	maxMediaNameLength    = 255
+	mediaProgressInterval = time.Second // Progress events are published at most this often
+	mediaProgressTTL      = time.Minute // How long other replicas relay and keep a transfer's progress
+)
+
+var (
+	errMediaNotFound    = errors.New("image not found in the library")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errMediaNotShared   = errors.New("virtual media is disabled: in a cluster on the Kubernetes store, media_dir must be a volume shared by every replica")
+)
+
+// MediaImage is an image in the server's ISO library
+type MediaImage struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"` // Empty for images copied into the directory by hand
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// MediaState is a device's virtual drive (GET /api/devices/{id}/media)
+type MediaState struct {
+	Image     string        `json:"image,omitempty"` // The selected image, if any
+	Connected bool          `json:"connected"`       // Presented to the host
+	CDROM     bool          `json:"cdrom"`
+	RW        bool          `json:"rw"`
+	Busy      bool          `json:"busy"`
+	Free      int64         `json:"free"`   // Bytes left on the device's storage
+	Stored    []StoredImage `json:"stored"` // Images already on the device
+}
+
+// StoredImage is an image kept on a device's own storage
+type StoredImage struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Complete bool   `json:"complete"`
+}
+
+// MediaRequest is the body of POST /api/devices/{id}/media
+type MediaRequest struct {
+	Image string `json:"image"` // Name in the library
+	CDROM *bool  `json:"cdrom"` // Present as a CD-ROM (default: for .iso images) or a flash drive
+	RW    bool   `json:"rw"`    // Let the host write to a flash drive image
+	Force bool   `json:"force"` // Upload even if the device has an image of that name and size
+}
+
+// MediaResponse is returned by POST /api/devices/{id}/media
+type MediaResponse struct {
+	ID       string     `json:"id"`
+	Image    string     `json:"image"`
+	Uploaded bool       `json:"uploaded"` // False if the device already had the image
+	State    MediaState `json:"state"`
+}
+
+// MediaProgress is published on the event stream as "media" events while an
+// image is received into the library or uploaded to a device
+type MediaProgress struct {
+	ID    string `json:"id,omitempty"` // The device, for uploads to one
+	Image string `json:"image"`
+	Stage string `json:"stage"` // "receiving" or "uploading", then "stored", "attached" or "failed"
+	Bytes int64  `json:"bytes"`
+	Total int64  `json:"total"` // 0 if unknown
+	Error string `json:"error,omitempty"`
+}
+
+// progressReader tells progress how many bytes have been read through it
+type progressReader struct {
+	r        io.Reader
+	n        int64
+	progress func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if n > 0 && p.progress != nil {
+		p.progress(p.n)
+	}
+	return n, err
+}
+
+// validateMediaName accepts plain file names, as images are stored by name
+// both here and on the devices
+func validateMediaName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("image name is required")
+	case len(name) > maxMediaNameLength:
+		return fmt.Errorf("image name is longer than %d characters", maxMediaNameLength)
+	case strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, "."):
+		return fmt.Errorf("invalid image name %q", name)
+	case strings.HasSuffix(name, checksumSuffix):
+		return fmt.Errorf("image names cannot end in %s", checksumSuffix)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("invalid image name %q", name)
+		}
+	}
+	return nil
+}
+
+// mediaLibrary keeps images as files in a directory, each with a
+// sha256sum-style checksum file beside it. Uploads are streamed to a
+// temporary file and renamed into place, so a partial upload is never
+// listed.
+type mediaLibrary struct {
+	dir string
+}
+
+func newMediaLibrary(dir string) *mediaLibrary {
+	return &mediaLibrary{dir: dir}
+}
+
+func (l *mediaLibrary) path(name string) string {
+	return filepath.Join(l.dir, name)
+}
+
+// List returns the images in the library by name
+func (l *mediaLibrary) List() ([]MediaImage, error) {
+	entries, err := os.ReadDir(l.dir)
+	if os.IsNotExist(err) {
+		return []MediaImage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	images := []MediaImage{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || validateMediaName(name) != nil {
+			continue
+		}
+		if img, err := l.Get(name); err == nil {
+			images = append(images, img)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+// Get describes one image
+func (l *mediaLibrary) Get(name string) (MediaImage, error) {
+	if validateMediaName(name) != nil {
+		return MediaImage{}, errMediaNotFound
+	}
+	info, err := os.Stat(l.path(name))
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+		return MediaImage{}, errMediaNotFound
+	}
+	if err != nil {
+		return MediaImage{}, err
+	}
+	img := MediaImage{Name: name, Size: info.Size(), UploadedAt: info.ModTime().UTC()}
+
+	// A checksum older than the image is for whatever it replaced
+	sumPath := l.path(name) + checksumSuffix
+	if sumInfo, err := os.Stat(sumPath); err == nil && !sumInfo.ModTime().Before(info.ModTime()) {
+		if data, err := os.ReadFile(sumPath); err == nil {
+			if fields := strings.Fields(string(data)); len(fields) > 0 {
+				img.SHA256 = fields[0]
+			}
+		}
+	}
+	return img, nil
+}
+
+// Open opens an image for reading
+func (l *mediaLibrary) Open(name string) (*os.File, error) {
+	if validateMediaName(name) != nil {
+		return nil, errMediaNotFound
+	}
+	f, err := os.Open(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, errMediaNotFound
+	}
+	return f, err
+}
+
+// Save streams an image into the library, replacing any of the same name.
+// If expected is set, the image is only kept if its SHA-256 matches.
+func (l *mediaLibrary) Save(name string, r io.Reader, expected string, progress func(n int64)) (MediaImage, error) {
+	if err := validateMediaName(name); err != nil {
+		return MediaImage{}, err
+	}
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return MediaImage{}, fmt.Errorf("creating media dir: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(l.dir, ".upload-*")
+	if err != nil {
+		return MediaImage{}, err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), &progressReader{r: r, progress: progress}); err != nil {
+		tmp.Close()
+		return MediaImage{}, fmt.Errorf("receiving %s: %w", name, err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return MediaImage{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return MediaImage{}, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if expected != "" && !strings.EqualFold(expected, sum) {
+		return MediaImage{}, fmt.Errorf("%w: %s has SHA-256 %s", errChecksumMismatch, name, sum)
+	}
+
+	if err := os.Rename(tmp.Name(), l.path(name)); err != nil {
+		return MediaImage{}, err
+	}
+	if err := writeFileAtomic(l.path(name)+checksumSuffix, []byte(sum+"  "+name+"\n")); err != nil {
+		log.Printf("Writing checksum of %s: %v", name, err)
+	}
+	return l.Get(name)
+}
+
+// Delete removes an image and its checksum
+func (l *mediaLibrary) Delete(name string) error {
+	if validateMediaName(name) != nil {
+		return errMediaNotFound
+	}
+	err := os.Remove(l.path(name))
+	if os.IsNotExist(err) {
+		return errMediaNotFound
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(l.path(name) + checksumSuffix)
+	return nil
+}
+
+// mediaTransfer publishes the progress of one transfer into the library or
+// onto a device as "media" events
+type mediaTransfer struct {
+	config   *Config
+	id       string // Names the transfer's record in the store
+	progress MediaProgress
+	last     time.Time
+}
+
+func (h *Handlers) newMediaTransfer(p MediaProgress) *mediaTransfer {
+	return &mediaTransfer{config: h.config, id: uuid.NewString(), progress: p}
+}
+
+// update publishes the byte count, at most once per mediaProgressInterval
+func (t *mediaTransfer) update(n int64) {
+	if time.Since(t.last) < mediaProgressInterval {
+		return
+	}
+	t.last = time.Now()
+	t.progress.Bytes = n
+	t.config.publishMedia(t.id, t.progress)
+}
+
+// done publishes the final stage of a transfer of size bytes
+func (t *mediaTransfer) done(stage string, size int64) {
+	t.progress.Stage, t.progress.Bytes, t.progress.Total = stage, size, size
+	t.config.publishMedia(t.id, t.progress)
+}
+
+func (t *mediaTransfer) failed(err error) {
+	t.progress.Stage, t.progress.Error = "failed", err.Error()
+	t.config.publishMedia(t.id, t.progress)
+}
+
+// mediaProgressRecord is a transfer's latest progress, kept in the store so
+// replicas other than the one doing the transfer can publish it too
+type mediaProgressRecord struct {
+	MediaProgress
+	Time time.Time `json:"time"`
+}
+
+// publishMedia publishes a transfer's progress to this replica's clients
+// and, in a cluster, records it in the store for the other replicas
+func (c *Config) publishMedia(id string, p MediaProgress) {
+	c.events.Publish(Event{Type: "media", Data: p})
+	if !c.Server.Cluster.Enabled {
+		return
+	}
+
+	now := time.Now().UTC()
+	data, err := json.Marshal(mediaProgressRecord{MediaProgress: p, Time: now})
+	if err != nil {
+		return
+	}
+	c.mediaMu.Lock()
+	if c.mediaLocal == nil {
+		c.mediaLocal = make(map[string]bool)
+	}
+	c.mediaLocal[id] = true // Already published here
+	c.mediaMu.Unlock()
+	err = c.store.UpdateRecord(mediaProgressRecords, id, func([]byte) ([]byte, error) { return data, nil })
+	if err != nil {
+		log.Printf("Media progress of %s not shared with other replicas: %v", p.Image, err)
+	}
+
+	// Finished transfers clean up after the ones before them
+	if p.Stage != "receiving" && p.Stage != "uploading" {
+		records, err := c.store.ListRecords(mediaProgressRecords)
+		if err != nil {
+			return
+		}
+		for rid, data := range records {
+			var r mediaProgressRecord
+			if json.Unmarshal(data, &r) == nil && now.Sub(r.Time) < mediaProgressTTL {
+				continue
+			}
+			c.store.UpdateRecord(mediaProgressRecords, rid, func([]byte) ([]byte, error) { return nil, nil })
+			c.mediaMu.Lock()
+			delete(c.mediaLocal, rid)
+			c.mediaMu.Unlock()
+		}
+	}
+}
+
+// relayMediaProgress publishes media progress that other replicas recorded
+// in the store since the last call. Records older than mediaProgressTTL,
+// such as those found at startup, are not replayed.
+func (c *Config) relayMediaProgress() {
+	records, err := c.store.ListRecords(mediaProgressRecords)
+	if err != nil {
+		log.Printf("WatchStore: %v", err)
+		return
+	}
+	now := time.Now()
+
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+	if c.mediaSeen == nil {
+		c.mediaSeen = make(map[string]string)
+	}
+	for id := range c.mediaSeen {
+		if _, ok := records[id]; !ok {
+			delete(c.mediaSeen, id)
+		}
+	}
+	for id, data := range records {
+		if c.mediaLocal[id] || c.mediaSeen[id] == string(data) {
+			continue
+		}
+		c.mediaSeen[id] = string(data)
+		var r mediaProgressRecord
+		if err := json.Unmarshal(data, &r); err != nil || now.Sub(r.Time) > mediaProgressTTL {
+			continue
+		}
+		c.events.Publish(Event{Type: "media", Data: r.MediaProgress})
+	}
+}
+
+// mediaDirShared reports whether every replica sees the same ISO library.
+// Replicas of a TOML cluster share the config directory, and media/ in it;
+// on the Kubernetes store media_dir has to name a shared volume.
+func (c *Config) mediaDirShared() bool {
+	return !c.Server.Cluster.Enabled || c.storeKind() != "kubernetes" || c.Server.MediaDir != ""
+}
+
+// MediaHandler manages the ISO library (GET /api/media,
+// GET/PUT/DELETE /api/media/{name}). PUT streams the request body to disk;
+// ?sha256= rejects the upload unless it matches.
+func (h *Handlers) MediaHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/media"), "/")
+	if !h.config.mediaDirShared() {
+		http.Error(w, errMediaNotShared.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		images, err := h.media.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(images)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		img, err := h.media.Get(name)
+		if errors.Is(err, errMediaNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(img)
+	case http.MethodPut:
+		if err := validateMediaName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		transfer := h.newMediaTransfer(MediaProgress{Image: name, Stage: "receiving", Total: max(r.ContentLength, 0)})
+		img, err := h.media.Save(name, r.Body, r.URL.Query().Get("sha256"), transfer.update)
+		if err != nil {
+			transfer.failed(err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, errChecksumMismatch) {
+				status = http.StatusUnprocessableEntity
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Printf("Image %s (%d bytes, sha256 %s) uploaded by %s", img.Name, img.Size, img.SHA256, clientIP(r))
+		transfer.done("stored", img.Size)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(img)
+	case http.MethodDelete:
+		err := h.media.Delete(name)
+		if errors.Is(err, errMediaNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Image %s deleted by %s", name, clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DeviceMediaHandler shows, attaches and ejects a device's virtual drive
+// (GET/POST/DELETE /api/devices/{id}/media). POST uploads the library image
+// unless the device already has it, then connects it to the host; it
+// answers once done, and is cancelled if the client goes away.
+func (h *Handlers) DeviceMediaHandler(w http.ResponseWriter, r *http.Request) {
+	device, ctrl, ok := h.deviceController(w, r, "media")
+	if !ok {
+		return
+	}
+	drive, ok := ctrl.(mediaDrive)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s devices have no virtual media drive", typeName(device)), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ctx, cancel := context.WithTimeout(r.Context(), powerTimeout)
+		defer cancel()
+		state, err := drive.MediaState(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	case http.MethodPost:
+		h.attachMedia(w, r, device, drive)
+	case http.MethodDelete:
+		ctx, cancel := context.WithTimeout(r.Context(), powerTimeout)
+		defer cancel()
+		if err := drive.EjectMedia(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Printf("Virtual media ejected from device %s (%s) by %s", device.ID, device.Host, clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// attachMedia pushes a library image to a device and attaches it
+// (POST /api/devices/{id}/media)
+func (h *Handlers) attachMedia(w http.ResponseWriter, r *http.Request, device Device, drive mediaDrive) {
+	if !h.config.mediaDirShared() {
+		http.Error(w, errMediaNotShared.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var req MediaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	img, err := h.media.Get(req.Image)
+	if errors.Is(err, errMediaNotFound) {
+		http.Error(w, "Image not found in the library", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cdrom := strings.EqualFold(filepath.Ext(img.Name), ".iso")
+	if req.CDROM != nil {
+		cdrom = *req.CDROM
+	}
+	if cdrom && req.RW {
+		http.Error(w, "CD-ROM images are read-only", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	transfer := h.newMediaTransfer(MediaProgress{ID: device.ID, Image: img.Name, Stage: "uploading", Total: img.Size})
+	failed := func(err error) {
+		transfer.failed(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+
+	state, err := drive.MediaState(ctx)
+	if err != nil {
+		failed(err)
+		return
+	}
+	resp := MediaResponse{ID: device.ID, Image: img.Name}
+	if req.Force || !state.has(img) {
+		f, err := h.media.Open(img.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		start := time.Now()
+		if err := drive.UploadMedia(ctx, img.Name, f, img.Size, transfer.update); err != nil {
+			failed(err)
+			return
+		}
+		log.Printf("Image %s uploaded to device %s (%s) in %s", img.Name, device.ID, device.Host, time.Since(start).Round(time.Second))
+		resp.Uploaded = true
+	}
+	if err := drive.AttachMedia(ctx, img.Name, cdrom, req.RW); err != nil {
+		failed(err)
+		return
+	}
+	log.Printf("Image %s attached to device %s (%s) by %s", img.Name, device.ID, device.Host, clientIP(r))
+	transfer.done("attached", img.Size)
+
+	if resp.State, err = drive.MediaState(ctx); err != nil {
+		resp.State = MediaState{Image: img.Name, Connected: true, CDROM: cdrom, RW: req.RW}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// has reports whether the device already stores a complete copy of an
+// image. Devices don't report checksums, so the size has to do.
+func (s MediaState) has(img MediaImage) bool {
+	for _, stored := range s.Stored {
+		if stored.Name == img.Name {
+			return stored.Complete && stored.Size == img.Size
+		}
+	}
+	return false
+}
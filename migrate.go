@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/uuid"
+)
+
+// schemaVersion is the config.toml schema version written by this build.
+// Bump it together with a new entry in migrations whenever the on-disk
+// layout of Config changes in a way older files need upgrading for.
+const schemaVersion = 1
+
+// migration upgrades a raw config document from version From to From+1
+type migration struct {
+	From        int
+	Description string
+	Apply       func(doc map[string]interface{}) error
+}
+
+// migrations is the ordered chain of schema upgrades run by LoadConfig
+var migrations = []migration{
+	{From: 0, Description: "assign persistent IDs to devices", Apply: migrateV0},
+}
+
+// migrateV0 upgrades unversioned configs. Devices written by hand often have
+// no id, which used to be regenerated on every start and broke /go/{id} links.
+func migrateV0(doc map[string]interface{}) error {
+	devices, err := docDevices(doc)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if id, _ := d["id"].(string); id == "" {
+			d["id"] = uuid.New().String()
+		}
+	}
+	return nil
+}
+
+// docDevices returns the [[devices]] tables of a raw config document
+func docDevices(doc map[string]interface{}) ([]map[string]interface{}, error) {
+	raw, ok := doc["devices"]
+	if !ok {
+		return nil, nil
+	}
+	switch v := raw.(type) {
+	case []map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		devices := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			d, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("devices: unexpected entry type %T", item)
+			}
+			devices = append(devices, d)
+		}
+		doc["devices"] = devices
+		return devices, nil
+	default:
+		return nil, fmt.Errorf("devices: unexpected type %T", raw)
+	}
+}
+
+// docSchemaVersion reads schema_version from a raw config document (0 if absent)
+func docSchemaVersion(doc map[string]interface{}) (int, error) {
+	raw, ok := doc["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	v, ok := raw.(int64)
+	if !ok || v < 0 {
+		return 0, fmt.Errorf("invalid schema_version %v", raw)
+	}
+	return int(v), nil
+}
+
+// migrateConfigData runs every migration needed to bring data up to
+// schemaVersion. It returns the re-encoded document and the version the
+// input was at; when no migration is needed the input is returned unchanged.
+func migrateConfigData(data []byte) ([]byte, int, error) {
+	doc := make(map[string]interface{})
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, 0, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	from, err := docSchemaVersion(doc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from > schemaVersion {
+		return nil, from, fmt.Errorf("config schema version %d is newer than this kvmm supports (%d)", from, schemaVersion)
+	}
+	if from == schemaVersion {
+		return data, from, nil
+	}
+
+	for v := from; v < schemaVersion; v++ {
+		m, ok := findMigration(v)
+		if !ok {
+			return nil, from, fmt.Errorf("no migration from schema version %d", v)
+		}
+		if err := m.Apply(doc); err != nil {
+			return nil, from, fmt.Errorf("migrating schema %d -> %d (%s): %w", v, v+1, m.Description, err)
+		}
+		doc["schema_version"] = int64(v + 1)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+		return nil, from, fmt.Errorf("encoding migrated config: %w", err)
+	}
+	return buf.Bytes(), from, nil
+}
+
+func findMigration(from int) (migration, bool) {
+	for _, m := range migrations {
+		if m.From == from {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// migrationBackupPath returns where the pre-migration copy of a config is kept
+func migrationBackupPath(path string, from int) string {
+	return fmt.Sprintf("%s.v%d.bak", path, from)
+}
+
+// writeMigrationBackup saves the original file contents beside the config
+func writeMigrationBackup(path string, from int, data []byte) error {
+	backup := migrationBackupPath(path, from)
+	if err := os.WriteFile(backup, data, 0600); err != nil {
+		return fmt.Errorf("writing config backup: %w", err)
+	}
+	log.Printf("Config schema upgraded from version %d to %d; previous file saved to %s", from, schemaVersion, backup)
+	return nil
+}
+
+// runConfig dispatches `kvmm config <subcommand>`
+func runConfig(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm config migrate|backups|restore")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "migrate":
+		runConfigMigrate(args[1:])
+	case "backups":
+		runConfigBackups()
+	case "restore":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: kvmm config restore <backup-id>")
+			os.Exit(1)
+		}
+		runConfigRestore(args[1])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown config command: %s\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// runConfigMigrate upgrades a config file in place, or prints the diff with -dry-run
+func runConfigMigrate(args []string) {
+	flags := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	configPath := flags.String("config", "config.toml", "Path to configuration file")
+	dryRun := flags.Bool("dry-run", false, "Print the changes without writing them")
+	flags.Parse(args)
+
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	migrated, from, err := migrateConfigData(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if from == schemaVersion {
+		fmt.Printf("%s is already at schema version %d\n", *configPath, schemaVersion)
+		return
+	}
+
+	// Render through Config so the diff matches what Save would write
+	cfg := &Config{filePath: *configPath}
+	if err := toml.Unmarshal(migrated, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: parsing migrated config: %v\n", err)
+		os.Exit(1)
+	}
+	out, err := cfg.encode()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dryRun {
+		fmt.Printf("--- %s (schema %d)\n+++ %s (schema %d)\n", *configPath, from, *configPath, schemaVersion)
+		fmt.Print(lineDiff(string(data), string(out)))
+		return
+	}
+
+	if err := writeMigrationBackup(*configPath, from, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := cfg.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Migrated %s from schema version %d to %d (backup: %s)\n",
+		*configPath, from, schemaVersion, migrationBackupPath(*configPath, from))
+}
+
+// lineDiff returns a minimal line-based diff of a and b, prefixing each line
+// with "-", "+" or " " like a unified diff without hunk headers
+func lineDiff(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// Longest common subsequence table
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			sb.WriteString(" " + x[i] + "\n")
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			sb.WriteString("-" + x[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+" + y[j] + "\n")
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		sb.WriteString("-" + x[i] + "\n")
+	}
+	for ; j < len(y); j++ {
+		sb.WriteString("+" + y[j] + "\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Every schema version kvmm has written must keep loading. Bumping
+// schemaVersion needs a testdata/config/v<N>.toml fixture and a case here.
+var migrationFixtures = []struct {
+	file  string
+	from  int
+	check func(t *testing.T, cfg *Config)
+}{
+	{"v0.toml", 0, func(t *testing.T, cfg *Config) {
+		if len(cfg.Devices) != 3 {
+			t.Fatalf("got %d devices, want 3", len(cfg.Devices))
+		}
+		if d := cfg.Devices[0]; d.ID != "dev-001" || d.Username != "admin" || d.Password != "admin" {
+			t.Errorf("existing device changed: %+v", d)
+		}
+		for _, d := range cfg.Devices[1:] {
+			if d.ID == "" {
+				t.Errorf("device %s has no ID", d.Host)
+			}
+		}
+		if cfg.Devices[2].Thumbnail != "rack1.png" {
+			t.Errorf("thumbnail = %q", cfg.Devices[2].Thumbnail)
+		}
+	}},
+	{"v1.toml", 1, func(t *testing.T, cfg *Config) {
+		if cfg.Server.Port != 9090 || cfg.Server.Backups != 5 || cfg.Server.Site != "fra1" ||
+			len(cfg.Server.Webhooks) != 1 || cfg.Server.StatusInterval != "1m" {
+			t.Errorf("server settings lost: %+v", cfg.Server)
+		}
+		if len(cfg.Devices) != 2 {
+			t.Fatalf("got %d devices, want 2", len(cfg.Devices))
+		}
+		d := cfg.Devices[1]
+		if d.Type != "redfish" || d.MAC != "aa:bb:cc:dd:ee:01" || d.Password != "calvin" || d.WakeBroadcast != "10.0.0.255:9" {
+			t.Errorf("device fields lost: %+v", d)
+		}
+		if strings.Join(cfg.Devices[0].Tags, ",") != "rack3,prod" {
+			t.Errorf("tags = %v", cfg.Devices[0].Tags)
+		}
+	}},
+	{"v1-maintenance.toml", 1, func(t *testing.T, cfg *Config) {
+		if len(cfg.Maintenance) != 1 || cfg.Maintenance[0].ID != "mw-001" || cfg.Maintenance[0].Reason != "CHG-1234" {
+			t.Fatalf("maintenance = %+v", cfg.Maintenance)
+		}
+		records, err := cfg.store.ListRecords(maintenanceRecords)
+		if err != nil || len(records) != 1 {
+			t.Errorf("store holds %d windows, %v", len(records), err)
+		}
+		data, _ := os.ReadFile(cfg.filePath)
+		if strings.Contains(string(data), "[[maintenance]]") {
+			t.Error("[[maintenance]] left in config.toml")
+		}
+	}},
+}
+
+func TestMigrationFixturesCoverEverySchema(t *testing.T) {
+	for v := 0; v <= schemaVersion; v++ {
+		if _, err := os.Stat(filepath.Join("testdata", "config", fmt.Sprintf("v%d.toml", v))); err != nil {
+			t.Errorf("no fixture for schema version %d: %v", v, err)
+		}
+	}
+}
+
+func TestLoadConfigMigratesFixtures(t *testing.T) {
+	for _, tc := range migrationFixtures {
+		t.Run(tc.file, func(t *testing.T) {
+			original, err := os.ReadFile(filepath.Join("testdata", "config", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, original, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			defer cfg.Close()
+			tc.check(t, cfg)
+
+			var onDisk struct {
+				SchemaVersion int      `toml:"schema_version"`
+				Devices       []Device `toml:"devices"`
+			}
+			if _, err := toml.DecodeFile(path, &onDisk); err != nil {
+				t.Fatalf("reading migrated config: %v", err)
+			}
+			if onDisk.SchemaVersion != schemaVersion {
+				t.Errorf("schema_version on disk = %d, want %d", onDisk.SchemaVersion, schemaVersion)
+			}
+
+			backup, err := os.ReadFile(migrationBackupPath(path, tc.from))
+			if tc.from < schemaVersion {
+				if err != nil || string(backup) != string(original) {
+					t.Errorf("backup of the original missing or changed: %v", err)
+				}
+			} else if err == nil {
+				t.Error("backup written for a config that needed no migration")
+			}
+
+			// Loading again changes nothing, so assigned IDs are stable
+			again, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("second LoadConfig: %v", err)
+			}
+			defer again.Close()
+			for i, d := range again.Devices {
+				if d.ID != cfg.Devices[i].ID || d.ID != onDisk.Devices[i].ID {
+					t.Errorf("device %d ID changed on reload: %q, was %q", i, d.ID, cfg.Devices[i].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateConfigData(t *testing.T) {
+	current := []byte(fmt.Sprintf("schema_version = %d\n", schemaVersion))
+	out, from, err := migrateConfigData(current)
+	if err != nil || from != schemaVersion || string(out) != string(current) {
+		t.Errorf("current schema: %q, %d, %v; want unchanged", out, from, err)
+	}
+
+	newer := fmt.Sprintf("schema_version = %d\n", schemaVersion+1)
+	if _, _, err := migrateConfigData([]byte(newer)); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer schema: err = %v", err)
+	}
+
+	if _, _, err := migrateConfigData([]byte("schema_version = -1\n")); err == nil {
+		t.Error("negative schema_version accepted")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// deviceCache is the last device list fetched from a server, kept so the
+// CLI can still reach consoles while the server is down. The API never
+// returns passwords, so it holds no secrets.
+type deviceCache struct {
+	Server  string      `json:"server"`
+	SavedAt time.Time   `json:"saved_at"`
+	Devices []CLIDevice `json:"devices"`
+}
+
+// deviceCachePath returns the cache file for a server, under
+// $XDG_CACHE_HOME/kvmm (default ~/.cache/kvmm)
+func deviceCachePath(server string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(server))
+	return filepath.Join(dir, "kvmm", "devices-"+hex.EncodeToString(sum[:6])+".json"), nil
+}
+
+// saveDeviceCache records a successfully fetched device list. Failures
+// are ignored: the cache is only a fallback.
+func saveDeviceCache(server string, devices []CLIDevice) {
+	path, err := deviceCachePath(server)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(deviceCache{Server: server, SavedAt: time.Now(), Devices: devices})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+
+	// Write then rename so a concurrent reader never sees half a file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// loadDeviceCache reads the cached device list for a server
+func loadDeviceCache(server string) (*deviceCache, error) {
+	path, err := deviceCachePath(server)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no cached device list for %s", server)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cache deviceCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return &cache, nil
+}
+
+// isUnreachable reports whether err means the server couldn't be reached
+// at all, as opposed to answering with an error
+func isUnreachable(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// directURL is the device's own web interface, bypassing the server
+func directURL(d CLIDevice) string {
+	return "http://" + d.Host + "/"
+}
+
+// warnOffline tells the user the CLI is working from the cache
+func warnOffline(cache *deviceCache, err error) {
+	fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	fmt.Fprintf(os.Stderr, "Warning: server unreachable, using the device list cached %s ago (%s)\n",
+		time.Since(cache.SavedAt).Round(time.Second), cache.SavedAt.Local().Format("2006-01-02 15:04"))
+}
+
+// runOpenOffline opens a cached device's own web interface when the server
+// is unreachable. Auto-login isn't available without the server.
+func runOpenOffline(server, query string, serverErr error) {
+	cache, err := loadDeviceCache(server)
+	if err != nil {
+		fail(exitError, "%v (and %v)", serverErr, err)
+	}
+	warnOffline(cache, serverErr)
+
+	devices := make([]Device, len(cache.Devices))
+	byID := make(map[string]CLIDevice, len(cache.Devices))
+	for i, d := range cache.Devices {
+		devices[i] = Device{ID: d.ID, Host: d.Host, Alias: d.Alias, Site: d.Site, Tags: d.Tags}
+		byID[d.ID] = d
+	}
+
+	result := searchDevices(devices, query)
+	matches := make([]CLIDevice, len(result.Results))
+	for i, m := range result.Results {
+		matches[i] = byID[m.ID]
+	}
+
+	device := chooseDevice("", query, matches, result.Best)
+	url := directURL(device)
+	fmt.Printf("Opening %s directly at %s (no auto-login)...\n", displayName(device), url)
+	if err := openBrowser(url); err != nil {
+		fmt.Printf("Open this URL in your browser: %s\n", url)
+	}
+}
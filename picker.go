@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const pickerRows = 10 // Devices shown at once
+
+// canPick reports whether an interactive picker can be shown
+func canPick() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// picker is a type-to-filter device list drawn on stderr
+type picker struct {
+	devices  []CLIDevice
+	statuses map[string]bool
+	query    []rune
+	filtered []CLIDevice
+	cursor   int
+	offset   int
+	drawn    int // Lines drawn by the last render
+	color    bool
+}
+
+// pickDevice lets the user choose one of devices with the arrow keys,
+// filtering as they type. Statuses are filled in when they arrive. It
+// reports false if the user cancels.
+func pickDevice(devices []CLIDevice, query string, statuses <-chan []CLIDeviceStatus) (CLIDevice, bool) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fail(exitError, "starting picker: %v", err)
+	}
+	defer term.Restore(fd, state)
+
+	p := &picker{
+		devices:  devices,
+		statuses: make(map[string]bool),
+		query:    []rune(query),
+		color:    os.Getenv("NO_COLOR") == "",
+	}
+	p.filter()
+	p.render()
+	defer p.clear()
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	for {
+		select {
+		case list := <-statuses:
+			for _, s := range list {
+				p.statuses[s.ID] = s.Reachable
+			}
+			statuses = nil // Only one update is sent
+			p.render()
+		case key, ok := <-keys:
+			if !ok {
+				return CLIDevice{}, false
+			}
+			done, picked := p.handle(key)
+			if done {
+				if picked && len(p.filtered) > 0 {
+					return p.filtered[p.cursor], true
+				}
+				return CLIDevice{}, false
+			}
+			p.render()
+		}
+	}
+}
+
+// handle applies a key press, reporting whether picking is over and
+// whether a device was chosen
+func (p *picker) handle(key []byte) (done, picked bool) {
+	switch string(key) {
+	case "\r", "\n":
+		return true, true
+	case "\x03", "\x1b", "\x04": // Ctrl-C, Esc, Ctrl-D
+		return true, false
+	case "\x1b[A", "\x1bOA", "\x10": // Up, Ctrl-P
+		p.move(-1)
+	case "\x1b[B", "\x1bOB", "\x0e": // Down, Ctrl-N
+		p.move(1)
+	case "\x1b[5~": // Page up
+		p.move(-pickerRows)
+	case "\x1b[6~": // Page down
+		p.move(pickerRows)
+	case "\x7f", "\x08": // Backspace
+		if len(p.query) > 0 {
+			p.query = p.query[:len(p.query)-1]
+			p.filter()
+		}
+	case "\x15": // Ctrl-U
+		p.query = nil
+		p.filter()
+	default:
+		if key[0] == '\x1b' {
+			return false, false // Ignore other escape sequences
+		}
+		for len(key) > 0 {
+			r, size := utf8.DecodeRune(key)
+			key = key[size:]
+			if unicode.IsPrint(r) {
+				p.query = append(p.query, r)
+			}
+		}
+		p.filter()
+	}
+	return false, false
+}
+
+func (p *picker) move(delta int) {
+	p.cursor += delta
+	if p.cursor < 0 {
+		p.cursor = 0
+	}
+	if p.cursor >= len(p.filtered) {
+		p.cursor = len(p.filtered) - 1
+	}
+	if p.cursor < 0 {
+		p.cursor = 0
+	}
+}
+
+// filter keeps devices whose alias, host or site contain the query's
+// characters in order
+func (p *picker) filter() {
+	query := strings.ToLower(string(p.query))
+	p.filtered = p.filtered[:0]
+	for _, d := range p.devices {
+		text := strings.ToLower(d.Alias + " " + d.Host + " " + d.Site)
+		if isSubsequence(query, text) {
+			p.filtered = append(p.filtered, d)
+		}
+	}
+	p.cursor, p.offset = 0, 0
+}
+
+// render redraws the prompt and the visible part of the list
+func (p *picker) render() {
+	var b strings.Builder
+	p.rewind(&b)
+
+	if p.cursor < p.offset {
+		p.offset = p.cursor
+	}
+	if p.cursor >= p.offset+pickerRows {
+		p.offset = p.cursor - pickerRows + 1
+	}
+
+	aliasWidth := 5
+	for _, d := range p.filtered {
+		if n := utf8.RuneCountInString(displayName(d)); n > aliasWidth {
+			aliasWidth = n
+		}
+	}
+
+	fmt.Fprintf(&b, "Open device (%d/%d, ↑/↓ to move, Enter to open, Esc to cancel)\r\n", len(p.filtered), len(p.devices))
+	fmt.Fprintf(&b, "> %s", string(p.query))
+	lines := 1
+
+	end := p.offset + pickerRows
+	if end > len(p.filtered) {
+		end = len(p.filtered)
+	}
+	for i := p.offset; i < end; i++ {
+		d := p.filtered[i]
+		marker := "  "
+		if i == p.cursor {
+			marker = "▸ "
+		}
+
+		dot := symbolUnknown
+		if reachable, ok := p.statuses[d.ID]; ok {
+			dot = symbolOffline
+			if reachable {
+				dot = symbolOnline
+			}
+		}
+
+		line := fmt.Sprintf("%s%s %-*s  %s", marker, dot, aliasWidth, displayName(d), d.Host)
+		if d.Site != "" {
+			line += "  [" + d.Site + "]"
+		}
+		if p.color {
+			line = colorizeStatus(line)
+			if i == p.cursor {
+				// Bold the whole line, re-applying it after each colour reset
+				line = "\x1b[1m" + strings.ReplaceAll(line, "\x1b[0m", "\x1b[0m\x1b[1m") + "\x1b[0m"
+			}
+		}
+		b.WriteString("\r\n" + line)
+		lines++
+	}
+	if len(p.filtered) == 0 {
+		b.WriteString("\r\n  No matching devices")
+		lines++
+	}
+
+	// Leave the cursor at the end of the query line
+	fmt.Fprintf(&b, "\x1b[%dA\r\x1b[%dC", lines-1, 2+utf8.RuneCountInString(string(p.query)))
+	p.drawn = lines + 1
+	fmt.Fprint(os.Stderr, b.String())
+}
+
+// rewind moves to the start of the previous render and clears it
+func (p *picker) rewind(b *strings.Builder) {
+	if p.drawn > 0 {
+		// The cursor sits on the query line, one below the title
+		b.WriteString("\x1b[1A")
+	}
+	b.WriteString("\r\x1b[J")
+}
+
+// clear erases the picker from the terminal
+func (p *picker) clear() {
+	var b strings.Builder
+	p.rewind(&b)
+	fmt.Fprint(os.Stderr, b.String())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultStatusInterval = 30 * time.Second
+
+// StatusChange is published and sent to webhooks when a device's
+// reachability changes
+type StatusChange struct {
+	Event     string    `json:"event"` // Always "device.status"
+	ID        string    `json:"id"`
+	Alias     string    `json:"alias,omitempty"`
+	Host      string    `json:"host"`
+	Reachable bool      `json:"reachable"`
+	Previous  *bool     `json:"previous,omitempty"` // nil on the first check
+	Time      time.Time `json:"time"`
+
+	Maintenance *DeviceMaintenance `json:"maintenance,omitempty"` // Set during a maintenance window
+}
+
+// StatusPoller periodically checks every device, publishes status events
+// for transitions and delivers them to the configured webhooks. Webhooks
+// are held back while a device is in a maintenance window; if it is still
+// in a different state when the window ends, that is reported then. In a
+// cluster only the leader runs it.
+type StatusPoller struct {
+	config   *Config
+	interval time.Duration
+	client   *http.Client
+
+	lifecycle sync.Mutex // Serializes Start and Stop
+	mu        sync.Mutex
+	last      map[string]bool
+	notified  map[string]bool // State last reported to webhooks
+	stop      chan struct{}
+	done      chan struct{} // Closed when the polling goroutine exits
+}
+
+// NewStatusPoller creates a poller using the server's status_interval
+func NewStatusPoller(cfg *Config) *StatusPoller {
+	interval := defaultStatusInterval
+	if cfg.Server.StatusInterval != "" {
+		if d, err := time.ParseDuration(cfg.Server.StatusInterval); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Printf("Invalid status_interval %q, using %s", cfg.Server.StatusInterval, defaultStatusInterval)
+		}
+	}
+	return &StatusPoller{
+		config:   cfg,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		last:     make(map[string]bool),
+		notified: make(map[string]bool),
+	}
+}
+
+// Start begins polling in the background; it is a no-op if already running
+func (p *StatusPoller) Start() {
+	p.lifecycle.Lock()
+	defer p.lifecycle.Unlock()
+	if p.stop != nil {
+		return
+	}
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	go p.run(p.stop, p.done)
+	log.Printf("Status poller started (every %s)", p.interval)
+}
+
+// Stop halts polling and waits for an in-flight poll to finish, so a
+// replica that loses the lease stops reporting before Stop returns. It is a
+// no-op if not running.
+func (p *StatusPoller) Stop() {
+	p.lifecycle.Lock()
+	defer p.lifecycle.Unlock()
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop, p.done = nil, nil
+
+	// A new leader starts from scratch, so forget what we saw
+	p.mu.Lock()
+	p.last = make(map[string]bool)
+	p.notified = make(map[string]bool)
+	p.mu.Unlock()
+	log.Printf("Status poller stopped")
+}
+
+func (p *StatusPoller) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.poll(stop)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll checks all devices once and reports transitions, unless stop is
+// closed while the checks are running
+func (p *StatusPoller) poll(stop <-chan struct{}) {
+	devices := p.config.GetDevices()
+	statuses := checkDevices(devices)
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	p.config.RecordStatuses(statuses)
+
+	now := time.Now().UTC()
+	for i, st := range statuses {
+		maintenance := p.config.deviceMaintenance(devices[i], now)
+
+		p.mu.Lock()
+		prev, known := p.last[st.ID]
+		p.last[st.ID] = st.Reachable
+		notified, wasNotified := p.notified[st.ID]
+		if maintenance == nil {
+			p.notified[st.ID] = st.Reachable
+		}
+		p.mu.Unlock()
+
+		change := StatusChange{
+			Event:       "device.status",
+			ID:          st.ID,
+			Alias:       devices[i].Alias,
+			Host:        devices[i].Host,
+			Reachable:   st.Reachable,
+			Time:        now,
+			Maintenance: maintenance,
+		}
+		if !known || prev != st.Reachable {
+			if known {
+				change.Previous = &prev
+			}
+			p.config.events.Publish(Event{Type: "status", Data: change})
+		}
+
+		// Webhooks hear about changes from the state they were last told of,
+		// which catches up on anything that changed during maintenance
+		switch {
+		case maintenance != nil:
+			if known && prev != st.Reachable {
+				log.Printf("Webhooks held back for device %s (%s): in maintenance window %s", st.ID, devices[i].Host, maintenance.ID)
+			}
+		case wasNotified && notified != st.Reachable:
+			change.Previous = &notified
+			p.notify(change)
+		}
+	}
+}
+
+// notify posts a status change to every configured webhook
+func (p *StatusPoller) notify(change StatusChange) {
+	if len(p.config.Server.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		return
+	}
+	for _, url := range p.config.Server.Webhooks {
+		go func(url string) {
+			resp, err := p.client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("Webhook %s: %v", url, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("Webhook %s: returned %d", url, resp.StatusCode)
+			}
+		}(url)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Device types, which decide how power and other device APIs are reached
+const (
+	deviceTypePiKVM   = "pikvm"   // PiKVM, the default
+	deviceTypeBliKVM  = "blikvm"  // BliKVM runs PiKVM's kvmd, so shares its API
+	deviceTypeRedfish = "redfish" // BMC managed through Redfish
+	deviceTypeIPMI    = "ipmi"    // BMC managed through IPMI-over-LAN v2.0
+	deviceTypeGeneric = "generic" // Any other web KVM; console only
+)
+
+var deviceTypes = []string{deviceTypePiKVM, deviceTypeBliKVM, deviceTypeRedfish, deviceTypeIPMI, deviceTypeGeneric}
+
+// Power actions accepted by POST /api/devices/{id}/power
+var powerActions = []string{"on", "off", "off_hard", "reset"}
+
+const powerTimeout = 15 * time.Second
+
+// errPowerBusy is returned when the device is still carrying out an
+// earlier action
+var errPowerBusy = errors.New("another power action is in progress")
+
+// validateDeviceType rejects unknown device types; empty means PiKVM
+func validateDeviceType(t string) error {
+	if t == "" {
+		return nil
+	}
+	for _, known := range deviceTypes {
+		if t == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown device type %q (use %s)", t, strings.Join(deviceTypes, ", "))
+}
+
+// PowerState is the host's power as seen by the KVM's ATX board or the BMC
+type PowerState struct {
+	Power string          `json:"power"`          // "on", "off" or "unknown"
+	LEDs  map[string]bool `json:"leds,omitempty"` // e.g. "power", "hdd", "identify"
+	Busy  bool            `json:"busy"`           // An action is still running
+}
+
+// PowerRequest is the body of POST /api/devices/{id}/power
+type PowerRequest struct {
+	Action string `json:"action"` // One of powerActions
+}
+
+// PowerResponse is returned by POST /api/devices/{id}/power
+type PowerResponse struct {
+	Action string     `json:"action"`
+	State  PowerState `json:"state"`
+}
+
+// PowerEvent is published on the event stream after a power action
+type PowerEvent struct {
+	ID     string    `json:"id"`
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+// SensorReading is one of a BMC's sensors (GET /api/devices/{id}/sensors)
+type SensorReading struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`            // "temperature", "fan", "voltage", "current", "power" or "other"
+	Value  *float64 `json:"value"`           // nil when the sensor has no reading
+	Units  string   `json:"units,omitempty"` // e.g. "C", "RPM", "V", "W", "%"
+	Status string   `json:"status"`          // "ok", "warning", "critical" or "unknown"
+}
+
+// SELEntry is an entry of a BMC's system event log (GET /api/devices/{id}/sel)
+type SELEntry struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity,omitempty"` // As reported, e.g. "OK", "Warning", "Critical"
+	Message  string    `json:"message"`
+}
+
+// powerController drives a device's power buttons
+type powerController interface {
+	PowerState(ctx context.Context) (PowerState, error)
+	Power(ctx context.Context, action string) error
+}
+
+// sensorReader is implemented by controllers for devices with sensors
+type sensorReader interface {
+	Sensors(ctx context.Context) ([]SensorReading, error)
+}
+
+// selReader is implemented by controllers for devices with an event log
+type selReader interface {
+	SEL(ctx context.Context) ([]SELEntry, error)
+}
+
+// snapshotter is implemented by controllers that can capture the screen
+type snapshotter interface {
+	Snapshot(ctx context.Context) ([]byte, error)
+}
+
+// mediaDrive is implemented by controllers with a virtual USB drive that
+// images can be uploaded to and presented to the host
+type mediaDrive interface {
+	MediaState(ctx context.Context) (MediaState, error)
+	UploadMedia(ctx context.Context, name string, image io.ReadSeeker, size int64, progress func(sent int64)) error
+	AttachMedia(ctx context.Context, name string, cdrom, rw bool) error
+	EjectMedia(ctx context.Context) error
+}
+
+// newPowerController returns the controller for a device's type
+func newPowerController(d Device) (powerController, error) {
+	switch d.Type {
+	case "", deviceTypePiKVM, deviceTypeBliKVM:
+		return newPiKVMClient(d), nil
+	case deviceTypeRedfish:
+		return newRedfishClient(d), nil
+	case deviceTypeIPMI:
+		return newIPMIClient(d), nil
+	}
+	return nil, fmt.Errorf("%s devices only open their console", d.Type)
+}
+
+// newDeviceHTTPClient is for talking to device APIs. KVMs and BMCs mostly
+// ship with self-signed certificates, so they aren't verified.
+func newDeviceHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   powerTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+}
+
+// doDeviceRequest sends a request over HTTPS, retrying over HTTP for devices
+// with TLS turned off. newReq is called once per attempt so bodies can be
+// re-sent.
+func doDeviceRequest(client *http.Client, newReq func(scheme string) (*http.Request, error)) (*http.Response, error) {
+	req, err := newReq("https")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	// net/http reports a plain HTTP answer as ErrSchemeMismatch; other
+	// non-TLS replies surface as the raw record header error
+	var notTLS tls.RecordHeaderError
+	if errors.Is(err, http.ErrSchemeMismatch) || errors.As(err, &notTLS) {
+		if req, err = newReq("http"); err != nil {
+			return nil, err
+		}
+		resp, err = client.Do(req)
+	}
+	return resp, err
+}
+
+func isPowerAction(action string) bool {
+	for _, a := range powerActions {
+		if action == a {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceController looks up the device in a /api/devices/{id}/{suffix}
+// request and its controller, writing the error response if there is none
+func (h *Handlers) deviceController(w http.ResponseWriter, r *http.Request, suffix string) (Device, powerController, bool) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/"+suffix)
+	device, found := h.config.GetDevice(id)
+	if !found {
+		if h.deviceExists(id) {
+			http.Error(w, "Federated devices are controlled from their own site's server", http.StatusBadRequest)
+			return Device{}, nil, false
+		}
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return Device{}, nil, false
+	}
+
+	ctrl, err := newPowerController(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Device{}, nil, false
+	}
+	return device, ctrl, true
+}
+
+// PowerHandler reads or changes a device's power state using its stored
+// credentials (GET/POST /api/devices/{id}/power)
+func (h *Handlers) PowerHandler(w http.ResponseWriter, r *http.Request) {
+	device, ctrl, ok := h.deviceController(w, r, "power")
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), powerTimeout)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := ctrl.PowerState(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	case http.MethodPost:
+		var req PowerRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Action == "" {
+			req.Action = r.URL.Query().Get("action")
+		}
+		if !isPowerAction(req.Action) {
+			http.Error(w, fmt.Sprintf("action must be one of %s", strings.Join(powerActions, ", ")), http.StatusBadRequest)
+			return
+		}
+
+		if err := ctrl.Power(ctx, req.Action); err != nil {
+			status := http.StatusBadGateway
+			if errors.Is(err, errPowerBusy) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Printf("Power %s sent to device %s (%s) by %s", req.Action, device.ID, device.Host, clientIP(r))
+		h.config.events.Publish(Event{Type: "power", Data: PowerEvent{ID: device.ID, Action: req.Action, Time: time.Now().UTC()}})
+
+		resp := PowerResponse{Action: req.Action, State: PowerState{Power: "unknown"}}
+		if state, err := ctrl.PowerState(ctx); err == nil {
+			resp.State = state
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SensorsHandler returns a BMC's sensor readings (GET /api/devices/{id}/sensors)
+func (h *Handlers) SensorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	device, ctrl, ok := h.deviceController(w, r, "sensors")
+	if !ok {
+		return
+	}
+	reader, ok := ctrl.(sensorReader)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s devices have no sensors", typeName(device)), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), powerTimeout)
+	defer cancel()
+	sensors, err := reader.Sensors(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sensors)
+}
+
+// SELHandler returns a BMC's system event log, newest first
+// (GET /api/devices/{id}/sel)
+func (h *Handlers) SELHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	device, ctrl, ok := h.deviceController(w, r, "sel")
+	if !ok {
+		return
+	}
+	reader, ok := ctrl.(selReader)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s devices have no event log", typeName(device)), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), powerTimeout)
+	defer cancel()
+	entries, err := reader.SEL(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// typeName is a device's type, filling in the default
+func typeName(d Device) string {
+	if d.Type == "" {
+		return deviceTypePiKVM
+	}
+	return d.Type
+}
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+// IPMI-over-LAN v2.0 (RMCP+) client, covering chassis power and sensor
+// readings. Sessions use cipher suite 3 (RAKP-HMAC-SHA1 authentication,
+// HMAC-SHA1-96 integrity, AES-CBC-128 confidentiality), which IPMI 2.0 BMCs
+// support by default.
+
+const (
+	ipmiPort        = "623"
+	ipmiReadTimeout = 2 * time.Second // Per attempt; UDP packets get lost
+	ipmiRetries     = 3
+	ipmiMaxSDR      = 512 // Records read before giving up on a looping repository
+)
+
+// Network functions and commands
+const (
+	ipmiNetFnChassis = 0x00
+	ipmiNetFnSensor  = 0x04
+	ipmiNetFnApp     = 0x06
+	ipmiNetFnStorage = 0x0a
+
+	ipmiCmdChassisStatus       = 0x01
+	ipmiCmdChassisControl      = 0x02
+	ipmiCmdReserveSDR          = 0x22
+	ipmiCmdGetSDR              = 0x23
+	ipmiCmdGetSensorReading    = 0x2d
+	ipmiCmdGetChannelAuthCaps  = 0x38
+	ipmiCmdSetSessionPrivilege = 0x3b
+	ipmiCmdCloseSession        = 0x3c
+)
+
+// RMCP+ payload types
+const (
+	ipmiPayloadIPMI         = 0x00
+	ipmiPayloadOpenRequest  = 0x10
+	ipmiPayloadOpenResponse = 0x11
+	ipmiPayloadRAKP1        = 0x12
+	ipmiPayloadRAKP2        = 0x13
+	ipmiPayloadRAKP3        = 0x14
+	ipmiPayloadRAKP4        = 0x15
+)
+
+const (
+	ipmiPrivAdmin      = 0x04
+	ipmiBMCAddr        = 0x20
+	ipmiConsoleAddr    = 0x81
+	ipmiReservationErr = 0xc5 // The SDR reservation was cancelled
+)
+
+// ipmiChassisControl maps our power actions to Chassis Control values
+var ipmiChassisControl = map[string]byte{
+	"on":       0x01, // Power up
+	"off":      0x05, // Soft shutdown via ACPI
+	"off_hard": 0x00, // Power down
+	"reset":    0x03, // Hard reset
+}
+
+// ipmiUnits are the sensor base unit codes we name
+var ipmiUnits = map[byte]string{1: "C", 2: "F", 3: "K", 4: "V", 5: "A", 6: "W", 18: "RPM"}
+
+// ipmiCompletionCodes describes the completion codes worth explaining
+var ipmiCompletionCodes = map[byte]string{
+	0xc0: "node busy",
+	0xc1: "command not supported",
+	0xc3: "timed out",
+	0xcb: "not present",
+	0xcc: "invalid data field",
+	0xd4: "insufficient privilege",
+	0xd5: "not supported in present state",
+}
+
+// ipmiStatusCodes describes RMCP+ session setup status codes
+var ipmiStatusCodes = map[byte]string{
+	0x01: "no free sessions",
+	0x09: "invalid role",
+	0x0a: "unauthorized role",
+	0x0d: "unknown user",
+	0x11: "cipher suite 3 not supported",
+}
+
+var errIPMIPassword = errors.New("the BMC rejected the stored credentials")
+
+// ipmiClient controls a BMC over IPMI-over-LAN. A port in the device's host
+// is taken as the IPMI UDP port.
+type ipmiClient struct {
+	addr     string
+	username string
+	password string
+}
+
+func newIPMIClient(d Device) *ipmiClient {
+	addr := d.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, ipmiPort)
+	}
+	return &ipmiClient{addr: addr, username: d.Username, password: d.Password}
+}
+
+// PowerState reads Get Chassis Status
+func (c *ipmiClient) PowerState(ctx context.Context) (PowerState, error) {
+	s, err := c.open(ctx)
+	if err != nil {
+		return PowerState{}, err
+	}
+	defer s.close()
+
+	data, err := s.command(ipmiNetFnChassis, 0, ipmiCmdChassisStatus, nil)
+	if err != nil {
+		return PowerState{}, err
+	}
+	if len(data) < 3 {
+		return PowerState{}, fmt.Errorf("%s: short chassis status", c.addr)
+	}
+	state := PowerState{Power: "off"}
+	if data[0]&0x01 != 0 {
+		state.Power = "on"
+	}
+	if data[2]&0x40 != 0 { // Identify state is reported
+		state.LEDs = map[string]bool{"identify": (data[2]>>4)&0x03 != 0}
+	}
+	return state, nil
+}
+
+// Power sends Chassis Control
+func (c *ipmiClient) Power(ctx context.Context, action string) error {
+	control, ok := ipmiChassisControl[action]
+	if !ok {
+		return fmt.Errorf("unsupported action %q", action)
+	}
+	s, err := c.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	_, err = s.command(ipmiNetFnChassis, 0, ipmiCmdChassisControl, []byte{control})
+	return err
+}
+
+// Sensors walks the SDR repository and reads each threshold sensor the BMC
+// owns
+func (c *ipmiClient) Sensors(ctx context.Context) ([]SensorReading, error) {
+	s, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	records, err := s.readSDR()
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := []SensorReading{}
+	for _, rec := range records {
+		sensor, ok := parseFullSensorRecord(rec)
+		if !ok {
+			continue
+		}
+		reading := SensorReading{Name: sensor.name, Type: sensor.kind(), Units: sensor.units(), Status: "unknown"}
+		data, err := s.command(ipmiNetFnSensor, sensor.lun, ipmiCmdGetSensorReading, []byte{sensor.number})
+		// Bit 5 marks the reading unavailable; bit 6 is clear while scanning is disabled
+		if err == nil && len(data) >= 2 && data[1]&0x20 == 0 && data[1]&0x40 != 0 {
+			v := sensor.convert(data[0])
+			reading.Value = &v
+			reading.Status = "ok"
+			if len(data) >= 3 {
+				switch {
+				case data[2]&0x36 != 0: // Below/above critical or non-recoverable
+					reading.Status = "critical"
+				case data[2]&0x09 != 0: // Below/above non-critical
+					reading.Status = "warning"
+				}
+			}
+		}
+		sensors = append(sensors, reading)
+	}
+	return sensors, nil
+}
+
+// ipmiSensor is the part of a full sensor record needed to read it
+type ipmiSensor struct {
+	name          string
+	number        byte
+	lun           byte
+	sensorType    byte
+	units1        byte // Analog data format and percentage flag
+	baseUnit      byte
+	linearization byte
+	m, b          int
+	rExp, bExp    int
+}
+
+// parseFullSensorRecord decodes a full sensor record (type 0x01) for a
+// threshold sensor owned by the BMC. Other records are skipped.
+func parseFullSensorRecord(rec []byte) (ipmiSensor, bool) {
+	if len(rec) < 48 || rec[3] != 0x01 || rec[13] != 0x01 || rec[5] != ipmiBMCAddr {
+		return ipmiSensor{}, false
+	}
+	if rec[20]>>6 == 0x03 { // No analog reading
+		return ipmiSensor{}, false
+	}
+
+	signed := func(v, bits int) int {
+		if v&(1<<(bits-1)) != 0 {
+			v -= 1 << bits
+		}
+		return v
+	}
+	s := ipmiSensor{
+		number:        rec[7],
+		lun:           rec[6] & 0x03,
+		sensorType:    rec[12],
+		units1:        rec[20],
+		baseUnit:      rec[21],
+		linearization: rec[23] & 0x7f,
+		m:             signed(int(rec[24])|int(rec[25]&0xc0)<<2, 10),
+		b:             signed(int(rec[26])|int(rec[27]&0xc0)<<2, 10),
+		rExp:          signed(int(rec[29]>>4), 4),
+		bExp:          signed(int(rec[29]&0x0f), 4),
+	}
+	if n := int(rec[47] & 0x1f); len(rec) >= 48+n {
+		s.name = string(rec[48 : 48+n])
+	}
+	if s.name == "" {
+		s.name = fmt.Sprintf("Sensor %d", s.number)
+	}
+	return s, true
+}
+
+// convert turns a raw reading into units: y = L[(M*x + B*10^Bexp) * 10^Rexp]
+func (s ipmiSensor) convert(raw byte) float64 {
+	var x float64
+	switch s.units1 >> 6 {
+	case 0x01: // One's complement
+		x = float64(int8(raw))
+		if raw&0x80 != 0 {
+			x++
+		}
+	case 0x02: // Two's complement
+		x = float64(int8(raw))
+	default:
+		x = float64(raw)
+	}
+	y := (float64(s.m)*x + float64(s.b)*math.Pow10(s.bExp)) * math.Pow10(s.rExp)
+
+	switch s.linearization {
+	case 1:
+		y = math.Log(y)
+	case 2:
+		y = math.Log10(y)
+	case 3:
+		y = math.Log2(y)
+	case 4:
+		y = math.Exp(y)
+	case 5:
+		y = math.Pow(10, y)
+	case 6:
+		y = math.Exp2(y)
+	case 7:
+		y = 1 / y
+	case 8:
+		y = y * y
+	case 9:
+		y = y * y * y
+	case 10:
+		y = math.Sqrt(y)
+	case 11:
+		y = math.Cbrt(y)
+	}
+	return math.Round(y*1000) / 1000
+}
+
+func (s ipmiSensor) kind() string {
+	switch {
+	case s.sensorType == 0x01:
+		return "temperature"
+	case s.sensorType == 0x02:
+		return "voltage"
+	case s.sensorType == 0x03:
+		return "current"
+	case s.sensorType == 0x04:
+		return "fan"
+	case s.baseUnit == 6:
+		return "power"
+	}
+	return "other"
+}
+
+func (s ipmiSensor) units() string {
+	if s.units1&0x01 != 0 {
+		return "%"
+	}
+	return ipmiUnits[s.baseUnit]
+}
+
+// ipmiSession is an activated RMCP+ session
+type ipmiSession struct {
+	addr      string
+	conn      net.Conn
+	deadline  time.Time
+	consoleID uint32 // Our session ID
+	bmcID     uint32 // The BMC's session ID
+	seq       uint32 // Session sequence number
+	rqSeq     byte   // IPMI message sequence number
+	k1, k2    []byte // Integrity and confidentiality keys, once active
+}
+
+// open connects and activates an administrator session
+func (c *ipmiClient) open(ctx context.Context) (*ipmiSession, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("contacting %s: %w", c.addr, err)
+	}
+	s := &ipmiSession{addr: c.addr, conn: conn}
+	s.deadline, _ = ctx.Deadline()
+	if err := s.activate(c.username, c.password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// activate runs session setup: Open Session, then the RAKP exchange, which
+// proves both sides know the password and derives the session keys
+func (s *ipmiSession) activate(username, password string) error {
+	// Checks the BMC speaks IPMI 2.0 before anything else
+	caps, err := s.command(ipmiNetFnApp, 0, ipmiCmdGetChannelAuthCaps, []byte{0x8e, ipmiPrivAdmin})
+	if err != nil {
+		return err
+	}
+	if len(caps) < 4 || caps[1]&0x80 == 0 || caps[3]&0x02 == 0 {
+		return fmt.Errorf("%s doesn't support IPMI 2.0", s.addr)
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	s.consoleID = binary.LittleEndian.Uint32(id) | 1
+
+	// Open Session: ask for cipher suite 3
+	req := []byte{0, ipmiPrivAdmin, 0, 0}
+	req = binary.LittleEndian.AppendUint32(req, s.consoleID)
+	req = append(req,
+		0x00, 0, 0, 0x08, 0x01, 0, 0, 0, // Authentication: RAKP-HMAC-SHA1
+		0x01, 0, 0, 0x08, 0x01, 0, 0, 0, // Integrity: HMAC-SHA1-96
+		0x02, 0, 0, 0x08, 0x01, 0, 0, 0, // Confidentiality: AES-CBC-128
+	)
+	resp, err := s.exchange(ipmiPayloadOpenRequest, req, ipmiPayloadOpenResponse)
+	if err != nil {
+		return err
+	}
+	if err := ipmiStatusError(resp, 12); err != nil {
+		return err
+	}
+	s.bmcID = binary.LittleEndian.Uint32(resp[8:12])
+
+	// RAKP 1 and 2: exchange random numbers and check the BMC's proof
+	user := []byte(username)
+	if len(user) > 16 || len(password) > 20 {
+		return fmt.Errorf("IPMI usernames are at most 16 characters and passwords 20")
+	}
+	rm := make([]byte, 16)
+	rand.Read(rm)
+	role := byte(ipmiPrivAdmin | 0x10) // Look the user up by name only
+	req = []byte{0, 0, 0, 0}
+	req = binary.LittleEndian.AppendUint32(req, s.bmcID)
+	req = append(req, rm...)
+	req = append(req, role, 0, 0, byte(len(user)))
+	req = append(req, user...)
+	resp, err = s.exchange(ipmiPayloadRAKP1, req, ipmiPayloadRAKP2)
+	if err != nil {
+		return err
+	}
+	if err := ipmiStatusError(resp, 60); err != nil {
+		return err
+	}
+	rc, guid := resp[8:24], resp[24:40]
+
+	kuid := make([]byte, 20)
+	copy(kuid, password)
+	sid := func(id uint32) []byte { return binary.LittleEndian.AppendUint32(nil, id) }
+	userInfo := append([]byte{role, byte(len(user))}, user...)
+	if !hmac.Equal(resp[40:60], hmacSHA1(kuid, sid(s.consoleID), sid(s.bmcID), rm, rc, guid, userInfo)) {
+		return errIPMIPassword
+	}
+	sik := hmacSHA1(kuid, rm, rc, userInfo)
+
+	// RAKP 3 and 4: prove we know the password and check the session key
+	req = []byte{0, 0, 0, 0}
+	req = binary.LittleEndian.AppendUint32(req, s.bmcID)
+	req = append(req, hmacSHA1(kuid, rc, sid(s.consoleID), userInfo)...)
+	resp, err = s.exchange(ipmiPayloadRAKP3, req, ipmiPayloadRAKP4)
+	if err != nil {
+		return err
+	}
+	if len(resp) >= 2 && resp[1] == 0x0f {
+		return errIPMIPassword
+	}
+	if err := ipmiStatusError(resp, 20); err != nil {
+		return err
+	}
+	if !hmac.Equal(resp[8:20], hmacSHA1(sik, rm, sid(s.bmcID), guid)[:12]) {
+		return fmt.Errorf("%s: session key check failed", s.addr)
+	}
+
+	s.k1 = hmacSHA1(sik, bytesOf(0x01, 20))
+	s.k2 = hmacSHA1(sik, bytesOf(0x02, 20))
+
+	_, err = s.command(ipmiNetFnApp, 0, ipmiCmdSetSessionPrivilege, []byte{ipmiPrivAdmin})
+	return err
+}
+
+// close ends the session; errors don't matter as the BMC times it out anyway
+func (s *ipmiSession) close() {
+	if s.k1 != nil {
+		s.command(ipmiNetFnApp, 0, ipmiCmdCloseSession, binary.LittleEndian.AppendUint32(nil, s.bmcID))
+	}
+	s.conn.Close()
+}
+
+// command sends an IPMI request and returns the response data after the
+// completion code
+func (s *ipmiSession) command(netFn, lun, cmd byte, data []byte) ([]byte, error) {
+	s.rqSeq = (s.rqSeq + 1) & 0x3f
+	header := []byte{ipmiBMCAddr, netFn<<2 | lun&0x03}
+	body := append([]byte{ipmiConsoleAddr, s.rqSeq << 2, cmd}, data...)
+	msg := append(append(header, ipmiChecksum(header)), body...)
+	msg = append(msg, ipmiChecksum(body))
+
+	seq := s.rqSeq
+	resp, err := s.roundTrip(func() []byte { return s.packet(ipmiPayloadIPMI, msg) }, func(payloadType byte, p []byte) bool {
+		return payloadType == ipmiPayloadIPMI && len(p) >= 8 && p[4]>>2 == seq && p[5] == cmd
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cc := resp[6]; cc != 0 {
+		return nil, &ipmiCompletionError{cmd: cmd, code: cc}
+	}
+	return resp[7 : len(resp)-1], nil
+}
+
+// exchange sends a session setup message and returns the reply, matched by
+// payload type
+func (s *ipmiSession) exchange(payloadType byte, payload []byte, replyType byte) ([]byte, error) {
+	return s.roundTrip(func() []byte { return s.packet(payloadType, payload) }, func(t byte, p []byte) bool {
+		return t == replyType && len(p) >= 2
+	})
+}
+
+// roundTrip sends a packet until a matching reply arrives, rebuilding it
+// for each attempt so retries get a fresh sequence number
+func (s *ipmiSession) roundTrip(build func() []byte, match func(byte, []byte) bool) ([]byte, error) {
+	buf := make([]byte, 1024)
+	for attempt := 0; attempt < ipmiRetries; attempt++ {
+		if _, err := s.conn.Write(build()); err != nil {
+			return nil, fmt.Errorf("contacting %s: %w", s.addr, err)
+		}
+		deadline := time.Now().Add(ipmiReadTimeout)
+		if !s.deadline.IsZero() && s.deadline.Before(deadline) {
+			deadline = s.deadline
+		}
+		s.conn.SetReadDeadline(deadline)
+		for {
+			n, err := s.conn.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("contacting %s: %w", s.addr, err)
+			}
+			payloadType, payload, err := s.parse(buf[:n])
+			if err == nil && match(payloadType, payload) {
+				return payload, nil
+			}
+		}
+		if !s.deadline.IsZero() && time.Now().After(s.deadline) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%s: no response to IPMI request", s.addr)
+}
+
+// packet wraps a payload in RMCP and the session header. Before session
+// setup the Get Channel Authentication Capabilities request uses IPMI 1.5
+// framing; once active, payloads are encrypted and signed.
+func (s *ipmiSession) packet(payloadType byte, payload []byte) []byte {
+	b := []byte{0x06, 0x00, 0xff, 0x07} // RMCP v1.0, no ACK, class IPMI
+	if payloadType == ipmiPayloadIPMI && s.k1 == nil && s.bmcID == 0 {
+		b = append(b, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, byte(len(payload)))
+		return append(b, payload...)
+	}
+
+	sessionID, seq := uint32(0), uint32(0)
+	if s.k1 != nil {
+		payloadType |= 0xc0 // Encrypted and authenticated
+		payload = s.encrypt(payload)
+		s.seq++
+		sessionID, seq = s.bmcID, s.seq
+	}
+	b = append(b, 0x06, payloadType) // Auth type RMCP+
+	b = binary.LittleEndian.AppendUint32(b, sessionID)
+	b = binary.LittleEndian.AppendUint32(b, seq)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(payload)))
+	b = append(b, payload...)
+
+	if s.k1 != nil {
+		// Pad so the signed part, from the auth type to the next header
+		// byte, is a multiple of four bytes
+		pad := (4 - (len(b)-4+2)%4) % 4
+		b = append(b, bytesOf(0xff, pad)...)
+		b = append(b, byte(pad), 0x07)
+		b = append(b, hmacSHA1(s.k1, b[4:])[:12]...)
+	}
+	return b
+}
+
+// parse checks an incoming packet and returns its payload type and
+// decrypted payload
+func (s *ipmiSession) parse(b []byte) (byte, []byte, error) {
+	if len(b) < 14 || b[0] != 0x06 || b[3] != 0x07 {
+		return 0, nil, errors.New("not an IPMI packet")
+	}
+	if b[4] == 0x00 { // IPMI 1.5 framing, only used before session setup
+		n := int(b[13])
+		if len(b) < 14+n {
+			return 0, nil, errors.New("truncated packet")
+		}
+		return ipmiPayloadIPMI, b[14 : 14+n], nil
+	}
+	if b[4] != 0x06 || len(b) < 16 {
+		return 0, nil, errors.New("unsupported session type")
+	}
+
+	payloadType := b[5]
+	n := int(binary.LittleEndian.Uint16(b[14:16]))
+	if len(b) < 16+n {
+		return 0, nil, errors.New("truncated packet")
+	}
+	payload := b[16 : 16+n]
+	if payloadType&0x40 != 0 {
+		if s.k1 == nil || len(b) < 16+n+14 || binary.LittleEndian.Uint32(b[6:10]) != s.consoleID {
+			return 0, nil, errors.New("unexpected authenticated packet")
+		}
+		end := len(b) - 12
+		if !hmac.Equal(b[end:], hmacSHA1(s.k1, b[4:end])[:12]) {
+			return 0, nil, errors.New("integrity check failed")
+		}
+	}
+	if payloadType&0x80 != 0 {
+		var err error
+		if payload, err = s.decrypt(payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	return payloadType & 0x3f, payload, nil
+}
+
+// encrypt applies AES-CBC-128 with a random IV and the IPMI padding scheme
+func (s *ipmiSession) encrypt(data []byte) []byte {
+	pad := (16 - (len(data)+1)%16) % 16
+	plain := append([]byte{}, data...)
+	for i := 1; i <= pad; i++ {
+		plain = append(plain, byte(i))
+	}
+	plain = append(plain, byte(pad))
+
+	out := make([]byte, aes.BlockSize+len(plain))
+	rand.Read(out[:aes.BlockSize])
+	block, _ := aes.NewCipher(s.k2[:16])
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+	return out
+}
+
+func (s *ipmiSession) decrypt(data []byte) ([]byte, error) {
+	if s.k2 == nil || len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted payload")
+	}
+	block, _ := aes.NewCipher(s.k2[:16])
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[aes.BlockSize:])
+	pad := int(plain[len(plain)-1])
+	if pad >= len(plain) {
+		return nil, errors.New("invalid padding")
+	}
+	return plain[:len(plain)-1-pad], nil
+}
+
+// readSDR reads every record in the SDR repository. Records are fetched in
+// small pieces, as many BMCs can't return a whole record in one response.
+func (s *ipmiSession) readSDR() ([][]byte, error) {
+	reserve := func() ([]byte, error) {
+		data, err := s.command(ipmiNetFnStorage, 0, ipmiCmdReserveSDR, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%s: short SDR reservation", s.addr)
+		}
+		return data[:2], nil
+	}
+	reservation, err := reserve()
+	if err != nil {
+		return nil, err
+	}
+
+	read := func(id uint16, offset, count byte) (uint16, []byte, error) {
+		req := append([]byte{}, reservation...)
+		req = binary.LittleEndian.AppendUint16(req, id)
+		req = append(req, offset, count)
+		data, err := s.command(ipmiNetFnStorage, 0, ipmiCmdGetSDR, req)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(data) < 2 {
+			return 0, nil, fmt.Errorf("%s: short SDR response", s.addr)
+		}
+		return binary.LittleEndian.Uint16(data[:2]), data[2:], nil
+	}
+
+	var records [][]byte
+	id := uint16(0)
+	for retried := false; id != 0xffff && len(records) < ipmiMaxSDR; {
+		next, rec, err := read(id, 0, 5)
+		if err == nil && len(rec) == 5 {
+			for offset := 5; offset < 5+int(rec[4]); {
+				count := 5 + int(rec[4]) - offset
+				if count > 16 {
+					count = 16
+				}
+				var chunk []byte
+				if _, chunk, err = read(id, byte(offset), byte(count)); err != nil {
+					break
+				}
+				rec = append(rec, chunk...)
+				offset += len(chunk)
+				if len(chunk) == 0 {
+					break
+				}
+			}
+		}
+
+		var cerr *ipmiCompletionError
+		if errors.As(err, &cerr) && cerr.code == ipmiReservationErr && !retried {
+			// Something changed the repository; start this record again
+			if reservation, err = reserve(); err != nil {
+				return nil, err
+			}
+			retried = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+		id, retried = next, false
+	}
+	return records, nil
+}
+
+// ipmiCompletionError is a non-zero completion code in a response
+type ipmiCompletionError struct {
+	cmd  byte
+	code byte
+}
+
+func (e *ipmiCompletionError) Error() string {
+	if desc, ok := ipmiCompletionCodes[e.code]; ok {
+		return fmt.Sprintf("IPMI command 0x%02x failed: %s", e.cmd, desc)
+	}
+	return fmt.Sprintf("IPMI command 0x%02x failed with completion code 0x%02x", e.cmd, e.code)
+}
+
+// ipmiStatusError checks a session setup reply's status code and length
+func ipmiStatusError(resp []byte, minLen int) error {
+	if code := resp[1]; code != 0 {
+		if desc, ok := ipmiStatusCodes[code]; ok {
+			return fmt.Errorf("IPMI session setup failed: %s", desc)
+		}
+		return fmt.Errorf("IPMI session setup failed with status 0x%02x", code)
+	}
+	if len(resp) < minLen {
+		return errors.New("IPMI session setup failed: short reply")
+	}
+	return nil
+}
+
+func ipmiChecksum(b []byte) byte {
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	return -sum
+}
+
+func hmacSHA1(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+func bytesOf(v byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = v
+	}
+	return b
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBMC answers IPMI-over-LAN on a local UDP port: the pre-session
+// capabilities query, RMCP+ session setup with cipher suite 3, and the
+// chassis, SDR and sensor commands the client sends. It follows the IPMI 2.0
+// spec independently of the client, so the RAKP proofs, session keys and
+// packet framing are checked against a second implementation.
+type fakeBMC struct {
+	conn     net.PacketConn
+	username string
+	password string
+	guid     []byte
+
+	mu             sync.Mutex
+	sessions       map[uint32]*fakeBMCSession // By our (the BMC's) session ID
+	power          bool
+	identify       bool
+	controls       []byte // Chassis Control values received
+	closed         int    // Sessions closed by the client
+	sdr            [][]byte
+	readings       map[byte][3]byte // Sensor number -> reading, flags, thresholds
+	reservation    uint16
+	cancelOnce     bool // Cancel the SDR reservation during the next partial read
+	corruptRAKP4   bool // Send a wrong integrity check value in RAKP 4
+	integrityFails int
+}
+
+type fakeBMCSession struct {
+	consoleID uint32
+	rm, rc    []byte
+	userInfo  []byte // Role, username length, username
+	k1, k2    []byte
+	seq       uint32
+}
+
+func newFakeBMC(t *testing.T) *fakeBMC {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBMC{
+		conn:     conn,
+		username: "admin",
+		password: "secret",
+		guid:     []byte("0123456789abcdef"),
+		sessions: make(map[uint32]*fakeBMCSession),
+		readings: make(map[byte][3]byte),
+	}
+	go b.serve()
+	t.Cleanup(func() { conn.Close() })
+	return b
+}
+
+// locked runs fn with the BMC's state locked, for setting it up and
+// inspecting it from tests
+func (b *fakeBMC) locked(fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn()
+}
+
+func (b *fakeBMC) client() *ipmiClient {
+	return newIPMIClient(Device{Host: b.conn.LocalAddr().String(), Username: b.username, Password: b.password})
+}
+
+func (b *fakeBMC) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		reply := b.handle(append([]byte(nil), buf[:n]...))
+		b.mu.Unlock()
+		if reply != nil {
+			b.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+func (b *fakeBMC) handle(pkt []byte) []byte {
+	if len(pkt) < 14 || pkt[0] != 0x06 || pkt[2] != 0xff || pkt[3] != 0x07 {
+		return nil
+	}
+	if pkt[4] == 0x00 { // IPMI 1.5, only for the capabilities query
+		msg := pkt[14 : 14+int(pkt[13])]
+		resp := b.command(msg)
+		out := []byte{0x06, 0x00, 0xff, 0x07, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, byte(len(resp))}
+		return append(out, resp...)
+	}
+	if pkt[4] != 0x06 || len(pkt) < 16 {
+		return nil
+	}
+
+	payloadType := pkt[5]
+	sessionID := binary.LittleEndian.Uint32(pkt[6:10])
+	n := int(binary.LittleEndian.Uint16(pkt[14:16]))
+	payload := pkt[16 : 16+n]
+
+	switch payloadType & 0x3f {
+	case ipmiPayloadOpenRequest:
+		return b.openSession(payload)
+	case ipmiPayloadRAKP1:
+		return b.rakp1(payload)
+	case ipmiPayloadRAKP3:
+		return b.rakp3(payload)
+	case ipmiPayloadIPMI:
+	default:
+		return nil
+	}
+
+	// Session traffic must be encrypted and authenticated with K1 and K2
+	s, ok := b.sessions[sessionID]
+	if !ok || s.k1 == nil || payloadType&0xc0 != 0xc0 {
+		return nil
+	}
+	end := len(pkt) - 12
+	if pkt[end-1] != 0x07 || (end-4)%4 != 0 || !hmac.Equal(pkt[end:], hmacSHA1(s.k1, pkt[4:end])[:12]) {
+		b.integrityFails++
+		return nil
+	}
+	msg := aesCBCDecrypt(s.k2[:16], payload)
+	if msg == nil {
+		return nil
+	}
+	if len(msg) >= 6 && msg[5] == ipmiCmdCloseSession {
+		b.closed++
+		defer delete(b.sessions, sessionID)
+	}
+	return b.sessionPacket(s, b.command(msg))
+}
+
+// sessionPacket encrypts and signs a reply for the console
+func (b *fakeBMC) sessionPacket(s *fakeBMCSession, msg []byte) []byte {
+	if msg == nil {
+		return nil
+	}
+	s.seq++
+	payload := aesCBCEncrypt(s.k2[:16], msg)
+	out := []byte{0x06, 0x00, 0xff, 0x07, 0x06, 0xc0 | ipmiPayloadIPMI}
+	out = binary.LittleEndian.AppendUint32(out, s.consoleID)
+	out = binary.LittleEndian.AppendUint32(out, s.seq)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(payload)))
+	out = append(out, payload...)
+	pad := 0
+	for (len(out)-4+pad+2)%4 != 0 {
+		pad++
+	}
+	out = append(out, make([]byte, pad)...)
+	out = append(out, byte(pad), 0x07)
+	return append(out, hmacSHA1(s.k1, out[4:])[:12]...)
+}
+
+// setupPacket frames an unauthenticated session setup reply
+func setupPacket(payloadType byte, payload []byte) []byte {
+	out := []byte{0x06, 0x00, 0xff, 0x07, 0x06, payloadType, 0, 0, 0, 0, 0, 0, 0, 0}
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(payload)))
+	return append(out, payload...)
+}
+
+func (b *fakeBMC) openSession(req []byte) []byte {
+	consoleID := binary.LittleEndian.Uint32(req[4:8])
+	status := byte(0)
+	// Only cipher suite 3: RAKP-HMAC-SHA1, HMAC-SHA1-96, AES-CBC-128
+	if len(req) < 32 || req[8] != 0x00 || req[12] != 0x01 || req[16] != 0x01 || req[20] != 0x01 ||
+		req[24] != 0x02 || req[28] != 0x01 {
+		status = 0x11
+	}
+	bmcID := uint32(0x1000 + len(b.sessions) + 1)
+	b.sessions[bmcID] = &fakeBMCSession{consoleID: consoleID}
+
+	resp := []byte{req[0], status, ipmiPrivAdmin, 0}
+	resp = binary.LittleEndian.AppendUint32(resp, consoleID)
+	resp = binary.LittleEndian.AppendUint32(resp, bmcID)
+	resp = append(resp, req[8:32]...)
+	return setupPacket(ipmiPayloadOpenResponse, resp)
+}
+
+func (b *fakeBMC) rakp1(req []byte) []byte {
+	bmcID := binary.LittleEndian.Uint32(req[4:8])
+	s, ok := b.sessions[bmcID]
+	if !ok {
+		return nil
+	}
+	s.rm = append([]byte(nil), req[8:24]...)
+	ulen := int(req[27])
+	s.userInfo = append([]byte{req[24], req[27]}, req[28:28+ulen]...)
+	s.rc = make([]byte, 16)
+	rand.Read(s.rc)
+
+	resp := []byte{req[0], 0, 0, 0}
+	resp = binary.LittleEndian.AppendUint32(resp, s.consoleID)
+	if string(req[28:28+ulen]) != b.username {
+		resp[1] = 0x0d // Unknown user
+		return setupPacket(ipmiPayloadRAKP2, resp)
+	}
+	resp = append(resp, s.rc...)
+	resp = append(resp, b.guid...)
+	// HMAC_Kuid(SIDm, SIDc, Rm, Rc, GUIDc, ROLEm, ULENGTHm, UNAMEm)
+	resp = append(resp, hmacSHA1(b.kuid(), le32(s.consoleID), le32(bmcID), s.rm, s.rc, b.guid, s.userInfo)...)
+	return setupPacket(ipmiPayloadRAKP2, resp)
+}
+
+func (b *fakeBMC) rakp3(req []byte) []byte {
+	bmcID := binary.LittleEndian.Uint32(req[4:8])
+	s, ok := b.sessions[bmcID]
+	if !ok {
+		return nil
+	}
+	resp := []byte{req[0], 0, 0, 0}
+	resp = binary.LittleEndian.AppendUint32(resp, s.consoleID)
+	// HMAC_Kuid(Rc, SIDm, ROLEm, ULENGTHm, UNAMEm)
+	if !hmac.Equal(req[8:28], hmacSHA1(b.kuid(), s.rc, le32(s.consoleID), s.userInfo)) {
+		resp[1] = 0x0f // Invalid integrity check value
+		return setupPacket(ipmiPayloadRAKP4, resp)
+	}
+
+	sik := hmacSHA1(b.kuid(), s.rm, s.rc, s.userInfo)
+	s.k1 = hmacSHA1(sik, bytesOf(0x01, 20))
+	s.k2 = hmacSHA1(sik, bytesOf(0x02, 20))
+	check := hmacSHA1(sik, s.rm, le32(bmcID), b.guid)[:12]
+	if b.corruptRAKP4 {
+		check[0] ^= 0xff
+	}
+	return setupPacket(ipmiPayloadRAKP4, append(resp, check...))
+}
+
+func (b *fakeBMC) kuid() []byte {
+	k := make([]byte, 20)
+	copy(k, b.password)
+	return k
+}
+
+// command runs one IPMI request message and builds the response message
+func (b *fakeBMC) command(msg []byte) []byte {
+	if len(msg) < 7 || msg[0] != ipmiBMCAddr || ipmiChecksum(msg[:2]) != msg[2] ||
+		ipmiChecksum(msg[3:len(msg)-1]) != msg[len(msg)-1] {
+		return nil
+	}
+	netFn, lun, seq, cmd := msg[1]>>2, msg[1]&0x03, msg[4], msg[5]
+	data := msg[6 : len(msg)-1]
+
+	cc, out := byte(0), []byte{}
+	switch {
+	case netFn == ipmiNetFnApp && cmd == ipmiCmdGetChannelAuthCaps:
+		out = []byte{0x01, 0x80 | 0x10, 0x04, 0x02, 0, 0, 0, 0} // IPMI 2.0 extended capabilities
+	case netFn == ipmiNetFnApp && cmd == ipmiCmdSetSessionPrivilege:
+		out = []byte{data[0]}
+	case netFn == ipmiNetFnApp && cmd == ipmiCmdCloseSession:
+	case netFn == ipmiNetFnChassis && cmd == ipmiCmdChassisStatus:
+		misc := byte(0x40) // Identify state reported
+		if b.identify {
+			misc |= 0x20 // Identify on, indefinitely
+		}
+		power := byte(0)
+		if b.power {
+			power = 0x01
+		}
+		out = []byte{power, 0, misc}
+	case netFn == ipmiNetFnChassis && cmd == ipmiCmdChassisControl:
+		b.controls = append(b.controls, data[0])
+		switch data[0] {
+		case 0x00, 0x05:
+			b.power = false
+		case 0x01:
+			b.power = true
+		}
+	case netFn == ipmiNetFnStorage && cmd == ipmiCmdReserveSDR:
+		b.reservation++
+		out = le16(b.reservation)
+	case netFn == ipmiNetFnStorage && cmd == ipmiCmdGetSDR:
+		cc, out = b.getSDR(data)
+	case netFn == ipmiNetFnSensor && cmd == ipmiCmdGetSensorReading:
+		r, ok := b.readings[data[0]]
+		if !ok {
+			cc = 0xcb
+		} else {
+			out = r[:]
+		}
+	default:
+		cc = 0xc1
+	}
+
+	resp := []byte{ipmiConsoleAddr, (netFn|1)<<2 | lun}
+	resp = append(resp, ipmiChecksum(resp))
+	body := append([]byte{ipmiBMCAddr, seq, cmd, cc}, out...)
+	resp = append(resp, body...)
+	return append(resp, ipmiChecksum(body))
+}
+
+// getSDR serves Get SDR, requiring the current reservation for partial
+// reads and at most 16 bytes at a time
+func (b *fakeBMC) getSDR(req []byte) (byte, []byte) {
+	reservation := binary.LittleEndian.Uint16(req[0:2])
+	id := binary.LittleEndian.Uint16(req[2:4])
+	offset, count := int(req[4]), int(req[5])
+	if offset > 0 && b.cancelOnce {
+		b.cancelOnce = false
+		b.reservation++
+		return ipmiReservationErr, nil
+	}
+	if offset > 0 && reservation != b.reservation {
+		return ipmiReservationErr, nil
+	}
+	if count > 16 {
+		return 0xca, nil // Cannot return that many bytes
+	}
+
+	index := 0
+	if id != 0 {
+		index = int(id) - 1
+	}
+	if index >= len(b.sdr) {
+		return 0xcb, nil
+	}
+	next := uint16(0xffff)
+	if index+1 < len(b.sdr) {
+		next = uint16(index + 2)
+	}
+	rec := b.sdr[index]
+	if offset+count > len(rec) {
+		count = len(rec) - offset
+	}
+	return 0, append(le16(next), rec[offset:offset+count]...)
+}
+
+// addSDR appends a record, filling in its ID and length
+func (b *fakeBMC) addSDR(rec []byte) {
+	binary.LittleEndian.PutUint16(rec[0:2], uint16(len(b.sdr)+1))
+	rec[4] = byte(len(rec) - 5)
+	b.sdr = append(b.sdr, rec)
+}
+
+// fullSensorRecord builds a type 0x01 record for a threshold sensor:
+// y = (M*x + B*10^bExp) * 10^rExp
+func fullSensorRecord(number, sensorType, baseUnit byte, m, bOffset, rExp, bExp int, name string) []byte {
+	rec := make([]byte, 48+len(name))
+	rec[2] = 0x51 // SDR version
+	rec[3] = 0x01
+	rec[5] = ipmiBMCAddr
+	rec[7] = number
+	rec[12] = sensorType
+	rec[13] = 0x01 // Threshold
+	rec[20] = 0x00 // Unsigned readings
+	rec[21] = baseUnit
+	rec[24], rec[25] = byte(m), byte(m>>8&0x03)<<6
+	rec[26], rec[27] = byte(bOffset), byte(bOffset>>8&0x03)<<6
+	rec[29] = byte(rExp&0x0f)<<4 | byte(bExp&0x0f)
+	rec[47] = 0xc0 | byte(len(name))
+	copy(rec[48:], name)
+	return rec
+}
+
+func le16(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+
+// aesCBCEncrypt applies the IPMI confidentiality trailer: pad bytes 1, 2, ...
+// then the pad length
+func aesCBCEncrypt(key, data []byte) []byte {
+	plain := append([]byte(nil), data...)
+	for pad := 1; (len(plain)+1)%aes.BlockSize != 0; pad++ {
+		plain = append(plain, byte(pad))
+	}
+	plain = append(plain, byte(len(plain)-len(data)))
+	out := make([]byte, aes.BlockSize+len(plain))
+	rand.Read(out[:aes.BlockSize])
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+	return out
+}
+
+func aesCBCDecrypt(key, data []byte) []byte {
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil
+	}
+	block, _ := aes.NewCipher(key)
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[aes.BlockSize:])
+	pad := int(plain[len(plain)-1])
+	for i := 0; i < pad; i++ { // Pad bytes must count up from 1
+		if plain[len(plain)-1-pad+i] != byte(i+1) {
+			return nil
+		}
+	}
+	return plain[:len(plain)-1-pad]
+}
+
+func ipmiTestContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestIPMIPowerState(t *testing.T) {
+	bmc := newFakeBMC(t)
+	bmc.locked(func() { bmc.power, bmc.identify = true, true })
+
+	state, err := bmc.client().PowerState(ipmiTestContext(t))
+	if err != nil {
+		t.Fatalf("PowerState: %v", err)
+	}
+	if state.Power != "on" || !state.LEDs["identify"] {
+		t.Errorf("state = %+v, want on with identify lit", state)
+	}
+	bmc.locked(func() {
+		if bmc.closed != 1 || bmc.integrityFails != 0 {
+			t.Errorf("closed %d sessions with %d integrity failures, want 1 and 0", bmc.closed, bmc.integrityFails)
+		}
+	})
+}
+
+func TestIPMIPower(t *testing.T) {
+	for action, control := range ipmiChassisControl {
+		t.Run(action, func(t *testing.T) {
+			bmc := newFakeBMC(t)
+			if err := bmc.client().Power(ipmiTestContext(t), action); err != nil {
+				t.Fatalf("Power(%s): %v", action, err)
+			}
+			bmc.locked(func() {
+				if len(bmc.controls) != 1 || bmc.controls[0] != control {
+					t.Errorf("BMC got chassis control %v, want %#x", bmc.controls, control)
+				}
+			})
+		})
+	}
+}
+
+func TestIPMISessionSetupErrors(t *testing.T) {
+	bmc := newFakeBMC(t)
+	c := bmc.client()
+
+	// RAKP 2's proof doesn't match a wrong password
+	c.password = "wrong"
+	if _, err := c.PowerState(ipmiTestContext(t)); !errors.Is(err, errIPMIPassword) {
+		t.Errorf("wrong password: %v, want errIPMIPassword", err)
+	}
+
+	c = bmc.client()
+	c.username = "nobody"
+	if _, err := c.PowerState(ipmiTestContext(t)); err == nil || !strings.Contains(err.Error(), "unknown user") {
+		t.Errorf("unknown user: %v", err)
+	}
+
+	// A BMC that can't prove it derived the same session key is rejected
+	bmc.locked(func() { bmc.corruptRAKP4 = true })
+	if _, err := bmc.client().PowerState(ipmiTestContext(t)); err == nil || !strings.Contains(err.Error(), "session key check failed") {
+		t.Errorf("bad RAKP 4: %v", err)
+	}
+}
+
+func TestIPMISensors(t *testing.T) {
+	bmc := newFakeBMC(t)
+	bmc.mu.Lock()
+	bmc.addSDR(fullSensorRecord(1, 0x01, 1, 1, 0, 0, 0, "CPU Temp"))            // 1 C per count
+	bmc.addSDR(fullSensorRecord(2, 0x02, 4, 6, 0, -2, 0, "12V"))                // 0.06 V per count
+	bmc.addSDR(fullSensorRecord(3, 0x04, 18, 75, 0, 0, 0, "FAN1"))              // 75 RPM per count
+	bmc.addSDR(fullSensorRecord(4, 0x01, 1, 1, -40, 0, 0, "Inlet Temp"))        // Offset by -40 C
+	bmc.addSDR(fullSensorRecord(5, 0x0b, 6, 2, 0, 0, 0, "PSU Power"))           // Other sensor type in watts
+	bmc.addSDR(fullSensorRecord(6, 0x01, 1, 1, 0, 0, 0, "Absent Temp"))         // Reading unavailable
+	bmc.addSDR(fullSensorRecord(7, 0x01, 1, 1, 0, 0, 0, "A name that is long")) // Needs three partial reads
+	compact := make([]byte, 32)
+	compact[3] = 0x02 // Compact sensor records have no conversion factors
+	bmc.addSDR(compact)
+
+	bmc.readings[1] = [3]byte{42, 0x40, 0}
+	bmc.readings[2] = [3]byte{200, 0x40, 0}
+	bmc.readings[3] = [3]byte{40, 0x40, 0x01} // Below lower non-critical
+	bmc.readings[4] = [3]byte{65, 0x40, 0x10} // Above upper critical
+	bmc.readings[5] = [3]byte{90, 0x40, 0}
+	bmc.readings[6] = [3]byte{0, 0x60, 0}
+	bmc.readings[7] = [3]byte{30, 0x40, 0}
+	bmc.cancelOnce = true
+	bmc.mu.Unlock()
+
+	sensors, err := bmc.client().Sensors(ipmiTestContext(t))
+	if err != nil {
+		t.Fatalf("Sensors: %v", err)
+	}
+	want := []struct {
+		name, kind, units, status string
+		value                     float64
+	}{
+		{"CPU Temp", "temperature", "C", "ok", 42},
+		{"12V", "voltage", "V", "ok", 12},
+		{"FAN1", "fan", "RPM", "warning", 3000},
+		{"Inlet Temp", "temperature", "C", "critical", 25},
+		{"PSU Power", "power", "W", "ok", 180},
+		{"Absent Temp", "temperature", "C", "unknown", 0},
+		{"A name that is long", "temperature", "C", "ok", 30},
+	}
+	if len(sensors) != len(want) {
+		t.Fatalf("got %d sensors, want %d: %+v", len(sensors), len(want), sensors)
+	}
+	for i, w := range want {
+		s := sensors[i]
+		if s.Name != w.name || s.Type != w.kind || s.Units != w.units || s.Status != w.status {
+			t.Errorf("sensor %d = %+v, want %+v", i, s, w)
+		}
+		switch {
+		case w.status == "unknown" && s.Value != nil:
+			t.Errorf("%s: value %v for an unavailable reading", w.name, *s.Value)
+		case w.status != "unknown" && (s.Value == nil || *s.Value != w.value):
+			t.Errorf("%s: value %v, want %v", w.name, s.Value, w.value)
+		}
+	}
+	bmc.locked(func() {
+		if bmc.cancelOnce {
+			t.Error("the cancelled reservation was never exercised")
+		}
+	})
+}
+
+func TestIPMISensorConversion(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    ipmiSensor
+		raw  byte
+		want float64
+	}{
+		{"unsigned", ipmiSensor{m: 1}, 200, 200},
+		{"two's complement", ipmiSensor{units1: 0x80, m: 1}, 0xf6, -10},
+		{"one's complement", ipmiSensor{units1: 0x40, m: 1}, 0xf5, -10},
+		{"offset with exponent", ipmiSensor{m: 5, b: 3, bExp: 1, rExp: -1}, 10, 8},
+		{"square", ipmiSensor{m: 1, linearization: 8}, 12, 144},
+	} {
+		if got := tc.s.convert(tc.raw); got != tc.want {
+			t.Errorf("%s: convert(%#x) = %v, want %v", tc.name, tc.raw, got, tc.want)
+		}
+	}
+
+	// Records for other owners or without analog readings are skipped
+	rec := fullSensorRecord(1, 0x01, 1, 1, 0, 0, 0, "x")
+	rec[5] = 0x2c
+	if _, ok := parseFullSensorRecord(rec); ok {
+		t.Error("parsed a record owned by another controller")
+	}
+	rec = fullSensorRecord(1, 0x01, 1, 1, 0, 0, 0, "x")
+	rec[20] = 0xc0
+	if _, ok := parseFullSensorRecord(rec); ok {
+		t.Error("parsed a sensor without analog readings")
+	}
+	if s, ok := parseFullSensorRecord(fullSensorRecord(9, 0x01, 1, -3, -100, -1, 2, "")); !ok ||
+		s.m != -3 || s.b != -100 || s.rExp != -1 || s.bExp != 2 || s.name != "Sensor 9" {
+		t.Errorf("negative factors: %+v, %v", s, ok)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// pikvmActions maps our power actions to kvmd's ATX actions
+var pikvmActions = map[string]string{
+	"on":       "on",
+	"off":      "off",
+	"off_hard": "off_hard",
+	"reset":    "reset_hard",
+}
+
+// pikvmClient talks to kvmd's ATX (/api/atx), streamer and mass storage
+// (/api/msd) APIs, authenticating with the device's stored credentials
+type pikvmClient struct {
+	host     string
+	username string
+	password string
+	client   *http.Client
+}
+
+func newPiKVMClient(d Device) *pikvmClient {
+	return &pikvmClient{
+		host:     d.Host,
+		username: d.Username,
+		password: d.Password,
+		client:   newDeviceHTTPClient(),
+	}
+}
+
+// PowerState reads the ATX LEDs (GET /api/atx)
+func (c *pikvmClient) PowerState(ctx context.Context) (PowerState, error) {
+	var atx struct {
+		Enabled bool `json:"enabled"`
+		Busy    bool `json:"busy"`
+		LEDs    struct {
+			Power bool `json:"power"`
+			HDD   bool `json:"hdd"`
+		} `json:"leds"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/api/atx", &atx); err != nil {
+		return PowerState{}, err
+	}
+	if !atx.Enabled {
+		return PowerState{}, fmt.Errorf("ATX is disabled on this PiKVM")
+	}
+
+	state := PowerState{
+		Power: "off",
+		LEDs:  map[string]bool{"power": atx.LEDs.Power, "hdd": atx.LEDs.HDD},
+		Busy:  atx.Busy,
+	}
+	if atx.LEDs.Power {
+		state.Power = "on"
+	}
+	return state, nil
+}
+
+// Power presses the ATX buttons (POST /api/atx/power?action=...)
+func (c *pikvmClient) Power(ctx context.Context, action string) error {
+	atxAction, ok := pikvmActions[action]
+	if !ok {
+		return fmt.Errorf("unsupported action %q", action)
+	}
+	return c.call(ctx, http.MethodPost, "/api/atx/power?action="+url.QueryEscape(atxAction), nil)
+}
+
+// maxSnapshotSize caps the screen snapshots read from kvmd
+const maxSnapshotSize = 16 << 20
+
+// Snapshot grabs the current screen as a JPEG (GET /api/streamer/snapshot)
+func (c *pikvmClient) Snapshot(ctx context.Context) ([]byte, error) {
+	resp, err := c.request(ctx, http.MethodGet, "/api/streamer/snapshot")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		return io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize))
+	}
+	// Errors, e.g. the streamer not running, come back as kvmd's JSON
+	if err := c.decode(resp, nil); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s: unexpected snapshot response (HTTP %d)", c.host, resp.StatusCode)
+}
+
+// kvmdMSD is kvmd's mass storage state (GET /api/msd)
+type kvmdMSD struct {
+	Enabled bool `json:"enabled"`
+	Online  bool `json:"online"`
+	Busy    bool `json:"busy"`
+	Storage struct {
+		Free   int64 `json:"free"`
+		Images map[string]struct {
+			Size     int64 `json:"size"`
+			Complete bool  `json:"complete"`
+		} `json:"images"`
+	} `json:"storage"`
+	Drive struct {
+		Image *struct {
+			Name string `json:"name"`
+		} `json:"image"`
+		Connected bool `json:"connected"`
+		CDROM     bool `json:"cdrom"`
+		RW        bool `json:"rw"`
+	} `json:"drive"`
+}
+
+// msd reads the mass storage state, failing if the drive can't be used
+func (c *pikvmClient) msd(ctx context.Context) (kvmdMSD, error) {
+	var msd kvmdMSD
+	if err := c.call(ctx, http.MethodGet, "/api/msd", &msd); err != nil {
+		return msd, err
+	}
+	switch {
+	case !msd.Enabled:
+		return msd, fmt.Errorf("%s: mass storage is disabled on this PiKVM", c.host)
+	case !msd.Online:
+		return msd, fmt.Errorf("%s: the mass storage drive is offline", c.host)
+	}
+	return msd, nil
+}
+
+// MediaState reads the virtual drive and the images stored on the device
+func (c *pikvmClient) MediaState(ctx context.Context) (MediaState, error) {
+	msd, err := c.msd(ctx)
+	if err != nil {
+		return MediaState{}, err
+	}
+	state := MediaState{
+		Connected: msd.Drive.Connected,
+		CDROM:     msd.Drive.CDROM,
+		RW:        msd.Drive.RW,
+		Busy:      msd.Busy,
+		Free:      msd.Storage.Free,
+		Stored:    []StoredImage{},
+	}
+	if msd.Drive.Image != nil {
+		state.Image = msd.Drive.Image.Name
+	}
+	for name, img := range msd.Storage.Images {
+		state.Stored = append(state.Stored, StoredImage{Name: name, Size: img.Size, Complete: img.Complete})
+	}
+	sort.Slice(state.Stored, func(i, j int) bool { return state.Stored[i].Name < state.Stored[j].Name })
+	return state, nil
+}
+
+// UploadMedia writes an image to the device's storage, replacing any image
+// of the same name (POST /api/msd/write). kvmd needs the size up front, so
+// the image is streamed with a Content-Length.
+func (c *pikvmClient) UploadMedia(ctx context.Context, name string, image io.ReadSeeker, size int64, progress func(sent int64)) error {
+	msd, err := c.msd(ctx)
+	if err != nil {
+		return err
+	}
+	free := msd.Storage.Free
+	if old, ok := msd.Storage.Images[name]; ok {
+		if msd.Drive.Connected && msd.Drive.Image != nil && msd.Drive.Image.Name == name {
+			if err := c.setConnected(ctx, false); err != nil {
+				return err
+			}
+		}
+		if err := c.call(ctx, http.MethodPost, "/api/msd/remove?image="+url.QueryEscape(name), nil); err != nil {
+			return err
+		}
+		free += old.Size
+	}
+	if free < size {
+		return fmt.Errorf("%s: not enough space for %s (%d bytes free)", c.host, name, free)
+	}
+
+	// Uploads take as long as they take; ctx decides when to give up
+	client := *c.client
+	client.Timeout = 0
+	path := "/api/msd/write?remove_incomplete=1&image=" + url.QueryEscape(name)
+	resp, err := c.send(ctx, &client, http.MethodPost, path, image, size, progress)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.decode(resp, nil)
+}
+
+// AttachMedia selects an image and connects the drive to the host,
+// disconnecting whatever was attached before
+func (c *pikvmClient) AttachMedia(ctx context.Context, name string, cdrom, rw bool) error {
+	msd, err := c.msd(ctx)
+	if err != nil {
+		return err
+	}
+	if msd.Drive.Connected {
+		if err := c.setConnected(ctx, false); err != nil {
+			return err
+		}
+	}
+	params := url.Values{"image": {name}, "cdrom": {boolParam(cdrom)}, "rw": {boolParam(rw)}}
+	if err := c.call(ctx, http.MethodPost, "/api/msd/set_params?"+params.Encode(), nil); err != nil {
+		return err
+	}
+	return c.setConnected(ctx, true)
+}
+
+// EjectMedia disconnects the drive from the host; the image stays stored
+func (c *pikvmClient) EjectMedia(ctx context.Context) error {
+	msd, err := c.msd(ctx)
+	if err != nil {
+		return err
+	}
+	if !msd.Drive.Connected {
+		return nil
+	}
+	return c.setConnected(ctx, false)
+}
+
+func (c *pikvmClient) setConnected(ctx context.Context, connected bool) error {
+	return c.call(ctx, http.MethodPost, "/api/msd/set_connected?connected="+boolParam(connected), nil)
+}
+
+// boolParam formats a flag the way kvmd's query parameters expect
+func boolParam(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// call makes a kvmd API request and decodes its result into out
+func (c *pikvmClient) call(ctx context.Context, method, path string, out interface{}) error {
+	resp, err := c.request(ctx, method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.decode(resp, out)
+}
+
+// request sends a kvmd API request with the stored credentials
+func (c *pikvmClient) request(ctx context.Context, method, path string) (*http.Response, error) {
+	return c.send(ctx, c.client, method, path, nil, 0, nil)
+}
+
+// send is request with an optional body of a known size. The body is
+// rewound for each attempt, and progress is told how much has been read.
+func (c *pikvmClient) send(ctx context.Context, client *http.Client, method, path string, body io.ReadSeeker, size int64, progress func(sent int64)) (*http.Response, error) {
+	resp, err := doDeviceRequest(client, func(scheme string) (*http.Request, error) {
+		var reader io.Reader
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			reader = &progressReader{r: body, progress: progress}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+c.host+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.ContentLength = size
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		if c.username != "" {
+			req.Header.Set("X-KVMD-User", c.username)
+			req.Header.Set("X-KVMD-Passwd", c.password)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("contacting %s: %w", c.host, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s rejected the stored credentials", c.host)
+	}
+	return resp, nil
+}
+
+// decode reads a kvmd response, decoding its result into out if given
+func (c *pikvmClient) decode(resp *http.Response, out interface{}) error {
+	// kvmd wraps every response as {"ok": bool, "result": ...}
+	var body struct {
+		OK     bool            `json:"ok"`
+		Result json.RawMessage `json:"result"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err := json.Unmarshal(data, &body); err != nil {
+		return fmt.Errorf("%s: unexpected response (HTTP %d); is it a PiKVM?", c.host, resp.StatusCode)
+	}
+	if !body.OK {
+		var kvmdErr struct {
+			Error    string `json:"error"`
+			ErrorMsg string `json:"error_msg"`
+		}
+		json.Unmarshal(body.Result, &kvmdErr)
+		if kvmdErr.Error == "AtxIsBusyError" {
+			return errPowerBusy
+		}
+		msg := kvmdErr.ErrorMsg
+		if msg == "" {
+			msg = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		}
+		return fmt.Errorf("%s: %s", c.host, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Result, out)
+}
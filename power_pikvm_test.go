@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKVMD serves the parts of kvmd's ATX API the PiKVM client uses
+type fakeKVMD struct {
+	username, password string
+
+	mu      sync.Mutex
+	enabled bool
+	busy    bool
+	power   bool
+	hdd     bool
+	actions []string // ATX actions received, in order
+}
+
+func (k *fakeKVMD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-KVMD-User") != k.username || r.Header.Get("X-KVMD-Passwd") != k.password {
+		kvmdReply(w, http.StatusForbidden, false, map[string]string{"error": "ForbiddenError", "error_msg": "Forbidden"})
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/atx":
+		result := map[string]interface{}{
+			"enabled": k.enabled,
+			"busy":    k.busy,
+			"leds":    map[string]bool{"power": k.power, "hdd": k.hdd},
+		}
+		kvmdReply(w, http.StatusOK, true, result)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/atx/power":
+		action := r.URL.Query().Get("action")
+		switch {
+		case k.busy:
+			kvmdReply(w, http.StatusConflict, false, map[string]string{"error": "AtxIsBusyError", "error_msg": "Performing another ATX operation"})
+			return
+		case action == "on":
+			k.power = true
+		case action == "off" || action == "off_hard":
+			k.power = false
+		case action == "reset_hard":
+		default:
+			kvmdReply(w, http.StatusBadRequest, false, map[string]string{"error": "ValidatorError", "error_msg": "Invalid ATX power action"})
+			return
+		}
+		k.actions = append(k.actions, action)
+		kvmdReply(w, http.StatusOK, true, map[string]interface{}{})
+	default:
+		kvmdReply(w, http.StatusNotFound, false, map[string]string{"error": "HttpError", "error_msg": "Not found"})
+	}
+}
+
+// kvmdReply writes kvmd's {"ok": ..., "result": ...} envelope
+func kvmdReply(w http.ResponseWriter, status int, ok bool, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": ok, "result": result})
+}
+
+// newFakeKVMD starts a kvmd fake over HTTPS, as PiKVMs serve by default
+func newFakeKVMD(t *testing.T) (*fakeKVMD, *pikvmClient) {
+	t.Helper()
+	k := &fakeKVMD{username: "admin", password: "admin", enabled: true}
+	srv := httptest.NewTLSServer(k)
+	t.Cleanup(srv.Close)
+	return k, newPiKVMClient(Device{Host: strings.TrimPrefix(srv.URL, "https://"), Username: "admin", Password: "admin"})
+}
+
+func TestPiKVMPowerState(t *testing.T) {
+	k, c := newFakeKVMD(t)
+	ctx := context.Background()
+
+	state, err := c.PowerState(ctx)
+	if err != nil {
+		t.Fatalf("PowerState: %v", err)
+	}
+	if state.Power != "off" || state.LEDs["power"] || state.LEDs["hdd"] || state.Busy {
+		t.Errorf("state = %+v, want off", state)
+	}
+
+	k.mu.Lock()
+	k.power, k.hdd, k.busy = true, true, true
+	k.mu.Unlock()
+	state, err = c.PowerState(ctx)
+	if err != nil {
+		t.Fatalf("PowerState: %v", err)
+	}
+	if state.Power != "on" || !state.LEDs["power"] || !state.LEDs["hdd"] || !state.Busy {
+		t.Errorf("state = %+v, want on with both LEDs lit and busy", state)
+	}
+
+	k.mu.Lock()
+	k.enabled = false
+	k.mu.Unlock()
+	if _, err := c.PowerState(ctx); err == nil || !strings.Contains(err.Error(), "ATX is disabled") {
+		t.Errorf("PowerState with ATX disabled: %v", err)
+	}
+}
+
+func TestPiKVMPower(t *testing.T) {
+	for _, tc := range []struct {
+		action, atx string
+		power       bool
+	}{
+		{"on", "on", true},
+		{"off", "off", false},
+		{"off_hard", "off_hard", false},
+		{"reset", "reset_hard", true},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			k, c := newFakeKVMD(t)
+			k.power = tc.action != "on"
+			if err := c.Power(context.Background(), tc.action); err != nil {
+				t.Fatalf("Power(%s): %v", tc.action, err)
+			}
+			if len(k.actions) != 1 || k.actions[0] != tc.atx {
+				t.Errorf("kvmd got %v, want %s", k.actions, tc.atx)
+			}
+			if state, _ := c.PowerState(context.Background()); state.LEDs["power"] != tc.power {
+				t.Errorf("power LED = %v after %s", state.LEDs["power"], tc.action)
+			}
+		})
+	}
+}
+
+func TestPiKVMPowerErrors(t *testing.T) {
+	k, c := newFakeKVMD(t)
+	ctx := context.Background()
+
+	if err := c.Power(ctx, "cycle"); err == nil || len(k.actions) != 0 {
+		t.Errorf("unsupported action: err = %v, kvmd got %v", err, k.actions)
+	}
+
+	k.busy = true
+	if err := c.Power(ctx, "on"); !errors.Is(err, errPowerBusy) {
+		t.Errorf("Power while busy = %v, want errPowerBusy", err)
+	}
+
+	c.password = "wrong"
+	if _, err := c.PowerState(ctx); err == nil || !strings.Contains(err.Error(), "rejected the stored credentials") {
+		t.Errorf("PowerState with a wrong password: %v", err)
+	}
+}
+
+func TestPiKVMPlainHTTP(t *testing.T) {
+	k := &fakeKVMD{enabled: true, power: true}
+	srv := httptest.NewServer(k)
+	defer srv.Close()
+
+	c := newPiKVMClient(Device{Host: strings.TrimPrefix(srv.URL, "http://")})
+	state, err := c.PowerState(context.Background())
+	if err != nil || state.Power != "on" {
+		t.Errorf("PowerState over HTTP = %+v, %v", state, err)
+	}
+}
+
+func TestPiKVMNotAPiKVM(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>router login</html>"))
+	}))
+	defer srv.Close()
+
+	c := newPiKVMClient(Device{Host: strings.TrimPrefix(srv.URL, "https://")})
+	if _, err := c.PowerState(context.Background()); err == nil || !strings.Contains(err.Error(), "is it a PiKVM?") {
+		t.Errorf("PowerState = %v", err)
+	}
+}
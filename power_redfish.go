@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// redfishResetTypes maps our power actions to ComputerSystem.Reset types
+var redfishResetTypes = map[string]string{
+	"on":       "On",
+	"off":      "GracefulShutdown",
+	"off_hard": "ForceOff",
+	"reset":    "ForceRestart",
+}
+
+// maxSELEntries caps how many event log entries are returned
+const maxSELEntries = 200
+
+// redfishClient manages a BMC through its Redfish API, using the first
+// system and chassis it lists. It authenticates with basic auth, which
+// every Redfish service supports, so no session needs cleaning up.
+type redfishClient struct {
+	host     string
+	username string
+	password string
+	client   *http.Client
+}
+
+// redfishLink is a reference to another resource
+type redfishLink struct {
+	ID string `json:"@odata.id"`
+}
+
+// redfishCollection is a resource collection, e.g. /redfish/v1/Systems
+type redfishCollection struct {
+	Members []redfishLink `json:"Members"`
+}
+
+type redfishStatus struct {
+	State  string `json:"State"`
+	Health string `json:"Health"`
+}
+
+func newRedfishClient(d Device) *redfishClient {
+	return &redfishClient{
+		host:     d.Host,
+		username: d.Username,
+		password: d.Password,
+		client:   newDeviceHTTPClient(),
+	}
+}
+
+// PowerState reads the first system's power state and indicator LED
+func (c *redfishClient) PowerState(ctx context.Context) (PowerState, error) {
+	var system struct {
+		PowerState   string `json:"PowerState"`
+		IndicatorLED string `json:"IndicatorLED"`
+	}
+	uri, err := c.firstMember(ctx, "/redfish/v1/Systems")
+	if err != nil {
+		return PowerState{}, err
+	}
+	if err := c.get(ctx, uri, &system); err != nil {
+		return PowerState{}, err
+	}
+
+	state := PowerState{Power: "unknown"}
+	switch system.PowerState {
+	case "On":
+		state.Power = "on"
+	case "Off":
+		state.Power = "off"
+	case "PoweringOn":
+		state.Power, state.Busy = "off", true
+	case "PoweringOff":
+		state.Power, state.Busy = "on", true
+	}
+	if system.IndicatorLED != "" && system.IndicatorLED != "Unknown" {
+		state.LEDs = map[string]bool{"identify": system.IndicatorLED != "Off"}
+	}
+	return state, nil
+}
+
+// Power posts ComputerSystem.Reset to the first system
+func (c *redfishClient) Power(ctx context.Context, action string) error {
+	resetType, ok := redfishResetTypes[action]
+	if !ok {
+		return fmt.Errorf("unsupported action %q", action)
+	}
+
+	uri, err := c.firstMember(ctx, "/redfish/v1/Systems")
+	if err != nil {
+		return err
+	}
+	var system struct {
+		Actions map[string]struct {
+			Target  string   `json:"target"`
+			Allowed []string `json:"ResetType@Redfish.AllowableValues"`
+		} `json:"Actions"`
+	}
+	if err := c.get(ctx, uri, &system); err != nil {
+		return err
+	}
+
+	target := uri + "/Actions/ComputerSystem.Reset"
+	if reset, ok := system.Actions["#ComputerSystem.Reset"]; ok {
+		if reset.Target != "" {
+			target = reset.Target
+		}
+		if len(reset.Allowed) > 0 && !containsString(reset.Allowed, resetType) {
+			return fmt.Errorf("%s doesn't support the %s reset type (it allows %s)",
+				c.host, resetType, strings.Join(reset.Allowed, ", "))
+		}
+	}
+
+	body, _ := json.Marshal(map[string]string{"ResetType": resetType})
+	return c.do(ctx, http.MethodPost, target, body, nil)
+}
+
+// Sensors reads temperatures, fans, power and voltages from the first
+// chassis' Thermal and Power resources
+func (c *redfishClient) Sensors(ctx context.Context) ([]SensorReading, error) {
+	uri, err := c.firstMember(ctx, "/redfish/v1/Chassis")
+	if err != nil {
+		return nil, err
+	}
+	var chassis struct {
+		Thermal redfishLink `json:"Thermal"`
+		Power   redfishLink `json:"Power"`
+	}
+	if err := c.get(ctx, uri, &chassis); err != nil {
+		return nil, err
+	}
+
+	sensors := []SensorReading{}
+	if chassis.Thermal.ID != "" {
+		var thermal struct {
+			Temperatures []struct {
+				Name           string        `json:"Name"`
+				ReadingCelsius *float64      `json:"ReadingCelsius"`
+				Status         redfishStatus `json:"Status"`
+			} `json:"Temperatures"`
+			Fans []struct {
+				Name         string        `json:"Name"`
+				FanName      string        `json:"FanName"` // Before Redfish 2016.2
+				Reading      *float64      `json:"Reading"`
+				ReadingUnits string        `json:"ReadingUnits"`
+				Status       redfishStatus `json:"Status"`
+			} `json:"Fans"`
+		}
+		if err := c.get(ctx, chassis.Thermal.ID, &thermal); err != nil {
+			return nil, err
+		}
+		for _, t := range thermal.Temperatures {
+			if t.Status.State != "Absent" {
+				sensors = append(sensors, SensorReading{Name: t.Name, Type: "temperature", Value: t.ReadingCelsius, Units: "C", Status: redfishHealth(t.Status)})
+			}
+		}
+		for _, f := range thermal.Fans {
+			if f.Status.State == "Absent" {
+				continue
+			}
+			name, units := f.Name, "RPM"
+			if name == "" {
+				name = f.FanName
+			}
+			if f.ReadingUnits == "Percent" {
+				units = "%"
+			}
+			sensors = append(sensors, SensorReading{Name: name, Type: "fan", Value: f.Reading, Units: units, Status: redfishHealth(f.Status)})
+		}
+	}
+
+	if chassis.Power.ID != "" {
+		var power struct {
+			PowerControl []struct {
+				Name               string        `json:"Name"`
+				PowerConsumedWatts *float64      `json:"PowerConsumedWatts"`
+				Status             redfishStatus `json:"Status"`
+			} `json:"PowerControl"`
+			Voltages []struct {
+				Name         string        `json:"Name"`
+				ReadingVolts *float64      `json:"ReadingVolts"`
+				Status       redfishStatus `json:"Status"`
+			} `json:"Voltages"`
+		}
+		if err := c.get(ctx, chassis.Power.ID, &power); err != nil {
+			return nil, err
+		}
+		for _, p := range power.PowerControl {
+			name := p.Name
+			if name == "" {
+				name = "Power consumption"
+			}
+			sensors = append(sensors, SensorReading{Name: name, Type: "power", Value: p.PowerConsumedWatts, Units: "W", Status: redfishHealth(p.Status)})
+		}
+		for _, v := range power.Voltages {
+			if v.Status.State != "Absent" {
+				sensors = append(sensors, SensorReading{Name: v.Name, Type: "voltage", Value: v.ReadingVolts, Units: "V", Status: redfishHealth(v.Status)})
+			}
+		}
+	}
+	return sensors, nil
+}
+
+// SEL returns the system event log. Services put it under the system or
+// under the manager (the BMC itself), so both are searched for a log
+// service called SEL, falling back to the first one found.
+func (c *redfishClient) SEL(ctx context.Context) ([]SELEntry, error) {
+	var services []string
+	for _, parent := range []string{"/redfish/v1/Systems", "/redfish/v1/Managers"} {
+		uri, err := c.firstMember(ctx, parent)
+		if err != nil {
+			continue
+		}
+		var res struct {
+			LogServices redfishLink `json:"LogServices"`
+		}
+		if err := c.get(ctx, uri, &res); err != nil || res.LogServices.ID == "" {
+			continue
+		}
+		var logs redfishCollection
+		if err := c.get(ctx, res.LogServices.ID, &logs); err != nil {
+			continue
+		}
+		for _, m := range logs.Members {
+			services = append(services, m.ID)
+		}
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("%s has no event log", c.host)
+	}
+
+	service := services[0]
+	for _, s := range services {
+		if name := strings.ToLower(s[strings.LastIndex(s, "/")+1:]); name == "sel" || name == "log" {
+			service = s
+			break
+		}
+	}
+
+	var logService struct {
+		Entries redfishLink `json:"Entries"`
+	}
+	if err := c.get(ctx, service, &logService); err != nil {
+		return nil, err
+	}
+	if logService.Entries.ID == "" {
+		logService.Entries.ID = service + "/Entries"
+	}
+
+	entries := []SELEntry{}
+	next := logService.Entries.ID
+	for next != "" && len(entries) < maxSELEntries {
+		var page struct {
+			Members []struct {
+				ID       string    `json:"Id"`
+				Created  time.Time `json:"Created"`
+				Severity string    `json:"Severity"`
+				Message  string    `json:"Message"`
+			} `json:"Members"`
+			NextLink string `json:"Members@odata.nextLink"`
+		}
+		if err := c.get(ctx, next, &page); err != nil {
+			return nil, err
+		}
+		for _, m := range page.Members {
+			entries = append(entries, SELEntry{ID: m.ID, Time: m.Created, Severity: m.Severity, Message: m.Message})
+		}
+		next = page.NextLink
+	}
+	if len(entries) > maxSELEntries {
+		entries = entries[:maxSELEntries]
+	}
+	return entries, nil
+}
+
+// firstMember returns the first member of a collection
+func (c *redfishClient) firstMember(ctx context.Context, uri string) (string, error) {
+	var coll redfishCollection
+	if err := c.get(ctx, uri, &coll); err != nil {
+		return "", err
+	}
+	if len(coll.Members) == 0 {
+		return "", fmt.Errorf("%s lists no members in %s", c.host, uri)
+	}
+	return coll.Members[0].ID, nil
+}
+
+func (c *redfishClient) get(ctx context.Context, uri string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, uri, nil, out)
+}
+
+// do makes a request and decodes the JSON response into out, if given
+func (c *redfishClient) do(ctx context.Context, method, uri string, body []byte, out interface{}) error {
+	resp, err := doDeviceRequest(c.client, func(scheme string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+c.host+uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(c.username, c.password)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("contacting %s: %w", c.host, err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s rejected the stored credentials", c.host)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%s: %s", c.host, redfishError(data, resp.Status))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s: unexpected response from %s; is it a Redfish service?", c.host, uri)
+	}
+	return nil
+}
+
+// redfishError extracts the message from a Redfish error response
+func redfishError(data []byte, status string) string {
+	var body struct {
+		Error struct {
+			Message  string `json:"message"`
+			Extended []struct {
+				Message string `json:"Message"`
+			} `json:"@Message.ExtendedInfo"`
+		} `json:"error"`
+	}
+	json.Unmarshal(data, &body)
+	if len(body.Error.Extended) > 0 && body.Error.Extended[0].Message != "" {
+		return body.Error.Extended[0].Message
+	}
+	if body.Error.Message != "" {
+		return body.Error.Message
+	}
+	return status
+}
+
+// redfishHealth maps a Redfish health to a sensor status
+func redfishHealth(s redfishStatus) string {
+	switch s.Health {
+	case "OK":
+		return "ok"
+	case "Warning":
+		return "warning"
+	case "Critical":
+		return "critical"
+	}
+	return "unknown"
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
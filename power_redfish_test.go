@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedfish serves a Redfish tree from a map of resources, with basic auth
+// and a ComputerSystem.Reset action that records the reset types posted
+type fakeRedfish struct {
+	username, password string
+
+	mu        sync.Mutex
+	resources map[string]interface{}
+	resets    map[string][]string // Target -> ResetTypes received
+}
+
+func (f *fakeRedfish) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != f.username || pass != f.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/Actions/ComputerSystem.Reset") {
+		var body struct{ ResetType string }
+		json.NewDecoder(r.Body).Decode(&body)
+		if _, ok := f.resources[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]interface{}{"message": "Resource not found"},
+			})
+			return
+		}
+		f.resets[r.URL.Path] = append(f.resets[r.URL.Path], body.ResetType)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	res, ok := f.resources[r.URL.RequestURI()]
+	if !ok || r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+type redfishObject = map[string]interface{}
+
+func redfishMembers(ids ...string) redfishObject {
+	var members []interface{}
+	for _, id := range ids {
+		members = append(members, redfishObject{"@odata.id": id})
+	}
+	return redfishObject{"Members": members}
+}
+
+// newFakeRedfish starts a service with one system whose reset action lives
+// at a vendor-specific target, as many BMCs do
+func newFakeRedfish(t *testing.T) (*fakeRedfish, *redfishClient) {
+	t.Helper()
+	f := &fakeRedfish{
+		username: "root",
+		password: "calvin",
+		resets:   make(map[string][]string),
+		resources: map[string]interface{}{
+			"/redfish/v1/Systems": redfishMembers("/redfish/v1/Systems/System.Embedded.1"),
+			"/redfish/v1/Systems/System.Embedded.1": redfishObject{
+				"PowerState":   "On",
+				"IndicatorLED": "Blinking",
+				"Actions": redfishObject{
+					"#ComputerSystem.Reset": redfishObject{
+						"target":                            "/redfish/v1/Systems/System.Embedded.1/Oem/Actions/ComputerSystem.Reset",
+						"ResetType@Redfish.AllowableValues": []string{"On", "ForceOff", "GracefulShutdown", "ForceRestart"},
+					},
+				},
+				"LogServices": redfishObject{"@odata.id": "/redfish/v1/Systems/System.Embedded.1/LogServices"},
+			},
+			"/redfish/v1/Systems/System.Embedded.1/Oem/Actions/ComputerSystem.Reset": nil,
+		},
+	}
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+	return f, newRedfishClient(Device{Host: strings.TrimPrefix(srv.URL, "https://"), Username: "root", Password: "calvin"})
+}
+
+func TestRedfishPowerState(t *testing.T) {
+	f, c := newFakeRedfish(t)
+	system := f.resources["/redfish/v1/Systems/System.Embedded.1"].(redfishObject)
+
+	for _, tc := range []struct {
+		power, led string
+		want       PowerState
+	}{
+		{"On", "Blinking", PowerState{Power: "on", LEDs: map[string]bool{"identify": true}}},
+		{"Off", "Off", PowerState{Power: "off", LEDs: map[string]bool{"identify": false}}},
+		{"PoweringOn", "", PowerState{Power: "off", Busy: true}},
+		{"PoweringOff", "Unknown", PowerState{Power: "on", Busy: true}},
+		{"Paused", "", PowerState{Power: "unknown"}},
+	} {
+		f.mu.Lock()
+		system["PowerState"], system["IndicatorLED"] = tc.power, tc.led
+		f.mu.Unlock()
+
+		got, err := c.PowerState(context.Background())
+		if err != nil {
+			t.Fatalf("PowerState(%s): %v", tc.power, err)
+		}
+		if got.Power != tc.want.Power || got.Busy != tc.want.Busy || len(got.LEDs) != len(tc.want.LEDs) ||
+			got.LEDs["identify"] != tc.want.LEDs["identify"] {
+			t.Errorf("%s/%s: got %+v, want %+v", tc.power, tc.led, got, tc.want)
+		}
+	}
+}
+
+func TestRedfishResetDiscovery(t *testing.T) {
+	f, c := newFakeRedfish(t)
+	ctx := context.Background()
+	oem := "/redfish/v1/Systems/System.Embedded.1/Oem/Actions/ComputerSystem.Reset"
+
+	for action, resetType := range redfishResetTypes {
+		if err := c.Power(ctx, action); err != nil {
+			t.Fatalf("Power(%s): %v", action, err)
+		}
+		got := f.resets[oem]
+		if len(got) == 0 || got[len(got)-1] != resetType {
+			t.Errorf("Power(%s) posted %v to the advertised target, want %s", action, got, resetType)
+		}
+	}
+
+	// Reset types the service doesn't allow are refused up front
+	system := f.resources["/redfish/v1/Systems/System.Embedded.1"].(redfishObject)
+	system["Actions"] = redfishObject{
+		"#ComputerSystem.Reset": redfishObject{
+			"target":                            oem,
+			"ResetType@Redfish.AllowableValues": []string{"On", "ForceOff"},
+		},
+	}
+	before := len(f.resets[oem])
+	err := c.Power(ctx, "reset")
+	if err == nil || !strings.Contains(err.Error(), "doesn't support the ForceRestart reset type (it allows On, ForceOff)") {
+		t.Errorf("disallowed reset: %v", err)
+	}
+	if len(f.resets[oem]) != before {
+		t.Error("a disallowed reset type was posted")
+	}
+
+	// Without an advertised action the standard target is used
+	delete(system, "Actions")
+	standard := "/redfish/v1/Systems/System.Embedded.1/Actions/ComputerSystem.Reset"
+	f.resources[standard] = nil
+	if err := c.Power(ctx, "off_hard"); err != nil {
+		t.Fatalf("Power without Actions: %v", err)
+	}
+	if got := f.resets[standard]; len(got) != 1 || got[0] != "ForceOff" {
+		t.Errorf("standard target got %v", got)
+	}
+
+	if err := c.Power(ctx, "cycle"); err == nil {
+		t.Error("unsupported action accepted")
+	}
+}
+
+func TestRedfishErrors(t *testing.T) {
+	f, c := newFakeRedfish(t)
+	ctx := context.Background()
+
+	// Error messages come from the Redfish error body
+	system := f.resources["/redfish/v1/Systems/System.Embedded.1"].(redfishObject)
+	system["Actions"] = redfishObject{"#ComputerSystem.Reset": redfishObject{"target": "/redfish/v1/Missing/Actions/ComputerSystem.Reset"}}
+	if err := c.Power(ctx, "on"); err == nil || !strings.Contains(err.Error(), "Resource not found") {
+		t.Errorf("failed reset: %v", err)
+	}
+
+	f.resources["/redfish/v1/Systems"] = redfishMembers()
+	if _, err := c.PowerState(ctx); err == nil || !strings.Contains(err.Error(), "lists no members") {
+		t.Errorf("no systems: %v", err)
+	}
+
+	c.password = "wrong"
+	if _, err := c.PowerState(ctx); err == nil || !strings.Contains(err.Error(), "rejected the stored credentials") {
+		t.Errorf("wrong password: %v", err)
+	}
+}
+
+func TestRedfishSensors(t *testing.T) {
+	f, c := newFakeRedfish(t)
+	f.resources["/redfish/v1/Chassis"] = redfishMembers("/redfish/v1/Chassis/1")
+	f.resources["/redfish/v1/Chassis/1"] = redfishObject{
+		"Thermal": redfishObject{"@odata.id": "/redfish/v1/Chassis/1/Thermal"},
+		"Power":   redfishObject{"@odata.id": "/redfish/v1/Chassis/1/Power"},
+	}
+	f.resources["/redfish/v1/Chassis/1/Thermal"] = redfishObject{
+		"Temperatures": []interface{}{
+			redfishObject{"Name": "CPU1 Temp", "ReadingCelsius": 48, "Status": redfishObject{"State": "Enabled", "Health": "OK"}},
+			redfishObject{"Name": "CPU2 Temp", "Status": redfishObject{"State": "Absent"}},
+		},
+		"Fans": []interface{}{
+			redfishObject{"FanName": "FAN 1", "Reading": 5400, "Status": redfishObject{"State": "Enabled", "Health": "Warning"}},
+			redfishObject{"Name": "FAN 2", "Reading": 40, "ReadingUnits": "Percent", "Status": redfishObject{"Health": "Critical"}},
+		},
+	}
+	f.resources["/redfish/v1/Chassis/1/Power"] = redfishObject{
+		"PowerControl": []interface{}{redfishObject{"PowerConsumedWatts": 212, "Status": redfishObject{"Health": "OK"}}},
+		"Voltages":     []interface{}{redfishObject{"Name": "PS1 Voltage", "ReadingVolts": 230, "Status": redfishObject{}}},
+	}
+
+	sensors, err := c.Sensors(context.Background())
+	if err != nil {
+		t.Fatalf("Sensors: %v", err)
+	}
+	want := []struct {
+		name, kind, units, status string
+		value                     float64
+	}{
+		{"CPU1 Temp", "temperature", "C", "ok", 48},
+		{"FAN 1", "fan", "RPM", "warning", 5400},
+		{"FAN 2", "fan", "%", "critical", 40},
+		{"Power consumption", "power", "W", "ok", 212},
+		{"PS1 Voltage", "voltage", "V", "unknown", 230},
+	}
+	if len(sensors) != len(want) {
+		t.Fatalf("got %d sensors, want %d: %+v", len(sensors), len(want), sensors)
+	}
+	for i, w := range want {
+		s := sensors[i]
+		if s.Name != w.name || s.Type != w.kind || s.Units != w.units || s.Status != w.status || s.Value == nil || *s.Value != w.value {
+			t.Errorf("sensor %d = %+v, want %+v", i, s, w)
+		}
+	}
+}
+
+func TestRedfishSEL(t *testing.T) {
+	f, c := newFakeRedfish(t)
+	logs := "/redfish/v1/Systems/System.Embedded.1/LogServices"
+	// The log called SEL is preferred over the first one listed
+	f.resources[logs] = redfishMembers(logs+"/Lclog", logs+"/Sel")
+	f.resources[logs+"/Sel"] = redfishObject{"Entries": redfishObject{"@odata.id": logs + "/Sel/Entries"}}
+	f.resources[logs+"/Sel/Entries"] = redfishObject{
+		"Members": []interface{}{
+			redfishObject{"Id": "1", "Created": "2024-05-01T10:00:00Z", "Severity": "OK", "Message": "System boot"},
+		},
+		"Members@odata.nextLink": logs + "/Sel/Entries?$skip=1",
+	}
+	f.resources[logs+"/Sel/Entries?$skip=1"] = redfishObject{
+		"Members": []interface{}{
+			redfishObject{"Id": "2", "Created": "2024-05-01T10:05:00Z", "Severity": "Critical", "Message": "Fan 2 failed"},
+		},
+	}
+
+	entries, err := c.SEL(context.Background())
+	if err != nil {
+		t.Fatalf("SEL: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Message != "System boot" || entries[1].Severity != "Critical" {
+		t.Errorf("entries = %+v", entries)
+	}
+}
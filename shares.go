@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	sharesFile           = "kvmm-shares.json"
+	defaultShareDuration = time.Hour
+	maxShareDuration     = 7 * 24 * time.Hour
+	shareRetention       = 30 * 24 * time.Hour // Ended shares are kept this long for their audit trail
+	maxShareAccessLog    = 100                 // Audit entries kept per share
+)
+
+var errShareNotFound = errors.New("share not found")
+
+// Share is a signed link that opens one device's console without a kvmm
+// account, e.g. for a vendor during a support call
+type Share struct {
+	ID        string        `json:"id"`
+	DeviceID  string        `json:"device_id"`
+	Note      string        `json:"note,omitempty"` // Who it's for, a ticket number...
+	MaxUses   int           `json:"max_uses"`       // 0 means unlimited until expiry
+	Uses      int           `json:"uses"`
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	RevokedAt *time.Time    `json:"revoked_at,omitempty"`
+	Access    []ShareAccess `json:"access"`        // Audit trail, newest last
+	URL       string        `json:"url,omitempty"` // Only returned when created
+}
+
+// ShareAccess is an audit entry for one attempt to open a share
+type ShareAccess struct {
+	Time      time.Time `json:"time"`
+	RemoteIP  string    `json:"remote_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Result    string    `json:"result"` // "opened", "expired", "revoked" or "used up"
+}
+
+// ShareRequest is the body of POST /api/devices/{id}/share
+type ShareRequest struct {
+	Duration string `json:"duration"` // e.g. "2h" (default 1h, max 7 days)
+	Uses     *int   `json:"uses"`     // Default 1; 0 for unlimited
+	Note     string `json:"note"`
+}
+
+// state reports why a share can't be used, or "active"
+func (s *Share) state(now time.Time) string {
+	switch {
+	case s.RevokedAt != nil:
+		return "revoked"
+	case now.After(s.ExpiresAt):
+		return "expired"
+	case s.MaxUses > 0 && s.Uses >= s.MaxUses:
+		return "used up"
+	}
+	return "active"
+}
+
+// shareStore keeps shares as records in the device store, so every replica
+// sharing the store sees the same ones and counts their uses together
+type shareStore struct {
+	store DeviceStore
+}
+
+// newShareStore wraps store, moving in any shares from kvmm-shares.json in
+// dir, where earlier versions kept them
+func newShareStore(store DeviceStore, dir string) *shareStore {
+	st := &shareStore{store: store}
+	if err := st.importFile(filepath.Join(dir, sharesFile)); err != nil {
+		log.Printf("Importing shares: %v", err)
+	}
+	return st
+}
+
+func (st *shareStore) importFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []Share
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, s := range list {
+		if err := st.put(s, false); err != nil {
+			return err
+		}
+	}
+	log.Printf("Moved %d shares from %s to the device store", len(list), path)
+	return os.Remove(path)
+}
+
+// put stores a share. Unless replace is set, an existing share with the
+// same ID is left alone.
+func (st *shareStore) put(s Share, replace bool) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return st.store.UpdateRecord(shareRecords, s.ID, func(old []byte) ([]byte, error) {
+		if old != nil && !replace {
+			return old, nil
+		}
+		return data, nil
+	})
+}
+
+// create stores a new share, dropping those that ended long ago
+func (st *shareStore) create(s Share) error {
+	if err := st.put(s, true); err != nil {
+		return err
+	}
+
+	all, err := st.List("")
+	if err != nil {
+		return nil // The new share is stored; pruning can wait
+	}
+	now := time.Now()
+	for _, old := range all {
+		ended := old.ExpiresAt
+		if old.RevokedAt != nil && old.RevokedAt.Before(ended) {
+			ended = *old.RevokedAt
+		}
+		if now.Sub(ended) <= shareRetention {
+			continue
+		}
+		err := st.store.UpdateRecord(shareRecords, old.ID, func([]byte) ([]byte, error) { return nil, nil })
+		if err != nil {
+			log.Printf("Dropping share %s: %v", old.ID, err)
+		}
+	}
+	return nil
+}
+
+// update applies fn to a stored share and returns the result. fn runs again
+// if another replica changed the share in the meantime.
+func (st *shareStore) update(id string, fn func(s *Share) error) (Share, error) {
+	var share Share
+	err := st.store.UpdateRecord(shareRecords, id, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, errShareNotFound
+		}
+		share = Share{}
+		if err := json.Unmarshal(old, &share); err != nil {
+			return nil, fmt.Errorf("decoding share %s: %w", id, err)
+		}
+		if err := fn(&share); err != nil {
+			return nil, err
+		}
+		return json.Marshal(share)
+	})
+	return share, err
+}
+
+// List returns shares, optionally for one device, newest first
+func (st *shareStore) List(deviceID string) ([]Share, error) {
+	records, err := st.store.ListRecords(shareRecords)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Share{}
+	for id, data := range records {
+		var s Share
+		if err := json.Unmarshal(data, &s); err != nil {
+			log.Printf("Skipping share %s: %v", id, err)
+			continue
+		}
+		if deviceID == "" || s.DeviceID == deviceID {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list, nil
+}
+
+// CreateShare issues a share link for a device (POST /api/devices/{id}/share)
+func (h *Handlers) CreateShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/share")
+	if _, found := h.config.GetDevice(id); !found {
+		if h.deviceExists(id) {
+			http.Error(w, "Federated devices are shared from their own site's server", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var req ShareRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	duration := defaultShareDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		if d > maxShareDuration {
+			http.Error(w, fmt.Sprintf("duration may not exceed %s", maxShareDuration), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	uses := 1
+	if req.Uses != nil {
+		if *req.Uses < 0 {
+			http.Error(w, "uses must be 0 (unlimited) or more", http.StatusBadRequest)
+			return
+		}
+		uses = *req.Uses
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	share := Share{
+		ID:        uuid.New().String(),
+		DeviceID:  id,
+		Note:      strings.TrimSpace(req.Note),
+		MaxUses:   uses,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+		Access:    []ShareAccess{},
+	}
+	if err := h.shares.create(share); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Share %s created for device %s (expires %s, uses %d, note %q) by %s",
+		share.ID, id, share.ExpiresAt.Format(time.RFC3339), uses, share.Note, clientIP(r))
+
+	resp := share
+	resp.URL = requestBaseURL(r) + "/s/" + h.links.SignValue("share", share.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SharesHandler lists and revokes shares
+// (GET /api/shares?device=id, GET /api/shares/{id}, DELETE /api/shares/{id})
+func (h *Handlers) SharesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/shares"), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		shares, err := h.shares.List(r.URL.Query().Get("device"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if id == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(shares)
+			return
+		}
+		for _, s := range shares {
+			if s.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(s)
+				return
+			}
+		}
+		http.Error(w, "Share not found", http.StatusNotFound)
+	case http.MethodDelete:
+		if id == "" {
+			http.Error(w, "Share ID required", http.StatusBadRequest)
+			return
+		}
+		_, err := h.shares.update(id, func(s *Share) error {
+			if s.RevokedAt == nil {
+				now := time.Now().UTC()
+				s.RevokedAt = &now
+			}
+			return nil
+		})
+		if err == errShareNotFound {
+			http.Error(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Share %s revoked by %s", id, clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// OpenShare checks a share link, records the attempt and redirects to the
+// device (GET /s/{token})
+func (h *Handlers) OpenShare(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.links.VerifyValue("share", strings.TrimPrefix(r.URL.Path, "/s/"))
+	if !ok {
+		log.Printf("OpenShare: invalid link from %s", clientIP(r))
+		http.Error(w, "This link is invalid", http.StatusNotFound)
+		return
+	}
+
+	result := ""
+	share, err := h.shares.update(id, func(s *Share) error {
+		now := time.Now().UTC()
+		result = s.state(now)
+		if result == "active" {
+			result = "opened"
+			s.Uses++
+		}
+		s.Access = append(s.Access, ShareAccess{
+			Time:      now,
+			RemoteIP:  clientIP(r),
+			UserAgent: r.UserAgent(),
+			Result:    result,
+		})
+		if len(s.Access) > maxShareAccessLog {
+			s.Access = s.Access[len(s.Access)-maxShareAccessLog:]
+		}
+		return nil
+	})
+	if err == errShareNotFound {
+		http.Error(w, "This link is invalid", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Share %s for device %s: %s by %s", id, share.DeviceID, result, clientIP(r))
+
+	switch result {
+	case "expired":
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	case "revoked":
+		http.Error(w, "This link has been revoked", http.StatusGone)
+		return
+	case "used up":
+		http.Error(w, "This link has already been used", http.StatusGone)
+		return
+	}
+
+	device, found := h.config.GetDevice(share.DeviceID)
+	if !found {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	// Never with the stored credentials: redirectToDevice puts them in the
+	// URL, handing them to the recipient
+	http.Redirect(w, r, fmt.Sprintf("http://%s/", device.Host), http.StatusFound)
+}
+
+// clientIP is the request's remote address without the port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
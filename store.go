@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const storeWatchInterval = 2 * time.Second
+
+// DeviceStore persists the device inventory. Config keeps the inventory in
+// memory for reads and writes changes through a store, so backends that can
+// update a single record don't have to rewrite everything on every change.
+type DeviceStore interface {
+	// List returns every device, including trashed ones, in insertion order
+	List() ([]Device, error)
+	// Get returns a single device by ID
+	Get(id string) (Device, error)
+	// Create adds a device; the ID must not already exist
+	Create(d Device) error
+	// Update replaces an existing device with the same ID
+	Update(d Device) error
+	// Delete permanently removes a device
+	Delete(id string) error
+	// Commit creates or updates puts and removes deletes as one unit: if it
+	// fails, none of the changes remain
+	Commit(puts []Device, deletes []string) error
+	// ListRecords returns the records of one kind, keyed by ID
+	ListRecords(kind string) (map[string][]byte, error)
+	// UpdateRecord stores what fn returns for a record's current JSON (nil
+	// if there is none). Returning nil deletes the record, returning old
+	// unchanged skips the write, and an error aborts. fn runs again if
+	// another writer changed the record in the meantime.
+	UpdateRecord(kind, id string, fn func(old []byte) ([]byte, error)) error
+	// Watch returns a channel of changes, including ones made by other
+	// writers, and a function that stops the watch
+	Watch() (<-chan StoreEvent, func())
+	// Close releases the backend
+	Close() error
+}
+
+// statusRecorder is implemented by stores that persist device reachability
+type statusRecorder interface {
+	RecordStatuses(statuses []DeviceStatus)
+}
+
+// thumbnailMirror is implemented by stores that can keep explicit
+// thumbnails alongside the devices, so the local thumbnail directory can be
+// rebuilt on startup
+type thumbnailMirror interface {
+	PutThumbnail(name string, data []byte) error
+	DeleteThumbnail(name string) error
+	FetchThumbnails(dir string) error
+}
+
+// StoreEvent describes a change to the inventory in a DeviceStore
+type StoreEvent struct {
+	Type   string `json:"type"` // "put", "delete", "reload" or "records"
+	ID     string `json:"id,omitempty"`
+	Kind   string `json:"kind,omitempty"` // Record kind for "records"; empty if unknown
+	Device Device `json:"-"`
+}
+
+// errStoreNotFound is returned by DeviceStore methods for unknown IDs
+var errStoreNotFound = fmt.Errorf("device not found")
+
+// Record kinds. Records are small JSON documents that belong to the server
+// rather than to a device, kept in the device store so that replicas
+// sharing a store share them too.
+const (
+	maintenanceRecords = "maintenance"
+	shareRecords       = "share"
+	linkKeyRecords     = "link-key"
+	linkNonceRecords   = "link-nonce"
+
+	// Progress of media transfers, relayed between replicas and not
+	// copied between stores
+	mediaProgressRecords = "media-progress"
+)
+
+// recordKinds lists every record kind, for copying between stores
+var recordKinds = []string{maintenanceRecords, shareRecords, linkKeyRecords, linkNonceRecords}
+
+// recordsFile holds the records of a TOML store, beside config.toml
+const recordsFile = "kvmm-records.json"
+
+// storeKind returns the configured backend name
+func (c *Config) storeKind() string {
+	if c.Server.Store == "" {
+		return "toml"
+	}
+	return c.Server.Store
+}
+
+// storePath returns where a non-TOML backend keeps its data
+func (c *Config) storePath() string {
+	if c.Server.StorePath != "" {
+		if filepath.IsAbs(c.Server.StorePath) {
+			return c.Server.StorePath
+		}
+		return filepath.Join(c.GetConfigDir(), c.Server.StorePath)
+	}
+	return filepath.Join(c.GetConfigDir(), "kvmm.db")
+}
+
+// openStore opens the backend named in the server config
+func openStore(c *Config) (DeviceStore, error) {
+	switch c.storeKind() {
+	case "toml":
+		return newTOMLStore(c.filePath), nil
+	case "bolt":
+		return newBoltStore(c.storePath())
+	case "kubernetes":
+		return newKubernetesStore(c.Server.Kubernetes)
+	}
+	return nil, fmt.Errorf("unknown store %q (use toml, bolt or kubernetes)", c.Server.Store)
+}
+
+// storeHub fans store events out to watchers. Backends embed it.
+type storeHub struct {
+	hubMu    sync.Mutex
+	watchers map[chan StoreEvent]struct{}
+}
+
+func (h *storeHub) watch() (<-chan StoreEvent, func()) {
+	ch := make(chan StoreEvent, 64)
+	h.hubMu.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[chan StoreEvent]struct{})
+	}
+	h.watchers[ch] = struct{}{}
+	h.hubMu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.hubMu.Lock()
+			delete(h.watchers, ch)
+			h.hubMu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (h *storeHub) publish(ev StoreEvent) {
+	h.hubMu.Lock()
+	defer h.hubMu.Unlock()
+	for ch := range h.watchers {
+		select {
+		case ch <- ev:
+		default:
+			// Slow watcher; it will catch up on the next reload
+		}
+	}
+}
+
+// publishCommit emits put and delete events for a committed transaction
+func (h *storeHub) publishCommit(puts []Device, deletes []string) {
+	for _, d := range puts {
+		h.publish(StoreEvent{Type: "put", ID: d.ID, Device: d})
+	}
+	for _, id := range deletes {
+		h.publish(StoreEvent{Type: "delete", ID: id})
+	}
+}
+
+// tomlStore keeps devices in the [[devices]] tables of config.toml. Every
+// change rewrites the whole file, preserving the other settings on disk.
+// Records go in kvmm-records.json beside it, so they can change without
+// touching config.toml.
+type tomlStore struct {
+	storeHub
+	path        string
+	recordsPath string
+
+	mu             sync.Mutex
+	modTime        time.Time // mtime after our last write, to ignore our own changes
+	recordsModTime time.Time
+}
+
+func newTOMLStore(path string) *tomlStore {
+	s := &tomlStore{path: path, recordsPath: filepath.Join(filepath.Dir(path), recordsFile)}
+	if info, err := os.Stat(path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	if info, err := os.Stat(s.recordsPath); err == nil {
+		s.recordsModTime = info.ModTime()
+	}
+	return s
+}
+
+// read loads the whole config file
+func (s *tomlStore) read() (*configFile, error) {
+	file := &configFile{}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return file, nil
+		}
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	if err := toml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+	return file, nil
+}
+
+// write replaces the config file atomically
+func (s *tomlStore) write(file *configFile) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(file); err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+	if err := writeFileAtomic(s.path, buf.Bytes()); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// markWritten records a write to config.toml made outside the store (by
+// Config.save) so the watcher doesn't report it as an external edit
+func (s *tomlStore) markWritten() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+}
+
+func (s *tomlStore) List() ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return file.Devices, nil
+}
+
+func (s *tomlStore) Get(id string) (Device, error) {
+	devices, err := s.List()
+	if err != nil {
+		return Device{}, err
+	}
+	for _, d := range devices {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return Device{}, errStoreNotFound
+}
+
+func (s *tomlStore) Create(d Device) error {
+	if _, err := s.Get(d.ID); err == nil {
+		return fmt.Errorf("device %s already exists", d.ID)
+	}
+	return s.Commit([]Device{d}, nil)
+}
+
+func (s *tomlStore) Update(d Device) error {
+	if _, err := s.Get(d.ID); err != nil {
+		return err
+	}
+	return s.Commit([]Device{d}, nil)
+}
+
+func (s *tomlStore) Delete(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	return s.Commit(nil, []string{id})
+}
+
+func (s *tomlStore) Commit(puts []Device, deletes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := s.read()
+	if err != nil {
+		return err
+	}
+	file.SchemaVersion = schemaVersion
+	file.Devices = applyCommit(file.Devices, puts, deletes)
+	if err := s.write(file); err != nil {
+		return err
+	}
+
+	s.publishCommit(puts, deletes)
+	return nil
+}
+
+// readRecords loads every record, by kind and then ID
+func (s *tomlStore) readRecords() (map[string]map[string]json.RawMessage, error) {
+	records := make(map[string]map[string]json.RawMessage)
+	data, err := os.ReadFile(s.recordsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, fmt.Errorf("reading records: %w", err)
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", s.recordsPath, err)
+	}
+	return records, nil
+}
+
+func (s *tomlStore) ListRecords(kind string) (map[string][]byte, error) {
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(records[kind]))
+	for id, data := range records[kind] {
+		out[id] = data
+	}
+	return out, nil
+}
+
+// UpdateRecord rewrites the records file under a lock file, which also
+// serializes replicas sharing the config directory
+func (s *tomlStore) UpdateRecord(kind, id string, fn func(old []byte) ([]byte, error)) error {
+	unlock, err := lockFile(s.recordsPath + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records, err := s.readRecords()
+	if err != nil {
+		return err
+	}
+	var old []byte
+	if data, ok := records[kind][id]; ok {
+		old = data
+	}
+	updated, err := fn(old)
+	if err != nil || (old != nil && bytes.Equal(updated, old)) {
+		return err
+	}
+	if updated == nil {
+		if old == nil {
+			return nil
+		}
+		delete(records[kind], id)
+	} else {
+		if !json.Valid(updated) {
+			return fmt.Errorf("record %s/%s is not valid JSON", kind, id)
+		}
+		if records[kind] == nil {
+			records[kind] = make(map[string]json.RawMessage)
+		}
+		records[kind][id] = updated
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Records include the link signing key, so keep them private
+	tmp := s.recordsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing records: %w", err)
+	}
+	if err := os.Rename(tmp, s.recordsPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("renaming records: %w", err)
+	}
+	s.mu.Lock()
+	if info, err := os.Stat(s.recordsPath); err == nil {
+		s.recordsModTime = info.ModTime()
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reports edits made to config.toml by other writers as "reload"
+// events and edits to the records file as "records" events, in addition to
+// changes committed through this store
+func (s *tomlStore) Watch() (<-chan StoreEvent, func()) {
+	ch, stop := s.watch()
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(storeWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if s.changedSince(s.path, &s.modTime) {
+					s.publish(StoreEvent{Type: "reload"})
+				}
+				if s.changedSince(s.recordsPath, &s.recordsModTime) {
+					s.publish(StoreEvent{Type: "records"})
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			close(done)
+			stop()
+		})
+	}
+}
+
+// changedSince reports whether path's mtime differs from *seen, updating it
+func (s *tomlStore) changedSince(path string, seen *time.Time) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info.ModTime().Equal(*seen) {
+		return false
+	}
+	*seen = info.ModTime()
+	return true
+}
+
+func (s *tomlStore) Close() error {
+	return nil
+}
+
+// applyCommit returns devices with puts upserted in place (new ones
+// appended) and deletes removed
+func applyCommit(devices []Device, puts []Device, deletes []string) []Device {
+	out := make([]Device, 0, len(devices)+len(puts))
+	removed := make(map[string]bool, len(deletes))
+	for _, id := range deletes {
+		removed[id] = true
+	}
+	pending := make(map[string]Device, len(puts))
+	var order []string
+	for _, d := range puts {
+		if _, seen := pending[d.ID]; !seen {
+			order = append(order, d.ID)
+		}
+		pending[d.ID] = d
+	}
+
+	for _, d := range devices {
+		if removed[d.ID] {
+			continue
+		}
+		if p, ok := pending[d.ID]; ok {
+			d = p
+			delete(pending, d.ID)
+		}
+		out = append(out, d)
+	}
+	for _, id := range order {
+		if d, ok := pending[id]; ok && !removed[id] {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("writing temp config file: %w", err)
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("renaming config file: %w", err)
+	}
+	return nil
+}
+
+// lockFile takes a short-lived lock file shared with other processes,
+// returning a function that releases it. Locks older than ten seconds are
+// assumed to be left behind by a crashed process and broken.
+func lockFile(path string) (func(), error) {
+	for i := 0; i < 20; i++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > 10*time.Second {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timed out waiting for %s", path)
+}
+
+// WatchStore keeps the in-memory inventory in sync with changes made to the
+// store by other writers and publishes every change as a "device" event. It
+// blocks until stop is closed, so run it in its own goroutine.
+func (c *Config) WatchStore(stop <-chan struct{}) {
+	events, unwatch := c.store.Watch()
+	defer unwatch()
+
+	for {
+		var ev StoreEvent
+		select {
+		case <-stop:
+			return
+		case ev = <-events:
+		}
+
+		// Our own commits are already applied in memory
+		switch ev.Type {
+		case "reload":
+			if err := c.reloadDevices(); err != nil {
+				log.Printf("WatchStore: reload failed: %v", err)
+				continue
+			}
+		case "records":
+			if ev.Kind == "" || ev.Kind == maintenanceRecords {
+				c.refreshMaintenance()
+			}
+			if ev.Kind == "" || ev.Kind == mediaProgressRecords {
+				c.relayMediaProgress()
+			}
+			continue
+		}
+		// Let SSE clients on this replica refresh, whichever replica wrote
+		c.events.Publish(Event{Type: "device", Data: ev})
+	}
+}
+
+// RecordStatuses hands reachability results to stores that persist them.
+// Only the status poller calls it, so in a cluster only the leader writes.
+func (c *Config) RecordStatuses(statuses []DeviceStatus) {
+	if rec, ok := c.store.(statusRecorder); ok {
+		rec.RecordStatuses(statuses)
+	}
+}
+
+// mirrorThumbnail copies an explicit thumbnail into the store, if supported
+func (c *Config) mirrorThumbnail(name string, data []byte) {
+	if m, ok := c.store.(thumbnailMirror); ok {
+		if err := m.PutThumbnail(name, data); err != nil {
+			log.Printf("mirrorThumbnail: %s: %v", name, err)
+		}
+	}
+}
+
+// unmirrorThumbnail removes an explicit thumbnail from the store, if supported
+func (c *Config) unmirrorThumbnail(name string) {
+	if m, ok := c.store.(thumbnailMirror); ok {
+		if err := m.DeleteThumbnail(name); err != nil {
+			log.Printf("unmirrorThumbnail: %s: %v", name, err)
+		}
+	}
+}
+
+// reloadDevices replaces the in-memory inventory with the store's contents
+func (c *Config) reloadDevices() error {
+	devices, err := c.store.List()
+	if err != nil {
+		return err
+	}
+	assigned := assignMissingIDs(devices)
+	if err := validateDevices(devices); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.Devices = devices
+	if assigned {
+		if err := c.save(); err != nil {
+			log.Printf("WatchStore: failed to save assigned device IDs: %v", err)
+		}
+	}
+	c.mu.Unlock()
+
+	log.Printf("Reloaded %d devices from %s store", len(devices), c.storeKind())
+	// Windows may have changed while a watch was disconnected
+	c.refreshMaintenance()
+	// Another replica may have uploaded thumbnails
+	if m, ok := c.store.(thumbnailMirror); ok {
+		if err := m.FetchThumbnails(c.GetThumbnailDir()); err != nil {
+			log.Printf("WatchStore: failed to fetch thumbnails: %v", err)
+		}
+	}
+	c.GenerateMissingThumbnails()
+	return nil
+}
+
+// runStore dispatches `kvmm store <subcommand>`
+func runStore(args []string) {
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Fprintln(os.Stderr, "Usage: kvmm store migrate -from toml -to bolt|kubernetes [-config path]")
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("store migrate", flag.ExitOnError)
+	configPath := flags.String("config", "config.toml", "Path to configuration file")
+	from := flags.String("from", "toml", "Source store: toml, bolt or kubernetes")
+	to := flags.String("to", "bolt", "Destination store: toml, bolt or kubernetes")
+	flags.Parse(args[1:])
+
+	if *from == *to {
+		fmt.Fprintln(os.Stderr, "Error: -from and -to must differ")
+		os.Exit(1)
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cfg.Close()
+
+	if cfg.storeKind() != *from {
+		fmt.Fprintf(os.Stderr, "Error: %s uses the %s store, not %s\n", *configPath, cfg.storeKind(), *from)
+		os.Exit(1)
+	}
+
+	devices := cfg.GetAllDevices()
+
+	// Open the destination with the new settings and copy everything over
+	cfg.mu.Lock()
+	oldServer := cfg.Server
+	cfg.Server.Store = *to
+	if *to == "toml" {
+		cfg.Server.Store = ""
+	}
+	dest, err := openStore(cfg)
+	if err != nil {
+		cfg.Server = oldServer
+		cfg.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := dest.Commit(devices, nil); err != nil {
+		dest.Close()
+		cfg.Server = oldServer
+		cfg.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "Error: copying devices: %v\n", err)
+		os.Exit(1)
+	}
+	if err := copyRecords(cfg.store, dest); err != nil {
+		dest.Close()
+		cfg.Server = oldServer
+		cfg.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "Error: copying records: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Point the config at the new store; save drops [[devices]] from
+	// config.toml when they now live elsewhere
+	cfg.store.Close()
+	cfg.store = dest
+	err = cfg.save()
+	cfg.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Migrated %d devices from %s to %s\n", len(devices), *from, *to)
+}
+
+// copyRecords copies every record from one store to another
+func copyRecords(from, to DeviceStore) error {
+	for _, kind := range recordKinds {
+		records, err := from.ListRecords(kind)
+		if err != nil {
+			return err
+		}
+		for id, data := range records {
+			err := to.UpdateRecord(kind, id, func([]byte) ([]byte, error) { return data, nil })
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", kind, id, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltDevicesBucket = []byte("devices")
+	boltRecordsBucket = []byte("records") // One nested bucket per kind
+)
+
+// boltStore keeps one record per device in an embedded bbolt database, so a
+// change only writes the affected devices
+type boltStore struct {
+	storeHub
+	db *bolt.DB
+}
+
+// boltRecord is the stored form of a Device. Password is hidden from
+// Device's JSON encoding, so it is carried explicitly.
+type boltRecord struct {
+	Seq uint64 `json:"seq"` // Preserves insertion order
+	Device
+	Password string `json:"password,omitempty"`
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltDevicesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltRecordsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing bolt store: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func decodeBoltRecord(data []byte) (boltRecord, error) {
+	var rec boltRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, err
+	}
+	rec.Device.Password = rec.Password
+	return rec, nil
+}
+
+func (s *boltStore) List() ([]Device, error) {
+	var records []boltRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDevicesBucket).ForEach(func(k, v []byte) error {
+			rec, err := decodeBoltRecord(v)
+			if err != nil {
+				return fmt.Errorf("decoding device %s: %w", k, err)
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	devices := make([]Device, len(records))
+	for i, rec := range records {
+		devices[i] = rec.Device
+	}
+	return devices, nil
+}
+
+func (s *boltStore) Get(id string) (Device, error) {
+	var device Device
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltDevicesBucket).Get([]byte(id))
+		if v == nil {
+			return errStoreNotFound
+		}
+		rec, err := decodeBoltRecord(v)
+		device = rec.Device
+		return err
+	})
+	return device, err
+}
+
+func (s *boltStore) Create(d Device) error {
+	if _, err := s.Get(d.ID); err == nil {
+		return fmt.Errorf("device %s already exists", d.ID)
+	}
+	return s.Commit([]Device{d}, nil)
+}
+
+func (s *boltStore) Update(d Device) error {
+	if _, err := s.Get(d.ID); err != nil {
+		return err
+	}
+	return s.Commit([]Device{d}, nil)
+}
+
+func (s *boltStore) Delete(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	return s.Commit(nil, []string{id})
+}
+
+func (s *boltStore) Commit(puts []Device, deletes []string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDevicesBucket)
+		for _, d := range puts {
+			key := []byte(d.ID)
+			rec := boltRecord{Device: d, Password: d.Password}
+			if existing := b.Get(key); existing != nil {
+				old, err := decodeBoltRecord(existing)
+				if err != nil {
+					return fmt.Errorf("decoding device %s: %w", d.ID, err)
+				}
+				rec.Seq = old.Seq
+			} else {
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				rec.Seq = seq
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return fmt.Errorf("encoding device %s: %w", d.ID, err)
+			}
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		for _, id := range deletes {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publishCommit(puts, deletes)
+	return nil
+}
+
+func (s *boltStore) ListRecords(kind string) (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			records[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// UpdateRecord runs fn inside a write transaction, so it never conflicts
+func (s *boltStore) UpdateRecord(kind, id string, fn func(old []byte) ([]byte, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		var old []byte
+		if v := b.Get([]byte(id)); v != nil {
+			old = append([]byte(nil), v...)
+		}
+		updated, err := fn(old)
+		switch {
+		case err != nil:
+			return err
+		case updated == nil:
+			return b.Delete([]byte(id))
+		case bytes.Equal(updated, old):
+			return nil
+		}
+		return b.Put([]byte(id), updated)
+	})
+}
+
+// Watch reports changes committed through this store. The database file is
+// locked by a single process, so there are no other writers to observe.
+func (s *boltStore) Watch() (<-chan StoreEvent, func()) {
+	return s.watch()
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
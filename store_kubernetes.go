@@ -0,0 +1,1006 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kvmDeviceGroup      = "kvmm.io"
+	kvmDeviceVersion    = "v1"
+	kvmDevicePlural     = "kvmdevices"
+	kvmDeviceKind       = "KVMDevice"
+	thumbnailLabel      = "kvmm.io/thumbnail"
+	thumbnailConfigMap  = "kvmm-thumbnail-"
+	recordLabel         = "kvmm.io/record" // Value is the record kind
+	recordKey           = "record"
+	passwordLabel       = "kvmm.io/device-password"
+	passwordSecret      = "kvmm-device-"
+	passwordKey         = "password"
+	passwordVersion     = "kvmm.io/password-version" // Annotation that changes with the Secret
+	serviceAccountDir   = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeWatchRetryDelay = 5 * time.Second
+)
+
+// KubernetesConfig configures the kubernetes device store. Empty fields
+// fall back to the pod's in-cluster service account.
+type KubernetesConfig struct {
+	APIServer string `toml:"api_server,omitempty"`
+	Namespace string `toml:"namespace,omitempty"`
+	TokenFile string `toml:"token_file,omitempty"`
+	CAFile    string `toml:"ca_file,omitempty"`
+	Insecure  bool   `toml:"insecure_skip_verify,omitempty"`
+	// Where explicit thumbnails are kept: "" for local disk only, or
+	// "configmap" to mirror them into ConfigMaps so pods can be stateless
+	Thumbnails string `toml:"thumbnails,omitempty"`
+}
+
+// dnsLabel matches names Kubernetes accepts for KVMDevice resources
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// kubeMeta is the subset of ObjectMeta used by the store
+type kubeMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	CreationTimestamp string            `json:"creationTimestamp,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+}
+
+// kvmDevice is the KVMDevice custom resource
+type kvmDevice struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Metadata   kubeMeta         `json:"metadata"`
+	Spec       kvmDeviceSpec    `json:"spec"`
+	Status     *kvmDeviceStatus `json:"status,omitempty"`
+}
+
+type kvmDeviceSpec struct {
+	ID        string     `json:"id"`
+	Host      string     `json:"host"`
+	Alias     string     `json:"alias,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	MAC       string     `json:"mac,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Thumbnail string     `json:"thumbnail,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+
+	WakeBroadcast string `json:"wakeBroadcast,omitempty"`
+	WakeInterface string `json:"wakeInterface,omitempty"`
+
+	// The password lives in a Secret. Password is only read, from resources
+	// written by hand or by earlier versions, and moved to a Secret on the
+	// next write.
+	PasswordSecretRef *kvmSecretRef `json:"passwordSecretRef,omitempty"`
+	Password          string        `json:"password,omitempty"`
+}
+
+// kvmSecretRef points at a key in a Secret in the device's namespace
+type kvmSecretRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type kvmDeviceStatus struct {
+	Reachable   bool   `json:"reachable"`
+	LastChecked string `json:"lastChecked,omitempty"`
+}
+
+type kvmDeviceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kvmDevice `json:"items"`
+}
+
+type kubeConfigMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeMeta          `json:"metadata"`
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+}
+
+type kubeConfigMapList struct {
+	Items []kubeConfigMap `json:"items"`
+}
+
+// kubeRecord is a ConfigMap or Secret holding one record
+type kubeRecord struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeMeta          `json:"metadata"`
+	Type       string            `json:"type,omitempty"`       // Secrets only
+	Data       map[string][]byte `json:"data,omitempty"`       // Secrets only
+	BinaryData map[string][]byte `json:"binaryData,omitempty"` // ConfigMaps only
+}
+
+type kubeRecordList struct {
+	Items []kubeRecord `json:"items"`
+}
+
+func (r kubeRecord) payload() []byte {
+	if r.Kind == "Secret" {
+		return r.Data[recordKey]
+	}
+	return r.BinaryData[recordKey]
+}
+
+// kubeSecret is a Secret holding a device password
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeMeta          `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+type kubeSecretList struct {
+	Items []kubeSecret `json:"items"`
+}
+
+// kubeStatusError is returned for non-2xx API responses
+type kubeStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.Code, e.Message)
+}
+
+func isKubeStatus(err error, code int) bool {
+	se, ok := err.(*kubeStatusError)
+	return ok && se.Code == code
+}
+
+// kubernetesStore keeps each device in a KVMDevice custom resource. Writes
+// are applied resource by resource, so a Commit is not atomic across devices.
+type kubernetesStore struct {
+	storeHub
+	client     *http.Client
+	apiServer  string
+	namespace  string
+	tokenFile  string
+	thumbnails string
+
+	mu       sync.Mutex
+	ownRVs   map[string]bool // resourceVersions we wrote, skipped by Watch
+	statuses map[string]bool // last reachability written per device
+}
+
+func newKubernetesStore(kc KubernetesConfig) (*kubernetesStore, error) {
+	s := &kubernetesStore{
+		apiServer:  kc.APIServer,
+		namespace:  kc.Namespace,
+		tokenFile:  kc.TokenFile,
+		thumbnails: kc.Thumbnails,
+		ownRVs:     make(map[string]bool),
+		statuses:   make(map[string]bool),
+	}
+
+	if s.apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("kubernetes store: api_server not set and not running in a cluster")
+		}
+		s.apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+	s.apiServer = strings.TrimSuffix(s.apiServer, "/")
+
+	if s.namespace == "" {
+		data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes store: namespace not set: %w", err)
+		}
+		s.namespace = strings.TrimSpace(string(data))
+	}
+
+	if s.tokenFile == "" {
+		if _, err := os.Stat(filepath.Join(serviceAccountDir, "token")); err == nil {
+			s.tokenFile = filepath.Join(serviceAccountDir, "token")
+		}
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: kc.Insecure}
+	caFile := kc.CAFile
+	if caFile == "" && kc.APIServer == "" {
+		caFile = filepath.Join(serviceAccountDir, "ca.crt")
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes store: reading CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kubernetes store: no certificates in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	s.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	// Fail early if the CRD or RBAC is missing
+	items, _, err := s.list()
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes store: %w", err)
+	}
+	s.moveInlinePasswords(items)
+	return s, nil
+}
+
+// moveInlinePasswords moves passwords written into KVMDevice specs into
+// Secrets
+func (s *kubernetesStore) moveInlinePasswords(items []kvmDevice) {
+	for _, r := range items {
+		if r.Spec.Password == "" {
+			continue
+		}
+		d, err := s.device(r, nil)
+		if err == nil {
+			err = s.put(d)
+		}
+		if err != nil {
+			log.Printf("kubernetes store: moving the password of %s to a Secret: %v", r.Metadata.Name, err)
+			continue
+		}
+		log.Printf("kubernetes store: moved the password of %s to a Secret", r.Metadata.Name)
+	}
+}
+
+func (s *kubernetesStore) devicesPath() string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", kvmDeviceGroup, kvmDeviceVersion, s.namespace, kvmDevicePlural)
+}
+
+func (s *kubernetesStore) configMapsPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/configmaps", s.namespace)
+}
+
+func (s *kubernetesStore) secretsPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets", s.namespace)
+}
+
+// recordsPath is where records of a kind are kept: the link key in a
+// Secret, everything else in ConfigMaps
+func (s *kubernetesStore) recordsPath(kind string) string {
+	if kind == linkKeyRecords {
+		return s.secretsPath()
+	}
+	return s.configMapsPath()
+}
+
+// recordName maps a record to its ConfigMap or Secret name
+func recordName(kind, id string) (string, error) {
+	return resourceName("kvmm-" + kind + "-" + id)
+}
+
+// do sends a request to the API server, decoding a JSON response into out
+func (s *kubernetesStore) do(method, path, contentType string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, s.apiServer+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := s.authorize(req); err != nil {
+		return err
+	}
+
+	client := *s.client
+	client.Timeout = 30 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return &kubeStatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// authorize adds the service account token, re-reading it so rotated
+// tokens are picked up
+func (s *kubernetesStore) authorize(req *http.Request) error {
+	if s.tokenFile == "" {
+		return nil
+	}
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return nil
+}
+
+// resourceName maps a device ID to a KVMDevice name
+func resourceName(id string) (string, error) {
+	if len(id) > 63 || !dnsLabel.MatchString(id) {
+		return "", fmt.Errorf("device id %q is not a valid Kubernetes name", id)
+	}
+	return id, nil
+}
+
+func toKVMDevice(d Device) kvmDevice {
+	return kvmDevice{
+		APIVersion: kvmDeviceGroup + "/" + kvmDeviceVersion,
+		Kind:       kvmDeviceKind,
+		Spec: kvmDeviceSpec{
+			ID:        d.ID,
+			Host:      d.Host,
+			Alias:     d.Alias,
+			Username:  d.Username,
+			Type:      d.Type,
+			MAC:       d.MAC,
+			Tags:      d.Tags,
+			Thumbnail: d.Thumbnail,
+			DeletedAt: d.DeletedAt,
+
+			WakeBroadcast: d.WakeBroadcast,
+			WakeInterface: d.WakeInterface,
+		},
+	}
+}
+
+// device converts a resource without its password; see kubernetesStore.device
+func (r kvmDevice) device() Device {
+	id := r.Spec.ID
+	if id == "" {
+		id = r.Metadata.Name
+	}
+	return Device{
+		ID:        id,
+		Host:      r.Spec.Host,
+		Alias:     r.Spec.Alias,
+		Username:  r.Spec.Username,
+		Type:      r.Spec.Type,
+		MAC:       r.Spec.MAC,
+		Tags:      r.Spec.Tags,
+		Thumbnail: r.Spec.Thumbnail,
+		DeletedAt: r.Spec.DeletedAt,
+
+		WakeBroadcast: r.Spec.WakeBroadcast,
+		WakeInterface: r.Spec.WakeInterface,
+	}
+}
+
+// list returns all resources, oldest first, and the list resourceVersion
+func (s *kubernetesStore) list() ([]kvmDevice, string, error) {
+	var list kvmDeviceList
+	if err := s.do(http.MethodGet, s.devicesPath(), "", nil, &list); err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(list.Items, func(i, j int) bool {
+		a, b := list.Items[i].Metadata, list.Items[j].Metadata
+		if a.CreationTimestamp != b.CreationTimestamp {
+			return a.CreationTimestamp < b.CreationTimestamp
+		}
+		return a.Name < b.Name
+	})
+	return list.Items, list.Metadata.ResourceVersion, nil
+}
+
+func (s *kubernetesStore) List() ([]Device, error) {
+	items, _, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	var secrets kubeSecretList
+	if err := s.do(http.MethodGet, s.secretsPath()+"?labelSelector="+passwordLabel, "", nil, &secrets); err != nil {
+		return nil, fmt.Errorf("listing password secrets: %w", err)
+	}
+	byName := make(map[string]kubeSecret, len(secrets.Items))
+	for _, sec := range secrets.Items {
+		byName[sec.Metadata.Name] = sec
+	}
+
+	devices := make([]Device, len(items))
+	for i, item := range items {
+		if devices[i], err = s.device(item, byName); err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+// device converts a resource, reading its password from the referenced
+// Secret. known holds Secrets already fetched, by name.
+func (s *kubernetesStore) device(r kvmDevice, known map[string]kubeSecret) (Device, error) {
+	d := r.device()
+	ref := r.Spec.PasswordSecretRef
+	if ref == nil {
+		d.Password = r.Spec.Password
+		return d, nil
+	}
+	sec, ok := known[ref.Name]
+	if !ok {
+		err := s.do(http.MethodGet, s.secretsPath()+"/"+ref.Name, "", nil, &sec)
+		if isKubeStatus(err, http.StatusNotFound) {
+			log.Printf("kubernetes store: device %s: secret %s not found", d.ID, ref.Name)
+			return d, nil
+		}
+		if err != nil {
+			return d, fmt.Errorf("reading password of device %s: %w", d.ID, err)
+		}
+	}
+	d.Password = string(sec.Data[ref.Key])
+	return d, nil
+}
+
+func (s *kubernetesStore) get(id string) (kvmDevice, error) {
+	var r kvmDevice
+	name, err := resourceName(id)
+	if err != nil {
+		return r, errStoreNotFound
+	}
+	err = s.do(http.MethodGet, s.devicesPath()+"/"+name, "", nil, &r)
+	if isKubeStatus(err, http.StatusNotFound) {
+		return r, errStoreNotFound
+	}
+	return r, err
+}
+
+func (s *kubernetesStore) Get(id string) (Device, error) {
+	r, err := s.get(id)
+	if err != nil {
+		return Device{}, err
+	}
+	return s.device(r, nil)
+}
+
+func (s *kubernetesStore) Create(d Device) error {
+	if _, err := s.get(d.ID); err == nil {
+		return fmt.Errorf("device %s already exists", d.ID)
+	}
+	return s.Commit([]Device{d}, nil)
+}
+
+func (s *kubernetesStore) Update(d Device) error {
+	if _, err := s.get(d.ID); err != nil {
+		return err
+	}
+	return s.Commit([]Device{d}, nil)
+}
+
+func (s *kubernetesStore) Delete(id string) error {
+	if _, err := s.get(id); err != nil {
+		return err
+	}
+	return s.Commit(nil, []string{id})
+}
+
+// put creates or replaces the resource for a device
+func (s *kubernetesStore) put(d Device) error {
+	name, err := resourceName(d.ID)
+	if err != nil {
+		return err
+	}
+
+	r := toKVMDevice(d)
+	r.Metadata = kubeMeta{Name: name, Namespace: s.namespace}
+
+	var out kvmDevice
+	existing, err := s.get(d.ID)
+	found := err == nil
+	if err != nil && err != errStoreNotFound {
+		return err
+	}
+	if found {
+		r.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+		r.Metadata.CreationTimestamp = existing.Metadata.CreationTimestamp
+		r.Metadata.Labels = existing.Metadata.Labels
+		r.Metadata.Annotations = existing.Metadata.Annotations
+	}
+	if err := s.putPassword(&r, existing, found, d.Password); err != nil {
+		return err
+	}
+
+	if found {
+		err = s.do(http.MethodPut, s.devicesPath()+"/"+name, "", r, &out)
+	} else {
+		err = s.do(http.MethodPost, s.devicesPath(), "", r, &out)
+	}
+	if err != nil {
+		return err
+	}
+	s.rememberRV(out.Metadata.ResourceVersion)
+	return nil
+}
+
+// putPassword stores a device's password in its Secret and points r at it.
+// A Secret the resource already references is kept if it holds the same
+// password, so references written by hand survive edits. The Secret's
+// resourceVersion goes in an annotation, so a password change alone still
+// changes the KVMDevice and other replicas reload it.
+func (s *kubernetesStore) putPassword(r *kvmDevice, existing kvmDevice, found bool, password string) error {
+	managed := passwordSecret + r.Metadata.Name
+	if found && existing.Spec.PasswordSecretRef != nil && existing.Spec.PasswordSecretRef.Name != managed {
+		if current, err := s.device(existing, nil); err == nil && current.Password == password {
+			r.Spec.PasswordSecretRef = existing.Spec.PasswordSecretRef
+			return nil
+		}
+	}
+
+	if password == "" {
+		err := s.do(http.MethodDelete, s.secretsPath()+"/"+managed, "", nil, nil)
+		if err != nil && !isKubeStatus(err, http.StatusNotFound) {
+			return fmt.Errorf("deleting password secret: %w", err)
+		}
+		delete(r.Metadata.Annotations, passwordVersion)
+		return nil
+	}
+
+	sec := kubeSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: kubeMeta{
+			Name:      managed,
+			Namespace: s.namespace,
+			Labels:    map[string]string{passwordLabel: "true"},
+		},
+		Type: "Opaque",
+		Data: map[string][]byte{passwordKey: []byte(password)},
+	}
+	var out kubeSecret
+	err := s.do(http.MethodPut, s.secretsPath()+"/"+managed, "", sec, &out)
+	if isKubeStatus(err, http.StatusNotFound) {
+		err = s.do(http.MethodPost, s.secretsPath(), "", sec, &out)
+	}
+	if err != nil {
+		return fmt.Errorf("writing password secret: %w", err)
+	}
+
+	r.Spec.PasswordSecretRef = &kvmSecretRef{Name: managed, Key: passwordKey}
+	if r.Metadata.Annotations == nil {
+		r.Metadata.Annotations = make(map[string]string)
+	}
+	r.Metadata.Annotations[passwordVersion] = out.Metadata.ResourceVersion
+	return nil
+}
+
+// Commit writes one resource at a time, as the API has no transactions.
+// Before each write it reads the device's current state, and if a write
+// fails it restores the devices already written, newest first, so a failed
+// commit leaves the store as it was.
+func (s *kubernetesStore) Commit(puts []Device, deletes []string) error {
+	var undo []func() error
+	fail := func(err error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil {
+				return fmt.Errorf("%w (rolling back earlier writes also failed: %v)", err, uerr)
+			}
+		}
+		return err
+	}
+
+	for _, d := range puts {
+		prev, err := s.Get(d.ID)
+		if err != nil && err != errStoreNotFound {
+			return fail(fmt.Errorf("reading device %s: %w", d.ID, err))
+		}
+		// Registered before writing, since put may fail after the Secret
+		id, existed := d.ID, err == nil
+		undo = append(undo, func() error {
+			if existed {
+				return s.put(prev)
+			}
+			return s.remove(id)
+		})
+		if err := s.put(d); err != nil {
+			return fail(fmt.Errorf("writing device %s: %w", d.ID, err))
+		}
+	}
+	for _, id := range deletes {
+		prev, err := s.Get(id)
+		if err == errStoreNotFound {
+			continue
+		}
+		if err != nil {
+			return fail(fmt.Errorf("reading device %s: %w", id, err))
+		}
+		undo = append(undo, func() error { return s.put(prev) })
+		if err := s.remove(id); err != nil {
+			return fail(err)
+		}
+	}
+
+	s.publishCommit(puts, deletes)
+	return nil
+}
+
+// remove deletes a device's resource and its password Secret
+func (s *kubernetesStore) remove(id string) error {
+	name, err := resourceName(id)
+	if err != nil {
+		return nil // Could never have been stored
+	}
+	err = s.do(http.MethodDelete, s.devicesPath()+"/"+name, "", nil, nil)
+	if err != nil && !isKubeStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("deleting device %s: %w", id, err)
+	}
+	err = s.do(http.MethodDelete, s.secretsPath()+"/"+passwordSecret+name, "", nil, nil)
+	if err != nil && !isKubeStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("deleting password of device %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *kubernetesStore) rememberRV(rv string) {
+	if rv == "" {
+		return
+	}
+	s.mu.Lock()
+	s.ownRVs[rv] = true
+	s.mu.Unlock()
+}
+
+// ownWrite reports (and forgets) whether a resourceVersion was written by us
+func (s *kubernetesStore) ownWrite(rv string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ownRVs[rv] {
+		delete(s.ownRVs, rv)
+		return true
+	}
+	return false
+}
+
+// Watch streams KVMDevice changes made by kubectl, controllers or other
+// replicas as "reload" events and record changes as "records" events,
+// reconnecting when a stream drops
+func (s *kubernetesStore) Watch() (<-chan StoreEvent, func()) {
+	ch, stop := s.watch()
+	done := make(chan struct{})
+
+	go s.watchLoop(s.devicesPath(), done, StoreEvent{Type: "reload"}, func(obj json.RawMessage) StoreEvent {
+		var r kvmDevice
+		json.Unmarshal(obj, &r)
+		return StoreEvent{Type: "reload", ID: r.device().ID}
+	})
+	// The link key Secret is only read at startup, so ConfigMaps suffice
+	go s.watchLoop(s.configMapsPath()+"?labelSelector="+recordLabel, done, StoreEvent{Type: "records"}, func(obj json.RawMessage) StoreEvent {
+		var r kubeRecord
+		json.Unmarshal(obj, &r)
+		return StoreEvent{Type: "records", Kind: r.Metadata.Labels[recordLabel]}
+	})
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			close(done)
+			stop()
+		})
+	}
+}
+
+// watchLoop watches the collection at path until done is closed, publishing
+// toEvent for each change. After a reconnect, when changes may have been
+// missed, it publishes resync.
+func (s *kubernetesStore) watchLoop(path string, done <-chan struct{}, resync StoreEvent, toEvent func(json.RawMessage) StoreEvent) {
+	first := true
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		var list struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}
+		if err := s.do(http.MethodGet, path, "", nil, &list); err != nil {
+			log.Printf("kubernetes store: list failed: %v", err)
+			time.Sleep(kubeWatchRetryDelay)
+			continue
+		}
+		if !first {
+			s.publish(resync)
+		}
+		first = false
+
+		if err := s.watchFrom(path, list.Metadata.ResourceVersion, done, toEvent); err != nil {
+			log.Printf("kubernetes store: watch ended: %v", err)
+			time.Sleep(kubeWatchRetryDelay)
+		}
+	}
+}
+
+// watchFrom consumes one watch stream starting at resourceVersion rv
+func (s *kubernetesStore) watchFrom(path, rv string, done <-chan struct{}, toEvent func(json.RawMessage) StoreEvent) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	path += sep + "watch=1&allowWatchBookmarks=true&resourceVersion=" + rv
+	req, err := http.NewRequest(http.MethodGet, s.apiServer+path, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &kubeStatusError{Code: resp.StatusCode, Message: "watch failed"}
+	}
+
+	go func() {
+		<-done
+		resp.Body.Close()
+	}()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var obj struct {
+				Metadata kubeMeta `json:"metadata"`
+			}
+			json.Unmarshal(ev.Object, &obj)
+			if ev.Type != "DELETED" && s.ownWrite(obj.Metadata.ResourceVersion) {
+				continue
+			}
+			s.publish(toEvent(ev.Object))
+		case "ERROR":
+			return fmt.Errorf("watch error event")
+		}
+	}
+}
+
+// ListRecords returns the records of a kind from their labelled ConfigMaps
+// or Secrets
+func (s *kubernetesStore) ListRecords(kind string) (map[string][]byte, error) {
+	var list kubeRecordList
+	path := s.recordsPath(kind) + "?labelSelector=" + recordLabel + "%3D" + kind
+	if err := s.do(http.MethodGet, path, "", nil, &list); err != nil {
+		return nil, err
+	}
+	records := make(map[string][]byte, len(list.Items))
+	for _, r := range list.Items {
+		id := strings.TrimPrefix(r.Metadata.Name, "kvmm-"+kind+"-")
+		records[id] = r.payload()
+	}
+	return records, nil
+}
+
+// UpdateRecord reads, changes and writes a record with the API server's
+// optimistic concurrency, retrying when another writer got there first
+func (s *kubernetesStore) UpdateRecord(kind, id string, fn func(old []byte) ([]byte, error)) error {
+	name, err := recordName(kind, id)
+	if err != nil {
+		return err
+	}
+	path := s.recordsPath(kind)
+
+	for attempt := 0; attempt < 10; attempt++ {
+		var existing kubeRecord
+		err := s.do(http.MethodGet, path+"/"+name, "", nil, &existing)
+		found := err == nil
+		if err != nil && !isKubeStatus(err, http.StatusNotFound) {
+			return err
+		}
+		var old []byte
+		if found {
+			old = existing.payload()
+		}
+
+		updated, err := fn(old)
+		if err != nil {
+			return err
+		}
+		var out kubeRecord
+		switch {
+		case updated == nil && !found:
+			return nil
+		case updated == nil:
+			precondition := map[string]interface{}{
+				"preconditions": map[string]string{"resourceVersion": existing.Metadata.ResourceVersion},
+			}
+			err = s.do(http.MethodDelete, path+"/"+name, "", precondition, nil)
+			if isKubeStatus(err, http.StatusNotFound) {
+				return nil
+			}
+		case found && bytes.Equal(updated, old):
+			return nil
+		default:
+			r := s.newRecord(kind, name, updated)
+			if found {
+				r.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+				err = s.do(http.MethodPut, path+"/"+name, "", r, &out)
+			} else {
+				err = s.do(http.MethodPost, path, "", r, &out)
+			}
+		}
+		if isKubeStatus(err, http.StatusConflict) {
+			continue
+		}
+		if err == nil {
+			s.rememberRV(out.Metadata.ResourceVersion)
+		}
+		return err
+	}
+	return fmt.Errorf("record %s/%s: too many conflicting writes", kind, id)
+}
+
+// newRecord builds the ConfigMap or Secret for a record
+func (s *kubernetesStore) newRecord(kind, name string, data []byte) kubeRecord {
+	r := kubeRecord{
+		APIVersion: "v1",
+		Metadata: kubeMeta{
+			Name:      name,
+			Namespace: s.namespace,
+			Labels:    map[string]string{recordLabel: kind},
+		},
+	}
+	if kind == linkKeyRecords {
+		r.Kind, r.Type = "Secret", "Opaque"
+		r.Data = map[string][]byte{recordKey: data}
+	} else {
+		r.Kind = "ConfigMap"
+		r.BinaryData = map[string][]byte{recordKey: data}
+	}
+	return r
+}
+
+func (s *kubernetesStore) Close() error {
+	return nil
+}
+
+// RecordStatuses writes reachability to the KVMDevice status subresource,
+// only patching devices whose status changed since the last write
+func (s *kubernetesStore) RecordStatuses(statuses []DeviceStatus) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, st := range statuses {
+		s.mu.Lock()
+		last, known := s.statuses[st.ID]
+		s.mu.Unlock()
+		if known && last == st.Reachable {
+			continue
+		}
+
+		name, err := resourceName(st.ID)
+		if err != nil {
+			continue
+		}
+		patch := map[string]interface{}{
+			"status": kvmDeviceStatus{Reachable: st.Reachable, LastChecked: now},
+		}
+		var out kvmDevice
+		err = s.do(http.MethodPatch, s.devicesPath()+"/"+name+"/status", "application/merge-patch+json", patch, &out)
+		if err != nil {
+			log.Printf("kubernetes store: updating status of %s: %v", st.ID, err)
+			continue
+		}
+		s.rememberRV(out.Metadata.ResourceVersion)
+
+		s.mu.Lock()
+		s.statuses[st.ID] = st.Reachable
+		s.mu.Unlock()
+	}
+}
+
+// thumbnailConfigMapName maps a thumbnail file name to its ConfigMap
+func thumbnailConfigMapName(name string) (string, error) {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	return resourceName(thumbnailConfigMap + base)
+}
+
+// PutThumbnail stores a thumbnail in a ConfigMap when enabled
+func (s *kubernetesStore) PutThumbnail(name string, data []byte) error {
+	if s.thumbnails != "configmap" {
+		return nil
+	}
+	cmName, err := thumbnailConfigMapName(name)
+	if err != nil {
+		return err
+	}
+
+	cm := kubeConfigMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata: kubeMeta{
+			Name:      cmName,
+			Namespace: s.namespace,
+			Labels:    map[string]string{thumbnailLabel: "true"},
+		},
+		BinaryData: map[string][]byte{name: data},
+	}
+	err = s.do(http.MethodPut, s.configMapsPath()+"/"+cmName, "", cm, nil)
+	if isKubeStatus(err, http.StatusNotFound) {
+		err = s.do(http.MethodPost, s.configMapsPath(), "", cm, nil)
+	}
+	return err
+}
+
+// DeleteThumbnail removes a thumbnail ConfigMap when enabled
+func (s *kubernetesStore) DeleteThumbnail(name string) error {
+	if s.thumbnails != "configmap" {
+		return nil
+	}
+	cmName, err := thumbnailConfigMapName(name)
+	if err != nil {
+		return nil
+	}
+	err = s.do(http.MethodDelete, s.configMapsPath()+"/"+cmName, "", nil, nil)
+	if isKubeStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// FetchThumbnails writes every stored thumbnail into dir
+func (s *kubernetesStore) FetchThumbnails(dir string) error {
+	if s.thumbnails != "configmap" {
+		return nil
+	}
+	var list kubeConfigMapList
+	if err := s.do(http.MethodGet, s.configMapsPath()+"?labelSelector="+thumbnailLabel+"%3Dtrue", "", nil, &list); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, cm := range list.Items {
+		for name, data := range cm.BinaryData {
+			if err := os.WriteFile(filepath.Join(dir, filepath.Base(name)), data, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
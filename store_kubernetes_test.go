@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestKubernetesStorePasswordsInSecrets(t *testing.T) {
+	kube := newFakeKube(t)
+	s := kube.store(t)
+
+	d := Device{ID: "pikvm-1", Host: "10.0.0.1", Username: "admin", Password: "hunter2"}
+	if err := s.Create(d); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	r := kube.object("kvmdevices", "pikvm-1")
+	spec := r["spec"].(map[string]interface{})
+	if _, ok := spec["password"]; ok {
+		t.Errorf("password written into the KVMDevice spec: %v", spec)
+	}
+	ref, _ := spec["passwordSecretRef"].(map[string]interface{})
+	if ref["name"] != "kvmm-device-pikvm-1" || ref["key"] != "password" {
+		t.Errorf("passwordSecretRef = %v", ref)
+	}
+	if got := secretPassword(t, kube, "kvmm-device-pikvm-1"); got != "hunter2" {
+		t.Errorf("secret holds %q, want hunter2", got)
+	}
+
+	got, err := s.Get("pikvm-1")
+	if err != nil || got.Password != "hunter2" {
+		t.Fatalf("Get = %+v, %v", got, err)
+	}
+	devices, err := s.List()
+	if err != nil || len(devices) != 1 || devices[0].Password != "hunter2" {
+		t.Fatalf("List = %+v, %v", devices, err)
+	}
+
+	// A password change alone changes the KVMDevice, so replicas reload it
+	before := kube.object("kvmdevices", "pikvm-1")["metadata"].(map[string]interface{})["resourceVersion"]
+	d.Password = "correct horse"
+	if err := s.Update(d); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	after := kube.object("kvmdevices", "pikvm-1")["metadata"].(map[string]interface{})["resourceVersion"]
+	if before == after {
+		t.Error("KVMDevice unchanged after a password change")
+	}
+	if got := secretPassword(t, kube, "kvmm-device-pikvm-1"); got != "correct horse" {
+		t.Errorf("secret holds %q after update", got)
+	}
+
+	d.Password = ""
+	if err := s.Update(d); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if kube.object("secrets", "kvmm-device-pikvm-1") != nil {
+		t.Error("secret kept after the password was cleared")
+	}
+
+	d.Password = "again"
+	s.Update(d)
+	if err := s.Delete("pikvm-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if kube.object("secrets", "kvmm-device-pikvm-1") != nil {
+		t.Error("secret kept after the device was deleted")
+	}
+}
+
+func TestKubernetesStoreKeepsForeignSecretRef(t *testing.T) {
+	kube := newFakeKube(t)
+	kube.apply("secrets", map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "vault-synced"},
+		"data":     map[string]interface{}{"pw": base64.StdEncoding.EncodeToString([]byte("from-vault"))},
+	})
+	kube.apply("kvmdevices", map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pikvm-1"},
+		"spec": map[string]interface{}{
+			"host":              "10.0.0.1",
+			"passwordSecretRef": map[string]interface{}{"name": "vault-synced", "key": "pw"},
+		},
+	})
+	s := kube.store(t)
+
+	d, err := s.Get("pikvm-1")
+	if err != nil || d.Password != "from-vault" {
+		t.Fatalf("Get = %+v, %v", d, err)
+	}
+	d.Alias = "rack 3"
+	if err := s.Update(d); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	ref := kube.object("kvmdevices", "pikvm-1")["spec"].(map[string]interface{})["passwordSecretRef"].(map[string]interface{})
+	if ref["name"] != "vault-synced" {
+		t.Errorf("hand-written reference replaced: %v", ref)
+	}
+	if kube.object("secrets", "kvmm-device-pikvm-1") != nil {
+		t.Error("managed secret created for an unchanged password")
+	}
+}
+
+func TestKubernetesStoreMovesInlinePasswords(t *testing.T) {
+	kube := newFakeKube(t)
+	kube.apply("kvmdevices", map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pikvm-1"},
+		"spec":     map[string]interface{}{"host": "10.0.0.1", "password": "legacy"},
+	})
+	s := kube.store(t)
+
+	spec := kube.object("kvmdevices", "pikvm-1")["spec"].(map[string]interface{})
+	if _, ok := spec["password"]; ok {
+		t.Errorf("inline password left in the spec: %v", spec)
+	}
+	if got := secretPassword(t, kube, "kvmm-device-pikvm-1"); got != "legacy" {
+		t.Errorf("secret holds %q, want legacy", got)
+	}
+	if d, err := s.Get("pikvm-1"); err != nil || d.Password != "legacy" {
+		t.Errorf("Get = %+v, %v", d, err)
+	}
+}
+
+func TestKubernetesStoreWatch(t *testing.T) {
+	kube := newFakeKube(t)
+	s := kube.store(t)
+	events, stop := s.Watch()
+	defer stop()
+
+	// Our own write is published by Commit. The watch may race the response
+	// and echo it as a reload, which is harmless.
+	if err := s.Create(Device{ID: "pikvm-1", Host: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	ev := nextStoreEvent(t, events)
+	for ev.Type == "reload" && ev.ID == "pikvm-1" {
+		ev = nextStoreEvent(t, events)
+	}
+	if ev.Type != "put" || ev.ID != "pikvm-1" {
+		t.Fatalf("got %+v, want put pikvm-1", ev)
+	}
+
+	kube.apply("kvmdevices", map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pikvm-2"},
+		"spec":     map[string]interface{}{"host": "10.0.0.2"},
+	})
+	if ev := nextStoreEvent(t, events); ev.Type != "reload" || ev.ID != "pikvm-2" {
+		t.Fatalf("got %+v, want reload pikvm-2", ev)
+	}
+
+	// Records changed by another replica
+	other := kube.store(t)
+	if err := other.UpdateRecord(maintenanceRecords, "w1", func([]byte) ([]byte, error) { return []byte(`{}`), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextStoreEvent(t, events); ev.Type != "records" || ev.Kind != maintenanceRecords {
+		t.Fatalf("got %+v, want records %s", ev, maintenanceRecords)
+	}
+
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKubernetesStoreLinkKeyInSecret(t *testing.T) {
+	kube := newFakeKube(t)
+	s := kube.store(t)
+
+	if err := s.UpdateRecord(linkKeyRecords, "default", func([]byte) ([]byte, error) { return []byte(`{"key":"c2VjcmV0"}`), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if kube.object("secrets", "kvmm-link-key-default") == nil {
+		t.Errorf("link key not stored in a Secret; secrets: %v", kube.names("secrets"))
+	}
+	if len(kube.names("configmaps")) != 0 {
+		t.Errorf("link key leaked into ConfigMaps: %v", kube.names("configmaps"))
+	}
+	records, err := s.ListRecords(linkKeyRecords)
+	if err != nil || string(records["default"]) != `{"key":"c2VjcmV0"}` {
+		t.Errorf("ListRecords = %q, %v", records, err)
+	}
+}
+
+func TestKubeLease(t *testing.T) {
+	kube := newFakeKube(t)
+	a := &kubeLease{store: kube.store(t), name: "kvmm-leader"}
+	b := &kubeLease{store: kube.store(t), name: "kvmm-leader"}
+
+	if ok, err := a.TryAcquire("a", time.Minute); !ok || err != nil {
+		t.Fatalf("a.TryAcquire = %v, %v", ok, err)
+	}
+	if ok, err := b.TryAcquire("b", time.Minute); ok || err != nil {
+		t.Fatalf("b.TryAcquire while held = %v, %v", ok, err)
+	}
+	if ok, err := a.TryAcquire("a", time.Minute); !ok || err != nil {
+		t.Fatalf("a renewing = %v, %v", ok, err)
+	}
+	if err := a.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.TryAcquire("b", time.Second); !ok || err != nil {
+		t.Fatalf("b.TryAcquire after release = %v, %v", ok, err)
+	}
+
+	// An expired lease can be taken over
+	time.Sleep(1100 * time.Millisecond)
+	if ok, err := a.TryAcquire("a", time.Minute); !ok || err != nil {
+		t.Fatalf("a.TryAcquire after expiry = %v, %v", ok, err)
+	}
+}
+
+// secretPassword reads the password key of a Secret in the fake
+func secretPassword(t *testing.T, kube *fakeKube, name string) string {
+	t.Helper()
+	sec := kube.object("secrets", name)
+	if sec == nil {
+		t.Fatalf("secret %s not found; secrets: %v", name, kube.names("secrets"))
+	}
+	data, _ := sec["data"].(map[string]interface{})
+	encoded, _ := data["password"].(string)
+	password, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("secret %s: %v", name, err)
+	}
+	return string(password)
+}
+
+// nextStoreEvent waits for a store event
+func nextStoreEvent(t *testing.T, events <-chan StoreEvent) StoreEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a store event")
+		return StoreEvent{}
+	}
+}
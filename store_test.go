@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storeBackend opens a backend for the conformance suite. reopen returns a
+// second handle on the same data, as a restarted server or another replica
+// would see it. failWriteAfter, for backends that write more than once per
+// commit, makes the write after the next n fail.
+type storeBackend struct {
+	name           string
+	open           func(t *testing.T) (s DeviceStore, reopen func() DeviceStore)
+	failWriteAfter func(s DeviceStore, n int)
+}
+
+var storeBackends = []storeBackend{
+	{"toml", func(t *testing.T) (DeviceStore, func() DeviceStore) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		return newTOMLStore(path), func() DeviceStore { return newTOMLStore(path) }
+	}, nil},
+	{"bolt", func(t *testing.T) (DeviceStore, func() DeviceStore) {
+		path := filepath.Join(t.TempDir(), "kvmm.db")
+		s, err := newBoltStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s, func() DeviceStore {
+			s.Close() // bolt holds an exclusive lock on the file
+			reopened, err := newBoltStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { reopened.Close() })
+			return reopened
+		}
+	}, nil},
+	{"kubernetes", func(t *testing.T) (DeviceStore, func() DeviceStore) {
+		kube := newFakeKube(t)
+		s := kube.store(t)
+		fakeKubes[s] = kube
+		t.Cleanup(func() { delete(fakeKubes, s) })
+		return s, func() DeviceStore { return kube.store(t) }
+	}, func(s DeviceStore, n int) {
+		fakeKubes[s].failWriteAfter(n)
+	}},
+}
+
+// fakeKubes maps the kubernetes stores the suite opened to their API server
+var fakeKubes = make(map[DeviceStore]*fakeKube)
+
+var storeConformance = []struct {
+	name string
+	run  func(t *testing.T, b storeBackend, s DeviceStore, reopen func() DeviceStore)
+}{
+	{"empty", func(t *testing.T, _ storeBackend, s DeviceStore, _ func() DeviceStore) {
+		devices, err := s.List()
+		if err != nil || len(devices) != 0 {
+			t.Fatalf("List = %v, %v", devices, err)
+		}
+		if _, err := s.Get("pikvm-1"); err != errStoreNotFound {
+			t.Errorf("Get unknown = %v, want errStoreNotFound", err)
+		}
+		if err := s.Update(Device{ID: "pikvm-1"}); err != errStoreNotFound {
+			t.Errorf("Update unknown = %v, want errStoreNotFound", err)
+		}
+		if err := s.Delete("pikvm-1"); err != errStoreNotFound {
+			t.Errorf("Delete unknown = %v, want errStoreNotFound", err)
+		}
+	}},
+	{"create and get", func(t *testing.T, _ storeBackend, s DeviceStore, reopen func() DeviceStore) {
+		deleted := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		want := Device{
+			ID: "pikvm-1", Host: "10.0.0.1", Alias: "db-1", Username: "admin", Password: "hunter2",
+			Type: "redfish", MAC: "aa:bb:cc:dd:ee:ff", Tags: []string{"rack3", "db"}, Thumbnail: "db.png",
+			DeletedAt: &deleted, WakeBroadcast: "10.0.0.255:9", WakeInterface: "eth1",
+		}
+		if err := s.Create(want); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := s.Create(want); err == nil {
+			t.Error("Create succeeded for an existing ID")
+		}
+		got, err := s.Get("pikvm-1")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		assertDevice(t, got, want)
+
+		got, err = reopen().Get("pikvm-1")
+		if err != nil {
+			t.Fatalf("Get after reopening: %v", err)
+		}
+		assertDevice(t, got, want)
+	}},
+	{"insertion order", func(t *testing.T, _ storeBackend, s DeviceStore, reopen func() DeviceStore) {
+		for _, id := range []string{"zulu", "alpha", "mike"} {
+			if err := s.Create(Device{ID: id, Host: id + ".lan"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Updating a device keeps its place
+		if err := s.Update(Device{ID: "zulu", Host: "zulu.example"}); err != nil {
+			t.Fatal(err)
+		}
+		assertIDs(t, s, "zulu", "alpha", "mike")
+		assertIDs(t, reopen(), "zulu", "alpha", "mike")
+	}},
+	{"update and delete", func(t *testing.T, _ storeBackend, s DeviceStore, _ func() DeviceStore) {
+		s.Create(Device{ID: "pikvm-1", Host: "10.0.0.1", Password: "old"})
+		s.Create(Device{ID: "pikvm-2", Host: "10.0.0.2"})
+
+		if err := s.Update(Device{ID: "pikvm-1", Host: "10.0.0.9", Password: "new"}); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := s.Get("pikvm-1")
+		assertDevice(t, got, Device{ID: "pikvm-1", Host: "10.0.0.9", Password: "new"})
+
+		if err := s.Delete("pikvm-1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("pikvm-1"); err != errStoreNotFound {
+			t.Errorf("Get deleted = %v, want errStoreNotFound", err)
+		}
+		assertIDs(t, s, "pikvm-2")
+	}},
+	{"commit", func(t *testing.T, _ storeBackend, s DeviceStore, _ func() DeviceStore) {
+		s.Create(Device{ID: "a", Host: "a.lan"})
+		s.Create(Device{ID: "b", Host: "b.lan"})
+		events, stop := s.Watch()
+		defer stop()
+
+		puts := []Device{{ID: "a", Host: "a.example"}, {ID: "c", Host: "c.lan"}}
+		if err := s.Commit(puts, []string{"b", "never-existed"}); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		assertIDs(t, s, "a", "c")
+		if got, _ := s.Get("a"); got.Host != "a.example" {
+			t.Errorf("a.Host = %q", got.Host)
+		}
+
+		want := []StoreEvent{{Type: "put", ID: "a"}, {Type: "put", ID: "c"}, {Type: "delete", ID: "b"}, {Type: "delete", ID: "never-existed"}}
+		for _, w := range want {
+			ev := nextStoreEvent(t, events)
+			for ev.Type == "reload" { // Echoes of our own writes are allowed
+				ev = nextStoreEvent(t, events)
+			}
+			if ev.Type != w.Type || ev.ID != w.ID {
+				t.Fatalf("event %+v, want %s %s", ev, w.Type, w.ID)
+			}
+		}
+	}},
+	{"failed commit", func(t *testing.T, b storeBackend, s DeviceStore, reopen func() DeviceStore) {
+		if b.failWriteAfter == nil {
+			t.Skip("commits in a single write")
+		}
+		before := []Device{{ID: "a", Host: "a.lan", Password: "a-pw"}, {ID: "b", Host: "b.lan", Password: "b-pw"}}
+		for _, d := range before {
+			if err := s.Create(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		puts := []Device{{ID: "a", Host: "a.example", Password: "a-new"}, {ID: "c", Host: "c.lan", Password: "c-pw"}}
+
+		// Fail each write of the commit in turn until it gets through
+		for n := 0; ; n++ {
+			b.failWriteAfter(s, n)
+			err := s.Commit(puts, []string{"b"})
+			if err == nil {
+				break
+			}
+			if n > 20 {
+				t.Fatalf("Commit still failing after %d writes: %v", n, err)
+			}
+			other := reopen()
+			assertIDs(t, other, "a", "b")
+			for _, d := range before {
+				got, err := other.Get(d.ID)
+				if err != nil {
+					t.Fatalf("failing write %d: Get(%s): %v", n+1, d.ID, err)
+				}
+				assertDevice(t, got, d)
+			}
+		}
+		assertIDs(t, reopen(), "a", "c")
+	}},
+	{"records", func(t *testing.T, _ storeBackend, s DeviceStore, reopen func() DeviceStore) {
+		set := func(data string) func([]byte) ([]byte, error) {
+			return func([]byte) ([]byte, error) { return []byte(data), nil }
+		}
+		if err := s.UpdateRecord(maintenanceRecords, "w1", set(`{"reason":"one"}`)); err != nil {
+			t.Fatalf("UpdateRecord: %v", err)
+		}
+		s.UpdateRecord(maintenanceRecords, "w2", set(`{"reason":"two"}`))
+		s.UpdateRecord(shareRecords, "w1", set(`{"uses":1}`))
+		assertRecords(t, s, maintenanceRecords, map[string]string{"w1": `{"reason":"one"}`, "w2": `{"reason":"two"}`})
+		assertRecords(t, s, shareRecords, map[string]string{"w1": `{"uses":1}`})
+		assertRecords(t, s, linkNonceRecords, map[string]string{})
+
+		// fn sees the current value, and nil for a missing record
+		var seen []byte
+		s.UpdateRecord(maintenanceRecords, "w1", func(old []byte) ([]byte, error) {
+			seen = old
+			return old, nil
+		})
+		assertJSON(t, seen, `{"reason":"one"}`)
+		s.UpdateRecord(maintenanceRecords, "missing", func(old []byte) ([]byte, error) {
+			seen = old
+			return nil, nil
+		})
+		if seen != nil {
+			t.Errorf("fn saw %q for a missing record", seen)
+		}
+		assertRecords(t, s, maintenanceRecords, map[string]string{"w1": `{"reason":"one"}`, "w2": `{"reason":"two"}`})
+
+		// An error aborts and comes back unwrapped
+		errAbort := errors.New("abort")
+		if err := s.UpdateRecord(maintenanceRecords, "w1", func([]byte) ([]byte, error) {
+			return []byte(`{"reason":"changed"}`), errAbort
+		}); err != errAbort {
+			t.Errorf("UpdateRecord = %v, want fn's error", err)
+		}
+
+		// nil deletes
+		if err := s.UpdateRecord(maintenanceRecords, "w2", func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+			t.Fatal(err)
+		}
+		assertRecords(t, s, maintenanceRecords, map[string]string{"w1": `{"reason":"one"}`})
+		assertRecords(t, reopen(), maintenanceRecords, map[string]string{"w1": `{"reason":"one"}`})
+	}},
+	{"records are shared", func(t *testing.T, _ storeBackend, s DeviceStore, reopen func() DeviceStore) {
+		// A create-only update, as used for link nonces, succeeds once
+		create := func(old []byte) ([]byte, error) {
+			if old != nil {
+				return nil, errAlreadyUsed
+			}
+			return []byte(`{}`), nil
+		}
+		if err := s.UpdateRecord(linkNonceRecords, "n1", create); err != nil {
+			t.Fatal(err)
+		}
+		if err := reopen().UpdateRecord(linkNonceRecords, "n1", create); err != errAlreadyUsed {
+			t.Errorf("second create = %v, want errAlreadyUsed", err)
+		}
+	}},
+}
+
+// errAlreadyUsed is returned by create-only record updates in the suite
+var errAlreadyUsed = errors.New("already used")
+
+func TestDeviceStoreConformance(t *testing.T) {
+	for _, backend := range storeBackends {
+		for _, tc := range storeConformance {
+			t.Run(backend.name+"/"+tc.name, func(t *testing.T) {
+				s, reopen := backend.open(t)
+				tc.run(t, backend, s, reopen)
+			})
+		}
+	}
+}
+
+// assertDevice compares the stored fields of two devices
+func assertDevice(t *testing.T, got, want Device) {
+	t.Helper()
+	if (got.DeletedAt == nil) != (want.DeletedAt == nil) ||
+		(got.DeletedAt != nil && !got.DeletedAt.Equal(*want.DeletedAt)) {
+		t.Errorf("DeletedAt = %v, want %v", got.DeletedAt, want.DeletedAt)
+	}
+	got.DeletedAt, want.DeletedAt = nil, nil
+	if len(got.Tags) == 0 && len(want.Tags) == 0 {
+		got.Tags, want.Tags = nil, nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("device = %+v, want %+v", got, want)
+	}
+}
+
+// assertIDs checks the devices a store lists, in order
+func assertIDs(t *testing.T, s DeviceStore, ids ...string) {
+	t.Helper()
+	devices, err := s.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var got []string
+	for _, d := range devices {
+		got = append(got, d.ID)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("List = %v, want %v", got, ids)
+	}
+}
+
+// assertRecords checks every record of a kind, comparing JSON by value
+func assertRecords(t *testing.T, s DeviceStore, kind string, want map[string]string) {
+	t.Helper()
+	records, err := s.ListRecords(kind)
+	if err != nil {
+		t.Fatalf("ListRecords(%s): %v", kind, err)
+	}
+	if len(records) != len(want) {
+		t.Errorf("ListRecords(%s) has %d records, want %d", kind, len(records), len(want))
+	}
+	for id, data := range want {
+		assertJSON(t, records[id], data)
+	}
+}
+
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var a, b bytes.Buffer
+	if err := json.Compact(&a, got); err != nil {
+		t.Errorf("record %q is not JSON: %v", got, err)
+		return
+	}
+	json.Compact(&b, []byte(want))
+	if a.String() != b.String() {
+		t.Errorf("record = %s, want %s", a.String(), b.String())
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// csvColumns is the column order used for CSV export
+var csvColumns = []string{"id", "host", "alias", "username", "password", "type", "mac", "wake_broadcast", "wake_interface", "tags"}
+
+// ImportResult reports what happened to a single imported row
+type ImportResult struct {
+	Row    int    `json:"row"`
+	Action string `json:"action"` // "created", "updated" or "error"
+	ID     string `json:"id,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Alias  string `json:"alias,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// transferFormat normalises a format name or file extension
+func transferFormat(name string) (string, error) {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "json":
+		return "json", nil
+	case "csv":
+		return "csv", nil
+	case "yaml", "yml":
+		return "yaml", nil
+	}
+	return "", fmt.Errorf("unsupported format %q (use json, csv or yaml)", name)
+}
+
+// formatFromContentType maps a request Content-Type to a transfer format
+func formatFromContentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		return "json"
+	case strings.HasPrefix(contentType, "text/csv"):
+		return "csv"
+	case strings.Contains(contentType, "yaml"):
+		return "yaml"
+	}
+	return ""
+}
+
+// transferContentType returns the Content-Type for a transfer format
+func transferContentType(format string) string {
+	switch format {
+	case "csv":
+		return "text/csv; charset=utf-8"
+	case "yaml":
+		return "application/yaml"
+	default:
+		return "application/json"
+	}
+}
+
+// exportRecords converts devices to transfer records, optionally with passwords
+func exportRecords(devices []Device, withCredentials bool) []DeviceWithAuth {
+	records := make([]DeviceWithAuth, len(devices))
+	for i, d := range devices {
+		records[i] = DeviceWithAuth{
+			ID:       d.ID,
+			Host:     d.Host,
+			Alias:    d.Alias,
+			Username: d.Username,
+			Type:     d.Type,
+			MAC:      d.MAC,
+
+			Tags:          d.Tags,
+			WakeBroadcast: d.WakeBroadcast,
+			WakeInterface: d.WakeInterface,
+		}
+		if withCredentials {
+			records[i].Password = d.Password
+		}
+	}
+	return records
+}
+
+// EncodeDevices writes device records in the given format
+func EncodeDevices(w io.Writer, format string, records []DeviceWithAuth) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(records); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(csvColumns)
+		for _, r := range records {
+			cw.Write([]string{r.ID, r.Host, r.Alias, r.Username, r.Password, r.Type, r.MAC, r.WakeBroadcast, r.WakeInterface, strings.Join(r.Tags, ",")})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
+
+// DecodeDevices reads device records in the given format
+func DecodeDevices(r io.Reader, format string) ([]DeviceWithAuth, error) {
+	var records []DeviceWithAuth
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	case "yaml":
+		if err := yaml.NewDecoder(r).Decode(&records); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid YAML: %v", err)
+		}
+	case "csv":
+		return decodeCSV(r)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	return records, nil
+}
+
+// decodeCSV reads CSV with a header row naming the columns. Column order is
+// free and unknown columns are ignored.
+func decodeCSV(r io.Reader) ([]DeviceWithAuth, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := cols["host"]; !ok {
+		return nil, fmt.Errorf("invalid CSV: missing host column")
+	}
+
+	field := func(row []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var records []DeviceWithAuth
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		records = append(records, DeviceWithAuth{
+			ID:       field(row, "id"),
+			Host:     field(row, "host"),
+			Alias:    field(row, "alias"),
+			Username: field(row, "username"),
+			Password: field(row, "password"),
+			Type:     field(row, "type"),
+			MAC:      field(row, "mac"),
+
+			Tags:          splitTags(field(row, "tags")),
+			WakeBroadcast: field(row, "wake_broadcast"),
+			WakeInterface: field(row, "wake_interface"),
+		})
+	}
+	return records, nil
+}
+
+// ImportDevices upserts records into the inventory with a single save.
+// Rows are matched to existing devices by ID, then by the match key ("host"
+// or "alias", case-insensitive). An empty password keeps the stored one so
+// exports without credentials can be re-imported. If any row fails, or
+// dryRun is set, nothing is changed.
+func (c *Config) ImportDevices(records []DeviceWithAuth, match string, dryRun bool) ([]ImportResult, error) {
+	if match == "" {
+		match = "host"
+	}
+	if match != "host" && match != "alias" {
+		return nil, fmt.Errorf("invalid match key %q (use host or alias)", match)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldDevices := c.Devices
+	working := make([]Device, len(c.Devices))
+	copy(working, c.Devices)
+
+	find := func(r DeviceWithAuth) int {
+		for i, d := range working {
+			if d.DeletedAt != nil {
+				continue
+			}
+			if r.ID != "" && d.ID == r.ID {
+				return i
+			}
+		}
+		key := strings.ToLower(r.Host)
+		if match == "alias" {
+			key = strings.ToLower(r.Alias)
+		}
+		if key == "" {
+			return -1
+		}
+		for i, d := range working {
+			if d.DeletedAt != nil {
+				continue
+			}
+			existing := strings.ToLower(d.Host)
+			if match == "alias" {
+				existing = strings.ToLower(d.Alias)
+			}
+			if existing == key {
+				return i
+			}
+		}
+		return -1
+	}
+
+	results := make([]ImportResult, len(records))
+	var created []Device
+	changed := make(map[string]bool)
+	failed := false
+	for i, r := range records {
+		res := ImportResult{Row: i + 1, Host: r.Host, Alias: r.Alias}
+		if r.Host == "" {
+			res.Action = "error"
+			res.Error = "host is required"
+			results[i] = res
+			failed = true
+			continue
+		}
+		if match == "alias" && r.Alias == "" {
+			res.Action = "error"
+			res.Error = "alias is required when matching by alias"
+			results[i] = res
+			failed = true
+			continue
+		}
+		if err := r.validate(); err != nil {
+			res.Action = "error"
+			res.Error = err.Error()
+			results[i] = res
+			failed = true
+			continue
+		}
+
+		if idx := find(r); idx != -1 {
+			d := working[idx]
+			d.Host = r.Host
+			d.Alias = r.Alias
+			d.Username = r.Username
+			if r.Password != "" {
+				d.Password = r.Password
+			}
+			if r.Type != "" {
+				d.Type = r.Type
+			}
+			if r.MAC != "" {
+				d.MAC = r.MAC
+			}
+			if r.WakeBroadcast != "" {
+				d.WakeBroadcast = r.WakeBroadcast
+			}
+			if r.WakeInterface != "" {
+				d.WakeInterface = r.WakeInterface
+			}
+			if len(r.Tags) > 0 {
+				d.Tags = normalizeTags(r.Tags)
+			}
+			working[idx] = d
+			changed[d.ID] = true
+			res.Action = "updated"
+			res.ID = d.ID
+		} else {
+			id := r.ID
+			if id == "" || deviceIDExists(working, id) {
+				id = uuid.New().String()
+			}
+			d := Device{
+				ID:       id,
+				Host:     r.Host,
+				Alias:    r.Alias,
+				Username: r.Username,
+				Password: r.Password,
+				Type:     r.Type,
+				MAC:      r.MAC,
+
+				Tags:          normalizeTags(r.Tags),
+				WakeBroadcast: r.WakeBroadcast,
+				WakeInterface: r.WakeInterface,
+			}
+			working = append(working, d)
+			created = append(created, d)
+			changed[d.ID] = true
+			res.Action = "created"
+			res.ID = id
+		}
+		results[i] = res
+	}
+
+	if failed || dryRun {
+		return results, nil
+	}
+
+	var puts []Device
+	for _, d := range working {
+		if changed[d.ID] {
+			puts = append(puts, d)
+		}
+	}
+
+	c.Devices = working
+	if err := c.commit(puts, nil); err != nil {
+		// Rollback
+		c.Devices = oldDevices
+		return nil, err
+	}
+
+	// Generate auto-thumbnails for new devices (not saved to config)
+	for _, d := range created {
+		seed := d.ID + d.Host + d.Alias
+		if pattern, err := GeneratePatternThumbnail(seed); err == nil {
+			c.SaveAutoThumbnail(d.ID, pattern)
+		}
+	}
+
+	return results, nil
+}
+
+// deviceIDExists reports whether any device, including trashed ones, uses id
+func deviceIDExists(devices []Device, id string) bool {
+	for _, d := range devices {
+		if d.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// importFailed reports whether any row in an import was rejected
+func importFailed(results []ImportResult) bool {
+	for _, r := range results {
+		if r.Action == "error" {
+			return true
+		}
+	}
+	return false
+}
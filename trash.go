@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	trashJanitorInterval  = time.Hour
+)
+
+// trashRetention returns how long deleted devices are kept before purging
+func (c *Config) trashRetention() time.Duration {
+	if c.Server.TrashRetention == "" {
+		return defaultTrashRetention
+	}
+	d, err := time.ParseDuration(c.Server.TrashRetention)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid trash_retention %q, using %s", c.Server.TrashRetention, defaultTrashRetention)
+		return defaultTrashRetention
+	}
+	return d
+}
+
+// GetTrashedDevices returns a copy of all devices in the trash
+func (c *Config) GetTrashedDevices() []Device {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var devices []Device
+	for _, d := range c.Devices {
+		if d.DeletedAt != nil {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// RestoreDevice moves a device out of the trash and saves the config
+func (c *Config) RestoreDevice(id string) (Device, error) {
+	c.mu.Lock()
+	var idx int = -1
+	for i, d := range c.Devices {
+		if d.ID == id && d.DeletedAt != nil {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		c.mu.Unlock()
+		return Device{}, fmt.Errorf("device not found")
+	}
+
+	deletedAt := c.Devices[idx].DeletedAt
+	c.Devices[idx].DeletedAt = nil
+	device := c.Devices[idx]
+	c.mu.Unlock()
+
+	if err := c.Commit([]Device{device}, nil); err != nil {
+		// Rollback
+		c.mu.Lock()
+		c.Devices[idx].DeletedAt = deletedAt
+		c.mu.Unlock()
+		return Device{}, err
+	}
+
+	c.GenerateMissingThumbnails()
+	return device, nil
+}
+
+// PurgeDevice permanently removes a trashed device and its thumbnails
+func (c *Config) PurgeDevice(id string) error {
+	n, err := c.purge(func(d Device) bool { return d.ID == id })
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("device not found")
+	}
+	return nil
+}
+
+// PurgeTrash permanently removes every trashed device, returning the count
+func (c *Config) PurgeTrash() (int, error) {
+	return c.purge(func(Device) bool { return true })
+}
+
+// PurgeExpired removes trashed devices older than the trash retention
+func (c *Config) PurgeExpired() (int, error) {
+	cutoff := time.Now().Add(-c.trashRetention())
+	return c.purge(func(d Device) bool { return d.DeletedAt.Before(cutoff) })
+}
+
+// purge removes trashed devices matching fn, saving once for the batch
+func (c *Config) purge(fn func(Device) bool) (int, error) {
+	c.mu.Lock()
+	oldDevices := make([]Device, len(c.Devices))
+	copy(oldDevices, c.Devices)
+
+	var kept, purged []Device
+	for _, d := range c.Devices {
+		if d.DeletedAt != nil && fn(d) {
+			purged = append(purged, d)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	if len(purged) == 0 {
+		c.mu.Unlock()
+		return 0, nil
+	}
+	c.Devices = kept
+	c.mu.Unlock()
+
+	ids := make([]string, len(purged))
+	for i, d := range purged {
+		ids[i] = d.ID
+	}
+	if err := c.Commit(nil, ids); err != nil {
+		// Rollback
+		c.mu.Lock()
+		c.Devices = oldDevices
+		c.mu.Unlock()
+		return 0, err
+	}
+
+	// Thumbnails are still referenced by config backups, so they are only
+	// removed from the live directory
+	for _, name := range thumbnailFiles(purged) {
+		path := filepath.Join(c.GetThumbnailDir(), name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("purge: failed to remove thumbnail %s: %v", path, err)
+		}
+	}
+	for _, d := range purged {
+		if d.Thumbnail != "" {
+			c.unmirrorThumbnail(d.Thumbnail)
+		}
+	}
+
+	return len(purged), nil
+}
+
+// TrashJanitor periodically purges expired devices from the trash. In a
+// cluster only the leader runs it, so replicas don't race to purge.
+type TrashJanitor struct {
+	config   *Config
+	interval time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTrashJanitor creates a janitor for cfg
+func NewTrashJanitor(cfg *Config) *TrashJanitor {
+	return &TrashJanitor{config: cfg, interval: trashJanitorInterval}
+}
+
+// Start begins purging in the background; it is a no-op if already running
+func (j *TrashJanitor) Start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil {
+		return
+	}
+	j.stop, j.done = make(chan struct{}), make(chan struct{})
+	go j.run(j.stop, j.done)
+}
+
+// Stop halts purging and waits for a purge in progress; it is a no-op if
+// not running
+func (j *TrashJanitor) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop == nil {
+		return
+	}
+	close(j.stop)
+	<-j.done
+	j.stop, j.done = nil, nil
+}
+
+func (j *TrashJanitor) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		if n, err := j.config.PurgeExpired(); err != nil {
+			log.Printf("Trash janitor: %v", err)
+		} else if n > 0 {
+			log.Printf("Trash janitor: purged %d expired device(s)", n)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
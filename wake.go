@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	wakePort         = "9" // Discard; the usual Wake-on-LAN port
+	defaultWakeAddr  = "255.255.255.255:" + wakePort
+	maxWakeWait      = 10 * time.Minute
+	wakePollInterval = 2 * time.Second
+)
+
+// WakeRequest is the optional body of POST /api/devices/{id}/wake
+type WakeRequest struct {
+	Wait string `json:"wait"` // e.g. "2m": wait for the host to come up (max 10m)
+}
+
+// WakeResponse is returned by POST /api/devices/{id}/wake
+type WakeResponse struct {
+	MAC     string `json:"mac"`
+	Target  string `json:"target"`            // Where the magic packet was sent
+	Awake   *bool  `json:"awake,omitempty"`   // Whether the host came up; only when waiting
+	Elapsed string `json:"elapsed,omitempty"` // How long it took, when waiting
+}
+
+// WakeEvent is published on the event stream when a magic packet is sent
+type WakeEvent struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// parseMAC accepts the usual MAC notations, and 12 bare hex digits
+func parseMAC(s string) (net.HardwareAddr, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 12 && !strings.ContainsAny(s, ":-.") {
+		parts := make([]string, 6)
+		for i := range parts {
+			parts[i] = s[2*i : 2*i+2]
+		}
+		s = strings.Join(parts, ":")
+	}
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", s)
+	}
+	return mac, nil
+}
+
+// magicPacket is six 0xFF bytes followed by the MAC sixteen times
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xff)
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+// wakeAddr resolves a wake_broadcast address, adding the default port
+func wakeAddr(addr string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, wakePort)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wake broadcast address: %v", err)
+	}
+	return udpAddr, nil
+}
+
+// wakeTarget works out where to send a device's magic packet and from
+// which local address. With an interface, packets leave from its IPv4
+// address and go to its subnet's broadcast address unless wake_broadcast
+// says otherwise.
+func wakeTarget(d Device) (local, remote *net.UDPAddr, err error) {
+	if d.WakeInterface != "" {
+		ifi, err := net.InterfaceByName(d.WakeInterface)
+		if err != nil {
+			return nil, nil, fmt.Errorf("wake interface: %v", err)
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, nil, fmt.Errorf("wake interface: %v", err)
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip, mask := ipNet.IP.To4(), net.IP(ipNet.Mask).To4()
+			broadcast := make(net.IP, 4)
+			for i := range broadcast {
+				broadcast[i] = ip[i] | ^mask[i]
+			}
+			local = &net.UDPAddr{IP: ip}
+			remote = &net.UDPAddr{IP: broadcast, Port: 9}
+			break
+		}
+		if local == nil {
+			return nil, nil, fmt.Errorf("wake interface %s has no IPv4 address", d.WakeInterface)
+		}
+	}
+
+	switch {
+	case d.WakeBroadcast != "":
+		remote, err = wakeAddr(d.WakeBroadcast)
+	case remote == nil:
+		remote, err = wakeAddr(defaultWakeAddr)
+	}
+	return local, remote, err
+}
+
+// sendWake sends a device's magic packet, returning where it went
+func sendWake(d Device) (string, error) {
+	mac, err := parseMAC(d.MAC)
+	if err != nil {
+		return "", err
+	}
+	local, remote, err := wakeTarget(d)
+	if err != nil {
+		return "", err
+	}
+	if err := wakeSender(local, remote, magicPacket(mac)); err != nil {
+		return "", err
+	}
+	return remote.String(), nil
+}
+
+// wakeSender sends a magic packet over UDP; tests replace it to capture
+// packets without a network
+var wakeSender = func(local, remote *net.UDPAddr, packet []byte) error {
+	// Go enables SO_BROADCAST on UDP sockets, so broadcast addresses work
+	conn, err := net.DialUDP("udp4", local, remote)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+// hostAwake reports whether the host behind a device is up: its power
+// state where the device can read it, otherwise the status check
+func hostAwake(ctx context.Context, d Device) bool {
+	if ctrl, err := newPowerController(d); err == nil {
+		if state, err := ctrl.PowerState(ctx); err == nil {
+			return state.Power == "on"
+		}
+	}
+	reachable, _ := checkHost(d.Host)
+	return reachable
+}
+
+// WakeDevice sends a Wake-on-LAN magic packet to the host behind a device,
+// optionally waiting for it to come up (POST /api/devices/{id}/wake)
+func (h *Handlers) WakeDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/wake")
+	device, found := h.config.GetDevice(id)
+	if !found {
+		if h.deviceExists(id) {
+			http.Error(w, "Federated devices are woken from their own site's server", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if device.MAC == "" {
+		http.Error(w, "Device has no MAC address", http.StatusBadRequest)
+		return
+	}
+
+	var req WakeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Wait == "" {
+		req.Wait = r.URL.Query().Get("wait")
+	}
+	var wait time.Duration
+	if req.Wait != "" {
+		d, err := time.ParseDuration(req.Wait)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		if d > maxWakeWait {
+			http.Error(w, fmt.Sprintf("wait may not exceed %s", maxWakeWait), http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+
+	target, err := sendWake(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Wake-on-LAN sent to device %s (%s) via %s by %s", device.ID, device.MAC, target, clientIP(r))
+	h.config.events.Publish(Event{Type: "wake", Data: WakeEvent{ID: device.ID, Time: time.Now().UTC()}})
+
+	resp := WakeResponse{MAC: device.MAC, Target: target}
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		start := time.Now()
+		awake := false
+		ticker := time.NewTicker(wakePollInterval)
+		defer ticker.Stop()
+	poll:
+		for {
+			if awake = hostAwake(ctx, device); awake {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				break poll
+			case <-ticker.C:
+			}
+		}
+		resp.Awake = &awake
+		resp.Elapsed = time.Since(start).Round(time.Second).String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseMAC(t *testing.T) {
+	want := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x0d, 0x0e, 0xff}
+	for _, s := range []string{
+		"aa:bb:cc:0d:0e:ff",
+		"AA-BB-CC-0D-0E-FF",
+		"aabb.cc0d.0eff",
+		"aabbcc0d0eff",
+		"  aa:bb:cc:0d:0e:ff\n",
+	} {
+		mac, err := parseMAC(s)
+		if err != nil || !bytes.Equal(mac, want) {
+			t.Errorf("parseMAC(%q) = %v, %v", s, mac, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"aa:bb:cc:dd:ee",
+		"aabbccddeeffgg",
+		"aabbccddeef",
+		"00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01", // InfiniBand
+		"02:00:5e:10:00:00:00:01",                                     // EUI-64
+	} {
+		if _, err := parseMAC(s); err == nil {
+			t.Errorf("parseMAC(%q) accepted", s)
+		}
+	}
+}
+
+func TestMagicPacket(t *testing.T) {
+	mac := net.HardwareAddr{0x01, 0x23, 0x45, 0x67, 0x89, 0xab}
+	packet := magicPacket(mac)
+	if len(packet) != 102 {
+		t.Fatalf("packet is %d bytes, want 102", len(packet))
+	}
+	if !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+		t.Errorf("sync stream = % x", packet[:6])
+	}
+	for i := 0; i < 16; i++ {
+		if got := packet[6+6*i : 12+6*i]; !bytes.Equal(got, mac) {
+			t.Errorf("repetition %d = %s", i, net.HardwareAddr(got))
+		}
+	}
+}
+
+func TestWakeTarget(t *testing.T) {
+	for _, tc := range []struct {
+		broadcast, want string
+	}{
+		{"", "255.255.255.255:9"},
+		{"10.0.0.255", "10.0.0.255:9"},
+		{"10.0.0.255:7", "10.0.0.255:7"},
+	} {
+		local, remote, err := wakeTarget(Device{WakeBroadcast: tc.broadcast})
+		if err != nil || local != nil || remote.String() != tc.want {
+			t.Errorf("wake_broadcast %q: local %v, remote %v, %v; want %s", tc.broadcast, local, remote, err, tc.want)
+		}
+	}
+	if _, _, err := wakeTarget(Device{WakeBroadcast: "not a host:port:9"}); err == nil {
+		t.Error("invalid wake_broadcast accepted")
+	}
+	if _, _, err := wakeTarget(Device{WakeInterface: "no-such-if0"}); err == nil {
+		t.Error("unknown wake_interface accepted")
+	}
+
+	lo := loopbackInterface(t)
+	local, remote, err := wakeTarget(Device{WakeInterface: lo.Name})
+	if err != nil {
+		t.Fatalf("wakeTarget via %s: %v", lo.Name, err)
+	}
+	if !local.IP.IsLoopback() || remote.Port != 9 || !remote.IP.Equal(subnetBroadcast(t, lo, local.IP)) {
+		t.Errorf("via %s: local %v, remote %v", lo.Name, local, remote)
+	}
+	// wake_broadcast still picks the destination when an interface is set
+	local, remote, err = wakeTarget(Device{WakeInterface: lo.Name, WakeBroadcast: "127.0.0.1:4000"})
+	if err != nil || !local.IP.IsLoopback() || remote.String() != "127.0.0.1:4000" {
+		t.Errorf("via %s with wake_broadcast: local %v, remote %v, %v", lo.Name, local, remote, err)
+	}
+}
+
+func TestSendWake(t *testing.T) {
+	type sent struct {
+		local, remote *net.UDPAddr
+		packet        []byte
+	}
+	var got []sent
+	defer func(orig func(local, remote *net.UDPAddr, packet []byte) error) { wakeSender = orig }(wakeSender)
+	wakeSender = func(local, remote *net.UDPAddr, packet []byte) error {
+		got = append(got, sent{local, remote, packet})
+		return nil
+	}
+
+	target, err := sendWake(Device{MAC: "aa-bb-cc-dd-ee-ff", WakeBroadcast: "192.168.1.255"})
+	if err != nil || target != "192.168.1.255:9" {
+		t.Fatalf("sendWake = %q, %v", target, err)
+	}
+	mac, _ := parseMAC("aa:bb:cc:dd:ee:ff")
+	if len(got) != 1 || got[0].local != nil || got[0].remote.String() != target || !bytes.Equal(got[0].packet, magicPacket(mac)) {
+		t.Errorf("sent %+v", got)
+	}
+
+	if _, err := sendWake(Device{MAC: "nonsense"}); err == nil || len(got) != 1 {
+		t.Errorf("invalid MAC: %v, %d packets sent", err, len(got))
+	}
+
+	wakeSender = func(*net.UDPAddr, *net.UDPAddr, []byte) error { return errors.New("network is unreachable") }
+	if _, err := sendWake(Device{MAC: "aa:bb:cc:dd:ee:ff"}); err == nil {
+		t.Error("send error swallowed")
+	}
+}
+
+// The default sender puts the packet on the wire
+func TestWakeSenderUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	d := Device{MAC: "01:02:03:04:05:06", WakeBroadcast: conn.LocalAddr().String()}
+	if _, err := sendWake(d); err != nil {
+		t.Fatalf("sendWake: %v", err)
+	}
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("reading the magic packet: %v", err)
+	}
+	mac, _ := parseMAC(d.MAC)
+	if !bytes.Equal(buf[:n], magicPacket(mac)) {
+		t.Errorf("received % x", buf[:n])
+	}
+}
+
+// loopbackInterface finds an up loopback interface with an IPv4 address
+func loopbackInterface(t *testing.T) net.Interface {
+	t.Helper()
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback == 0 || ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return ifi
+			}
+		}
+	}
+	t.Skip("no IPv4 loopback interface")
+	return net.Interface{}
+}
+
+// subnetBroadcast is the broadcast address of the interface subnet holding ip
+func subnetBroadcast(t *testing.T, ifi net.Interface, ip net.IP) net.IP {
+	t.Helper()
+	addrs, _ := ifi.Addrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			broadcast := make(net.IP, 4)
+			mask := net.IP(ipNet.Mask).To4()
+			for i, b := range ip.To4() {
+				broadcast[i] = b | ^mask[i]
+			}
+			return broadcast
+		}
+	}
+	t.Fatalf("%s has no address %s", ifi.Name, ip)
+	return nil
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	watchMaxBackoff  = time.Minute
+	watchHighlight   = 10 * time.Second // Rows stay highlighted this long after a change
+	flapWindow       = 10 * time.Minute
+	flapTransitions  = 3 // Changes within flapWindow that mark a device as flapping
+	eventsRetryStart = time.Second
+)
+
+// watchSortColumns are the columns the dashboard can sort by, in the order
+// the s key cycles through them
+var watchSortColumns = []string{"status", "alias", "host", "latency", "change"}
+
+// errEventsUnsupported is returned by servers without /api/events
+var errEventsUnsupported = errors.New("server has no event stream")
+
+// CLIStatusChange is a "status" event from /api/events
+type CLIStatusChange struct {
+	ID        string    `json:"id"`
+	Reachable bool      `json:"reachable"`
+	Time      time.Time `json:"time"`
+
+	Maintenance *CLIDeviceMaintenance `json:"maintenance"`
+}
+
+// watchRow is one device on the dashboard
+type watchRow struct {
+	device      CLIDevice
+	status      string // "online", "offline" or "unknown"
+	maintenance bool   // In a maintenance window
+	latency     float64
+	changed     time.Time   // Last transition seen, zero if none yet
+	transitions []time.Time // Within flapWindow
+}
+
+func (r *watchRow) flapping(now time.Time) bool {
+	n := 0
+	for _, t := range r.transitions {
+		if now.Sub(t) < flapWindow {
+			n++
+		}
+	}
+	return n >= flapTransitions
+}
+
+// dashboard is the state behind `kvmm status --watch`
+type dashboard struct {
+	server   string
+	interval time.Duration
+
+	mu         sync.Mutex
+	rows       map[string]*watchRow
+	filter     string
+	tags       []string // Only devices with all of these
+	sortBy     string
+	reverse    bool
+	live       bool // Event stream connected
+	lastUpdate time.Time
+	err        error
+
+	editing bool // Typing a filter after /
+	color   bool
+	redraw  chan struct{}
+	refresh chan struct{} // Asks the poller to refetch now
+}
+
+// runStatusWatch shows a full-screen table of device statuses that updates
+// from the server's event stream, polling for latency and as a fallback
+func runStatusWatch(server, filter string, tags []string, sortBy string, interval time.Duration, color bool) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		fail(exitUsage, "status --watch needs an interactive terminal")
+	}
+	if !validSortColumn(sortBy) {
+		fail(exitUsage, "unknown sort column %q (use %s)", sortBy, strings.Join(watchSortColumns, ", "))
+	}
+	if interval < time.Second {
+		fail(exitUsage, "--interval must be at least 1s")
+	}
+
+	d := &dashboard{
+		server:   server,
+		interval: interval,
+		rows:     make(map[string]*watchRow),
+		filter:   filter,
+		tags:     tags,
+		sortBy:   sortBy,
+		color:    color,
+		redraw:   make(chan struct{}, 1),
+		refresh:  make(chan struct{}, 1),
+	}
+
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fail(exitError, "starting dashboard: %v", err)
+	}
+	// Alternate screen, hidden cursor; both undone on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	resized, stopResize := notifyResize()
+	defer stopResize()
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	go d.poll()
+	go d.watchEvents()
+
+	tick := time.NewTicker(time.Second) // Ages "last change" and highlights
+	defer tick.Stop()
+
+	d.render()
+	for {
+		select {
+		case <-signals:
+			return
+		case <-resized:
+		case key, ok := <-keys:
+			if !ok || d.handleKey(key) {
+				return
+			}
+		case <-d.redraw:
+		case <-tick.C:
+		}
+		d.render()
+	}
+}
+
+func validSortColumn(name string) bool {
+	for _, c := range watchSortColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// changed schedules a redraw
+func (d *dashboard) changed() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// poll refetches devices and statuses every interval, backing off while
+// the server is unreachable
+func (d *dashboard) poll() {
+	backoff := d.interval
+	for {
+		devices, err := fetchDevices(d.server)
+		var statuses []CLIDeviceStatus
+		if err == nil {
+			statuses, err = fetchStatuses(d.server)
+		}
+
+		d.mu.Lock()
+		if err != nil {
+			d.err = err
+			backoff = min(backoff*2, watchMaxBackoff)
+		} else {
+			d.err = nil
+			backoff = d.interval
+			d.setDevices(devices)
+			now := time.Now()
+			for _, s := range statuses {
+				d.setStatus(s.ID, s.Reachable, s.Maintenance != nil, s.LatencyMS, now)
+			}
+			d.lastUpdate = now
+		}
+		d.mu.Unlock()
+		d.changed()
+
+		select {
+		case <-time.After(backoff):
+		case <-d.refresh:
+		}
+	}
+}
+
+// watchEvents applies status events as they happen and refetches the
+// inventory when devices change, reconnecting with backoff
+func (d *dashboard) watchEvents() {
+	backoff := eventsRetryStart
+	for {
+		connected := false
+		err := streamEvents(d.server, func() {
+			connected = true
+			d.mu.Lock()
+			d.live = true
+			d.mu.Unlock()
+			d.changed()
+		}, func(event string, data []byte) {
+			switch event {
+			case "status":
+				var change CLIStatusChange
+				if json.Unmarshal(data, &change) != nil {
+					return
+				}
+				d.mu.Lock()
+				d.setStatus(change.ID, change.Reachable, change.Maintenance != nil, -1, change.Time)
+				d.lastUpdate = time.Now()
+				d.mu.Unlock()
+				d.changed()
+			case "device", "maintenance":
+				select {
+				case d.refresh <- struct{}{}:
+				default:
+				}
+			}
+		})
+
+		d.mu.Lock()
+		d.live = false
+		d.mu.Unlock()
+		d.changed()
+
+		if errors.Is(err, errEventsUnsupported) {
+			return // Polling alone it is
+		}
+		if connected {
+			backoff = eventsRetryStart
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, watchMaxBackoff)
+	}
+}
+
+// streamEvents reads server-sent events from /api/events until the
+// connection drops, calling connected once the stream is open
+func streamEvents(server string, connected func(), handle func(event string, data []byte)) error {
+	req, err := http.NewRequest(http.MethodGet, server+"/api/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := newCLIClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errEventsUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+	connected()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var event string
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				handle(event, data.Bytes())
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// Comment or heartbeat
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				if data.Len() > 0 {
+					data.WriteByte('\n')
+				}
+				data.WriteString(value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream closed")
+}
+
+// setDevices replaces the inventory, keeping the history of known devices.
+// The caller holds d.mu.
+func (d *dashboard) setDevices(devices []CLIDevice) {
+	rows := make(map[string]*watchRow, len(devices))
+	for _, dev := range devices {
+		row, ok := d.rows[dev.ID]
+		if !ok {
+			row = &watchRow{status: "unknown"}
+		}
+		row.device = dev
+		rows[dev.ID] = row
+	}
+	d.rows = rows
+}
+
+// setStatus records a device's reachability; latency is negative when
+// unknown. The caller holds d.mu.
+func (d *dashboard) setStatus(id string, reachable, maintenance bool, latency float64, at time.Time) {
+	row, ok := d.rows[id]
+	if !ok {
+		return
+	}
+
+	status := "offline"
+	if reachable {
+		status = "online"
+	}
+	if row.status != "unknown" && row.status != status {
+		row.changed = at
+		row.transitions = append(row.transitions, at)
+		// Forget transitions too old to count towards flapping
+		for len(row.transitions) > 0 && at.Sub(row.transitions[0]) >= flapWindow {
+			row.transitions = row.transitions[1:]
+		}
+	}
+	row.status = status
+	row.maintenance = maintenance
+
+	switch {
+	case !reachable:
+		row.latency = 0
+	case latency >= 0:
+		row.latency = latency
+	}
+}
+
+// handleKey applies a key press, reporting whether to quit
+func (d *dashboard) handleKey(key []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.editing {
+		switch string(key) {
+		case "\x03": // Ctrl-C
+			return true
+		case "\r", "\n", "\x1b":
+			d.editing = false
+		case "\x7f", "\x08":
+			if r := []rune(d.filter); len(r) > 0 {
+				d.filter = string(r[:len(r)-1])
+			}
+		case "\x15": // Ctrl-U
+			d.filter = ""
+		default:
+			if key[0] == '\x1b' {
+				return false
+			}
+			for len(key) > 0 {
+				r, size := utf8.DecodeRune(key)
+				key = key[size:]
+				if unicode.IsPrint(r) {
+					d.filter += string(r)
+				}
+			}
+		}
+		return false
+	}
+
+	switch string(key) {
+	case "q", "Q", "\x03", "\x04": // Ctrl-C, Ctrl-D
+		return true
+	case "/":
+		d.editing = true
+	case "\x1b":
+		d.filter = ""
+	case "s":
+		for i, c := range watchSortColumns {
+			if c == d.sortBy {
+				d.sortBy = watchSortColumns[(i+1)%len(watchSortColumns)]
+				break
+			}
+		}
+	case "r":
+		d.reverse = !d.reverse
+	case "1", "2", "3", "4", "5":
+		d.sortBy = watchSortColumns[key[0]-'1']
+	}
+	return false
+}
+
+// visibleRows returns the rows with the dashboard's tags that match the
+// filter, sorted
+func (d *dashboard) visibleRows() []*watchRow {
+	filter := strings.ToLower(d.filter)
+	var rows []*watchRow
+	for _, r := range d.rows {
+		if !r.device.hasTags(d.tags) {
+			continue
+		}
+		text := strings.ToLower(r.device.Alias + " " + r.device.Host + " " + r.device.Site + " " + strings.Join(r.device.Tags, " "))
+		if filter == "" || strings.Contains(text, filter) {
+			rows = append(rows, r)
+		}
+	}
+
+	rank := map[string]int{"offline": 0, "unknown": 1, "online": 2}
+	less := func(a, b *watchRow) bool {
+		switch d.sortBy {
+		case "status":
+			if rank[a.status] != rank[b.status] {
+				return rank[a.status] < rank[b.status]
+			}
+		case "host":
+			if a.device.Host != b.device.Host {
+				return a.device.Host < b.device.Host
+			}
+		case "latency":
+			if a.latency != b.latency {
+				return a.latency > b.latency // Slowest first
+			}
+		case "change":
+			if !a.changed.Equal(b.changed) {
+				return a.changed.After(b.changed) // Most recent first
+			}
+		}
+		return strings.ToLower(displayName(a.device)) < strings.ToLower(displayName(b.device))
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if d.reverse {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+	return rows
+}
+
+// render redraws the whole screen
+func (d *dashboard) render() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	now := time.Now()
+	rows := d.visibleRows()
+
+	online, offline := 0, 0
+	showSite := false
+	for _, r := range d.rows {
+		switch r.status {
+		case "online":
+			online++
+		case "offline":
+			offline++
+		}
+		if r.device.Site != "" {
+			showSite = true
+		}
+	}
+
+	mode := fmt.Sprintf("polling every %s", d.interval)
+	if d.live {
+		mode = "live"
+	}
+	updated := "never"
+	if !d.lastUpdate.IsZero() {
+		updated = d.lastUpdate.Format("15:04:05")
+	}
+	title := fmt.Sprintf("kvmm status --watch  %s  [%s, updated %s]  %d online, %d offline, %d total",
+		d.server, mode, updated, online, offline, len(d.rows))
+
+	// Table body via tabwriter, coloured afterwards so escapes don't count as width
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	columns := []string{"STATUS", "ALIAS", "HOST", "LATENCY", "LAST CHANGE", ""}
+	if showSite {
+		columns = []string{"STATUS", "ALIAS", "HOST", "SITE", "LATENCY", "LAST CHANGE", ""}
+	}
+	for i, c := range columns {
+		if c != "" && strings.EqualFold(strings.Fields(c)[0], d.sortBy) ||
+			c == "LAST CHANGE" && d.sortBy == "change" {
+			arrow := "↓"
+			if d.reverse {
+				arrow = "↑"
+			}
+			columns[i] = c + arrow
+		}
+	}
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, r := range rows {
+		cells := []string{
+			symbolForStatus(r.status, r.maintenance) + " " + r.status,
+			dash(r.device.Alias),
+			r.device.Host,
+		}
+		if showSite {
+			cells = append(cells, dash(r.device.Site))
+		}
+		latency := "-"
+		if r.latency > 0 {
+			latency = fmt.Sprintf("%.1fms", r.latency)
+		}
+		last := "-"
+		if !r.changed.IsZero() {
+			last = formatAgo(now.Sub(r.changed)) + " ago"
+		}
+		note := ""
+		if r.flapping(now) {
+			note = "~ flapping"
+		}
+		cells = append(cells, latency, last, note)
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	tw.Flush()
+	table := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	line := func(s string) {
+		b.WriteString(s + "\x1b[K\r\n")
+	}
+
+	line(d.style(truncateLine(title, width), "\x1b[1m"))
+	if d.err != nil {
+		line(d.style(truncateLine("Error: "+d.err.Error()+" (retrying)", width), "\x1b[31m"))
+	} else {
+		line("")
+	}
+
+	// Leave room for the title, error, footer and a spare line
+	space := height - 4
+	for i, text := range table {
+		if i > space {
+			line(fmt.Sprintf("… %d more", len(table)-i))
+			break
+		}
+		text = truncateLine(text, width)
+		if i == 0 {
+			line(d.style(text, "\x1b[1m"))
+			continue
+		}
+		r := rows[i-1]
+		if d.color {
+			text = colorizeStatus(text)
+			text = strings.Replace(text, "~ flapping", "\x1b[33m~ flapping\x1b[0m", 1)
+			if !r.changed.IsZero() && now.Sub(r.changed) < watchHighlight {
+				// Reverse video, re-applied after each colour reset
+				text = "\x1b[7m" + strings.ReplaceAll(text, "\x1b[0m", "\x1b[0m\x1b[7m") + "\x1b[0m"
+			}
+		} else if !r.changed.IsZero() && now.Sub(r.changed) < watchHighlight {
+			text = "\x1b[7m" + text + "\x1b[0m"
+		}
+		line(text)
+	}
+	if len(rows) == 0 && len(d.rows) > 0 {
+		line("No devices match the filter")
+	}
+
+	b.WriteString("\x1b[J")
+	footer := "q quit  s sort  r reverse  / filter  Esc clear filter"
+	if d.editing {
+		footer = "Filter: " + d.filter + "▏  (Enter to apply)"
+	} else if d.filter != "" {
+		footer += "  [filter: " + d.filter + "]"
+	}
+	if len(d.tags) > 0 && !d.editing {
+		footer += "  [tag: " + strings.Join(d.tags, ",") + "]"
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H%s\x1b[K", height, d.style(truncateLine(footer, width), "\x1b[2m"))
+	fmt.Print(b.String())
+}
+
+// style wraps text in an escape sequence when colour is on
+func (d *dashboard) style(text, code string) string {
+	if !d.color || text == "" {
+		return text
+	}
+	return code + text + "\x1b[0m"
+}
+
+func symbolForStatus(status string, maintenance bool) string {
+	v := CLIDeviceView{Status: status}
+	if maintenance {
+		v.Maintenance = &CLIDeviceMaintenance{}
+	}
+	return v.symbol()
+}
+
+// truncateLine cuts text to width runes
+func truncateLine(text string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(text) <= width {
+		return text
+	}
+	r := []rune(text)
+	return string(r[:width-1]) + "…"
+}
+
+// formatAgo formats a duration coarsely: 45s, 12m, 3h, 2d
+func formatAgo(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyResize never fires on Windows, which has no resize signal; the
+// dashboard's once-a-second redraw picks up the new size instead
+func notifyResize() (<-chan os.Signal, func()) {
+	return nil, func() {}
+}